@@ -1,6 +1,9 @@
 package config
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"os"
 
 	"gopkg.in/yaml.v3"
@@ -10,11 +13,29 @@ type Server struct {
 	Protocol string `yaml:"protocol"`
 	URL      string `yaml:"url"`
 	Port     string `yaml:"port"`
+
+	// Only used with the https protocol. The API gateway is verified with the system
+	// CAs if no CA file is set. The client certificate is only needed if the API
+	// gateway requires mutual TLS.
+	CAFile                string `yaml:"ca_file"`                 // PEM
+	ClientCertificateFile string `yaml:"client_certificate_file"` // PEM
+	ClientKeyFile         string `yaml:"client_key_file"`         // PEM
+}
+
+// Either an API key or a bearer token issued for the wallets of the user
+type Credentials struct {
+	APIKey      string `yaml:"api_key"`
+	BearerToken string `yaml:"bearer_token"`
 }
 
 type Config struct {
-	Server         Server `yaml:"server"`
-	RequestTimeout int    `yaml:"request_timeout"`
+	Server         Server      `yaml:"server"`
+	Credentials    Credentials `yaml:"credentials"`
+	RequestTimeout int         `yaml:"request_timeout"`
+
+	// Deposits, withdrawals and transfers are answered with an operation ID before they
+	// are applied, instead of waiting for them
+	RespondAsync bool `yaml:"respond_async"`
 }
 
 func Load(filepath string) (*Config, error) {
@@ -43,3 +64,27 @@ func (server *Server) GetURL() string {
 	}
 	return url
 }
+
+func (server *Server) GetTLSConfig() (*tls.Config, error) {
+	tls_config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if len(server.CAFile) > 0 {
+		bytes, err := os.ReadFile(server.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tls_config.RootCAs = x509.NewCertPool()
+		if !tls_config.RootCAs.AppendCertsFromPEM(bytes) {
+			return nil, errors.New("No certificates found in CA file")
+		}
+	}
+	if len(server.ClientCertificateFile) > 0 {
+		certificate, err := tls.LoadX509KeyPair(server.ClientCertificateFile, server.ClientKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tls_config.Certificates = []tls.Certificate{certificate}
+	}
+	return tls_config, nil
+}
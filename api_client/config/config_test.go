@@ -19,7 +19,12 @@ func Test_LoadConfig(t *testing.T) {
 			URL:      "localhost",
 			Port:     "1120",
 		},
+		Credentials: Credentials{
+			APIKey:      "change_me_api_key",
+			BearerToken: "",
+		},
 		RequestTimeout: 10, // s
+		RespondAsync:   false,
 	}
 	if !reflect.DeepEqual(*config, expected_config) {
 		t.Fatal("Expected: ", expected_config, " Got: ", *config)
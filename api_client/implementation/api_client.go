@@ -3,13 +3,16 @@ package implementation
 import (
 	"api_client/config"
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
-	"shared/messages"
+	v1 "shared/api/v1"
 	"shared/responses"
 	"time"
 )
@@ -29,14 +32,24 @@ func convert_to_string(status int) string {
 
 func get_transaction_type(input string) string {
 	result := ""
-	if input == "D" {
+	if input == v1.Transaction_type_deposit {
 		result = "Deposit"
-	} else if input == "W" {
+	} else if input == v1.Transaction_type_withdrawal {
 		result = "Withdrawal"
 	}
 	return result
 }
 
+// Dates are entered as YYYYMMDD and sent as YYYY-MM-DD. Dates which cannot be parsed
+// are sent as they are and rejected by the API gateway.
+func convert_date(input string) string {
+	date, err := time.Parse("20060102", input)
+	if err != nil {
+		return input
+	}
+	return date.Format("2006-01-02")
+}
+
 type APIClient struct {
 	config *config.Config
 }
@@ -48,11 +61,121 @@ func CreateAPIClient(config *config.Config) *APIClient {
 	return api_client
 }
 
+// Attaches the credentials of the user to every request sent to the API gateway
+func (api_client *APIClient) send_request(http_client *http.Client, method string, url string, body io.Reader, idempotency_key string) (*http.Response, error) {
+	tls_config, err := api_client.config.Server.GetTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	http_client.Transport = &http.Transport{
+		TLSClientConfig: tls_config,
+	}
+
+	request, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	if len(idempotency_key) > 0 {
+		request.Header.Set("Idempotency-Key", idempotency_key)
+
+		// Deposits, withdrawals and transfers are answered before they are applied
+		if api_client.config.RespondAsync {
+			request.Header.Set("Prefer", "respond-async")
+		}
+	}
+	credentials := api_client.config.Credentials
+	if len(credentials.BearerToken) > 0 {
+		request.Header.Set("Authorization", "Bearer "+credentials.BearerToken)
+	} else if len(credentials.APIKey) > 0 {
+		request.Header.Set("X-API-Key", credentials.APIKey)
+	}
+	return http_client.Do(request)
+}
+
+// A new idempotency key is sent with every deposit, withdrawal and transfer. It can be
+// used to find out whether a request that timed out was applied.
+func generate_idempotency_key() string {
+	bytes := make([]byte, 16)
+	_, err := rand.Read(bytes)
+	if err != nil {
+		return ""
+	}
+	return hex.EncodeToString(bytes)
+}
+
+/*
+Returns true if the request failed. Failed requests are answered with problem details
+carrying an error code. Some error codes come with advice on what to do next.
+*/
+func print_problem(response *http.Response, idempotency_key string) bool {
+	if response.StatusCode < http.StatusBadRequest {
+		return false
+	}
+
+	problem := responses.Problem{}
+	err := json.NewDecoder(response.Body).Decode(&problem)
+	if err != nil {
+		fmt.Println("Request failed: ", response.Status)
+		return true
+	}
+
+	fmt.Println("Request status: ", convert_to_string(responses.Status_failed))
+	fmt.Println("Error code: ", problem.Code)
+	if len(problem.Detail) > 0 {
+		fmt.Println("Error message: ", problem.Detail)
+	}
+
+	switch problem.Code {
+	case responses.Error_code_unauthenticated:
+		fmt.Println("Please check the credentials in the configuration file.")
+	case responses.Error_code_forbidden:
+		fmt.Println("You are not allowed to access this wallet.")
+	case responses.Error_code_rate_limited:
+		fmt.Println("Please try again in ", response.Header.Get("Retry-After"), " s.")
+	case responses.Error_code_service_unavailable, responses.Error_code_database_error:
+		fmt.Println("The service is temporarily unavailable. Please try again later.")
+	case responses.Error_code_service_timeout:
+		fmt.Println("Request timed out. It may still be applied later.")
+		if len(idempotency_key) > 0 {
+			fmt.Println("Check whether it was applied with this command.")
+			fmt.Println()
+			fmt.Println("api_client get_request_outcome " + idempotency_key)
+		}
+	case responses.Error_code_idempotency_key_not_found:
+		fmt.Println("The request was never applied. It is safe to send it again.")
+	case responses.Error_code_operation_not_found:
+		fmt.Println("The operation does not exist or is too old to be kept.")
+	}
+	return true
+}
+
+// Returns true if the request was accepted without waiting for it to be applied, i.e.
+// sent with respond_async set in the configuration
+func print_accepted_operation(response *http.Response) bool {
+	if response.StatusCode != http.StatusAccepted {
+		return false
+	}
+	operation := v1.Operation{}
+	err := json.NewDecoder(response.Body).Decode(&operation)
+	if err != nil {
+		fmt.Println("Error parsing JSON response.")
+		return true
+	}
+	fmt.Println("Request status: ", operation.Status)
+	fmt.Println("The " + operation.Operation + " was accepted. Check whether it was applied with this command.")
+	fmt.Println()
+	fmt.Println("api_client get_operation " + operation.OperationID)
+	return true
+}
+
 func (api_client *APIClient) post_deposit() {
 
 	/*
 		api_client deposit <wallet_id> <currency> <amount>
-		POST /wallets/{wallet_id}/deposits
+		POST /v1/wallets/{wallet_id}/deposits
 		{
 		    "amount": 5000,
 		    "currency": "XXX"
@@ -89,21 +212,29 @@ func (api_client *APIClient) post_deposit() {
 	}
 	wallet_id := os.Args[2]
 	base_url := api_client.config.Server.GetURL()
-	full_url := base_url + "/wallets/{" + wallet_id + "}/deposits"
-	http_post_body := messages.POST_Deposit{
+	full_url := base_url + "/v1/wallets/" + url.PathEscape(wallet_id) + "/deposits"
+	http_post_body := v1.DepositRequest{
 		Amount:   os.Args[4],
 		Currency: os.Args[3],
 	}
+	idempotency_key := generate_idempotency_key()
 	http_post_body_bytes, err := json.Marshal(http_post_body)
 	if err != nil {
 		fmt.Println("Unable to serialise body of request into JSON.")
 		return
 	}
-	response, err := http_client.Post(full_url, "application/json", bytes.NewReader(http_post_body_bytes))
+	response, err := api_client.send_request(&http_client, http.MethodPost, full_url, bytes.NewReader(http_post_body_bytes), idempotency_key)
 	if err != nil {
 		fmt.Println("HTTP error occurred: ", err.Error())
 		return
 	}
+	defer response.Body.Close()
+	if print_problem(response, idempotency_key) {
+		return
+	}
+	if print_accepted_operation(response) {
+		return
+	}
 
 	// Parse result
 	response_bytes := make([]byte, response.ContentLength)
@@ -114,29 +245,23 @@ func (api_client *APIClient) post_deposit() {
 			return
 		}
 	}
-	response_body := responses.Deposit{}
+	response_body := v1.Deposit{}
 	err = json.Unmarshal(response_bytes, &response_body)
 	if err != nil {
 		fmt.Println("Error parsing JSON response.")
 		return
 	}
 
-	// Print result to console
-	fmt.Println("Request status: ", convert_to_string(response_body.Status))
-	switch response_body.Status {
-	case responses.Status_successful:
-		fmt.Println("New balance: ", response_body.Currency, " ", response_body.NewBalance)
-	case responses.Status_failed:
-		fmt.Println("Error message: ", response_body.ErrorMessage)
-	case responses.Status_unknown:
-	}
+	// Print result to console. Failed requests were answered with problem details.
+	fmt.Println("Request status: ", convert_to_string(responses.Status_successful))
+	fmt.Println("New balance: ", response_body.Currency, " ", response_body.NewBalance)
 }
 
 func (api_client *APIClient) post_withdrawal() {
 
 	/*
 		api_client withdraw <wallet_id> <currency> <amount>
-		POST /wallets/{wallet_id}/withdrawals
+		POST /v1/wallets/{wallet_id}/withdrawals
 		{
 		    "amount": 5000,
 		    "currency": "XXX"
@@ -173,21 +298,29 @@ func (api_client *APIClient) post_withdrawal() {
 	}
 	wallet_id := os.Args[2]
 	base_url := api_client.config.Server.GetURL()
-	full_url := base_url + "/wallets/{" + wallet_id + "}/withdrawals"
-	http_post_body := messages.POST_Withdraw{
+	full_url := base_url + "/v1/wallets/" + url.PathEscape(wallet_id) + "/withdrawals"
+	http_post_body := v1.WithdrawalRequest{
 		Amount:   os.Args[4],
 		Currency: os.Args[3],
 	}
+	idempotency_key := generate_idempotency_key()
 	http_post_body_bytes, err := json.Marshal(http_post_body)
 	if err != nil {
 		fmt.Println("Unable to serialise body of request into JSON.")
 		return
 	}
-	response, err := http_client.Post(full_url, "application/json", bytes.NewReader(http_post_body_bytes))
+	response, err := api_client.send_request(&http_client, http.MethodPost, full_url, bytes.NewReader(http_post_body_bytes), idempotency_key)
 	if err != nil {
 		fmt.Println("HTTP error occurred: ", err.Error())
 		return
 	}
+	defer response.Body.Close()
+	if print_problem(response, idempotency_key) {
+		return
+	}
+	if print_accepted_operation(response) {
+		return
+	}
 
 	// Parse result
 	response_bytes := make([]byte, response.ContentLength)
@@ -198,22 +331,16 @@ func (api_client *APIClient) post_withdrawal() {
 			return
 		}
 	}
-	response_body := responses.Withdraw{}
+	response_body := v1.Withdrawal{}
 	err = json.Unmarshal(response_bytes, &response_body)
 	if err != nil {
 		fmt.Println("Error parsing JSON response.")
 		return
 	}
 
-	// Print result to console
-	fmt.Println("Request status: ", convert_to_string(response_body.Status))
-	switch response_body.Status {
-	case responses.Status_successful:
-		fmt.Println("New balance: ", response_body.Currency, " ", response_body.NewBalance)
-	case responses.Status_failed:
-		fmt.Println("Error message: ", response_body.ErrorMessage)
-	case responses.Status_unknown:
-	}
+	// Print result to console. Failed requests were answered with problem details.
+	fmt.Println("Request status: ", convert_to_string(responses.Status_successful))
+	fmt.Println("New balance: ", response_body.Currency, " ", response_body.NewBalance)
 
 }
 
@@ -221,7 +348,7 @@ func (api_client *APIClient) post_transfer() {
 
 	/*
 		api_client transfer <source_wallet_id> <destination_wallet_id> <currency> <amount>
-		POST /transfer
+		POST /v1/transfer
 		{
 		    "source_wallet_id": "id1",
 		    "destination_wallet_id": "id2",
@@ -265,23 +392,31 @@ func (api_client *APIClient) post_transfer() {
 		Timeout: time.Duration(api_client.config.RequestTimeout) * time.Second,
 	}
 	base_url := api_client.config.Server.GetURL()
-	full_url := base_url + "/transfer"
-	http_post_body := messages.POST_Transfer{
+	full_url := base_url + "/v1/transfer"
+	http_post_body := v1.TransferRequest{
 		SourceWalletID:      os.Args[2],
 		DestinationWalletID: os.Args[3],
 		Amount:              os.Args[5],
 		Currency:            os.Args[4],
 	}
+	idempotency_key := generate_idempotency_key()
 	http_post_body_bytes, err := json.Marshal(http_post_body)
 	if err != nil {
 		fmt.Println("Unable to serialise body of request into JSON.")
 		return
 	}
-	response, err := http_client.Post(full_url, "application/json", bytes.NewReader(http_post_body_bytes))
+	response, err := api_client.send_request(&http_client, http.MethodPost, full_url, bytes.NewReader(http_post_body_bytes), idempotency_key)
 	if err != nil {
 		fmt.Println("HTTP error occurred: ", err.Error())
 		return
 	}
+	defer response.Body.Close()
+	if print_problem(response, idempotency_key) {
+		return
+	}
+	if print_accepted_operation(response) {
+		return
+	}
 
 	// Parse result
 	response_bytes := make([]byte, response.ContentLength)
@@ -292,28 +427,22 @@ func (api_client *APIClient) post_transfer() {
 			return
 		}
 	}
-	response_body := responses.Transfer{}
+	response_body := v1.Transfer{}
 	err = json.Unmarshal(response_bytes, &response_body)
 	if err != nil {
 		fmt.Println("Error parsing JSON response.")
 		return
 	}
 
-	// Print result to console
-	fmt.Println("Request status: ", convert_to_string(response_body.Status))
-	switch response_body.Status {
-	case responses.Status_successful:
-		fmt.Println("New balance: ", response_body.Currency, " ", response_body.NewBalance)
-	case responses.Status_failed:
-		fmt.Println("Error message: ", response_body.ErrorMessage)
-	case responses.Status_unknown:
-	}
+	// Print result to console. Failed requests were answered with problem details.
+	fmt.Println("Request status: ", convert_to_string(responses.Status_successful))
+	fmt.Println("New balance: ", response_body.Currency, " ", response_body.NewBalance)
 }
 
 func (api_client *APIClient) get_wallet_balance() {
 
 	// api_client get_balance <wallet_id>
-	// GET /wallets/{wallet_id}/balance
+	// GET /v1/wallets/{wallet_id}/balance
 
 	// Verify that inputs are correct
 	if len(os.Args) != number_of_arguments_get_balance {
@@ -333,12 +462,16 @@ func (api_client *APIClient) get_wallet_balance() {
 	}
 	wallet_id := os.Args[2]
 	base_url := api_client.config.Server.GetURL()
-	full_url := base_url + "/wallets/{" + wallet_id + "}/balance"
-	response, err := http_client.Get(full_url)
+	full_url := base_url + "/v1/wallets/" + url.PathEscape(wallet_id) + "/balance"
+	response, err := api_client.send_request(&http_client, http.MethodGet, full_url, nil, "")
 	if err != nil {
 		fmt.Println("HTTP error occurred: ", err.Error())
 		return
 	}
+	defer response.Body.Close()
+	if print_problem(response, "") {
+		return
+	}
 
 	// Parse result
 	bytes := make([]byte, response.ContentLength)
@@ -349,29 +482,23 @@ func (api_client *APIClient) get_wallet_balance() {
 			return
 		}
 	}
-	response_body := responses.Balance{}
+	response_body := v1.Balance{}
 	err = json.Unmarshal(bytes, &response_body)
 	if err != nil {
 		fmt.Println("Error parsing JSON response.")
 		return
 	}
 
-	// Print result to console
-	fmt.Println("Request status: ", convert_to_string(response_body.Status))
-	switch response_body.Status {
-	case responses.Status_successful:
-		fmt.Println("Balance: ", response_body.Currency, " ", response_body.Balance)
-	case responses.Status_failed:
-		fmt.Println("Error message: ", response_body.ErrorMessage)
-	case responses.Status_unknown:
-	}
+	// Print result to console. Failed requests were answered with problem details.
+	fmt.Println("Request status: ", convert_to_string(responses.Status_successful))
+	fmt.Println("Balance: ", response_body.Currency, " ", response_body.Balance)
 
 }
 
 func (api_client *APIClient) get_transaction_history() {
 
 	// api_client get_transaction_history <wallet_id> <start_date> <end_date>
-	// GET /wallets/{wallet_id}/transaction_history?from=YYYYMMDD&to=YYYYMMDD
+	// GET /v1/wallets/{wallet_id}/transaction_history?from=YYYY-MM-DD&to=YYYY-MM-DD
 
 	// Verify that inputs are correct
 	if len(os.Args) < minimum_number_of_arguments_get_transaction_history {
@@ -390,12 +517,12 @@ func (api_client *APIClient) get_transaction_history() {
 	// is left to the transaction history service.
 	var start_date string = ""
 	if len(os.Args) >= 4 && len(os.Args[3]) > 0 {
-		start_date = os.Args[3]
+		start_date = convert_date(os.Args[3])
 	}
 
 	var end_date string = ""
 	if len(os.Args) >= 5 && len(os.Args[4]) > 0 {
-		end_date = os.Args[4]
+		end_date = convert_date(os.Args[4])
 	}
 
 	// Prepare GET request
@@ -404,7 +531,7 @@ func (api_client *APIClient) get_transaction_history() {
 	}
 	wallet_id := os.Args[2]
 	base_url := api_client.config.Server.GetURL()
-	full_url := base_url + "/wallets/{" + wallet_id + "}/transaction_history" //
+	full_url := base_url + "/v1/wallets/" + url.PathEscape(wallet_id) + "/transaction_history"
 	started_query_string := false
 	if len(start_date) > 0 {
 		full_url += "?from=" + start_date
@@ -418,11 +545,15 @@ func (api_client *APIClient) get_transaction_history() {
 		}
 		started_query_string = true
 	}
-	response, err := http_client.Get(full_url)
+	response, err := api_client.send_request(&http_client, http.MethodGet, full_url, nil, "")
 	if err != nil {
 		fmt.Println("HTTP error occurred: ", err.Error())
 		return
 	}
+	defer response.Body.Close()
+	if print_problem(response, "") {
+		return
+	}
 
 	// Parse result
 	bytes := make([]byte, response.ContentLength)
@@ -433,36 +564,155 @@ func (api_client *APIClient) get_transaction_history() {
 			return
 		}
 	}
-	response_body := responses.TransactionHistory{}
+	response_body := v1.TransactionHistory{}
 	err = json.Unmarshal(bytes, &response_body)
 	if err != nil {
 		fmt.Println("Error parsing JSON response. ", string(bytes))
 		return
 	}
 
-	// Print result to console
-	fmt.Println("Request status: ", convert_to_string(response_body.Status))
-	switch response_body.Status {
-	case responses.Status_successful:
-		if len(response_body.History) == 0 {
-			fmt.Println("No transactions found")
-		} else {
-			fmt.Println("Transaction history")
-			fmt.Println()
-			fmt.Println("Dates are in YYYYMMDD format in UTC time.")
-			fmt.Println()
-			fmt.Println("Date \t\t Type \t\t Currency \t Amount")
-			for _, row := range response_body.History {
-				fmt.Println(row.Date, "\t", get_transaction_type(row.Type), "\t", row.Currency, "\t\t", row.Amount)
-			}
+	// Print result to console. Failed requests were answered with problem details.
+	fmt.Println("Request status: ", convert_to_string(responses.Status_successful))
+	if len(response_body.Transactions) == 0 {
+		fmt.Println("No transactions found")
+	} else {
+		fmt.Println("Transaction history")
+		fmt.Println()
+		fmt.Println("Dates are in YYYY-MM-DD format in UTC time.")
+		fmt.Println()
+		fmt.Println("Date \t\t Type \t\t Currency \t Amount")
+		for _, row := range response_body.Transactions {
+			fmt.Println(row.Date, "\t", get_transaction_type(row.Type), "\t", row.Currency, "\t\t", row.Amount)
 		}
-	case responses.Status_failed:
-		fmt.Println("Error message: ", response_body.ErrorMessage)
-	case responses.Status_unknown:
 	}
 
 }
 
+func (api_client *APIClient) get_request_outcome() {
+
+	// api_client get_request_outcome <idempotency_key>
+	// GET /v1/idempotency_keys/{idempotency_key}
+
+	// Verify that inputs are correct
+	if len(os.Args) != number_of_arguments_get_request_outcome {
+		fmt.Println("Incorrect number of arguments for get_request_outcome command. Please review the help menu for assistance. It can be accessed just by entering api_client.")
+		return
+	}
+	if len(os.Args[2]) == 0 {
+		fmt.Println("Please enter an idempotency key.")
+		fmt.Println()
+		fmt.Println("api_client get_request_outcome <idempotency_key>")
+		return
+	}
+
+	// Prepare GET request
+	http_client := http.Client{
+		Timeout: time.Duration(api_client.config.RequestTimeout) * time.Second,
+	}
+	idempotency_key := os.Args[2]
+	base_url := api_client.config.Server.GetURL()
+	full_url := base_url + "/v1/idempotency_keys/" + url.PathEscape(idempotency_key)
+	response, err := api_client.send_request(&http_client, http.MethodGet, full_url, nil, "")
+	if err != nil {
+		fmt.Println("HTTP error occurred: ", err.Error())
+		return
+	}
+	defer response.Body.Close()
+	if print_problem(response, "") {
+		return
+	}
+
+	// Parse result
+	bytes := make([]byte, response.ContentLength)
+	_, err = response.Body.Read(bytes)
+	if err != nil {
+		if !errors.Is(err, io.EOF) {
+			fmt.Println("Error reading response: ", err.Error())
+			return
+		}
+	}
+	response_body := v1.RequestOutcome{}
+	err = json.Unmarshal(bytes, &response_body)
+	if err != nil {
+		fmt.Println("Error parsing JSON response.")
+		return
+	}
+
+	// Print result to console. The request itself may have failed.
+	fmt.Println("Request status: ", convert_to_string(responses.Status_successful))
+	fmt.Println("Request was processed at: ", response_body.ProcessedAt)
+	print_result(response_body.Operation, &response_body.Result)
+}
+
+// Failed requests were not applied
+func print_result(operation string, result *v1.Result) {
+	switch {
+	case result.Error != nil:
+		fmt.Println("The " + operation + " failed and was not applied.")
+		fmt.Println("Error code: ", result.Error.Code)
+		fmt.Println("Error message: ", result.Error.Detail)
+	case result.Deposit != nil:
+		fmt.Println("New balance: ", result.Deposit.Currency, " ", result.Deposit.NewBalance)
+	case result.Withdrawal != nil:
+		fmt.Println("New balance: ", result.Withdrawal.Currency, " ", result.Withdrawal.NewBalance)
+	case result.Transfer != nil:
+		fmt.Println("New balance: ", result.Transfer.Currency, " ", result.Transfer.NewBalance)
+	}
+}
+
+func (api_client *APIClient) get_operation() {
+
+	// api_client get_operation <operation_id>
+	// GET /v1/operations/{operation_id}
+
+	// Verify that inputs are correct
+	if len(os.Args) != number_of_arguments_get_operation {
+		fmt.Println("Incorrect number of arguments for get_operation command. Please review the help menu for assistance. It can be accessed just by entering api_client.")
+		return
+	}
+	if len(os.Args[2]) == 0 {
+		fmt.Println("Please enter an operation ID.")
+		fmt.Println()
+		fmt.Println("api_client get_operation <operation_id>")
+		return
+	}
+
+	// Prepare GET request
+	http_client := http.Client{
+		Timeout: time.Duration(api_client.config.RequestTimeout) * time.Second,
+	}
+	operation_id := os.Args[2]
+	base_url := api_client.config.Server.GetURL()
+	full_url := base_url + "/v1/operations/" + url.PathEscape(operation_id)
+	response, err := api_client.send_request(&http_client, http.MethodGet, full_url, nil, "")
+	if err != nil {
+		fmt.Println("HTTP error occurred: ", err.Error())
+		return
+	}
+	defer response.Body.Close()
+	if print_problem(response, "") {
+		return
+	}
+
+	// Parse result
+	response_body := v1.Operation{}
+	err = json.NewDecoder(response.Body).Decode(&response_body)
+	if err != nil {
+		fmt.Println("Error parsing JSON response.")
+		return
+	}
+
+	// Print result to console. Pending operations have no result yet.
+	fmt.Println("Request status: ", response_body.Status)
+	fmt.Println("Request was accepted at: ", response_body.CreatedAt)
+	if response_body.Status == v1.Operation_status_pending {
+		fmt.Println("The " + response_body.Operation + " has not been applied yet. Please try again later.")
+		return
+	}
+	fmt.Println("Request was processed at: ", response_body.CompletedAt)
+	print_result(response_body.Operation, &response_body.Result)
+}
+
 func (api_client *APIClient) Run() {
 	verb := os.Args[1]
 	switch verb {
@@ -476,6 +726,14 @@ func (api_client *APIClient) Run() {
 		api_client.get_wallet_balance()
 	case action_get_transaction_history:
 		api_client.get_transaction_history()
+	case action_get_request_outcome:
+		api_client.get_request_outcome()
+	case action_get_operation:
+		api_client.get_operation()
+	case action_webhook_sink:
+		api_client.run_webhook_sink()
+	case action_watch_wallet:
+		api_client.watch_wallet()
 	default:
 		fmt.Println("Invalid command. Please review the help menu for assistance. It can be accessed by entering this command without any arguments.")
 		fmt.Println()
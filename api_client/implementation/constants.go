@@ -6,10 +6,18 @@ const (
 	action_transfer                string = "transfer"
 	action_get_balance             string = "get_balance"
 	action_get_transaction_history string = "get_transaction_history"
+	action_get_request_outcome     string = "get_request_outcome"
+	action_get_operation           string = "get_operation"
+	action_webhook_sink            string = "webhook_sink"
+	action_watch_wallet            string = "watch_wallet"
 
 	number_of_arguments_deposit                         int = 5
 	number_of_arguments_withdraw                        int = 5
 	number_of_arguments_transfer                        int = 6
 	number_of_arguments_get_balance                     int = 3
 	minimum_number_of_arguments_get_transaction_history int = 3
+	number_of_arguments_get_request_outcome             int = 3
+	number_of_arguments_get_operation                   int = 3
+	number_of_arguments_webhook_sink                    int = 4
+	minimum_number_of_arguments_watch_wallet            int = 3
 )
@@ -36,4 +36,28 @@ func PrintHelpMenu() {
 
 	fmt.Println("\tapi_client get_transaction_history <wallet_id> <start_date> <end_date>")
 	fmt.Println()
+
+	fmt.Println("This command allows you to check whether a deposit, withdrawal or transfer that timed out was applied. The idempotency key is printed when the request times out.")
+	fmt.Println()
+
+	fmt.Println("\tapi_client get_request_outcome <idempotency_key>")
+	fmt.Println()
+
+	fmt.Println("This command allows you to check whether a deposit, withdrawal or transfer accepted without waiting for it was applied. The operation ID is printed when such a request is accepted, i.e. when respond_async is set in the configuration file.")
+	fmt.Println()
+
+	fmt.Println("\tapi_client get_operation <operation_id>")
+	fmt.Println()
+
+	fmt.Println("This command allows you to receive webhooks on the specified port of this machine. The events in them are printed if their signature matches the secret returned when the webhook was created.")
+	fmt.Println()
+
+	fmt.Println("\tapi_client webhook_sink <port> <secret>")
+	fmt.Println()
+
+	fmt.Println("This command allows you to watch the deposits, withdrawals and transfers of the specified wallet as they happen. Events missed since the specified event ID are printed first.")
+	fmt.Println()
+
+	fmt.Println("\tapi_client watch_wallet <wallet_id> [last_event_id]")
+	fmt.Println()
 }
@@ -0,0 +1,146 @@
+package implementation
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"shared/events"
+	"shared/websocket"
+	"strings"
+	"time"
+)
+
+// Waited before reconnecting to the live feed after the connection was lost
+const reconnect_interval time.Duration = 5 * time.Second
+
+// Sent by the API gateway besides events
+const (
+	feed_message_heartbeat       string = "heartbeat"
+	feed_message_resync_required string = "resync_required"
+)
+
+/*
+Prints the events of the specified wallet as they happen. Reconnects when the
+connection is lost and is sent the events it missed. Events from before the command
+was started are printed first if the ID of the last event seen is given.
+*/
+func (api_client *APIClient) watch_wallet() {
+
+	// api_client watch_wallet <wallet_id> [last_event_id]
+	// GET /wallets/{wallet_id}/events
+
+	// Verify that inputs are correct
+	if len(os.Args) != minimum_number_of_arguments_watch_wallet && len(os.Args) != minimum_number_of_arguments_watch_wallet+1 {
+		fmt.Println("Incorrect number of arguments for watch_wallet command. Please review the help menu for assistance. It can be accessed just by entering api_client.")
+		return
+	}
+	wallet_id := os.Args[2]
+	if len(wallet_id) == 0 {
+		fmt.Println("Please enter a wallet ID.")
+		fmt.Println()
+		fmt.Println("api_client watch_wallet <wallet_id> [last_event_id]")
+		return
+	}
+	last_event_id := ""
+	if len(os.Args) > minimum_number_of_arguments_watch_wallet {
+		last_event_id = os.Args[3]
+	}
+
+	tls_config, err := api_client.config.Server.GetTLSConfig()
+	if err != nil {
+		fmt.Println("TLS error occurred: ", err.Error())
+		return
+	}
+	base_url := api_client.config.Server.GetURL()
+	base_url = "ws" + strings.TrimPrefix(base_url, "http")
+	full_url := base_url + "/v1/wallets/" + url.PathEscape(wallet_id) + "/events"
+	timeout := time.Duration(api_client.config.RequestTimeout) * time.Second
+
+	header := http.Header{}
+	credentials := api_client.config.Credentials
+	if len(credentials.BearerToken) > 0 {
+		header.Set("Authorization", "Bearer "+credentials.BearerToken)
+	} else if len(credentials.APIKey) > 0 {
+		header.Set("X-API-Key", credentials.APIKey)
+	}
+
+	fmt.Println("Watching wallet " + wallet_id + ". Press Ctrl+C to stop.")
+	fmt.Println()
+	is_connected_once := false
+	for {
+		header.Del("Last-Event-ID")
+		if len(last_event_id) > 0 {
+			header.Set("Last-Event-ID", last_event_id)
+		}
+		conn, err := websocket.Dial(full_url, header, tls_config, timeout)
+		if err != nil {
+			// Wrong credentials or wallet IDs will not get better by trying again
+			if !is_connected_once {
+				fmt.Println("Unable to watch wallet: ", err.Error())
+				return
+			}
+			fmt.Println("Unable to reconnect: ", err.Error())
+			time.Sleep(reconnect_interval)
+			continue
+		}
+		is_connected_once = true
+
+		last_event_id, err = print_wallet_events(conn, wallet_id, last_event_id)
+		conn.Close()
+		close_error := &websocket.CloseError{}
+		if errors.As(err, &close_error) {
+			fmt.Println("Connection closed by API gateway: ", close_error.Reason)
+		} else {
+			fmt.Println("Connection lost: ", err.Error())
+		}
+		fmt.Println("Reconnecting in " + reconnect_interval.String() + ".")
+		fmt.Println()
+		time.Sleep(reconnect_interval)
+	}
+}
+
+// Prints events until the connection is lost. Returns the ID of the last event printed.
+func print_wallet_events(conn *websocket.Conn, wallet_id string, last_event_id string) (string, error) {
+
+	// Heartbeats arrive regularly, so silence means the connection is lost
+	read_timeout := 2 * time.Minute
+
+	for {
+		opcode, message, err := conn.ReadMessage(time.Now().Add(read_timeout))
+		if err != nil {
+			return last_event_id, err
+		}
+		if opcode != websocket.Opcode_text {
+			continue
+		}
+		event := events.Event{}
+		err = json.Unmarshal(message, &event)
+		if err != nil {
+			fmt.Println("Error parsing JSON message.")
+			continue
+		}
+
+		// Print result to console
+		switch event.EventType {
+		case feed_message_heartbeat:
+		case feed_message_resync_required:
+			fmt.Println("Some events were missed. Enter api_client get_balance " + wallet_id + " to get the balance.")
+			fmt.Println()
+			last_event_id = ""
+		default:
+			fmt.Println("Event ID: ", event.EventID)
+			fmt.Println("Event type: ", event.EventType)
+			fmt.Println("Created at: ", event.CreatedAt)
+			fmt.Println("Amount: ", event.Data.Currency, " ", event.Data.Amount)
+			fmt.Println("New balance: ", event.Data.Currency, " ", event.Data.NewBalance)
+			if len(event.Data.CounterpartyWalletID) > 0 {
+				fmt.Println("Counterparty wallet ID: ", event.Data.CounterpartyWalletID)
+			}
+			fmt.Println()
+			last_event_id = event.EventID
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package implementation
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"shared/events"
+	"shared/webhooks"
+	"time"
+)
+
+// Largest webhook accepted by the sink
+const maximum_size_of_webhooks int64 = 1024 * 1024
+
+/*
+Receives webhooks on the given port and prints the events in them. Webhooks with a
+signature that does not match the secret are rejected with 401 Unauthorized, so the
+webhook service records the attempt as failed and retries it.
+
+Useful for trying out webhooks locally. Register http://localhost:<port>/ as the URL
+of a webhook and pass the secret returned by the API gateway to this command.
+*/
+func (api_client *APIClient) run_webhook_sink() {
+
+	// api_client webhook_sink <port> <secret>
+
+	// Verify that inputs are correct
+	if len(os.Args) != number_of_arguments_webhook_sink {
+		fmt.Println("Incorrect number of arguments for webhook_sink command. Please review the help menu for assistance. It can be accessed just by entering api_client.")
+		return
+	}
+	port := os.Args[2]
+	secret := os.Args[3]
+	if len(port) == 0 || len(secret) == 0 {
+		fmt.Println("Please enter a port and the secret of the webhook.")
+		fmt.Println()
+		fmt.Println("api_client webhook_sink <port> <secret>")
+		return
+	}
+
+	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodPost {
+			writer.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(request.Body, maximum_size_of_webhooks))
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		err = webhooks.Verify(
+			secret,
+			request.Header.Get(webhooks.Header_timestamp),
+			body,
+			request.Header.Get(webhooks.Header_signature),
+			webhooks.Default_tolerance,
+			time.Now())
+		if err != nil {
+			fmt.Println("Rejected delivery ", request.Header.Get(webhooks.Header_delivery_id), ": ", err.Error())
+			writer.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		event := events.Event{}
+		err = json.Unmarshal(body, &event)
+		if err != nil {
+			fmt.Println("Rejected delivery ", request.Header.Get(webhooks.Header_delivery_id), ": body is not a valid event")
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		// Print result to console
+		fmt.Println("Event ID: ", event.EventID)
+		fmt.Println("Delivery ID: ", request.Header.Get(webhooks.Header_delivery_id))
+		fmt.Println("Event type: ", event.EventType)
+		fmt.Println("Wallet ID: ", event.WalletID)
+		fmt.Println("Created at: ", event.CreatedAt)
+		fmt.Println("Amount: ", event.Data.Currency, " ", event.Data.Amount)
+		fmt.Println("New balance: ", event.Data.Currency, " ", event.Data.NewBalance)
+		if len(event.Data.CounterpartyWalletID) > 0 {
+			fmt.Println("Counterparty wallet ID: ", event.Data.CounterpartyWalletID)
+		}
+		fmt.Println()
+		writer.WriteHeader(http.StatusNoContent)
+	})
+
+	fmt.Println("Waiting for webhooks on port " + port + ". Press Ctrl+C to stop.")
+	fmt.Println()
+	err := http.ListenAndServe(":"+port, handler)
+	if err != nil {
+		fmt.Println("Unable to receive webhooks: ", err.Error())
+	}
+}
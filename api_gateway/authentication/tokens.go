@@ -0,0 +1,99 @@
+package authentication
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMalformedToken   = errors.New("Malformed bearer token")
+	ErrInvalidSignature = errors.New("Bearer token has an invalid signature")
+	ErrTokenExpired     = errors.New("Bearer token has expired")
+)
+
+// Only HMAC SHA256 signed tokens are accepted. Tokens specifying any other algorithm
+// (including "none") are rejected.
+const token_header string = `{"alg":"HS256","typ":"JWT"}`
+
+// The claims carried by a bearer token. A caller may only touch the wallets listed
+// in WalletIDs.
+type Claims struct {
+	Subject   string   `json:"sub"`
+	WalletIDs []string `json:"wallet_ids"`
+	ExpiresAt int64    `json:"exp"` // Unix time in s
+}
+
+func sign(signing_input string, signing_key []byte) []byte {
+	mac := hmac.New(sha256.New, signing_key)
+	mac.Write([]byte(signing_input))
+	return mac.Sum(nil)
+}
+
+/*
+Bearer tokens use the compact JSON web token format so that they can be issued and
+inspected with standard tooling.
+
+	base64url(header) + "." + base64url(claims) + "." + base64url(signature)
+*/
+func SignToken(claims *Claims, signing_key []byte) (string, error) {
+	claims_bytes, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	encoding := base64.RawURLEncoding
+	signing_input := encoding.EncodeToString([]byte(token_header)) + "." + encoding.EncodeToString(claims_bytes)
+	signature := sign(signing_input, signing_key)
+	return signing_input + "." + encoding.EncodeToString(signature), nil
+}
+
+func VerifyToken(token string, signing_key []byte, now time.Time) (*Claims, error) {
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformedToken
+	}
+	encoding := base64.RawURLEncoding
+
+	// Check the algorithm before trusting anything else in the token
+	header_bytes, err := encoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+	header := struct {
+		Algorithm string `json:"alg"`
+	}{}
+	err = json.Unmarshal(header_bytes, &header)
+	if err != nil || header.Algorithm != "HS256" {
+		return nil, ErrMalformedToken
+	}
+
+	// Signatures are compared in constant time to avoid leaking timing information
+	signature, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+	expected_signature := sign(parts[0]+"."+parts[1], signing_key)
+	if !hmac.Equal(signature, expected_signature) {
+		return nil, ErrInvalidSignature
+	}
+
+	claims_bytes, err := encoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+	claims := Claims{}
+	err = json.Unmarshal(claims_bytes, &claims)
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+	if claims.ExpiresAt <= now.Unix() {
+		return nil, ErrTokenExpired
+	}
+
+	return &claims, nil
+}
@@ -0,0 +1,97 @@
+package authentication
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_SignAndVerifyToken(t *testing.T) {
+
+	signing_key := []byte("authentication_unit_test_key")
+	now := time.Unix(1750000000, 0)
+	claims := Claims{
+		Subject:   "payroll",
+		WalletIDs: []string{"wallet_1", "wallet_2"},
+		ExpiresAt: now.Add(time.Hour).Unix(),
+	}
+
+	// Test with valid token
+	{
+		token, err := SignToken(&claims, signing_key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := VerifyToken(token, signing_key, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(*result, claims) {
+			t.Error("Expected: ", claims, ", Got: ", *result)
+		}
+	}
+
+	// Test with token signed by another key
+	{
+		token, err := SignToken(&claims, []byte("another_key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = VerifyToken(token, signing_key, now)
+		if !errors.Is(err, ErrInvalidSignature) {
+			t.Error("Expected: ", ErrInvalidSignature, ", Got: ", err)
+		}
+	}
+
+	// Test with tampered claims
+	{
+		token, err := SignToken(&claims, signing_key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		other_claims := claims
+		other_claims.WalletIDs = []string{"someone_elses_wallet"}
+		other_token, err := SignToken(&other_claims, signing_key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts := strings.Split(token, ".")
+		other_parts := strings.Split(other_token, ".")
+		tampered_token := parts[0] + "." + other_parts[1] + "." + parts[2]
+		_, err = VerifyToken(tampered_token, signing_key, now)
+		if !errors.Is(err, ErrInvalidSignature) {
+			t.Error("Expected: ", ErrInvalidSignature, ", Got: ", err)
+		}
+	}
+
+	// Test with expired token
+	{
+		token, err := SignToken(&claims, signing_key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = VerifyToken(token, signing_key, now.Add(2*time.Hour))
+		if !errors.Is(err, ErrTokenExpired) {
+			t.Error("Expected: ", ErrTokenExpired, ", Got: ", err)
+		}
+	}
+
+	// Test with unsigned token
+	{
+		token := "eyJhbGciOiJub25lIiwidHlwIjoiSldUIn0.eyJzdWIiOiJwYXlyb2xsIn0."
+		_, err := VerifyToken(token, signing_key, now)
+		if !errors.Is(err, ErrMalformedToken) {
+			t.Error("Expected: ", ErrMalformedToken, ", Got: ", err)
+		}
+	}
+
+	// Test with malformed tokens
+	for _, token := range []string{"", "abc", "a.b", "a.b.c.d", "!!.!!.!!"} {
+		_, err := VerifyToken(token, signing_key, now)
+		if !errors.Is(err, ErrMalformedToken) {
+			t.Error("Expected: ", ErrMalformedToken, ", Got: ", err)
+		}
+	}
+}
@@ -1,12 +1,23 @@
 package config
 
 import (
+	"fmt"
 	"os"
+	shared_config "shared/config"
 
 	"github.com/redis/go-redis/v9"
 	"gopkg.in/yaml.v3"
 )
 
+// HTTPS is served if both the certificate and the key file are set. Otherwise HTTP.
+// Clients must present a certificate signed by the client CA if it is set (mutual TLS).
+type TLS struct {
+	CertificateFile string `yaml:"certificate_file"` // PEM
+	KeyFile         string `yaml:"key_file"`         // PEM
+	MinimumVersion  string `yaml:"minimum_version"`  // 1.2 or 1.3
+	ClientCAFile    string `yaml:"client_ca_file"`   // PEM
+}
+
 type HTTPServer struct {
 	ListenPort      string `yaml:"listen_port"`
 	ReadTimeout     int    `yaml:"read_timeout"`     // s
@@ -14,6 +25,19 @@ type HTTPServer struct {
 	IdleTimeout     int    `yaml:"idle_timeout"`     // s
 	RetryInterval   int    `yaml:"retry_interval"`   // s
 	ShutdownTimeout int    `yaml:"shutdown_timeout"` // s
+	TLS             TLS    `yaml:"tls"`
+}
+
+// Serves the gRPC API next to the HTTP server, with the same TLS settings. Disabled if
+// the listen port is empty.
+type GRPCServer struct {
+	ListenPort    string `yaml:"listen_port"`
+	IdleTimeout   int    `yaml:"idle_timeout"`   // s
+	RetryInterval int    `yaml:"retry_interval"` // s
+}
+
+func (tls *TLS) IsEnabled() bool {
+	return len(tls.CertificateFile) > 0 && len(tls.KeyFile) > 0
 }
 
 type RedisMessageQueue struct {
@@ -23,21 +47,159 @@ type RedisMessageQueue struct {
 	Password  string `yaml:"password"`
 	QueueName string `yaml:"queue_name"`
 	Timeout   int    `yaml:"timeout"` // s
+
+	// Requests are added to a stream instead of a list if the transport is stream. Must
+	// be the same as the transport of the requests queue of the backend service.
+	Transport string `yaml:"transport"`
+
+	// Responses which are not valid JSON are moved to the dead-letter queue of the
+	// backend service on this Redis server. They are dropped if it is empty.
+	DeadLetterQueue string `yaml:"dead_letter_queue"`
+}
+
+// Stops sending requests to a backend service after FailureThreshold consecutive
+// requests without a response. Requests are rejected at once until OpenDuration has
+// passed. Then up to HalfOpenRequests requests are let through to find out whether the
+// backend service is back. Disabled if FailureThreshold is 0.
+type CircuitBreaker struct {
+	FailureThreshold int `yaml:"failure_threshold"`
+	OpenDuration     int `yaml:"open_duration"` // s
+	HalfOpenRequests int `yaml:"half_open_requests"`
 }
 
 type Service struct {
 	RequestsQueue    RedisMessageQueue `yaml:"redis_requests_queue"`
 	ResponsesQueue   RedisMessageQueue `yaml:"redis_responses_queue"`
 	CacheWaitTimeout int               `yaml:"cache_wait_timeout"` // s
+	CircuitBreaker   CircuitBreaker    `yaml:"circuit_breaker"`
+
+	// Backend services drop requests this long before the API gateway stops waiting for
+	// their response, so that a request they apply is answered in time. Must cover the
+	// time taken to process a request and the difference between the clocks. Must be
+	// shorter than CacheWaitTimeout.
+	DeadlineMargin int `yaml:"deadline_margin"` // s
+
+	// Requests waiting for a response from the backend service at the same time. Further
+	// requests are rejected. Unlimited if 0.
+	MaximumConcurrentRequests int `yaml:"maximum_concurrent_requests"`
+}
+
+// A static API key and the wallets its holder is allowed to touch
+type APIKey struct {
+	Name      string   `yaml:"name"`
+	Key       string   `yaml:"key"`
+	WalletIDs []string `yaml:"wallet_ids"`
+	Admin     bool     `yaml:"admin"` // May see the settings of the API gateway
+}
+
+type Authentication struct {
+	TokenSigningKey string   `yaml:"token_signing_key"` // Bearer tokens are rejected if empty
+	APIKeys         []APIKey `yaml:"api_keys"`
+}
+
+const (
+	Rate_limit_keyed_by_client_ip string = "client_ip"
+	Rate_limit_keyed_by_api_key   string = "api_key" // Name of API key or subject of bearer token
+	Rate_limit_keyed_by_wallet_id string = "wallet_id"
+)
+
+// Token bucket holding up to Burst tokens and refilled at Rate tokens per second.
+// Each request takes one token. Rate limiting is disabled if Rate is 0.
+type RateLimit struct {
+	KeyedBy string  `yaml:"keyed_by"`
+	Rate    float64 `yaml:"rate"` // requests/s
+	Burst   int     `yaml:"burst"`
+}
+
+type RateLimits struct {
+	Deposits           RateLimit `yaml:"deposits"`
+	Withdrawals        RateLimit `yaml:"withdrawals"`
+	Transfer           RateLimit `yaml:"transfer"`
+	Balance            RateLimit `yaml:"balance"`
+	TransactionHistory RateLimit `yaml:"transaction_history"`
+	Webhooks           RateLimit `yaml:"webhooks"`
+}
+
+// Deprecation of a version of the public API. Responses of a deprecated version carry
+// the Deprecation header, and the Sunset header once the date it stops being served is
+// known. Dates are RFC 3339, e.g. 2026-10-18T00:00:00Z. Empty if not set.
+type APIVersion struct {
+	DeprecatedAt string `yaml:"deprecated_at"`
+	SunsetAt     string `yaml:"sunset_at"`
+}
+
+type APIVersions struct {
+	Unversioned APIVersion `yaml:"unversioned"` // Routes without a version prefix
+	V1          APIVersion `yaml:"v1"`
+}
+
+/*
+Live feed of the events of each wallet, pushed to clients over WebSocket. The deposit,
+withdraw and transfer services add committed events to a Redis stream of each wallet
+and publish them on the channel named after the streams. Clients that reconnect with
+the ID of the last event they received are sent the events they missed, up to
+MaximumResumedEvents. Beyond that, they are told to fetch the balance again.
+*/
+type WalletEvents struct {
+	Host       string `yaml:"host"`
+	Port       string `yaml:"port"`
+	Username   string `yaml:"username"`
+	Password   string `yaml:"password"`
+	StreamName string `yaml:"stream_name"`
+	Timeout    int    `yaml:"timeout"` // s
+
+	// Clients are sent a heartbeat at this interval and are disconnected if nothing is
+	// heard from them for two intervals
+	HeartbeatInterval int `yaml:"heartbeat_interval"` // s
+	WriteTimeout      int `yaml:"write_timeout"`      // s
+
+	// Events waiting to be sent to each client. A client that falls further behind is
+	// sent the events it missed from the stream of its wallet.
+	BufferSize           int   `yaml:"buffer_size"`
+	MaximumResumedEvents int64 `yaml:"maximum_resumed_events"`
+}
+
+/*
+Deposits, withdrawals and transfers sent with Prefer: respond-async are answered with
+202 Accepted at once. Their status is kept in Redis under KeyPrefix and the ID of the
+operation for Retention seconds, so that it can be looked up from any instance of the
+API gateway, even after a restart.
+*/
+type Operations struct {
+	Host      string `yaml:"host"`
+	Port      string `yaml:"port"`
+	Username  string `yaml:"username"`
+	Password  string `yaml:"password"`
+	KeyPrefix string `yaml:"key_prefix"`
+	Timeout   int    `yaml:"timeout"`   // s
+	Retention int    `yaml:"retention"` // s
+}
+
+// Limits of POST /v1/batch. Items of batches which are not atomic are sent to the
+// backend services by at most Concurrency requests at a time.
+type Batch struct {
+	MaximumItems int `yaml:"maximum_items"`
+	Concurrency  int `yaml:"concurrency"`
 }
 
 type Config struct {
-	HTTPServer                HTTPServer `yaml:"http_server"`
-	DepositsService           Service    `yaml:"deposits_service"`
-	WithdrawalService         Service    `yaml:"withdrawal_service"`
-	TransferService           Service    `yaml:"transfer_service"`
-	BalanceService            Service    `yaml:"balance_service"`
-	TransactionHistoryService Service    `yaml:"transaction_history_service"`
+	NodeID                    int64                 `yaml:"node_id"`
+	HTTPServer                HTTPServer            `yaml:"http_server"`
+	GRPCServer                GRPCServer            `yaml:"grpc_server"`
+	Authentication            Authentication        `yaml:"authentication"`
+	RateLimits                RateLimits            `yaml:"rate_limits"`
+	DepositsService           Service               `yaml:"deposits_service"`
+	WithdrawalService         Service               `yaml:"withdrawal_service"`
+	TransferService           Service               `yaml:"transfer_service"`
+	BalanceService            Service               `yaml:"balance_service"`
+	TransactionHistoryService Service               `yaml:"transaction_history_service"`
+	WebhookService            Service               `yaml:"webhook_service"`
+	WalletEvents              WalletEvents          `yaml:"wallet_events"`
+	Operations                Operations            `yaml:"operations"`
+	Batch                     Batch                 `yaml:"batch"`
+	APIVersions               APIVersions           `yaml:"api_versions"`
+	Tracing                   shared_config.Tracing `yaml:"tracing"`
+	Logging                   shared_config.Logging `yaml:"logging"`
 }
 
 func Load(filepath string) (*Config, error) {
@@ -54,9 +216,107 @@ func Load(filepath string) (*Config, error) {
 		return nil, err
 	}
 
+	err = check_deadline_margins(&config)
+	if err != nil {
+		return nil, err
+	}
+
 	return &config, nil
 }
 
+// Requests must expire before the API gateway stops waiting for their response
+func check_deadline_margins(config *Config) error {
+	services := []struct {
+		name    string
+		service *Service
+	}{
+		{"deposits_service", &config.DepositsService},
+		{"withdrawal_service", &config.WithdrawalService},
+		{"transfer_service", &config.TransferService},
+		{"balance_service", &config.BalanceService},
+		{"transaction_history_service", &config.TransactionHistoryService},
+		{"webhook_service", &config.WebhookService},
+	}
+	for _, service := range services {
+		if service.service.DeadlineMargin >= service.service.CacheWaitTimeout {
+			return fmt.Errorf("%s.deadline_margin must be shorter than %s.cache_wait_timeout", service.name, service.name)
+		}
+	}
+	return nil
+}
+
+// The Redis server and transport of a queue without the name of the queue and the
+// timeout
+func (message_queue *RedisMessageQueue) get_server() RedisMessageQueue {
+	return RedisMessageQueue{
+		Host:      message_queue.Host,
+		Port:      message_queue.Port,
+		Username:  message_queue.Username,
+		Password:  message_queue.Password,
+		Transport: message_queue.Transport,
+	}
+}
+
+// The Redis server of the streams without the name of the streams and the settings of
+// the live feed
+func (wallet_events *WalletEvents) get_server() WalletEvents {
+	return WalletEvents{
+		Host:     wallet_events.Host,
+		Port:     wallet_events.Port,
+		Username: wallet_events.Username,
+		Password: wallet_events.Password,
+	}
+}
+
+// The Redis server of the operations without the key prefix and the timeouts
+func (operations *Operations) get_server() Operations {
+	return Operations{
+		Host:     operations.Host,
+		Port:     operations.Port,
+		Username: operations.Username,
+		Password: operations.Password,
+	}
+}
+
+func check_service_reload(restart_required *shared_config.RestartRequired, name string, current *Service, next *Service) {
+	restart_required.Compare(name+".redis_requests_queue", current.RequestsQueue.get_server(), next.RequestsQueue.get_server())
+	restart_required.Compare(name+".redis_responses_queue", current.ResponsesQueue.get_server(), next.ResponsesQueue.get_server())
+
+	// The reply queues of the API gateway are named after the responses queue
+	restart_required.Compare(name+".redis_responses_queue.queue_name", current.ResponsesQueue.QueueName, next.ResponsesQueue.QueueName)
+}
+
+/*
+Returns an error listing the settings that cannot be changed without a restart. All
+other settings, e.g. timeouts, rate limits, circuit breakers, API keys and the names
+of requests queues, are applied as soon as the configuration file is reloaded.
+*/
+func CheckReload(current *Config, next *Config) error {
+	restart_required := shared_config.RestartRequired{}
+	restart_required.Compare("node_id", current.NodeID, next.NodeID)
+	restart_required.Compare("http_server", current.HTTPServer, next.HTTPServer)
+	restart_required.Compare("grpc_server", current.GRPCServer, next.GRPCServer)
+	check_service_reload(&restart_required, "deposits_service", &current.DepositsService, &next.DepositsService)
+	check_service_reload(&restart_required, "withdrawal_service", &current.WithdrawalService, &next.WithdrawalService)
+	check_service_reload(&restart_required, "transfer_service", &current.TransferService, &next.TransferService)
+	check_service_reload(&restart_required, "balance_service", &current.BalanceService, &next.BalanceService)
+	check_service_reload(&restart_required, "transaction_history_service", &current.TransactionHistoryService, &next.TransactionHistoryService)
+	check_service_reload(&restart_required, "webhook_service", &current.WebhookService, &next.WebhookService)
+	restart_required.Compare("wallet_events", current.WalletEvents.get_server(), next.WalletEvents.get_server())
+
+	// The API gateway subscribes to the channel named after the streams when it starts
+	restart_required.Compare("wallet_events.stream_name", current.WalletEvents.StreamName, next.WalletEvents.StreamName)
+	restart_required.Compare("operations", current.Operations.get_server(), next.Operations.get_server())
+
+	// Operations stored under the old prefix could no longer be found
+	restart_required.Compare("operations.key_prefix", current.Operations.KeyPrefix, next.Operations.KeyPrefix)
+	restart_required.Compare("tracing", current.Tracing, next.Tracing)
+
+	// The level of the logs is applied at once
+	restart_required.Compare("logging.file", current.Logging.File, next.Logging.File)
+	return restart_required.Err()
+}
+
 func (message_queue *RedisMessageQueue) GetRedisOptions() *redis.Options {
 	options := &redis.Options{
 		Addr:     message_queue.Host + ":" + message_queue.Port,
@@ -65,3 +325,21 @@ func (message_queue *RedisMessageQueue) GetRedisOptions() *redis.Options {
 	}
 	return options
 }
+
+func (wallet_events *WalletEvents) GetRedisOptions() *redis.Options {
+	options := &redis.Options{
+		Addr:     wallet_events.Host + ":" + wallet_events.Port,
+		Username: wallet_events.Username,
+		Password: wallet_events.Password,
+	}
+	return options
+}
+
+func (operations *Operations) GetRedisOptions() *redis.Options {
+	options := &redis.Options{
+		Addr:     operations.Host + ":" + operations.Port,
+		Username: operations.Username,
+		Password: operations.Password,
+	}
+	return options
+}
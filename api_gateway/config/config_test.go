@@ -1,7 +1,11 @@
 package config
 
 import (
+	"os"
+	"path/filepath"
 	"reflect"
+	shared_config "shared/config"
+	"strings"
 	"testing"
 )
 
@@ -14,6 +18,7 @@ func Test_LoadConfig(t *testing.T) {
 	}
 
 	expected_config := Config{
+		NodeID: 1,
 		HTTPServer: HTTPServer{
 			ListenPort:      "1120",
 			ReadTimeout:     60,
@@ -21,15 +26,67 @@ func Test_LoadConfig(t *testing.T) {
 			IdleTimeout:     60,
 			RetryInterval:   60,
 			ShutdownTimeout: 60,
+			TLS: TLS{
+				MinimumVersion: "1.2",
+			},
+		},
+		GRPCServer: GRPCServer{
+			ListenPort:    "1125",
+			IdleTimeout:   60,
+			RetryInterval: 60,
+		},
+		Authentication: Authentication{
+			TokenSigningKey: "change_me_token_signing_key",
+			APIKeys: []APIKey{
+				{
+					Name:      "api_client",
+					Key:       "change_me_api_key",
+					WalletIDs: []string{"wallet_1", "wallet_2"},
+				},
+			},
+		},
+		RateLimits: RateLimits{
+			Deposits: RateLimit{
+				KeyedBy: Rate_limit_keyed_by_wallet_id,
+				Rate:    1,
+				Burst:   5,
+			},
+			Withdrawals: RateLimit{
+				KeyedBy: Rate_limit_keyed_by_wallet_id,
+				Rate:    1,
+				Burst:   5,
+			},
+			Transfer: RateLimit{
+				KeyedBy: Rate_limit_keyed_by_wallet_id,
+				Rate:    1,
+				Burst:   5,
+			},
+			Balance: RateLimit{
+				KeyedBy: Rate_limit_keyed_by_api_key,
+				Rate:    10,
+				Burst:   20,
+			},
+			TransactionHistory: RateLimit{
+				KeyedBy: Rate_limit_keyed_by_api_key,
+				Rate:    2,
+				Burst:   5,
+			},
+			Webhooks: RateLimit{
+				KeyedBy: Rate_limit_keyed_by_api_key,
+				Rate:    2,
+				Burst:   5,
+			},
 		},
 		DepositsService: Service{
 			RequestsQueue: RedisMessageQueue{
-				Host:      "localhost",
-				Port:      "1640",
-				Username:  "default",
-				Password:  "",
-				QueueName: "deposit_requests_queue",
-				Timeout:   5,
+				Host:            "localhost",
+				Port:            "1640",
+				Username:        "default",
+				Password:        "",
+				QueueName:       "deposit_requests_queue",
+				Timeout:         5,
+				Transport:       "list",
+				DeadLetterQueue: "deposit_dead_letter_queue",
 			},
 			ResponsesQueue: RedisMessageQueue{
 				Host:      "localhost",
@@ -40,15 +97,24 @@ func Test_LoadConfig(t *testing.T) {
 				Timeout:   5,
 			},
 			CacheWaitTimeout: 10,
+			DeadlineMargin:   2,
+			CircuitBreaker: CircuitBreaker{
+				FailureThreshold: 5,
+				OpenDuration:     30,
+				HalfOpenRequests: 1,
+			},
+			MaximumConcurrentRequests: 100,
 		},
 		WithdrawalService: Service{
 			RequestsQueue: RedisMessageQueue{
-				Host:      "localhost",
-				Port:      "1640",
-				Username:  "default",
-				Password:  "",
-				QueueName: "withdrawal_requests_queue",
-				Timeout:   5,
+				Host:            "localhost",
+				Port:            "1640",
+				Username:        "default",
+				Password:        "",
+				QueueName:       "withdrawal_requests_queue",
+				Timeout:         5,
+				Transport:       "list",
+				DeadLetterQueue: "withdrawal_dead_letter_queue",
 			},
 			ResponsesQueue: RedisMessageQueue{
 				Host:      "localhost",
@@ -59,15 +125,24 @@ func Test_LoadConfig(t *testing.T) {
 				Timeout:   5,
 			},
 			CacheWaitTimeout: 10,
+			DeadlineMargin:   2,
+			CircuitBreaker: CircuitBreaker{
+				FailureThreshold: 5,
+				OpenDuration:     30,
+				HalfOpenRequests: 1,
+			},
+			MaximumConcurrentRequests: 100,
 		},
 		TransferService: Service{
 			RequestsQueue: RedisMessageQueue{
-				Host:      "localhost",
-				Port:      "1640",
-				Username:  "default",
-				Password:  "",
-				QueueName: "transfer_requests_queue",
-				Timeout:   5,
+				Host:            "localhost",
+				Port:            "1640",
+				Username:        "default",
+				Password:        "",
+				QueueName:       "transfer_requests_queue",
+				Timeout:         5,
+				Transport:       "list",
+				DeadLetterQueue: "transfer_dead_letter_queue",
 			},
 			ResponsesQueue: RedisMessageQueue{
 				Host:      "localhost",
@@ -78,15 +153,24 @@ func Test_LoadConfig(t *testing.T) {
 				Timeout:   5,
 			},
 			CacheWaitTimeout: 10,
+			DeadlineMargin:   2,
+			CircuitBreaker: CircuitBreaker{
+				FailureThreshold: 5,
+				OpenDuration:     30,
+				HalfOpenRequests: 1,
+			},
+			MaximumConcurrentRequests: 100,
 		},
 		BalanceService: Service{
 			RequestsQueue: RedisMessageQueue{
-				Host:      "localhost",
-				Port:      "1640",
-				Username:  "default",
-				Password:  "",
-				QueueName: "balance_requests_queue",
-				Timeout:   5,
+				Host:            "localhost",
+				Port:            "1640",
+				Username:        "default",
+				Password:        "",
+				QueueName:       "balance_requests_queue",
+				Timeout:         5,
+				Transport:       "list",
+				DeadLetterQueue: "balance_dead_letter_queue",
 			},
 			ResponsesQueue: RedisMessageQueue{
 				Host:      "localhost",
@@ -97,25 +181,108 @@ func Test_LoadConfig(t *testing.T) {
 				Timeout:   5,
 			},
 			CacheWaitTimeout: 10,
+			DeadlineMargin:   2,
+			CircuitBreaker: CircuitBreaker{
+				FailureThreshold: 5,
+				OpenDuration:     30,
+				HalfOpenRequests: 1,
+			},
+			MaximumConcurrentRequests: 100,
 		},
 		TransactionHistoryService: Service{
 			RequestsQueue: RedisMessageQueue{
+				Host:            "localhost",
+				Port:            "1640",
+				Username:        "default",
+				Password:        "",
+				QueueName:       "transaction_history_requests_queue",
+				Timeout:         5,
+				Transport:       "list",
+				DeadLetterQueue: "transaction_history_dead_letter_queue",
+			},
+			ResponsesQueue: RedisMessageQueue{
 				Host:      "localhost",
 				Port:      "1640",
 				Username:  "default",
 				Password:  "",
-				QueueName: "transaction_history_requests_queue",
+				QueueName: "transaction_history_responses_queue",
 				Timeout:   5,
 			},
+			CacheWaitTimeout: 10,
+			DeadlineMargin:   2,
+			CircuitBreaker: CircuitBreaker{
+				FailureThreshold: 5,
+				OpenDuration:     30,
+				HalfOpenRequests: 1,
+			},
+			MaximumConcurrentRequests: 100,
+		},
+		WebhookService: Service{
+			RequestsQueue: RedisMessageQueue{
+				Host:            "localhost",
+				Port:            "1640",
+				Username:        "default",
+				Password:        "",
+				QueueName:       "webhook_requests_queue",
+				Timeout:         5,
+				Transport:       "list",
+				DeadLetterQueue: "webhook_dead_letter_queue",
+			},
 			ResponsesQueue: RedisMessageQueue{
 				Host:      "localhost",
 				Port:      "1640",
 				Username:  "default",
 				Password:  "",
-				QueueName: "transaction_history_responses_queue",
+				QueueName: "webhook_responses_queue",
 				Timeout:   5,
 			},
 			CacheWaitTimeout: 10,
+			DeadlineMargin:   2,
+			CircuitBreaker: CircuitBreaker{
+				FailureThreshold: 5,
+				OpenDuration:     30,
+				HalfOpenRequests: 1,
+			},
+			MaximumConcurrentRequests: 100,
+		},
+		WalletEvents: WalletEvents{
+			Host:                 "localhost",
+			Port:                 "1640",
+			Username:             "default",
+			Password:             "",
+			StreamName:           "wallet_events",
+			Timeout:              5,
+			HeartbeatInterval:    30,
+			WriteTimeout:         10,
+			BufferSize:           64,
+			MaximumResumedEvents: 500,
+		},
+		APIVersions: APIVersions{
+			Unversioned: APIVersion{
+				DeprecatedAt: "2026-10-18T00:00:00Z",
+			},
+		},
+		Operations: Operations{
+			Host:      "localhost",
+			Port:      "1640",
+			Username:  "default",
+			Password:  "",
+			KeyPrefix: "operations",
+			Timeout:   5,
+			Retention: 86400,
+		},
+		Batch: Batch{
+			MaximumItems: 1000,
+			Concurrency:  16,
+		},
+		Tracing: shared_config.Tracing{
+			Exporter: "none",
+			Endpoint: "http://localhost:4318/v1/traces",
+			Timeout:  5,
+		},
+		Logging: shared_config.Logging{
+			Level: "info",
+			File:  "",
 		},
 	}
 	if !reflect.DeepEqual(*config, expected_config) {
@@ -123,3 +290,88 @@ func Test_LoadConfig(t *testing.T) {
 	}
 
 }
+
+func Test_LoadDeadlineMargin(t *testing.T) {
+	bytes, err := os.ReadFile("../config.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Requests must expire before the API gateway stops waiting for their response
+	test_file_path := filepath.Join(t.TempDir(), "config.yml")
+	lines := strings.Split(string(bytes), "\n")
+	for index, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "deadline_margin:") {
+			lines[index] = "  deadline_margin: 10 # s"
+			break
+		}
+	}
+	err = os.WriteFile(test_file_path, []byte(strings.Join(lines, "\n")), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Load(test_file_path)
+	expected := "deposits_service.deadline_margin must be shorter than deposits_service.cache_wait_timeout"
+	if err == nil || err.Error() != expected {
+		t.Error("Expected: ", expected, ", Got: ", err)
+	}
+}
+
+func Test_CheckReload(t *testing.T) {
+
+	current, err := Load("../config.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Settings which are applied without a restart
+	{
+		next, err := Load("../config.yml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		next.Authentication.APIKeys = nil
+		next.RateLimits.Deposits.Rate = 1
+		next.DepositsService.CacheWaitTimeout = 1
+		next.DepositsService.RequestsQueue.QueueName = "new_deposits_requests_queue"
+		next.DepositsService.RequestsQueue.Timeout = 1
+		next.DepositsService.ResponsesQueue.Timeout = 1
+		next.DepositsService.CircuitBreaker.OpenDuration = 1
+		next.DepositsService.MaximumConcurrentRequests = 1
+		next.WalletEvents.HeartbeatInterval = 1
+		next.WalletEvents.MaximumResumedEvents = 1
+		next.APIVersions.V1.DeprecatedAt = "2027-01-01T00:00:00Z"
+		next.Operations.Retention = 1
+		next.Batch.MaximumItems = 1
+		next.Batch.Concurrency = 1
+		next.Logging.Level = "debug"
+
+		err = CheckReload(current, next)
+		if err != nil {
+			t.Error("Expected: ", nil, ", Got: ", err)
+		}
+	}
+
+	// Settings which need a restart
+	{
+		next, err := Load("../config.yml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		next.NodeID = 2
+		next.HTTPServer.ReadTimeout = 1
+		next.GRPCServer.ListenPort = "1122"
+		next.WithdrawalService.RequestsQueue.Host = "redis"
+		next.TransferService.ResponsesQueue.QueueName = "new_transfer_responses_queue"
+		next.WalletEvents.StreamName = "new_wallet_events"
+		next.Operations.KeyPrefix = "new_operations"
+		next.Tracing.Exporter = "otlp"
+		next.Logging.File = "api_gateway.log"
+
+		err = CheckReload(current, next)
+		expected := "Restart required to change node_id, http_server, grpc_server, withdrawal_service.redis_requests_queue, transfer_service.redis_responses_queue.queue_name, wallet_events.stream_name, operations.key_prefix, tracing, logging.file"
+		if err == nil || err.Error() != expected {
+			t.Error("Expected: ", expected, ", Got: ", err)
+		}
+	}
+}
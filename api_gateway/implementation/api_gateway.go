@@ -2,27 +2,41 @@ package implementation
 
 import (
 	"api_gateway/config"
+	"api_gateway/protos"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
-	"shared/responses"
+	"shared/logging"
+	"shared/queues"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/redis/go-redis/v9"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
 )
 
 type APIGateway struct {
+	// Settings the API gateway was started with. Only settings which need a restart
+	// are read from here. Reloaded settings are read from the HTTP multiplexer.
 	config           *config.Config
 	is_alive         atomic.Bool
 	http_server      *http.Server
 	http_multiplexer *http_request_multiplexer
 	redis_manager    *redis_manager
 	waitgroup        sync.WaitGroup
+
+	// Nil if the gRPC API is not enabled
+	grpc_server *grpc.Server
+
+	// Nil if HTTPS is not enabled
+	tls_reloader *tls_reloader
 }
 
 func CreateAPIGateway(config *config.Config) (*APIGateway, error) {
@@ -34,6 +48,12 @@ func CreateAPIGateway(config *config.Config) (*APIGateway, error) {
 		return nil, err
 	}
 
+	return create_api_gateway(config, redis_manager_, background_context)
+}
+
+// Requests and responses are passed on through the transports of the Redis manager
+func create_api_gateway(config *config.Config, redis_manager_ *redis_manager, background_context context.Context) (*APIGateway, error) {
+
 	http_multiplexer, err := create_http_request_multiplexer(config, redis_manager_, background_context)
 	if err != nil {
 		return nil, err
@@ -46,6 +66,26 @@ func CreateAPIGateway(config *config.Config) (*APIGateway, error) {
 		redis_manager:    redis_manager_,
 	}
 
+	if config.HTTPServer.TLS.IsEnabled() {
+		api_gateway.tls_reloader, err = create_tls_reloader(&config.HTTPServer.TLS)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(config.GRPCServer.ListenPort) > 0 {
+		options := []grpc.ServerOption{
+			grpc.KeepaliveParams(keepalive.ServerParameters{
+				MaxConnectionIdle: time.Duration(config.GRPCServer.IdleTimeout) * time.Second,
+			}),
+		}
+		if api_gateway.tls_reloader != nil {
+			options = append(options, grpc.Creds(credentials.NewTLS(api_gateway.tls_reloader.get_config())))
+		}
+		api_gateway.grpc_server = grpc.NewServer(options...)
+		protos.RegisterWalletServer(api_gateway.grpc_server, create_grpc_wallet_server(http_multiplexer))
+	}
+
 	return api_gateway, nil
 }
 
@@ -56,39 +96,78 @@ func (api_gateway *APIGateway) Run() {
 	go api_gateway.async_read_responses(
 		service_balance,
 		api_gateway.redis_manager.balance_responses_queue,
-		&api_gateway.http_multiplexer.balance_responses_cache,
-		&api_gateway.config.BalanceService.ResponsesQueue)
+		api_gateway.redis_manager.balance_reply_queue,
+		api_gateway.http_multiplexer.balance_response_waiters)
 
 	api_gateway.waitgroup.Add(1)
 	go api_gateway.async_read_responses(
 		service_deposit,
 		api_gateway.redis_manager.deposit_responses_queue,
-		&api_gateway.http_multiplexer.deposit_responses_cache,
-		&api_gateway.config.DepositsService.ResponsesQueue)
+		api_gateway.redis_manager.deposit_reply_queue,
+		api_gateway.http_multiplexer.deposit_response_waiters)
 
 	api_gateway.waitgroup.Add(1)
 	go api_gateway.async_read_responses(
 		service_transaction_history,
 		api_gateway.redis_manager.transaction_history_responses_queue,
-		&api_gateway.http_multiplexer.transaction_history_responses_cache,
-		&api_gateway.config.TransactionHistoryService.ResponsesQueue)
+		api_gateway.redis_manager.transaction_history_reply_queue,
+		api_gateway.http_multiplexer.transaction_history_response_waiters)
 
 	api_gateway.waitgroup.Add(1)
 	go api_gateway.async_read_responses(
 		service_transfer,
 		api_gateway.redis_manager.transfer_responses_queue,
-		&api_gateway.http_multiplexer.transfer_responses_cache,
-		&api_gateway.config.TransferService.ResponsesQueue)
+		api_gateway.redis_manager.transfer_reply_queue,
+		api_gateway.http_multiplexer.transfer_response_waiters)
 
 	api_gateway.waitgroup.Add(1)
 	go api_gateway.async_read_responses(
 		service_withdraw,
 		api_gateway.redis_manager.withdrawal_responses_queue,
-		&api_gateway.http_multiplexer.withdrawal_responses_cache,
-		&api_gateway.config.WithdrawalService.ResponsesQueue)
+		api_gateway.redis_manager.withdrawal_reply_queue,
+		api_gateway.http_multiplexer.withdrawal_response_waiters)
+
+	api_gateway.waitgroup.Add(1)
+	go api_gateway.async_read_responses(
+		service_webhook,
+		api_gateway.redis_manager.webhook_responses_queue,
+		api_gateway.redis_manager.webhook_reply_queue,
+		api_gateway.http_multiplexer.webhook_response_waiters)
+
+	// Responses to operations accepted with Prefer: respond-async. Operations are only
+	// accepted if they can be stored.
+	if api_gateway.redis_manager.operations != nil {
+		api_gateway.waitgroup.Add(1)
+		go api_gateway.async_complete_operations(
+			service_deposit,
+			api_gateway.redis_manager.deposit_responses_queue,
+			api_gateway.redis_manager.deposit_operations_queue)
+
+		api_gateway.waitgroup.Add(1)
+		go api_gateway.async_complete_operations(
+			service_withdraw,
+			api_gateway.redis_manager.withdrawal_responses_queue,
+			api_gateway.redis_manager.withdrawal_operations_queue)
+
+		api_gateway.waitgroup.Add(1)
+		go api_gateway.async_complete_operations(
+			service_transfer,
+			api_gateway.redis_manager.transfer_responses_queue,
+			api_gateway.redis_manager.transfer_operations_queue)
+	}
+
+	if api_gateway.redis_manager.wallet_events != nil {
+		api_gateway.waitgroup.Add(1)
+		go api_gateway.async_read_wallet_events()
+	}
 
 	api_gateway.waitgroup.Add(1)
 	go api_gateway.async_http_server()
+
+	if api_gateway.grpc_server != nil {
+		api_gateway.waitgroup.Add(1)
+		go api_gateway.async_grpc_server()
+	}
 }
 
 func (api_gateway *APIGateway) Shutdown() {
@@ -102,7 +181,24 @@ func (api_gateway *APIGateway) Shutdown() {
 		defer cancel()
 		api_gateway.http_server.Shutdown(context_with_timeout)
 	}
+	if api_gateway.grpc_server != nil {
+		// Calls in progress are given the same time to complete as HTTP requests
+		stopped := make(chan struct{})
+		go func() {
+			api_gateway.grpc_server.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(time.Duration(5) * time.Second):
+			api_gateway.grpc_server.Stop()
+		}
+	}
+	api_gateway.http_multiplexer.wallet_feed.close()
 	api_gateway.waitgroup.Wait()
+
+	// Spans of the last requests are still exported
+	api_gateway.http_multiplexer.tracer.Shutdown()
 }
 
 func (api_gateway *APIGateway) async_http_server() {
@@ -126,6 +222,10 @@ func (api_gateway *APIGateway) async_http_server() {
 			time.Sleep(time.Duration(config.HTTPServer.RetryInterval) * time.Second)
 			continue
 		}
+		if api_gateway.tls_reloader != nil {
+			listener = tls.NewListener(listener, api_gateway.tls_reloader.get_config())
+			log.Println("Serving HTTPS.")
+		}
 		log.Println("Listening on port: ", config.HTTPServer.ListenPort)
 
 		api_gateway.http_server = &http.Server{
@@ -145,11 +245,66 @@ func (api_gateway *APIGateway) async_http_server() {
 	}
 }
 
+func (api_gateway *APIGateway) async_grpc_server() {
+	defer func() {
+		api_gateway.waitgroup.Done()
+		log.Println("Shutdown gRPC server.")
+	}()
+
+	config := api_gateway.config
+
+	// Server continues running until terminated by user
+	for api_gateway.is_alive.Load() {
+
+		log.Println("Starting up gRPC server.")
+
+		// TLS is handled by the gRPC server itself
+		listener, err := net.Listen("tcp", ":"+config.GRPCServer.ListenPort)
+		if err != nil {
+			log.Print("Unable to listen on port: ", config.GRPCServer.ListenPort)
+			log.Print("Reestablishing in ", config.GRPCServer.RetryInterval, " s.")
+			time.Sleep(time.Duration(config.GRPCServer.RetryInterval) * time.Second)
+			continue
+		}
+		log.Println("Listening on port: ", config.GRPCServer.ListenPort)
+
+		err = api_gateway.grpc_server.Serve(listener)
+		if err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+			log.Print("Error with gRPC server: ", err.Error())
+			log.Print("Reestablishing in ", config.GRPCServer.RetryInterval, " s.")
+			time.Sleep(time.Duration(config.GRPCServer.RetryInterval) * time.Second)
+			continue
+		}
+	}
+}
+
+// Moves a response which cannot be read to the dead-letter queue of the backend service,
+// on the Redis server of its requests queue
+func (api_gateway *APIGateway) dead_letter(service_type int, queue_name string, bytes []byte, reason string) {
+	mux := api_gateway.http_multiplexer
+	service_name := get_service_name(service_type)
+	requests_queue := &get_service_config(mux.get_config(), service_type).RequestsQueue
+	if len(requests_queue.DeadLetterQueue) == 0 {
+		slog.Error("Dropped response", "backend_service", service_name, logging.Key_error, reason)
+		return
+	}
+	timeout_context, cancel := context.WithTimeout(mux.context, time.Duration(requests_queue.Timeout)*time.Second)
+	defer cancel()
+	dead_letter := queues.CreateDeadLetter(queues.Kind_response, queue_name, reason, bytes)
+	err := mux.get_requests_queue(service_type).PushDeadLetter(timeout_context, requests_queue.DeadLetterQueue, dead_letter)
+	if err != nil {
+		slog.Error("Unable to move response to dead-letter queue", "backend_service", service_name, logging.Key_error, err.Error())
+		return
+	}
+	slog.Warn("Moved response to dead-letter queue", "backend_service", service_name, logging.Key_error, reason)
+	mux.metrics.dead_letters.Inc(get_service_id(service_type))
+}
+
 func (api_gateway *APIGateway) async_read_responses(
 	service_type int,
-	responses_queue *redis.Client,
-	response_cache *sync.Map,
-	config *config.RedisMessageQueue) {
+	responses_queue queues.Transport,
+	reply_queue_name string,
+	response_waiters *response_waiters) {
 
 	service_name := get_service_name(service_type)
 	defer func() {
@@ -157,83 +312,43 @@ func (api_gateway *APIGateway) async_read_responses(
 		log.Println("Shutdown " + service_name + " responses thread.")
 	}()
 
-	log.Println("Started up " + service_name + " responses thread.")
+	// Readiness checks fail while this thread is not running
+	health_checker := api_gateway.http_multiplexer.health_checker
+	health_checker.set_reading(service_type, true)
+	defer health_checker.set_reading(service_type, false)
 
-	// Define aliases
-	timeout := time.Duration(config.Timeout) * time.Second
-	queue_name := config.QueueName
+	log.Println("Started up " + service_name + " responses thread.")
 
 	for api_gateway.is_alive.Load() {
 
-		// Read from Redis responses queue
+		// Timeouts may change when the configuration is reloaded
+		backend_service := get_service_config(api_gateway.http_multiplexer.get_config(), service_type)
+		timeout := time.Duration(backend_service.ResponsesQueue.Timeout) * time.Second
+
+		// Read from the reply queue of this instance of the API gateway
 		timeout_context, cancel := context.WithTimeout(api_gateway.http_multiplexer.context, timeout)
-		string_slice, err := responses_queue.BRPop(timeout_context, timeout, queue_name).Result()
+		bytes, err := responses_queue.PopResponse(timeout_context, reply_queue_name, timeout)
 		if err != nil {
 			cancel()
 			continue
 		}
 		cancel()
 
-		// string_slice[0] gives the name of the queue
-		// string_slice[1] gives the data retrieved from the queue
 		// Response is prepared by the primary backend service, not the API gateway.
 
-		// Put the response in the asynchronous map
-		switch service_type {
-		case service_balance:
-
-			response_message := responses.Balance{}
-			bytes := []byte(string_slice[1])
-			err := json.Unmarshal(bytes, &response_message)
-			if err != nil {
-				log.Println("Error deserialising JSON message. Must not happen in production.")
-				continue
-			}
-			response_cache.Store(response_message.Header.MessageID, bytes)
-
-		case service_deposit:
-
-			response_message := responses.Deposit{}
-			bytes := []byte(string_slice[1])
-			err := json.Unmarshal(bytes, &response_message)
-			if err != nil {
-				log.Println("Error deserialising JSON message. Must not happen in production.")
-				continue
-			}
-			response_cache.Store(response_message.Header.MessageID, bytes)
-
-		case service_transaction_history:
-
-			response_message := responses.TransactionHistory{}
-			bytes := []byte(string_slice[1])
-			err := json.Unmarshal(bytes, &response_message)
-			if err != nil {
-				log.Println("Error deserialising JSON message. Must not happen in production.")
-				continue
-			}
-			response_cache.Store(response_message.Header.MessageID, bytes)
-
-		case service_transfer:
-
-			response_message := responses.Transfer{}
-			bytes := []byte(string_slice[1])
-			err := json.Unmarshal(bytes, &response_message)
-			if err != nil {
-				log.Println("Error deserialising JSON message. Must not happen in production.")
-				continue
-			}
-			response_cache.Store(response_message.Header.MessageID, bytes)
-
-		case service_withdraw:
-
-			response_message := responses.Withdraw{}
-			bytes := []byte(string_slice[1])
-			err := json.Unmarshal(bytes, &response_message)
-			if err != nil {
-				log.Println("Error deserialising JSON message. Must not happen in production.")
-				continue
-			}
-			response_cache.Store(response_message.Header.MessageID, bytes)
+		// Only the header is needed to find the HTTP request waiting for the response.
+		// The rest of the response is passed on to the user as is.
+		response_message := response_status{}
+		err = json.Unmarshal(bytes, &response_message)
+		if err != nil {
+			api_gateway.dead_letter(service_type, reply_queue_name, bytes, "Failed to deserialise JSON message: "+err.Error())
+			continue
+		}
+
+		// The user is no longer waiting if the request timed out or was cancelled
+		if !response_waiters.deliver(response_message.Header.MessageID, bytes) {
+			slog.Warn("Discarded late response", "backend_service", service_name, logging.Key_message_id, response_message.Header.MessageID)
+			api_gateway.http_multiplexer.metrics.late_responses.Inc(get_service_id(service_type))
 		}
 	}
 }
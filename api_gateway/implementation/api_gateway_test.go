@@ -1,26 +1,44 @@
 package implementation
 
 import (
-	"api_gateway/config"
+	"api_gateway/authentication"
+	config_ "api_gateway/config"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"shared/identifiers"
 	"shared/messages"
+	"shared/queues"
+	"shared/responses"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
 func Test_APIGateway(t *testing.T) {
 
-	config, err := config.Load("../config.yml")
+	config, err := config_.Load("../config.yml")
 	if err != nil {
 		t.Fatal(err)
 	}
 	config.BalanceService.RequestsQueue.QueueName = "api_gateway_requests_queue_test"
 	config.BalanceService.ResponsesQueue.QueueName = "api_gateway_responses_queue_test"
+	api_key := "api_gateway_unit_test_key"
+	config.Authentication.APIKeys = []config_.APIKey{
+		{
+			Name:      "api_gateway_unit_test",
+			Key:       api_key,
+			WalletIDs: []string{"This is test message 2."},
+		},
+	}
+	config.Authentication.TokenSigningKey = "api_gateway_unit_test_signing_key"
 
 	// Start running test service
 	test_service_ := create_test_service(&config.BalanceService)
@@ -44,9 +62,17 @@ func Test_APIGateway(t *testing.T) {
 	}
 	url := "http://localhost:1120/test"
 
+	// Message ids are generated by the API gateway and echoed back by the test service
+	var first_message_id int64
+
 	// Test HTTP GET request
 	{
-		response, err := http_client.Get(url)
+		request, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set("X-API-Key", api_key)
+		response, err := http_client.Do(request)
 		if err != nil {
 			t.Fatal(err.Error())
 		}
@@ -61,9 +87,25 @@ func Test_APIGateway(t *testing.T) {
 		}
 		response.Body.Close()
 
-		expected_data := []byte("{\"header\":{\"id\":1,\"action\":4},\"status\":1,\"error_message\":\"Test service: I received your message: \"}")
-		if !reflect.DeepEqual(bytes, expected_data) {
-			t.Error("Expected: ", string(expected_data), ", Got: ", string(bytes))
+		response_message := responses.Balance{}
+		err = json.Unmarshal(bytes, &response_message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if identifiers.GetNodeID(response_message.Header.MessageID) != config.NodeID {
+			t.Error("Expected: ", config.NodeID, ", Got: ", identifiers.GetNodeID(response_message.Header.MessageID))
+		}
+		first_message_id = response_message.Header.MessageID
+		expected_response := responses.Balance{
+			Header: responses.Header{
+				MessageID: first_message_id,
+				Action:    messages.Action_get_balance,
+			},
+			Status:       responses.Status_successful,
+			ErrorMessage: "Test service: I received your message: ",
+		}
+		if !reflect.DeepEqual(response_message, expected_response) {
+			t.Error("Expected: ", expected_response, ", Got: ", response_message)
 		}
 	}
 
@@ -79,7 +121,13 @@ func Test_APIGateway(t *testing.T) {
 		}
 
 		// Send HTTP POST request and get response
-		response, err := http_client.Post(url, "application/json", bytes.NewReader(data))
+		request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("X-API-Key", api_key)
+		response, err := http_client.Do(request)
 		if err != nil {
 			t.Fatal(err.Error())
 		}
@@ -94,9 +142,452 @@ func Test_APIGateway(t *testing.T) {
 		}
 		response.Body.Close()
 
-		expected_data := []byte("{\"header\":{\"id\":2,\"action\":4},\"status\":1,\"error_message\":\"Test service: I received your message: This is test message 2.\"}")
-		if !reflect.DeepEqual(bytes, expected_data) {
-			t.Fatal("Expected: ", string(expected_data), ", Got: ", string(bytes))
+		response_message := responses.Balance{}
+		err = json.Unmarshal(bytes, &response_message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response_message.Header.MessageID <= first_message_id {
+			t.Error("Expected message id greater than ", first_message_id, ", Got: ", response_message.Header.MessageID)
+		}
+		expected_response := responses.Balance{
+			Header: responses.Header{
+				MessageID: response_message.Header.MessageID,
+				Action:    messages.Action_get_balance,
+			},
+			Status:       responses.Status_successful,
+			ErrorMessage: "Test service: I received your message: This is test message 2.",
+		}
+		if !reflect.DeepEqual(response_message, expected_response) {
+			t.Fatal("Expected: ", expected_response, ", Got: ", response_message)
+		}
+	}
+
+	// Test request without credentials
+	{
+		response, err := http_client.Get(url)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusUnauthorized {
+			t.Error("Expected: ", http.StatusUnauthorized, ", Got: ", response.StatusCode)
+		}
+	}
+
+	// Test request with unknown API key
+	{
+		request, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set("X-API-Key", "unknown_api_key")
+		response, err := http_client.Do(request)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusUnauthorized {
+			t.Error("Expected: ", http.StatusUnauthorized, ", Got: ", response.StatusCode)
+		}
+	}
+
+	// Test request with bearer token
+	{
+		claims := authentication.Claims{
+			Subject:   "api_gateway_unit_test",
+			WalletIDs: []string{"This is test message 2."},
+			ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		}
+		token, err := authentication.SignToken(&claims, []byte(config.Authentication.TokenSigningKey))
+		if err != nil {
+			t.Fatal(err)
+		}
+		request, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set("Authorization", "Bearer "+token)
+		response, err := http_client.Do(request)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			t.Error("Expected: ", http.StatusOK, ", Got: ", response.StatusCode)
+		}
+	}
+
+	// Test deposit into a wallet not owned by the caller
+	{
+		data, err := json.Marshal(messages.POST_Deposit{Amount: "10", Currency: "SGD"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		request, err := http.NewRequest(http.MethodPost, "http://localhost:1120/wallets/{someone_elses_wallet}/deposits", bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("X-API-Key", api_key)
+		response, err := http_client.Do(request)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusForbidden {
+			t.Error("Expected: ", http.StatusForbidden, ", Got: ", response.StatusCode)
+		}
+		problem := responses.Problem{}
+		err = json.NewDecoder(response.Body).Decode(&problem)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if problem.Code != responses.Error_code_forbidden {
+			t.Error("Expected: ", responses.Error_code_forbidden, ", Got: ", problem.Code)
+		}
+	}
+
+	// Test webhooks for a wallet not owned by the caller and for every wallet, which
+	// only administrators may create
+	for _, wallet_id := range []string{"someone_elses_wallet", ""} {
+		data, err := json.Marshal(messages.POST_Webhook{URL: "https://example.com/hooks", WalletID: wallet_id, EventTypes: []string{"deposit.completed"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		request, err := http.NewRequest(http.MethodPost, "http://localhost:1120/webhooks", bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("X-API-Key", api_key)
+		response, err := http_client.Do(request)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusForbidden {
+			t.Error("Expected: ", http.StatusForbidden, ", Got: ", response.StatusCode)
+		}
+	}
+
+	// Test path that does not exist
+	{
+		request, err := http.NewRequest(http.MethodGet, "http://localhost:1120/wallets/abc/balances", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set("X-API-Key", api_key)
+		response, err := http_client.Do(request)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusNotFound {
+			t.Error("Expected: ", http.StatusNotFound, ", Got: ", response.StatusCode)
+		}
+	}
+
+	// Test method that is not allowed
+	{
+		request, err := http.NewRequest(http.MethodDelete, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set("X-API-Key", api_key)
+		response, err := http_client.Do(request)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusMethodNotAllowed {
+			t.Error("Expected: ", http.StatusMethodNotAllowed, ", Got: ", response.StatusCode)
+		}
+		expected := "GET, POST"
+		if response.Header.Get("Allow") != expected {
+			t.Error("Expected: ", expected, ", Got: ", response.Header.Get("Allow"))
+		}
+	}
+
+	// Test health checks. No credentials are needed.
+	{
+		response, err := http_client.Get("http://localhost:1120/healthz")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			t.Error("Expected: ", http.StatusOK, ", Got: ", response.StatusCode)
+		}
+	}
+
+	{
+		response, err := http_client.Get("http://localhost:1120/readyz")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			t.Error("Expected: ", http.StatusOK, ", Got: ", response.StatusCode)
+		}
+		status := health_status{}
+		err = json.NewDecoder(response.Body).Decode(&status)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := service_health{
+			Status:          health_status_ok,
+			RequestsQueue:   health_status_ok,
+			ResponsesQueue:  health_status_ok,
+			ResponsesReader: health_status_running,
+		}
+		if status.Status != health_status_ok || len(status.Services) != 6 {
+			t.Error("Expected: 6 healthy services, Got: ", status)
+		}
+		if !reflect.DeepEqual(status.Services["balance"], expected) {
+			t.Error("Expected: ", expected, ", Got: ", status.Services["balance"])
+		}
+	}
+
+	// Test metrics. Requests sent above are counted by route and status.
+	{
+		response, err := http_client.Get("http://localhost:1120/metrics")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			t.Error("Expected: ", http.StatusOK, ", Got: ", response.StatusCode)
+		}
+		body, err := io.ReadAll(response.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, expected := range []string{
+			`api_gateway_http_requests_total{route="/test",method="GET",status="200"} 2`,
+			`api_gateway_http_requests_total{route="/test",method="GET",status="401"} 2`,
+			`api_gateway_http_requests_total{route="unmatched",method="GET",status="404"} 1`,
+			`api_gateway_queue_push_duration_seconds_count{service="balance"} 3`,
+			`api_gateway_response_wait_duration_seconds_count{service="balance"} 3`,
+			`api_gateway_response_waiters{service="balance"} 0`,
+		} {
+			if !strings.Contains(string(body), expected) {
+				t.Error("Expected: ", expected, ", Got: ", string(body))
+			}
+		}
+	}
+}
+
+func Test_APIGatewayInstances(t *testing.T) {
+
+	// Two instances of the API gateway share the same test service. Each must receive
+	// the responses to its own requests only.
+	number_of_instances := 2
+	requests_per_instance := 20
+	api_key := "api_gateway_unit_test_key"
+	wallet_id := "This is test message 2."
+
+	var configs []*config_.Config
+	for i := 0; i < number_of_instances; i++ {
+		config, err := config_.Load("../config.yml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.NodeID = int64(i + 1)
+		config.HTTPServer.ListenPort = strconv.Itoa(1120 + i)
+		config.GRPCServer.ListenPort = strconv.Itoa(1125 + i)
+		config.BalanceService.RequestsQueue.QueueName = "api_gateway_requests_queue_test"
+		config.BalanceService.ResponsesQueue.QueueName = "api_gateway_responses_queue_test"
+		config.Authentication.APIKeys = []config_.APIKey{
+			{
+				Name:      "api_gateway_unit_test",
+				Key:       api_key,
+				WalletIDs: []string{wallet_id},
+			},
+		}
+		configs = append(configs, config)
+	}
+
+	// Start running test service
+	test_service_ := create_test_service(&configs[0].BalanceService)
+	test_service_.run()
+	defer test_service_.shutdown()
+
+	// Start running API gateways
+	for _, config := range configs {
+		api_gateway, err := CreateAPIGateway(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		api_gateway.Run()
+		defer api_gateway.Shutdown()
+	}
+
+	time.Sleep(2 * time.Second)
+
+	http_client := http.Client{
+		Timeout: 5 * time.Second,
+	}
+
+	var waitgroup sync.WaitGroup
+	for _, config := range configs {
+		for i := 0; i < requests_per_instance; i++ {
+			waitgroup.Add(1)
+			go func(config *config_.Config) {
+				defer waitgroup.Done()
+
+				data, err := json.Marshal(messages.GET_Balance{WalletID: wallet_id})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				url := "http://localhost:" + config.HTTPServer.ListenPort + "/test"
+				request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				request.Header.Set("Content-Type", "application/json")
+				request.Header.Set("X-API-Key", api_key)
+				response, err := http_client.Do(request)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer response.Body.Close()
+				if response.StatusCode != http.StatusOK {
+					t.Error("Expected: ", http.StatusOK, ", Got: ", response.StatusCode)
+					return
+				}
+
+				response_message := responses.Balance{}
+				err = json.NewDecoder(response.Body).Decode(&response_message)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				node_id := identifiers.GetNodeID(response_message.Header.MessageID)
+				if node_id != config.NodeID {
+					t.Error("Expected: ", config.NodeID, ", Got: ", node_id)
+				}
+			}(config)
 		}
 	}
+	waitgroup.Wait()
+}
+
+// The API gateway and a backend service pass messages to each other in memory, so no
+// Redis server is needed
+func Test_APIGatewayInMemory(t *testing.T) {
+
+	config, err := config_.Load("../config.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.BalanceService.RequestsQueue.Host = "unreachable.invalid"
+	config.BalanceService.ResponsesQueue.Host = "unreachable.invalid"
+	api_key := "api_gateway_in_memory_unit_test_key"
+	config.Authentication.APIKeys = []config_.APIKey{
+		{
+			Name:      "api_gateway_in_memory_unit_test",
+			Key:       api_key,
+			WalletIDs: []string{"wallet_1"},
+		},
+	}
+	memory := queues.CreateMemory()
+
+	// Start running test service
+	test_service_ := create_test_service(&config.BalanceService)
+	test_service_.set_transport(memory)
+	test_service_.run()
+	defer test_service_.shutdown()
+
+	// Start running API gateway
+	api_gateway, err := create_api_gateway(config, create_memory_manager(config, memory), context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	api_gateway.Run()
+	defer api_gateway.Shutdown()
+
+	send := func(method string, path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(method, path, nil)
+		request.Header.Set("X-API-Key", api_key)
+		api_gateway.http_multiplexer.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	// The request reaches the test service and its response comes back
+	recorder := send(http.MethodGet, "/test")
+	if recorder.Code != http.StatusOK {
+		t.Fatal("Expected: ", http.StatusOK, ", Got: ", recorder.Code, " ", recorder.Body.String())
+	}
+	response_message := responses.Balance{}
+	err = json.Unmarshal(recorder.Body.Bytes(), &response_message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "Test service: I received your message: "
+	if response_message.Status != responses.Status_successful || response_message.ErrorMessage != expected {
+		t.Error("Expected: ", expected, ", Got: ", response_message)
+	}
+
+	// Queues in memory are always available
+	recorder = send(http.MethodGet, "/readyz")
+	if recorder.Code != http.StatusOK {
+		t.Error("Expected: ", http.StatusOK, ", Got: ", recorder.Code, " ", recorder.Body.String())
+	}
+
+	// Responses which are not valid JSON are moved to the dead-letter queue
+	reply_queue_name := api_gateway.http_multiplexer.balance_reply_queue
+	memory.PushResponse(context.Background(), reply_queue_name, []byte("{"), 0)
+	dead_letter_queue := config.BalanceService.RequestsQueue.DeadLetterQueue
+	deadline := time.Now().Add(5 * time.Second)
+	for len(memory.GetDeadLetters(dead_letter_queue)) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	dead_letters := memory.GetDeadLetters(dead_letter_queue)
+	if len(dead_letters) != 1 || dead_letters[0].Kind != queues.Kind_response || dead_letters[0].QueueName != reply_queue_name || dead_letters[0].Message != "{" {
+		t.Error("Expected: ", "response from "+reply_queue_name, ", Got: ", dead_letters)
+	}
+}
+
+func Test_Deadline(t *testing.T) {
+	backend_service := &config_.Service{CacheWaitTimeout: 10, DeadlineMargin: 2}
+
+	// Requests expire the deadline margin before the API gateway stops waiting for
+	// their response
+	request := httptest.NewRequest(http.MethodGet, "/test", nil)
+	gives_up_at := time.Now().Add(get_response_timeout(backend_service, request)).UnixMilli()
+	expected := time.Now().Add(8 * time.Second).UnixMilli()
+	deadline := get_deadline(backend_service, request)
+	if deadline < expected || deadline > expected+1000 {
+		t.Error("Expected: ", expected, ", Got: ", deadline)
+	}
+	if deadline > gives_up_at-2000 {
+		t.Error("Expected: ", "deadline before ", gives_up_at-2000, ", Got: ", deadline)
+	}
+
+	// Earlier deadlines of the user are kept, e.g. the deadline of a gRPC call
+	timeout_context, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	request = request.WithContext(timeout_context)
+	expected = time.Now().Add(3 * time.Second).UnixMilli()
+	deadline = get_deadline(backend_service, request)
+	if deadline > expected || deadline < expected-1000 {
+		t.Error("Expected: ", expected, ", Got: ", deadline)
+	}
+
+	// Deadlines of the user shorter than the margin leave half of the time left to the
+	// backend service instead of a deadline in the past
+	short_context, cancel_short := context.WithTimeout(context.Background(), time.Second)
+	defer cancel_short()
+	request = request.WithContext(short_context)
+	started_at := time.Now().UnixMilli()
+	deadline = get_deadline(backend_service, request)
+	gives_up_at = time.Now().Add(get_response_timeout(backend_service, request)).UnixMilli()
+	if deadline < started_at+400 || deadline > gives_up_at-400 {
+		t.Error("Expected: ", "deadline between ", started_at+400, " and ", gives_up_at-400, ", Got: ", deadline)
+	}
 }
@@ -0,0 +1,425 @@
+package implementation
+
+import (
+	"api_gateway/paths"
+	"encoding/json"
+	"errors"
+	"net/http"
+	v1 "shared/api/v1"
+	"shared/messages"
+	"shared/responses"
+	"time"
+)
+
+/*
+Version 1 of the public API. Requests are read into the bodies of shared/api/v1 and
+turned into the messages of the backend services. Responses of the backend services
+are turned back into the bodies of shared/api/v1 by the mappers below, so that fields
+of the messages between the API gateway and the backend services, e.g. headers and
+reply queues, never reach users.
+*/
+
+// Date format of version 1 of the public API and of the backend services
+const (
+	date_format_v1      string = "2006-01-02"
+	date_format_backend string = "20060102"
+)
+
+var transaction_types_v1 = map[string]string{
+	responses.Transaction_type_deposit:  v1.Transaction_type_deposit,
+	responses.Transaction_type_withdraw: v1.Transaction_type_withdrawal,
+}
+
+var operations_v1 = map[int]string{
+	messages.Action_deposit:  v1.Operation_deposit,
+	messages.Action_withdraw: v1.Operation_withdrawal,
+	messages.Action_transfer: v1.Operation_transfer,
+	messages.Action_batch:    v1.Operation_batch,
+}
+
+// Operations which can be items of a batch
+var batch_item_actions_v1 = map[string]int{
+	v1.Operation_deposit:    messages.Action_deposit,
+	v1.Operation_withdrawal: messages.Action_withdraw,
+	v1.Operation_transfer:   messages.Action_transfer,
+}
+
+// Dates which cannot be converted are passed on as they are, so that the receiver
+// can report them
+func convert_date(date string, from_format string, to_format string) string {
+	parsed, err := time.Parse(from_format, date)
+	if err != nil {
+		return date
+	}
+	return parsed.Format(to_format)
+}
+
+func map_deposit_v1(bytes []byte) (any, error) {
+	response_message := responses.Deposit{}
+	err := json.Unmarshal(bytes, &response_message)
+	if err != nil {
+		return nil, err
+	}
+	return &v1.Deposit{Currency: response_message.Currency, NewBalance: response_message.NewBalance}, nil
+}
+
+func map_withdrawal_v1(bytes []byte) (any, error) {
+	response_message := responses.Withdraw{}
+	err := json.Unmarshal(bytes, &response_message)
+	if err != nil {
+		return nil, err
+	}
+	return &v1.Withdrawal{Currency: response_message.Currency, NewBalance: response_message.NewBalance}, nil
+}
+
+func map_transfer_v1(bytes []byte) (any, error) {
+	response_message := responses.Transfer{}
+	err := json.Unmarshal(bytes, &response_message)
+	if err != nil {
+		return nil, err
+	}
+	return &v1.Transfer{Currency: response_message.Currency, NewBalance: response_message.NewBalance}, nil
+}
+
+func map_balance_v1(bytes []byte) (any, error) {
+	response_message := responses.Balance{}
+	err := json.Unmarshal(bytes, &response_message)
+	if err != nil {
+		return nil, err
+	}
+	return &v1.Balance{Currency: response_message.Currency, Balance: response_message.Balance}, nil
+}
+
+func map_transaction_history_v1(bytes []byte) (any, error) {
+	response_message := responses.TransactionHistory{}
+	err := json.Unmarshal(bytes, &response_message)
+	if err != nil {
+		return nil, err
+	}
+	history := &v1.TransactionHistory{Transactions: make([]v1.Transaction, 0, len(response_message.History))}
+	for _, transaction := range response_message.History {
+		transaction_type, exists := transaction_types_v1[transaction.Type]
+		if !exists {
+			transaction_type = transaction.Type
+		}
+		history.Transactions = append(history.Transactions, v1.Transaction{
+			Date:     convert_date(transaction.Date, date_format_backend, date_format_v1),
+			Type:     transaction_type,
+			Currency: transaction.Currency,
+			Amount:   transaction.Amount,
+		})
+	}
+	return history, nil
+}
+
+// The original response is kept as it was sent, so it may be a failed response
+func map_request_outcome_v1(bytes []byte) (any, error) {
+	response_message := responses.IdempotencyKey{}
+	err := json.Unmarshal(bytes, &response_message)
+	if err != nil {
+		return nil, err
+	}
+	operation, exists := operations_v1[response_message.RequestAction]
+	if !exists {
+		return nil, errors.New("unknown request action")
+	}
+	result, err := map_result_v1(response_message.RequestAction, response_message.Response)
+	if err != nil {
+		return nil, err
+	}
+	return &v1.RequestOutcome{Operation: operation, ProcessedAt: response_message.DateAndTime, Result: result}, nil
+}
+
+// Maps the original response to a deposit, withdrawal, transfer or atomic batch
+func map_result_v1(request_action int, bytes []byte) (v1.Result, error) {
+	result := v1.Result{}
+	original_status := response_status{}
+	err := json.Unmarshal(bytes, &original_status)
+	if err != nil {
+		return result, err
+	}
+	if original_status.Status == responses.Status_failed {
+		result.Error = &v1.Error{Code: original_status.ErrorCode, Detail: original_status.ErrorMessage}
+		return result, nil
+	}
+
+	var mapped any
+	switch request_action {
+	case messages.Action_deposit:
+		mapped, err = map_deposit_v1(bytes)
+		if err == nil {
+			result.Deposit = mapped.(*v1.Deposit)
+		}
+	case messages.Action_withdraw:
+		mapped, err = map_withdrawal_v1(bytes)
+		if err == nil {
+			result.Withdrawal = mapped.(*v1.Withdrawal)
+		}
+	case messages.Action_transfer:
+		mapped, err = map_transfer_v1(bytes)
+		if err == nil {
+			result.Transfer = mapped.(*v1.Transfer)
+		}
+	case messages.Action_batch:
+		mapped, err = map_batch_v1(bytes)
+		if err == nil {
+			result.Batch = mapped.(*v1.Batch)
+		}
+	}
+	return result, err
+}
+
+func convert_batch_v1(results []batch_item_result) (*v1.Batch, error) {
+	batch := &v1.Batch{Items: make([]v1.BatchItemResult, 0, len(results))}
+	for _, item := range results {
+		result, err := map_result_v1(item.action, item.response)
+		if err != nil {
+			return nil, err
+		}
+		batch.Items = append(batch.Items, v1.BatchItemResult{ItemID: item.item_id, Status: item.status, Result: result})
+	}
+	return batch, nil
+}
+
+func convert_batch_results_v1(results []batch_item_result) (any, error) {
+	batch, err := convert_batch_v1(results)
+	if err != nil {
+		return nil, err
+	}
+	return batch, nil
+}
+
+// Response of the transfer service to an atomic batch
+func map_batch_v1(bytes []byte) (any, error) {
+	results, err := get_batch_item_results(bytes)
+	if err != nil {
+		return nil, err
+	}
+	return convert_batch_v1(results)
+}
+
+// Pending operations have no result yet
+func map_operation_v1(operation *responses.Operation) (any, error) {
+	name, exists := operations_v1[operation.RequestAction]
+	if !exists {
+		return nil, errors.New("unknown request action")
+	}
+	mapped := &v1.Operation{
+		OperationID: operation.OperationID,
+		Operation:   name,
+		Status:      operation.Status,
+		CreatedAt:   operation.CreatedAt,
+		CompletedAt: operation.CompletedAt,
+	}
+	if operation.Status != responses.Operation_status_pending {
+		result, err := map_result_v1(operation.RequestAction, operation.Response)
+		if err != nil {
+			return nil, err
+		}
+		mapped.Result = result
+	}
+	return mapped, nil
+}
+
+func convert_webhook_v1(webhook *responses.Webhook) v1.Webhook {
+	event_types := webhook.EventTypes
+	if event_types == nil {
+		event_types = []string{}
+	}
+	return v1.Webhook{
+		WebhookID:  webhook.WebhookID,
+		URL:        webhook.URL,
+		WalletID:   webhook.WalletID,
+		EventTypes: event_types,
+		Secret:     webhook.Secret,
+		CreatedAt:  webhook.CreatedAt,
+	}
+}
+
+func map_webhooks_v1(bytes []byte) (any, error) {
+	response_message := responses.Webhooks{}
+	err := json.Unmarshal(bytes, &response_message)
+	if err != nil {
+		return nil, err
+	}
+	webhooks := &v1.Webhooks{Webhooks: make([]v1.Webhook, 0, len(response_message.Webhooks))}
+	for i := range response_message.Webhooks {
+		webhooks.Webhooks = append(webhooks.Webhooks, convert_webhook_v1(&response_message.Webhooks[i]))
+	}
+	return webhooks, nil
+}
+
+// The webhook service answers with the created webhook as the only one in the list
+func map_created_webhook_v1(bytes []byte) (any, error) {
+	response_message := responses.Webhooks{}
+	err := json.Unmarshal(bytes, &response_message)
+	if err != nil {
+		return nil, err
+	}
+	if len(response_message.Webhooks) == 0 {
+		return nil, errors.New("missing webhook")
+	}
+	webhook := convert_webhook_v1(&response_message.Webhooks[0])
+	return &webhook, nil
+}
+
+// Deleted webhooks are answered with 204 No Content
+func map_deleted_webhook_v1(bytes []byte) (any, error) {
+	return nil, nil
+}
+
+func convert_webhook_delivery_v1(delivery *responses.WebhookDelivery) v1.WebhookDelivery {
+	converted := v1.WebhookDelivery{
+		DeliveryID:    delivery.DeliveryID,
+		EventID:       delivery.EventID,
+		EventType:     delivery.EventType,
+		Status:        delivery.Status,
+		NextAttemptAt: delivery.NextAttemptAt,
+		RedeliveryOf:  delivery.RedeliveryOf,
+		CreatedAt:     delivery.CreatedAt,
+		Attempts:      make([]v1.WebhookDeliveryAttempt, 0, len(delivery.Attempts)),
+	}
+	for _, attempt := range delivery.Attempts {
+		converted.Attempts = append(converted.Attempts, v1.WebhookDeliveryAttempt{
+			Attempt:     attempt.Attempt,
+			AttemptedAt: attempt.DateAndTime,
+			StatusCode:  attempt.StatusCode,
+			Error:       attempt.Error,
+			Duration:    attempt.Duration,
+		})
+	}
+	return converted
+}
+
+func map_webhook_deliveries_v1(bytes []byte) (any, error) {
+	response_message := responses.WebhookDeliveries{}
+	err := json.Unmarshal(bytes, &response_message)
+	if err != nil {
+		return nil, err
+	}
+	deliveries := &v1.WebhookDeliveries{Deliveries: make([]v1.WebhookDelivery, 0, len(response_message.Deliveries))}
+	for i := range response_message.Deliveries {
+		deliveries.Deliveries = append(deliveries.Deliveries, convert_webhook_delivery_v1(&response_message.Deliveries[i]))
+	}
+	return deliveries, nil
+}
+
+// The webhook service answers with the new delivery as the only one in the list
+func map_redelivery_v1(bytes []byte) (any, error) {
+	response_message := responses.WebhookDeliveries{}
+	err := json.Unmarshal(bytes, &response_message)
+	if err != nil {
+		return nil, err
+	}
+	if len(response_message.Deliveries) == 0 {
+		return nil, errors.New("missing delivery")
+	}
+	delivery := convert_webhook_delivery_v1(&response_message.Deliveries[0])
+	return &delivery, nil
+}
+
+func (mux *http_request_multiplexer) POST_DepositV1(input *paths.MatchResult, writer http.ResponseWriter, request *http.Request) {
+	body := v1.DepositRequest{}
+	if !read_body(writer, request, &body) {
+		return
+	}
+	request_message := messages.POST_Deposit{Amount: body.Amount, Currency: body.Currency}
+	mux.deposit(input.WildcardSegments["wallet_id"], &request_message, map_deposit_v1, writer, request)
+}
+
+func (mux *http_request_multiplexer) POST_WithdrawalV1(input *paths.MatchResult, writer http.ResponseWriter, request *http.Request) {
+	body := v1.WithdrawalRequest{}
+	if !read_body(writer, request, &body) {
+		return
+	}
+	request_message := messages.POST_Withdraw{Amount: body.Amount, Currency: body.Currency}
+	mux.withdraw(input.WildcardSegments["wallet_id"], &request_message, map_withdrawal_v1, writer, request)
+}
+
+func (mux *http_request_multiplexer) POST_TransferV1(input *paths.MatchResult, writer http.ResponseWriter, request *http.Request) {
+	body := v1.TransferRequest{}
+	if !read_body(writer, request, &body) {
+		return
+	}
+	request_message := messages.POST_Transfer{
+		SourceWalletID:      body.SourceWalletID,
+		DestinationWalletID: body.DestinationWalletID,
+		Amount:              body.Amount,
+		Currency:            body.Currency,
+	}
+	mux.transfer(&request_message, map_transfer_v1, writer, request)
+}
+
+// Largest body of a batch item, with wallet IDs and an idempotency key of the greatest
+// length. Batch bodies are read up to this size for every item allowed.
+const maximum_batch_item_size int64 = 1024 // B
+
+func (mux *http_request_multiplexer) POST_BatchV1(input *paths.MatchResult, writer http.ResponseWriter, request *http.Request) {
+	body := v1.BatchRequest{}
+	maximum_items := mux.get_config().Batch.MaximumItems
+	if !read_body_up_to(writer, request, &body, maximum_body_size+int64(maximum_items)*maximum_batch_item_size) {
+		return
+	}
+	items := make([]batch_item, 0, len(body.Items))
+	for _, item := range body.Items {
+		action, exists := batch_item_actions_v1[item.Operation]
+		if !exists {
+			write_problem(writer, responses.Error_code_invalid_request, "Unknown operation of item "+item.ItemID)
+			return
+		}
+		items = append(items, batch_item{
+			BatchItem: messages.BatchItem{
+				ItemID:              item.ItemID,
+				Action:              action,
+				WalletID:            item.WalletID,
+				SourceWalletID:      item.SourceWalletID,
+				DestinationWalletID: item.DestinationWalletID,
+				Amount:              item.Amount,
+				Currency:            item.Currency,
+			},
+			idempotency_key: item.IdempotencyKey,
+		})
+	}
+	mux.batch(items, body.Atomic, map_batch_v1, convert_batch_results_v1, writer, request)
+}
+
+func (mux *http_request_multiplexer) GET_WalletBalanceV1(input *paths.MatchResult, writer http.ResponseWriter, request *http.Request) {
+	mux.get_balance(input.WildcardSegments["wallet_id"], map_balance_v1, writer, request)
+}
+
+// Dates are YYYY-MM-DD instead of the YYYYMMDD of the backend services
+func (mux *http_request_multiplexer) GET_TransactionHistoryV1(input *paths.MatchResult, writer http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+	from := convert_date(query.Get("from"), date_format_v1, date_format_backend)
+	to := convert_date(query.Get("to"), date_format_v1, date_format_backend)
+	mux.get_transaction_history(input.WildcardSegments["wallet_id"], from, to, map_transaction_history_v1, writer, request)
+}
+
+func (mux *http_request_multiplexer) GET_IdempotencyKeyV1(input *paths.MatchResult, writer http.ResponseWriter, request *http.Request) {
+	mux.look_up_idempotency_key(input.WildcardSegments["idempotency_key"], map_request_outcome_v1, writer, request)
+}
+
+func (mux *http_request_multiplexer) POST_WebhookV1(input *paths.MatchResult, writer http.ResponseWriter, request *http.Request) {
+	body := v1.WebhookRequest{}
+	if !read_body(writer, request, &body) {
+		return
+	}
+	request_message := messages.POST_Webhook{URL: body.URL, WalletID: body.WalletID, EventTypes: body.EventTypes}
+	mux.create_webhook(&request_message, map_created_webhook_v1, writer, request)
+}
+
+func (mux *http_request_multiplexer) GET_WebhooksV1(input *paths.MatchResult, writer http.ResponseWriter, request *http.Request) {
+	mux.get_webhooks(map_webhooks_v1, writer, request)
+}
+
+func (mux *http_request_multiplexer) DELETE_WebhookV1(input *paths.MatchResult, writer http.ResponseWriter, request *http.Request) {
+	mux.delete_webhook(input.WildcardSegments["webhook_id"], map_deleted_webhook_v1, writer, request)
+}
+
+func (mux *http_request_multiplexer) GET_WebhookDeliveriesV1(input *paths.MatchResult, writer http.ResponseWriter, request *http.Request) {
+	mux.get_webhook_deliveries(input.WildcardSegments["webhook_id"], map_webhook_deliveries_v1, writer, request)
+}
+
+func (mux *http_request_multiplexer) POST_WebhookRedeliveryV1(input *paths.MatchResult, writer http.ResponseWriter, request *http.Request) {
+	mux.redeliver_webhook(input.WildcardSegments["webhook_id"], input.WildcardSegments["delivery_id"], map_redelivery_v1, writer, request)
+}
@@ -0,0 +1,152 @@
+package implementation
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	v1 "shared/api/v1"
+	"shared/messages"
+	"shared/responses"
+	"testing"
+)
+
+func Test_MapResponsesV1(t *testing.T) {
+
+	// Dates and transaction types of the backend services are turned into those of
+	// version 1
+	{
+		bytes := []byte(`{"header":{"id":1,"action":5},"status":1,"history":[
+			{"date":"20261018","type":"D","currency":"SGD","amount":"10.00"},
+			{"date":"20261019","type":"W","currency":"SGD","amount":"2.50"}]}`)
+		mapped, err := map_transaction_history_v1(bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := &v1.TransactionHistory{
+			Transactions: []v1.Transaction{
+				{Date: "2026-10-18", Type: v1.Transaction_type_deposit, Currency: "SGD", Amount: "10.00"},
+				{Date: "2026-10-19", Type: v1.Transaction_type_withdrawal, Currency: "SGD", Amount: "2.50"},
+			},
+		}
+		if !reflect.DeepEqual(mapped, expected) {
+			t.Error("Expected: ", expected, ", Got: ", mapped)
+		}
+	}
+
+	// Empty lists are sent as [] instead of being left out
+	{
+		recorder := httptest.NewRecorder()
+		write_response(recorder, []byte(`{"header":{"id":1,"action":5},"status":1}`), map_transaction_history_v1)
+		expected := `{"transactions":[]}`
+		if recorder.Body.String() != expected {
+			t.Error("Expected: ", expected, ", Got: ", recorder.Body.String())
+		}
+	}
+
+	// Fields only used between the API gateway and the backend services are dropped
+	{
+		bytes := []byte(`{"header":{"id":1,"action":1,"idempotency_key":"caller:key"},"status":1,"currency":"SGD","new_balance":"10.00"}`)
+		recorder := httptest.NewRecorder()
+		write_response(recorder, bytes, map_deposit_v1)
+		expected := `{"currency":"SGD","new_balance":"10.00"}`
+		if recorder.Body.String() != expected {
+			t.Error("Expected: ", expected, ", Got: ", recorder.Body.String())
+		}
+	}
+
+	// Failed requests are still answered with problem details
+	{
+		bytes := []byte(`{"header":{"id":1,"action":2},"status":2,"error_code":"INSUFFICIENT_FUNDS","error_message":"Insufficient funds in wallet"}`)
+		recorder := httptest.NewRecorder()
+		write_response(recorder, bytes, map_withdrawal_v1)
+		if recorder.Code != http.StatusConflict {
+			t.Error("Expected: ", http.StatusConflict, ", Got: ", recorder.Code)
+		}
+		if recorder.Header().Get("Content-Type") != content_type_problem {
+			t.Error("Expected: ", content_type_problem, ", Got: ", recorder.Header().Get("Content-Type"))
+		}
+	}
+
+	// Outcomes of requests sent with an idempotency key hold the original response
+	{
+		original, err := json.Marshal(responses.Transfer{
+			Header:     responses.Header{MessageID: 1, Action: messages.Action_transfer},
+			Status:     responses.Status_successful,
+			Currency:   "SGD",
+			NewBalance: "5.00",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		bytes, err := json.Marshal(responses.IdempotencyKey{
+			Header:        responses.Header{MessageID: 2, Action: messages.Action_get_idempotency_key},
+			Status:        responses.Status_successful,
+			RequestAction: messages.Action_transfer,
+			DateAndTime:   "2026-10-18T09:30:00Z",
+			Response:      original,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		mapped, err := map_request_outcome_v1(bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := &v1.RequestOutcome{
+			Operation:   v1.Operation_transfer,
+			ProcessedAt: "2026-10-18T09:30:00Z",
+			Result:      v1.Result{Transfer: &v1.Transfer{Currency: "SGD", NewBalance: "5.00"}},
+		}
+		if !reflect.DeepEqual(mapped, expected) {
+			t.Error("Expected: ", expected, ", Got: ", mapped)
+		}
+	}
+
+	// Requests which failed have an error instead
+	{
+		bytes := []byte(`{"header":{"id":2,"action":6},"status":1,"request_action":2,"date_and_time":"2026-10-18T09:30:00Z",
+			"response":{"header":{"id":1,"action":2},"status":2,"error_code":"INSUFFICIENT_FUNDS","error_message":"Insufficient funds in wallet"}}`)
+		mapped, err := map_request_outcome_v1(bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := &v1.RequestOutcome{
+			Operation:   v1.Operation_withdrawal,
+			ProcessedAt: "2026-10-18T09:30:00Z",
+			Result:      v1.Result{Error: &v1.Error{Code: responses.Error_code_insufficient_funds, Detail: "Insufficient funds in wallet"}},
+		}
+		if !reflect.DeepEqual(mapped, expected) {
+			t.Error("Expected: ", expected, ", Got: ", mapped)
+		}
+	}
+
+	// Created webhooks are returned on their own and deleted webhooks without a body
+	{
+		bytes := []byte(`{"header":{"id":1,"action":7},"status":1,"webhooks":[
+			{"webhook_id":"1","url":"https://example.com/hooks","event_types":["deposit.completed"],"secret":"s","created_at":"2026-10-18T09:30:00Z"}]}`)
+		mapped, err := map_created_webhook_v1(bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := &v1.Webhook{
+			WebhookID:  "1",
+			URL:        "https://example.com/hooks",
+			EventTypes: []string{"deposit.completed"},
+			Secret:     "s",
+			CreatedAt:  "2026-10-18T09:30:00Z",
+		}
+		if !reflect.DeepEqual(mapped, expected) {
+			t.Error("Expected: ", expected, ", Got: ", mapped)
+		}
+
+		recorder := httptest.NewRecorder()
+		write_response(recorder, []byte(`{"header":{"id":1,"action":9},"status":1}`), map_deleted_webhook_v1)
+		if recorder.Code != http.StatusNoContent {
+			t.Error("Expected: ", http.StatusNoContent, ", Got: ", recorder.Code)
+		}
+		if recorder.Body.Len() != 0 {
+			t.Error("Expected: ", "", ", Got: ", recorder.Body.String())
+		}
+	}
+}
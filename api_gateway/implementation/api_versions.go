@@ -0,0 +1,143 @@
+package implementation
+
+import (
+	"api_gateway/config"
+	"api_gateway/paths"
+	"context"
+	"log"
+	"net/http"
+	"shared/responses"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+A version of the public API. The routes of a version are those of the unversioned API
+with the prefix of the version in front, e.g. /v1/wallets/{wallet_id}/balance.
+
+To serve a new version next to the old ones:
+ 1. Add its request and response bodies to shared/api, e.g. shared/api/v2.
+ 2. Add it below, and set the successor of the version it replaces.
+ 3. Add its settings to config.APIVersions and get_api_version_config.
+ 4. Register its routes in create_router with handlers mapping its bodies to the
+    messages of the backend services.
+ 5. Set how it returns operations accepted with Prefer: respond-async.
+*/
+type api_version struct {
+	name      string // Key of the version under api_versions in config.yml
+	prefix    string
+	successor string // Prefix of the version replacing this one, if any
+
+	// Turns an operation into the body returned by this version. Operations are
+	// returned as is if nil.
+	map_operation func(operation *responses.Operation) (any, error)
+}
+
+var (
+	api_version_unversioned = &api_version{name: "unversioned", prefix: "", successor: "/v1"}
+	api_version_1           = &api_version{name: "v1", prefix: "/v1", map_operation: map_operation_v1}
+)
+
+// Every version of the public API served by the API gateway
+var api_versions = []*api_version{api_version_unversioned, api_version_1}
+
+func get_api_version_config(config_ *config.Config, version *api_version) *config.APIVersion {
+	switch version {
+	case api_version_unversioned:
+		return &config_.APIVersions.Unversioned
+	case api_version_1:
+		return &config_.APIVersions.V1
+	}
+	return nil
+}
+
+// When a version was or will be deprecated and stops being served. Zero if not set.
+type api_deprecation struct {
+	deprecated_at time.Time
+	sunset_at     time.Time
+}
+
+// Reads the deprecation of every version from the configuration. Invalid dates are
+// logged and ignored, so that a typo does not keep the API gateway from starting.
+func create_api_deprecations(config_ *config.Config) map[*api_version]api_deprecation {
+	deprecations := make(map[*api_version]api_deprecation, len(api_versions))
+	for _, version := range api_versions {
+		version_config := get_api_version_config(config_, version)
+		if version_config == nil {
+			continue
+		}
+		deprecation := api_deprecation{
+			deprecated_at: parse_api_version_date(version, "deprecated_at", version_config.DeprecatedAt),
+			sunset_at:     parse_api_version_date(version, "sunset_at", version_config.SunsetAt),
+		}
+		if !deprecation.deprecated_at.IsZero() || !deprecation.sunset_at.IsZero() {
+			deprecations[version] = deprecation
+		}
+	}
+	return deprecations
+}
+
+func parse_api_version_date(version *api_version, name string, value string) time.Time {
+	if len(value) == 0 {
+		return time.Time{}
+	}
+	date, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		log.Println("Ignoring invalid api_versions." + version.name + "." + name + ": " + err.Error())
+		return time.Time{}
+	}
+	return date
+}
+
+/*
+Tells callers of a deprecated version about it with the Deprecation header of RFC 9745,
+the Sunset header of RFC 8594 and a link to the same route in the version replacing it.
+
+	Deprecation: @1792281600
+	Sunset: Sat, 01 May 2027 00:00:00 GMT
+	Link: </v1/wallets/wallet_1/balance>; rel="successor-version"
+*/
+func write_deprecation_headers(deprecation api_deprecation, version *api_version, writer http.ResponseWriter, request *http.Request) {
+	if !deprecation.deprecated_at.IsZero() {
+		writer.Header().Set("Deprecation", "@"+strconv.FormatInt(deprecation.deprecated_at.Unix(), 10))
+		if len(version.successor) > 0 {
+			successor_path := version.successor + strings.TrimPrefix(request.URL.EscapedPath(), version.prefix)
+			writer.Header().Add("Link", "<"+successor_path+">; rel=\"successor-version\"")
+		}
+	}
+	if !deprecation.sunset_at.IsZero() {
+		writer.Header().Set("Sunset", deprecation.sunset_at.UTC().Format(http.TimeFormat))
+	}
+}
+
+type api_version_context_key struct{}
+
+// Routes which are not part of the public API belong to the unversioned API
+func get_api_version(request *http.Request) *api_version {
+	version, exists := request.Context().Value(api_version_context_key{}).(*api_version)
+	if !exists {
+		return api_version_unversioned
+	}
+	return version
+}
+
+// Adds a route of a version of the public API. Deprecation settings are looked up on
+// each request, so they can be changed without a restart. Handlers find the version
+// of the route with get_api_version.
+func (mux *http_request_multiplexer) handle_versioned(
+	router *paths.Router,
+	version *api_version,
+	method string,
+	pattern string,
+	handler paths.Handler) {
+
+	router.Handle(method, version.prefix+pattern, func(input *paths.MatchResult, writer http.ResponseWriter, request *http.Request) {
+		deprecation, deprecated := mux.active_config.Load().api_deprecations[version]
+		if deprecated {
+			write_deprecation_headers(deprecation, version, writer, request)
+		}
+		request = request.WithContext(context.WithValue(request.Context(), api_version_context_key{}, version))
+		handler(input, writer, request)
+	})
+}
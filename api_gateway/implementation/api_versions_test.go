@@ -0,0 +1,160 @@
+package implementation
+
+import (
+	config_ "api_gateway/config"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"shared/responses"
+	"testing"
+	"time"
+)
+
+func Test_APIDeprecations(t *testing.T) {
+
+	config, err := config_.Load("../config.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.APIVersions.Unversioned = config_.APIVersion{
+		DeprecatedAt: "2026-10-18T00:00:00Z",
+		SunsetAt:     "2027-05-01T00:00:00Z",
+	}
+
+	// Invalid dates are ignored
+	config.APIVersions.V1 = config_.APIVersion{DeprecatedAt: "tomorrow"}
+
+	deprecations := create_api_deprecations(config)
+	if len(deprecations) != 1 {
+		t.Fatal("Expected: ", 1, ", Got: ", len(deprecations))
+	}
+	deprecation, exists := deprecations[api_version_unversioned]
+	if !exists {
+		t.Fatal("Expected: ", true, ", Got: ", exists)
+	}
+
+	// Callers are told when the version was deprecated, when it goes away and where
+	// the same route is in the next version
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodGet, "/wallets/wallet%2F1/balance", nil)
+	write_deprecation_headers(deprecation, api_version_unversioned, recorder, request)
+	expected := map[string]string{
+		"Deprecation": "@1792281600",
+		"Sunset":      "Sat, 01 May 2027 00:00:00 GMT",
+		"Link":        "</v1/wallets/wallet%2F1/balance>; rel=\"successor-version\"",
+	}
+	for name, value := range expected {
+		if recorder.Header().Get(name) != value {
+			t.Error("Expected: ", value, ", Got: ", recorder.Header().Get(name))
+		}
+	}
+
+	// Versions without a successor do not link to one
+	recorder = httptest.NewRecorder()
+	request = httptest.NewRequest(http.MethodGet, "/v1/wallets/wallet_1/balance", nil)
+	write_deprecation_headers(api_deprecation{deprecated_at: time.Now()}, api_version_1, recorder, request)
+	if len(recorder.Header().Get("Link")) > 0 {
+		t.Error("Expected: ", "", ", Got: ", recorder.Header().Get("Link"))
+	}
+	if len(recorder.Header().Get("Sunset")) > 0 {
+		t.Error("Expected: ", "", ", Got: ", recorder.Header().Get("Sunset"))
+	}
+}
+
+func Test_APIVersions(t *testing.T) {
+
+	config, err := config_.Load("../config.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wallet_id := "api_versions_unit_test_wallet"
+	api_key := "api_versions_unit_test_key"
+	config.Authentication.APIKeys = []config_.APIKey{
+		{
+			Name:      "api_versions_unit_test",
+			Key:       api_key,
+			WalletIDs: []string{wallet_id},
+		},
+	}
+	config.BalanceService.RequestsQueue.QueueName = "api_gateway_requests_queue_test"
+	config.BalanceService.ResponsesQueue.QueueName = "api_gateway_responses_queue_test"
+
+	// Start running test service
+	test_service_ := create_test_service(&config.BalanceService)
+	test_service_.run()
+	defer test_service_.shutdown()
+
+	// Start running API gateway
+	api_gateway, err := CreateAPIGateway(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api_gateway.Run()
+	defer api_gateway.Shutdown()
+
+	time.Sleep(2 * time.Second)
+
+	get_balance := func(path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, path, nil)
+		request.Header.Set("X-API-Key", api_key)
+		api_gateway.http_multiplexer.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusOK {
+			t.Fatal("Expected: ", http.StatusOK, ", Got: ", recorder.Code, " ", recorder.Body.String())
+		}
+		return recorder
+	}
+
+	// Routes without a version prefix pass on the response of the backend service and
+	// are deprecated in favour of /v1
+	{
+		recorder := get_balance("/wallets/" + wallet_id + "/balance")
+		if recorder.Header().Get("Deprecation") != "@1792281600" {
+			t.Error("Expected: ", "@1792281600", ", Got: ", recorder.Header().Get("Deprecation"))
+		}
+		expected_link := "</v1/wallets/" + wallet_id + "/balance>; rel=\"successor-version\""
+		if recorder.Header().Get("Link") != expected_link {
+			t.Error("Expected: ", expected_link, ", Got: ", recorder.Header().Get("Link"))
+		}
+		response_message := responses.Balance{}
+		err := json.Unmarshal(recorder.Body.Bytes(), &response_message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response_message.Status != responses.Status_successful {
+			t.Error("Expected: ", responses.Status_successful, ", Got: ", response_message.Status)
+		}
+	}
+
+	// Routes of /v1 only return the fields of version 1
+	{
+		recorder := get_balance("/v1/wallets/" + wallet_id + "/balance")
+		if len(recorder.Header().Get("Deprecation")) > 0 {
+			t.Error("Expected: ", "", ", Got: ", recorder.Header().Get("Deprecation"))
+		}
+		fields := map[string]any{}
+		err := json.Unmarshal(recorder.Body.Bytes(), &fields)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := map[string]any{"currency": "", "balance": ""}
+		if !reflect.DeepEqual(fields, expected) {
+			t.Error("Expected: ", expected, ", Got: ", fields)
+		}
+	}
+
+	// Versions are deprecated without a restart
+	{
+		next := *config
+		next.APIVersions.V1.DeprecatedAt = "2027-01-01T00:00:00Z"
+		err := api_gateway.Reload(&next)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder := get_balance("/v1/wallets/" + wallet_id + "/balance")
+		if recorder.Header().Get("Deprecation") != "@1798761600" {
+			t.Error("Expected: ", "@1798761600", ", Got: ", recorder.Header().Get("Deprecation"))
+		}
+	}
+}
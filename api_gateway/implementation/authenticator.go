@@ -0,0 +1,133 @@
+package implementation
+
+import (
+	"api_gateway/authentication"
+	"api_gateway/config"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"shared/websocket"
+	"strings"
+	"time"
+)
+
+const (
+	header_authorization string = "Authorization"
+	header_api_key       string = "X-API-Key"
+	bearer_prefix        string = "Bearer "
+
+	// Browsers cannot set headers on WebSocket handshakes
+	query_access_token string = "access_token"
+)
+
+var errMissingCredentials = errors.New("No credentials were provided")
+var errInvalidAPIKey = errors.New("Invalid API key")
+
+// An authenticated caller and the wallets it is allowed to touch
+type caller struct {
+	name       string
+	wallet_ids map[string]bool
+
+	// Administrators may see the settings of the API gateway
+	is_admin bool
+}
+
+func create_caller(name string, wallet_ids []string) *caller {
+	caller_ := &caller{
+		name:       name,
+		wallet_ids: make(map[string]bool, len(wallet_ids)),
+	}
+	for _, wallet_id := range wallet_ids {
+		caller_.wallet_ids[wallet_id] = true
+	}
+	return caller_
+}
+
+func (caller_ *caller) owns(wallet_id string) bool {
+	return caller_.wallet_ids[wallet_id]
+}
+
+type caller_context_key struct{}
+
+// Returns nil if the request was not authenticated
+func get_caller(request *http.Request) *caller {
+	caller_, _ := request.Context().Value(caller_context_key{}).(*caller)
+	return caller_
+}
+
+/*
+Callers authenticate themselves with either of these HTTP headers.
+
+	Authorization: Bearer <token signed with the configured token signing key>
+	X-API-Key: <static API key from the configuration file>
+
+Browsers cannot set headers on WebSocket handshakes, so bearer tokens may also be
+passed in the access_token query parameter of WebSocket upgrade requests. API keys
+are never accepted in the query string, since URLs end up in logs.
+
+API keys are looked up by their SHA256 hash so that the time taken to look up a key
+does not reveal how much of it was guessed correctly.
+*/
+type authenticator struct {
+	token_signing_key []byte
+	api_keys          map[[sha256.Size]byte]*caller
+}
+
+func create_authenticator(config *config.Authentication) *authenticator {
+	authenticator_ := &authenticator{
+		token_signing_key: []byte(config.TokenSigningKey),
+		api_keys:          make(map[[sha256.Size]byte]*caller, len(config.APIKeys)),
+	}
+	for _, api_key := range config.APIKeys {
+		if len(api_key.Key) == 0 {
+			continue
+		}
+		caller_ := create_caller(api_key.Name, api_key.WalletIDs)
+		caller_.is_admin = api_key.Admin
+		authenticator_.api_keys[sha256.Sum256([]byte(api_key.Key))] = caller_
+	}
+	return authenticator_
+}
+
+func (authenticator_ *authenticator) authenticate(request *http.Request) (*caller, error) {
+
+	authorization := request.Header.Get(header_authorization)
+	if len(authorization) == 0 && websocket.IsUpgradeRequest(request) {
+		access_token := request.URL.Query().Get(query_access_token)
+		if len(access_token) > 0 {
+			authorization = bearer_prefix + access_token
+		}
+	}
+	if len(authorization) > 0 {
+		if !strings.HasPrefix(authorization, bearer_prefix) {
+			return nil, authentication.ErrMalformedToken
+		}
+		if len(authenticator_.token_signing_key) == 0 {
+			return nil, authentication.ErrInvalidSignature
+		}
+		token := strings.TrimPrefix(authorization, bearer_prefix)
+		claims, err := authentication.VerifyToken(token, authenticator_.token_signing_key, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		return create_caller(claims.Subject, claims.WalletIDs), nil
+	}
+
+	api_key := request.Header.Get(header_api_key)
+	if len(api_key) > 0 {
+		caller_, exists := authenticator_.api_keys[sha256.Sum256([]byte(api_key))]
+		if !exists {
+			return nil, errInvalidAPIKey
+		}
+		return caller_, nil
+	}
+
+	return nil, errMissingCredentials
+}
+
+// Attaches the authenticated caller to the request so that handlers can check which
+// wallets it may touch
+func with_caller(request *http.Request, caller_ *caller) *http.Request {
+	return request.WithContext(context.WithValue(request.Context(), caller_context_key{}, caller_))
+}
@@ -0,0 +1,460 @@
+package implementation
+
+import (
+	"api_gateway/config"
+	"api_gateway/paths"
+	"encoding/json"
+	"log"
+	"net/http"
+	"shared/messages"
+	"shared/queues"
+	"shared/responses"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Item of a batch. Only items of batches which are not atomic have idempotency keys of
+// their own.
+type batch_item struct {
+	messages.BatchItem
+	idempotency_key string
+}
+
+// Response to an item of a batch, whether it was sent on its own or as part of an
+// atomic batch
+type batch_item_result struct {
+	item_id string
+	action  int
+
+	// HTTP status the item would have been answered with on its own
+	status int
+
+	// Response of the backend service. Items rejected by the API gateway have a failed
+	// response made up from the problem details.
+	response []byte
+}
+
+/*
+Sends every item to its backend service as if it was a request of its own, with the same
+validation, authorisation, rate limits, idempotency keys and circuit breakers. At most
+batch.concurrency items are sent at a time. Results are in the same order as the items.
+*/
+func (mux *http_request_multiplexer) dispatch_batch(items []batch_item, request *http.Request) []batch_item_result {
+	results := make([]batch_item_result, len(items))
+	concurrency := mux.get_config().Batch.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	slots := make(chan struct{}, concurrency)
+	var waitgroup sync.WaitGroup
+	for index := range items {
+
+		// Nobody is waiting for the results anymore
+		if request.Context().Err() != nil {
+			break
+		}
+
+		slots <- struct{}{}
+		waitgroup.Add(1)
+		go func(index int) {
+			defer func() {
+				<-slots
+				waitgroup.Done()
+			}()
+			results[index] = mux.send_batch_item(&items[index], request)
+		}(index)
+	}
+	waitgroup.Wait()
+	return results
+}
+
+// Body of POST /batch. Items carry the actions of the messages of the backend services,
+// e.g. 1 for a deposit.
+type batch_request struct {
+	Atomic bool                 `json:"atomic"`
+	Items  []batch_request_item `json:"items"`
+}
+
+type batch_request_item struct {
+	messages.BatchItem
+	IdempotencyKey string `json:"idempotency_key"`
+}
+
+func (mux *http_request_multiplexer) POST_Batch(input *paths.MatchResult, writer http.ResponseWriter, request *http.Request) {
+	body := batch_request{}
+	maximum_items := mux.get_config().Batch.MaximumItems
+	if !read_body_up_to(writer, request, &body, maximum_body_size+int64(maximum_items)*maximum_batch_item_size) {
+		return
+	}
+	items := make([]batch_item, 0, len(body.Items))
+	for _, item := range body.Items {
+		items = append(items, batch_item{BatchItem: item.BatchItem, idempotency_key: item.IdempotencyKey})
+	}
+	mux.batch(items, body.Atomic, map_batch, convert_batch_results, writer, request)
+}
+
+// Atomic batches are answered with the response of the transfer service as it is, which
+// holds the response to every item even if the batch was aborted
+func map_batch(bytes []byte) (any, error) {
+	return json.RawMessage(bytes), nil
+}
+
+// Batches which are not atomic are answered with the response to every item as its
+// backend service sent it. Items rejected by the API gateway have a failed response
+// made up from the problem details.
+func convert_batch_results(results []batch_item_result) (any, error) {
+	batch := &responses.Batch{
+		Header: responses.Header{Action: messages.Action_batch},
+		Items:  make([]responses.BatchItem, 0, len(results)),
+	}
+	for _, item := range results {
+		batch.Items = append(batch.Items, responses.BatchItem{ItemID: item.item_id, Action: item.action, Response: item.response})
+	}
+	return batch, nil
+}
+
+/*
+Shared by every version of the API. Atomic batches are sent to the transfer service as
+one message and answered through the response mapper. The results of other batches are
+converted into the body of the response once every item has been answered.
+*/
+func (mux *http_request_multiplexer) batch(
+	items []batch_item,
+	atomic bool,
+	mapper response_mapper,
+	convert_results func(results []batch_item_result) (any, error),
+	writer http.ResponseWriter,
+	request *http.Request) {
+
+	// Verify that input is correct
+	maximum_items := mux.get_config().Batch.MaximumItems
+	if len(items) == 0 {
+		write_problem(writer, responses.Error_code_invalid_request, "Missing items")
+		return
+	}
+	if len(items) > maximum_items {
+		write_problem(writer, responses.Error_code_invalid_request, "Too many items. At most "+strconv.Itoa(maximum_items)+" items are allowed.")
+		return
+	}
+	item_ids := make(map[string]bool, len(items))
+	for index := range items {
+		item := &items[index]
+		if len(item.ItemID) == 0 {
+			write_problem(writer, responses.Error_code_invalid_request, "Missing item ID")
+			return
+		}
+		if item_ids[item.ItemID] {
+			write_problem(writer, responses.Error_code_invalid_request, "Duplicate item ID "+item.ItemID)
+			return
+		}
+		item_ids[item.ItemID] = true
+		if atomic && len(item.idempotency_key) > 0 {
+			write_problem(writer, responses.Error_code_invalid_request, "Items of atomic batches cannot have idempotency keys")
+			return
+		}
+	}
+
+	if atomic {
+		mux.send_atomic_batch(items, mapper, writer, request)
+		return
+	}
+
+	// Nothing to send if the user cancelled the request
+	results := mux.dispatch_batch(items, request)
+	if request.Context().Err() != nil {
+		return
+	}
+	body, err := convert_results(results)
+	if err != nil {
+		write_problem(writer, responses.Error_code_internal_error, "Invalid response from backend service")
+		return
+	}
+	bytes, err := json.Marshal(body)
+	if err != nil {
+		write_problem(writer, responses.Error_code_internal_error, "Unable to serialise response")
+		return
+	}
+	writer.Header().Set("Content-Type", content_type_json)
+	writer.Write(bytes)
+}
+
+func (mux *http_request_multiplexer) send_batch_item(item *batch_item, request *http.Request) batch_item_result {
+
+	// Each item carries its own idempotency key. Items are never accepted asynchronously.
+	item_request := request.Clone(request.Context())
+	item_request.Header.Del(header_prefer)
+	item_request.Header.Del(header_idempotency_key)
+	if len(item.idempotency_key) > 0 {
+		item_request.Header.Set(header_idempotency_key, item.idempotency_key)
+	}
+
+	recorder := create_response_recorder()
+	switch item.Action {
+	case messages.Action_deposit:
+		body := messages.POST_Deposit{Amount: item.Amount, Currency: item.Currency}
+		mux.deposit(item.WalletID, &body, nil, recorder, item_request)
+	case messages.Action_withdraw:
+		body := messages.POST_Withdraw{Amount: item.Amount, Currency: item.Currency}
+		mux.withdraw(item.WalletID, &body, nil, recorder, item_request)
+	case messages.Action_transfer:
+		body := messages.POST_Transfer{
+			SourceWalletID:      item.SourceWalletID,
+			DestinationWalletID: item.DestinationWalletID,
+			Amount:              item.Amount,
+			Currency:            item.Currency,
+		}
+		mux.transfer(&body, nil, recorder, item_request)
+	default:
+		write_problem(recorder, responses.Error_code_invalid_request, "Unknown operation")
+	}
+
+	result := batch_item_result{item_id: item.ItemID, action: item.Action, status: recorder.status}
+	if recorder.status < http.StatusMultipleChoices {
+		result.response = recorder.body.Bytes()
+		return result
+	}
+	result.response = convert_problem_to_response(recorder.body.Bytes(), item.Action)
+	return result
+}
+
+// Turns problem details into the failed response of a backend service
+func convert_problem_to_response(bytes []byte, action int) []byte {
+	problem := responses.Problem{}
+	err := json.Unmarshal(bytes, &problem)
+	if err != nil || len(problem.Code) == 0 {
+		problem.Code = responses.Error_code_internal_error
+	}
+	response, _ := json.Marshal(response_status{
+		Header:       responses.Header{Action: action},
+		Status:       responses.Status_failed,
+		ErrorCode:    problem.Code,
+		ErrorMessage: problem.Detail,
+	})
+	return response
+}
+
+// Turns the response of the transfer service to an atomic batch into the response to
+// each item
+func get_batch_item_results(bytes []byte) ([]batch_item_result, error) {
+	response_message := responses.Batch{}
+	err := json.Unmarshal(bytes, &response_message)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]batch_item_result, 0, len(response_message.Items))
+	for _, item := range response_message.Items {
+		item_status := response_status{}
+		err = json.Unmarshal(item.Response, &item_status)
+		if err != nil {
+			return nil, err
+		}
+		status := http.StatusOK
+		if item_status.Status == responses.Status_failed {
+			status = get_http_status(item_status.ErrorCode)
+		}
+		results = append(results, batch_item_result{
+			item_id:  item.ItemID,
+			action:   item.Action,
+			status:   status,
+			response: item.Response,
+		})
+	}
+	return results, nil
+}
+
+// Items of atomic batches are checked like requests of their own before the batch is
+// sent, so that the whole batch is rejected if any of them would be. Rate limits are
+// checked for the whole batch once every item has passed.
+func (mux *http_request_multiplexer) check_batch_item(item *batch_item, writer http.ResponseWriter, request *http.Request) bool {
+	if len(item.Amount) == 0 {
+		write_problem(writer, responses.Error_code_invalid_request, "Missing amount of item "+item.ItemID)
+		return false
+	}
+	if len(item.Currency) == 0 {
+		write_problem(writer, responses.Error_code_invalid_request, "Missing currency of item "+item.ItemID)
+		return false
+	}
+
+	switch item.Action {
+	case messages.Action_deposit, messages.Action_withdraw:
+		if len(item.WalletID) == 0 {
+			write_problem(writer, responses.Error_code_invalid_request, "Missing wallet ID of item "+item.ItemID)
+			return false
+		}
+		if !is_authorised(request, item.WalletID) {
+			write_problem(writer, responses.Error_code_forbidden, "Wallet of item "+item.ItemID+" is not owned by caller")
+			return false
+		}
+		return true
+	case messages.Action_transfer:
+		if len(item.SourceWalletID) == 0 {
+			write_problem(writer, responses.Error_code_invalid_request, "Missing source wallet ID of item "+item.ItemID)
+			return false
+		}
+		if len(item.DestinationWalletID) == 0 {
+			write_problem(writer, responses.Error_code_invalid_request, "Missing destination wallet ID of item "+item.ItemID)
+			return false
+		}
+
+		// Money can be transferred to any wallet but only from a wallet owned by the caller
+		if !is_authorised(request, item.SourceWalletID) {
+			write_problem(writer, responses.Error_code_forbidden, "Source wallet of item "+item.ItemID+" is not owned by caller")
+			return false
+		}
+		return true
+	}
+	write_problem(writer, responses.Error_code_invalid_request, "Unknown operation of item "+item.ItemID)
+	return false
+}
+
+// Tokens taken from one bucket for the items of an atomic batch
+type batch_bucket struct {
+	route           string
+	limit           *config.RateLimit
+	backend_service *config.Service
+	client          *redis.Client
+	name            string
+	tokens          int
+	taken           bool
+}
+
+/*
+Returns false and responds with 429 Too Many Requests if any item of an atomic batch
+would exceed its rate limit. The tokens of all items counted against the same bucket
+are taken with a single call to Redis. If a bucket does not hold enough tokens, the
+tokens already taken from other buckets are given back, so that a rejected batch does
+not use up the rate limits of the caller. Batches needing more tokens than a bucket
+can hold are rejected with 400 Bad Request, since retrying them would never help.
+*/
+func (mux *http_request_multiplexer) take_batch_tokens(items []batch_item, writer http.ResponseWriter, request *http.Request) bool {
+	config := mux.get_config()
+	buckets := []*batch_bucket{}
+	bucket_indices := map[string]int{}
+	for index := range items {
+		item := &items[index]
+		var bucket *batch_bucket = nil
+		var requests_queue queues.Transport = nil
+		wallet_id := item.WalletID
+		switch item.Action {
+		case messages.Action_deposit:
+			bucket = &batch_bucket{route: "deposits", limit: &config.RateLimits.Deposits, backend_service: &config.DepositsService}
+			requests_queue = mux.deposit_requests_queue
+		case messages.Action_withdraw:
+			bucket = &batch_bucket{route: "withdrawals", limit: &config.RateLimits.Withdrawals, backend_service: &config.WithdrawalService}
+			requests_queue = mux.withdrawal_requests_queue
+		case messages.Action_transfer:
+			bucket = &batch_bucket{route: "transfer", limit: &config.RateLimits.Transfer, backend_service: &config.TransferService}
+			requests_queue = mux.transfer_requests_queue
+			wallet_id = item.SourceWalletID
+		default:
+			continue
+		}
+		client, bucket_name, limited := get_rate_limit_bucket(bucket.route, bucket.limit, requests_queue, wallet_id, request)
+		if !limited {
+			continue
+		}
+		bucket_index, ok := bucket_indices[bucket_name]
+		if ok {
+			buckets[bucket_index].tokens++
+			continue
+		}
+		bucket.client = client
+		bucket.name = bucket_name
+		bucket.tokens = 1
+		bucket_indices[bucket_name] = len(buckets)
+		buckets = append(buckets, bucket)
+	}
+
+	for _, bucket := range buckets {
+		if bucket.tokens > bucket.limit.Burst {
+			write_problem(writer, responses.Error_code_invalid_request, "Too many items for the rate limit of "+bucket.route+". At most "+strconv.Itoa(bucket.limit.Burst)+" items are allowed.")
+			return false
+		}
+	}
+
+	for index, bucket := range buckets {
+		timeout := time.Duration(bucket.backend_service.RequestsQueue.Timeout) * time.Second
+		allowed, retry_after, err := mux.rate_limiter.allow(bucket.client, bucket.name, bucket.limit, bucket.tokens, timeout)
+		if err != nil {
+			log.Println("Unable to check rate limit of " + bucket.route + ": " + err.Error())
+			continue
+		}
+		if allowed {
+			bucket.taken = true
+			continue
+		}
+		for _, taken_bucket := range buckets[:index] {
+			if !taken_bucket.taken {
+				continue
+			}
+			timeout := time.Duration(taken_bucket.backend_service.RequestsQueue.Timeout) * time.Second
+			_, _, err := mux.rate_limiter.allow(taken_bucket.client, taken_bucket.name, taken_bucket.limit, -taken_bucket.tokens, timeout)
+			if err != nil {
+				log.Println("Unable to give back tokens of " + taken_bucket.route + ": " + err.Error())
+			}
+		}
+		write_rate_limited(writer, bucket.route, retry_after)
+		return false
+	}
+	return true
+}
+
+// Sends the whole batch to the transfer service, which applies every item or none in a
+// single database transaction. The Idempotency-Key header applies to the whole batch.
+func (mux *http_request_multiplexer) send_atomic_batch(
+	items []batch_item,
+	mapper response_mapper,
+	writer http.ResponseWriter,
+	request *http.Request) {
+
+	for index := range items {
+		if !mux.check_batch_item(&items[index], writer, request) {
+			return
+		}
+	}
+
+	idempotency_key, valid := get_idempotency_key(request, request.Header.Get(header_idempotency_key))
+	if !valid {
+		write_problem(writer, responses.Error_code_invalid_request, "Invalid idempotency key")
+		return
+	}
+	if !mux.take_batch_tokens(items, writer, request) {
+		return
+	}
+
+	message_id, ok := mux.next_message_id(writer)
+	if !ok {
+		return
+	}
+
+	// Prepare redis message
+	body := messages.POST_Batch{Items: make([]messages.BatchItem, 0, len(items))}
+	for index := range items {
+		body.Items = append(body.Items, items[index].BatchItem)
+	}
+	body.Header.MessageID = message_id
+	body.Header.ReplyTo = mux.transfer_reply_queue
+	body.Header.TraceParent = get_trace_parent(request)
+	body.Header.Deadline = get_deadline(&mux.get_config().TransferService, request)
+	body.Header.Action = messages.Action_batch
+	body.Header.IdempotencyKey = idempotency_key
+	bytes, err := json.Marshal(body)
+	if err != nil {
+		write_problem(writer, responses.Error_code_internal_error, "Unable to serialise request")
+		return
+	}
+
+	mux.send_request_and_return_response(
+		service_transfer,
+		body.Header.MessageID,
+		bytes,
+		&mux.get_config().TransferService,
+		mux.transfer_requests_queue,
+		mux.transfer_response_waiters,
+		mapper,
+		writer,
+		request)
+}
@@ -0,0 +1,436 @@
+package implementation
+
+import (
+	config_ "api_gateway/config"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	v1 "shared/api/v1"
+	"shared/messages"
+	"shared/queues"
+	"shared/responses"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func Test_Batch(t *testing.T) {
+
+	config, err := config_.Load("../config.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wallet_id := "batch_unit_test_wallet"
+	config.Authentication.APIKeys = []config_.APIKey{
+		{
+			Name:      "batch_unit_test",
+			Key:       "batch_unit_test_key",
+			WalletIDs: []string{wallet_id},
+		},
+	}
+	config.TransferService.RequestsQueue.QueueName = "batch_requests_queue_test"
+	config.TransferService.ResponsesQueue.QueueName = "batch_responses_queue_test"
+	config.Batch.MaximumItems = 3
+
+	// No transfer service reads the requests queue, so the test removes it when done
+	requests_queue := redis.NewClient(config.TransferService.RequestsQueue.GetRedisOptions())
+	defer requests_queue.Close()
+	defer requests_queue.Del(context.Background(), config.TransferService.RequestsQueue.QueueName)
+
+	// Start running API gateway
+	api_gateway, err := CreateAPIGateway(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api_gateway.Run()
+	defer api_gateway.Shutdown()
+
+	time.Sleep(2 * time.Second)
+
+	send := func(body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, "/v1/batch", strings.NewReader(body))
+		request.Header.Set("X-API-Key", "batch_unit_test_key")
+		api_gateway.http_multiplexer.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	// Batches which are invalid as a whole are rejected before any item is sent
+	invalid := []string{
+		`{"items":[]}`,
+		`{"items":[{"item_id":"1","operation":"deposit"},{"item_id":"2","operation":"deposit"},{"item_id":"3","operation":"deposit"},{"item_id":"4","operation":"deposit"}]}`,
+		`{"items":[{"operation":"deposit"}]}`,
+		`{"items":[{"item_id":"1","operation":"deposit"},{"item_id":"1","operation":"withdrawal"}]}`,
+		`{"items":[{"item_id":"1","operation":"refund"}]}`,
+		`{"atomic":true,"items":[{"item_id":"1","operation":"deposit","idempotency_key":"key"}]}`,
+	}
+	for _, body := range invalid {
+		recorder := send(body)
+		if recorder.Code != http.StatusBadRequest {
+			t.Error("Expected: ", http.StatusBadRequest, ", Got: ", recorder.Code, " for ", body)
+		}
+	}
+
+	// Items of batches which are not atomic are answered independently of each other
+	{
+		recorder := send(`{"items":[
+			{"item_id":"a","operation":"deposit","wallet_id":"someone_else","amount":"1.00","currency":"SGD"},
+			{"item_id":"b","operation":"transfer","source_wallet_id":"` + wallet_id + `","destination_wallet_id":"someone_else","amount":"1.00"}]}`)
+		if recorder.Code != http.StatusOK {
+			t.Fatal("Expected: ", http.StatusOK, ", Got: ", recorder.Code, " ", recorder.Body.String())
+		}
+		batch := v1.Batch{}
+		err = json.Unmarshal(recorder.Body.Bytes(), &batch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(batch.Items) != 2 {
+			t.Fatal("Expected: ", 2, ", Got: ", len(batch.Items))
+		}
+		if batch.Items[0].ItemID != "a" || batch.Items[0].Status != http.StatusForbidden || batch.Items[0].Error == nil {
+			t.Error("Expected: ", http.StatusForbidden, ", Got: ", batch.Items[0])
+		}
+		if batch.Items[1].ItemID != "b" || batch.Items[1].Status != http.StatusBadRequest || batch.Items[1].Error == nil {
+			t.Error("Expected: ", http.StatusBadRequest, ", Got: ", batch.Items[1])
+		}
+	}
+
+	// Atomic batches are rejected as a whole if any item would be rejected on its own
+	{
+		recorder := send(`{"atomic":true,"items":[
+			{"item_id":"a","operation":"deposit","wallet_id":"` + wallet_id + `","amount":"1.00","currency":"SGD"},
+			{"item_id":"b","operation":"withdrawal","wallet_id":"someone_else","amount":"1.00","currency":"SGD"}]}`)
+		if recorder.Code != http.StatusForbidden {
+			t.Error("Expected: ", http.StatusForbidden, ", Got: ", recorder.Code)
+		}
+	}
+
+	// Atomic batches are sent to the transfer service as a single message
+	{
+		done := make(chan *httptest.ResponseRecorder)
+		go func() {
+			done <- send(`{"atomic":true,"items":[
+				{"item_id":"a","operation":"deposit","wallet_id":"` + wallet_id + `","amount":"1.00","currency":"SGD"},
+				{"item_id":"b","operation":"withdrawal","wallet_id":"` + wallet_id + `","amount":"5.00","currency":"SGD"}]}`)
+		}()
+
+		string_slice, err := requests_queue.BRPop(context.Background(), 5*time.Second, config.TransferService.RequestsQueue.QueueName).Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		request_message := messages.POST_Batch{}
+		err = json.Unmarshal([]byte(string_slice[1]), &request_message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if request_message.Header.Action != messages.Action_batch || len(request_message.Items) != 2 {
+			t.Fatal("Expected: ", messages.Action_batch, " ", 2, ", Got: ", request_message.Header.Action, " ", len(request_message.Items))
+		}
+		if request_message.Items[1].ItemID != "b" || request_message.Items[1].Action != messages.Action_withdraw {
+			t.Error("Expected: ", "b", " ", messages.Action_withdraw, ", Got: ", request_message.Items[1])
+		}
+
+		// The withdrawal fails, so the deposit is rolled back
+		item_response := func(action int, error_code string) json.RawMessage {
+			bytes, err := json.Marshal(responses.Deposit{
+				Header:    responses.Header{MessageID: request_message.Header.MessageID, Action: action},
+				Status:    responses.Status_failed,
+				ErrorCode: error_code,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return bytes
+		}
+		response_message := responses.Batch{
+			Header:       responses.Header{MessageID: request_message.Header.MessageID, Action: messages.Action_batch},
+			Status:       responses.Status_failed,
+			ErrorCode:    responses.Error_code_insufficient_funds,
+			ErrorMessage: "Item b failed: Insufficient funds in wallet",
+			Items: []responses.BatchItem{
+				{ItemID: "a", Action: messages.Action_deposit, Response: item_response(messages.Action_deposit, responses.Error_code_batch_aborted)},
+				{ItemID: "b", Action: messages.Action_withdraw, Response: item_response(messages.Action_withdraw, responses.Error_code_insufficient_funds)},
+			},
+		}
+		bytes, err := json.Marshal(response_message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = requests_queue.LPush(context.Background(), request_message.Header.ReplyTo, bytes).Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The batch is answered with the HTTP status of the failed item
+		recorder := <-done
+		if recorder.Code != http.StatusConflict {
+			t.Fatal("Expected: ", http.StatusConflict, ", Got: ", recorder.Code, " ", recorder.Body.String())
+		}
+		batch := v1.Batch{}
+		err = json.Unmarshal(recorder.Body.Bytes(), &batch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(batch.Items) != 2 {
+			t.Fatal("Expected: ", 2, ", Got: ", len(batch.Items))
+		}
+		if batch.Items[0].Status != http.StatusConflict || batch.Items[0].Error == nil || batch.Items[0].Error.Code != responses.Error_code_batch_aborted {
+			t.Error("Expected: ", responses.Error_code_batch_aborted, ", Got: ", batch.Items[0])
+		}
+		if batch.Items[1].Status != http.StatusConflict || batch.Items[1].Error == nil || batch.Items[1].Error.Code != responses.Error_code_insufficient_funds {
+			t.Error("Expected: ", responses.Error_code_insufficient_funds, ", Got: ", batch.Items[1])
+		}
+	}
+
+	// Batches without a version carry the actions of the messages and are answered with
+	// the responses of the backend services
+	{
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(`{"items":[
+			{"item_id":"a","action":`+strconv.Itoa(messages.Action_deposit)+`,"wallet_id":"someone_else","amount":"1.00","currency":"SGD"},
+			{"item_id":"b","action":99,"wallet_id":"`+wallet_id+`","amount":"1.00","currency":"SGD"}]}`))
+		request.Header.Set("X-API-Key", "batch_unit_test_key")
+		api_gateway.http_multiplexer.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusOK {
+			t.Fatal("Expected: ", http.StatusOK, ", Got: ", recorder.Code, " ", recorder.Body.String())
+		}
+		batch := responses.Batch{}
+		err = json.Unmarshal(recorder.Body.Bytes(), &batch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if batch.Header.Action != messages.Action_batch || len(batch.Items) != 2 {
+			t.Fatal("Expected: ", messages.Action_batch, " ", 2, ", Got: ", batch.Header.Action, " ", len(batch.Items))
+		}
+		expected_error_codes := []string{responses.Error_code_forbidden, responses.Error_code_invalid_request}
+		for index, item := range batch.Items {
+			item_response := responses.Deposit{}
+			err = json.Unmarshal(item.Response, &item_response)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if item_response.Status != responses.Status_failed || item_response.ErrorCode != expected_error_codes[index] {
+				t.Error("Expected: ", expected_error_codes[index], ", Got: ", string(item.Response))
+			}
+		}
+	}
+}
+
+func Test_LargeBatch(t *testing.T) {
+
+	config, err := config_.Load("../config.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wallet_id := "large_batch_unit_test_wallet"
+	config.Authentication.APIKeys = []config_.APIKey{
+		{
+			Name:      "large_batch_unit_test",
+			Key:       "large_batch_unit_test_key",
+			WalletIDs: []string{wallet_id},
+		},
+	}
+	config.TransferService.RequestsQueue.QueueName = "large_batch_requests_queue_test"
+	config.RateLimits.Deposits.Rate = 0
+
+	// No transfer service reads the requests queue, so the test removes it when done
+	requests_queue := redis.NewClient(config.TransferService.RequestsQueue.GetRedisOptions())
+	defer requests_queue.Close()
+	defer requests_queue.Del(context.Background(), config.TransferService.RequestsQueue.QueueName)
+
+	// Start running API gateway
+	api_gateway, err := CreateAPIGateway(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api_gateway.Run()
+	defer api_gateway.Shutdown()
+
+	time.Sleep(2 * time.Second)
+
+	url := "http://localhost:" + config.HTTPServer.ListenPort + "/v1/batch"
+	send := func(body string) (*http.Response, []byte) {
+		request, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set("X-API-Key", "large_batch_unit_test_key")
+		request.Header.Set("Content-Type", "application/json")
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		bytes, err := io.ReadAll(response.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response, bytes
+	}
+
+	// Batches of hundreds of items are read in full, however they arrive over the network
+	number_of_items := 500
+	items := make([]string, 0, number_of_items)
+	for index := 0; index < number_of_items; index++ {
+		items = append(items, `{"item_id":"`+strconv.Itoa(index)+`","operation":"deposit","wallet_id":"`+wallet_id+`","amount":"1.00","currency":"SGD"}`)
+	}
+	done := make(chan []byte)
+	go func() {
+		response, bytes := send(`{"atomic":true,"items":[` + strings.Join(items, ",") + `]}`)
+		if response.StatusCode != http.StatusOK {
+			t.Error("Expected: ", http.StatusOK, ", Got: ", response.StatusCode, " ", string(bytes))
+		}
+		done <- bytes
+	}()
+
+	string_slice, err := requests_queue.BRPop(context.Background(), 5*time.Second, config.TransferService.RequestsQueue.QueueName).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	request_message := messages.POST_Batch{}
+	err = json.Unmarshal([]byte(string_slice[1]), &request_message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(request_message.Items) != number_of_items {
+		t.Fatal("Expected: ", number_of_items, ", Got: ", len(request_message.Items))
+	}
+	response_message := responses.Batch{
+		Header: responses.Header{MessageID: request_message.Header.MessageID, Action: messages.Action_batch},
+		Status: responses.Status_successful,
+	}
+	for _, item := range request_message.Items {
+		bytes, err := json.Marshal(responses.Deposit{
+			Header:     responses.Header{MessageID: request_message.Header.MessageID, Action: messages.Action_deposit},
+			Status:     responses.Status_successful,
+			Currency:   "SGD",
+			NewBalance: "1.00",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		response_message.Items = append(response_message.Items, responses.BatchItem{ItemID: item.ItemID, Action: item.Action, Response: bytes})
+	}
+	bytes, err := json.Marshal(response_message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = requests_queue.LPush(context.Background(), request_message.Header.ReplyTo, bytes).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := v1.Batch{}
+	err = json.Unmarshal(<-done, &batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batch.Items) != number_of_items || batch.Items[number_of_items-1].Status != http.StatusOK {
+		t.Error("Expected: ", number_of_items, " ", http.StatusOK, ", Got: ", len(batch.Items))
+	}
+
+	// Bodies larger than the largest batch allowed are rejected without being read in full
+	maximum_size := maximum_body_size + int64(config.Batch.MaximumItems)*maximum_batch_item_size
+	response, bytes := send(`{"items":[],"padding":"` + strings.Repeat("0", int(maximum_size)) + `"}`)
+	if response.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Error("Expected: ", http.StatusRequestEntityTooLarge, ", Got: ", response.StatusCode, " ", string(bytes))
+	}
+}
+
+func Test_BatchRateLimits(t *testing.T) {
+
+	config, err := config_.Load("../config.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.RateLimits.Deposits.Rate = 0.001
+	config.RateLimits.Transfer.Rate = 0.001
+	ctx := context.Background()
+	client := redis.NewClient(config.TransferService.RequestsQueue.GetRedisOptions())
+	defer client.Close()
+	deposits_bucket := rate_limit_key_prefix + "deposits:" + config_.Rate_limit_keyed_by_wallet_id + ":batch_rate_limits_unit_test_a"
+	transfer_bucket := rate_limit_key_prefix + "transfer:" + config_.Rate_limit_keyed_by_wallet_id + ":batch_rate_limits_unit_test_b"
+	client.Del(ctx, deposits_bucket, transfer_bucket)
+	defer client.Del(ctx, deposits_bucket, transfer_bucket)
+
+	mux := &http_request_multiplexer{
+		rate_limiter:            create_rate_limiter(ctx),
+		deposit_requests_queue:  queues.CreateRedisTransport(client, queues.Transport_list, "", ""),
+		transfer_requests_queue: queues.CreateRedisTransport(client, queues.Transport_list, "", ""),
+	}
+	mux.active_config.Store(create_active_config(config))
+	create_items := func(action int, wallet_id string, number_of_items int) []batch_item {
+		items := make([]batch_item, 0, number_of_items)
+		for index := 0; index < number_of_items; index++ {
+			item := batch_item{BatchItem: messages.BatchItem{ItemID: strconv.Itoa(index), Action: action}}
+			if action == messages.Action_transfer {
+				item.SourceWalletID = wallet_id
+			} else {
+				item.WalletID = wallet_id
+			}
+			items = append(items, item)
+		}
+		return items
+	}
+	get_tokens := func(bucket string) float64 {
+		tokens, err := client.HGet(ctx, bucket, "tokens").Float64()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tokens
+	}
+	request := httptest.NewRequest(http.MethodPost, "/v1/batch", nil)
+
+	// Batches needing more tokens than a bucket can hold could never be let through, so
+	// they are rejected before any token is taken
+	items := create_items(messages.Action_transfer, "batch_rate_limits_unit_test_b", config.RateLimits.Transfer.Burst+1)
+	recorder := httptest.NewRecorder()
+	if mux.take_batch_tokens(items, recorder, request) {
+		t.Fatal("Expected batch to be rejected.")
+	}
+	if recorder.Code != http.StatusBadRequest || recorder.Header().Get("Retry-After") != "" {
+		t.Error("Expected: ", http.StatusBadRequest, ", Got: ", recorder.Code, " ", recorder.Header().Get("Retry-After"))
+	}
+	exists, err := client.Exists(ctx, transfer_bucket).Result()
+	if err != nil || exists != 0 {
+		t.Error("Expected: ", 0, ", Got: ", exists, " ", err)
+	}
+
+	// The batch is rejected as a whole if any bucket does not hold enough tokens, and
+	// the tokens taken from the other buckets are given back
+	items = create_items(messages.Action_transfer, "batch_rate_limits_unit_test_b", config.RateLimits.Transfer.Burst)
+	if !mux.take_batch_tokens(items, httptest.NewRecorder(), request) {
+		t.Fatal("Expected batch to be allowed.")
+	}
+	items = append(
+		create_items(messages.Action_deposit, "batch_rate_limits_unit_test_a", 3),
+		create_items(messages.Action_transfer, "batch_rate_limits_unit_test_b", 1)...)
+	recorder = httptest.NewRecorder()
+	if mux.take_batch_tokens(items, recorder, request) {
+		t.Fatal("Expected batch to be rejected.")
+	}
+	if recorder.Code != http.StatusTooManyRequests {
+		t.Error("Expected: ", http.StatusTooManyRequests, ", Got: ", recorder.Code)
+	}
+	tokens := get_tokens(deposits_bucket)
+	if tokens < float64(config.RateLimits.Deposits.Burst)-0.1 {
+		t.Error("Expected: ", config.RateLimits.Deposits.Burst, ", Got: ", tokens)
+	}
+
+	// Every item takes a token
+	items = create_items(messages.Action_deposit, "batch_rate_limits_unit_test_a", config.RateLimits.Deposits.Burst)
+	if !mux.take_batch_tokens(items, httptest.NewRecorder(), request) {
+		t.Fatal("Expected batch to be allowed.")
+	}
+	tokens = get_tokens(deposits_bucket)
+	if tokens > 0.1 {
+		t.Error("Expected: ", 0, ", Got: ", tokens)
+	}
+	if mux.take_batch_tokens(items[:1], httptest.NewRecorder(), request) {
+		t.Error("Expected batch to be rejected.")
+	}
+}
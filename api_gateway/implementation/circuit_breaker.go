@@ -0,0 +1,245 @@
+package implementation
+
+import (
+	"api_gateway/config"
+	"math"
+	"net/http"
+	"shared/responses"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	circuit_closed    int = 0 // Requests are sent to the backend service
+	circuit_open      int = 1 // Requests are rejected at once
+	circuit_half_open int = 2 // A few requests are sent to find out whether the backend service is back
+)
+
+/*
+A circuit_breaker stops the API gateway from sending requests to a backend service
+that is down. Without it, every request is still put into the requests queue and then
+waits for the full cache wait timeout, tying up the API gateway and piling up stale
+requests for the backend service to process once it is back.
+
+The circuit opens after a number of consecutive requests without a response. While it
+is open, requests are rejected at once with 503 Service Unavailable. Once the open
+duration has passed, the circuit is half open and a few trial requests are let
+through. The circuit closes if a trial request gets a response and opens again if it
+does not.
+
+Only the state of this instance of the API gateway is kept. Each instance finds out
+on its own that a backend service is down.
+*/
+type circuit_breaker struct {
+	// Returns the current settings, which may change when the configuration is reloaded
+	get_config func() *config.CircuitBreaker
+
+	mutex                sync.Mutex
+	state                int
+	consecutive_failures int
+	opened_at            time.Time
+	trial_requests       int // Trial requests waiting for a response while half open
+
+	// Replaced in unit tests
+	now func() time.Time
+}
+
+func create_circuit_breaker(get_config func() *config.CircuitBreaker) *circuit_breaker {
+	breaker := &circuit_breaker{
+		get_config: get_config,
+		state:      circuit_closed,
+		now:        time.Now,
+	}
+	return breaker
+}
+
+func (breaker *circuit_breaker) is_enabled() bool {
+	return breaker.get_config().FailureThreshold > 0
+}
+
+// Returns false and the time until the next trial request if the request must be
+// rejected. Every request allowed must be followed by a call to record_success,
+// record_failure or record_cancelled.
+func (breaker *circuit_breaker) allow() (bool, time.Duration) {
+	config := breaker.get_config()
+	if config.FailureThreshold <= 0 {
+		return true, 0
+	}
+
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	if breaker.state == circuit_open {
+		open_duration := time.Duration(config.OpenDuration) * time.Second
+		elapsed := breaker.now().Sub(breaker.opened_at)
+		if elapsed < open_duration {
+			return false, open_duration - elapsed
+		}
+		breaker.state = circuit_half_open
+		breaker.trial_requests = 0
+	}
+
+	if breaker.state == circuit_half_open {
+		if breaker.trial_requests >= max(config.HalfOpenRequests, 1) {
+			return false, time.Second
+		}
+		breaker.trial_requests++
+	}
+	return true, 0
+}
+
+// The backend service responded
+func (breaker *circuit_breaker) record_success() {
+	if !breaker.is_enabled() {
+		return
+	}
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	breaker.state = circuit_closed
+	breaker.consecutive_failures = 0
+	breaker.trial_requests = 0
+}
+
+// The backend service did not respond in time or the request could not be sent
+func (breaker *circuit_breaker) record_failure() {
+	config := breaker.get_config()
+	if config.FailureThreshold <= 0 {
+		return
+	}
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	switch breaker.state {
+	case circuit_closed:
+		breaker.consecutive_failures++
+		if breaker.consecutive_failures >= config.FailureThreshold {
+			breaker.state = circuit_open
+			breaker.opened_at = breaker.now()
+		}
+	case circuit_half_open:
+		breaker.state = circuit_open
+		breaker.opened_at = breaker.now()
+		breaker.trial_requests = 0
+	}
+}
+
+// The user cancelled the request. Nothing is known about the backend service.
+func (breaker *circuit_breaker) record_cancelled() {
+	if !breaker.is_enabled() {
+		return
+	}
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	if breaker.state == circuit_half_open && breaker.trial_requests > 0 {
+		breaker.trial_requests--
+	}
+}
+
+func (breaker *circuit_breaker) get_state() int {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	return breaker.state
+}
+
+/*
+A bulkhead caps the number of requests waiting for a response from a backend service,
+so that a slow backend service cannot use up all resources of the API gateway and
+starve the requests to other backend services. Requests over the cap are rejected at
+once instead of waiting for a slot.
+*/
+type bulkhead struct {
+	// Returns the current cap, which may change when the configuration is reloaded.
+	// The number of requests is unlimited if the cap is 0.
+	get_maximum func() int
+
+	mutex  sync.Mutex
+	in_use int
+}
+
+func create_bulkhead(get_maximum func() int) *bulkhead {
+	bulkhead_ := &bulkhead{
+		get_maximum: get_maximum,
+	}
+	return bulkhead_
+}
+
+// Returns false if all slots are taken. Every slot acquired must be released.
+func (bulkhead_ *bulkhead) try_acquire() bool {
+	maximum := bulkhead_.get_maximum()
+	bulkhead_.mutex.Lock()
+	defer bulkhead_.mutex.Unlock()
+	if maximum > 0 && bulkhead_.in_use >= maximum {
+		return false
+	}
+	bulkhead_.in_use++
+	return true
+}
+
+func (bulkhead_ *bulkhead) release() {
+	bulkhead_.mutex.Lock()
+	defer bulkhead_.mutex.Unlock()
+	bulkhead_.in_use--
+}
+
+func (bulkhead_ *bulkhead) size() int {
+	bulkhead_.mutex.Lock()
+	defer bulkhead_.mutex.Unlock()
+	return bulkhead_.in_use
+}
+
+// Protects the API gateway from a backend service that is down or too slow
+type service_guard struct {
+	circuit_breaker *circuit_breaker
+	bulkhead        *bulkhead
+}
+
+// Settings are read from the current configuration, so that they can be changed by
+// reloading the configuration
+func create_service_guard(get_config func() *config.Config, service_type int) *service_guard {
+	guard := &service_guard{
+		circuit_breaker: create_circuit_breaker(func() *config.CircuitBreaker {
+			return &get_service_config(get_config(), service_type).CircuitBreaker
+		}),
+		bulkhead: create_bulkhead(func() int {
+			return get_service_config(get_config(), service_type).MaximumConcurrentRequests
+		}),
+	}
+	return guard
+}
+
+const (
+	rejected_by_circuit_breaker string = "circuit_open"
+	rejected_by_bulkhead        string = "bulkhead_full"
+)
+
+// Returns false and responds with 503 Service Unavailable if the request must not be
+// sent to the backend service. Otherwise a slot of the bulkhead is taken, which the
+// caller must release.
+func (mux *http_request_multiplexer) enter_service_guard(service_type int, writer http.ResponseWriter) bool {
+	guard := mux.service_guards[service_type]
+	service_name := get_service_name(service_type)
+	service_id := get_service_id(service_type)
+
+	// The bulkhead is checked first, so that a full bulkhead does not use up the trial
+	// requests of a half open circuit
+	if !guard.bulkhead.try_acquire() {
+		mux.metrics.rejected_requests.Inc(service_id, rejected_by_bulkhead)
+		writer.Header().Set("Retry-After", "1")
+		write_problem(writer, responses.Error_code_service_unavailable, "Too many requests waiting for the "+service_name)
+		return false
+	}
+
+	allowed, retry_after := guard.circuit_breaker.allow()
+	if !allowed {
+		guard.bulkhead.release()
+		mux.metrics.rejected_requests.Inc(service_id, rejected_by_circuit_breaker)
+		retry_after_seconds := int(math.Ceil(retry_after.Seconds()))
+		if retry_after_seconds < 1 {
+			retry_after_seconds = 1
+		}
+		writer.Header().Set("Retry-After", strconv.Itoa(retry_after_seconds))
+		write_problem(writer, responses.Error_code_service_unavailable, "The "+service_name+" is not responding")
+		return false
+	}
+	return true
+}
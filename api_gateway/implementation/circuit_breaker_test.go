@@ -0,0 +1,195 @@
+package implementation
+
+import (
+	"api_gateway/config"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"shared/responses"
+	"testing"
+	"time"
+)
+
+func Test_CircuitBreaker(t *testing.T) {
+
+	current_time := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	breaker_config := &config.CircuitBreaker{
+		FailureThreshold: 3,
+		OpenDuration:     30,
+		HalfOpenRequests: 1,
+	}
+	breaker := create_circuit_breaker(func() *config.CircuitBreaker { return breaker_config })
+	breaker.now = func() time.Time { return current_time }
+
+	// Opens after consecutive failures only
+	for _, record := range []func(){breaker.record_failure, breaker.record_failure, breaker.record_success, breaker.record_failure, breaker.record_failure} {
+		allowed, _ := breaker.allow()
+		if !allowed {
+			t.Fatal("Expected: allowed, Got: rejected")
+		}
+		record()
+	}
+	if breaker.get_state() != circuit_closed {
+		t.Error("Expected: ", circuit_closed, ", Got: ", breaker.get_state())
+	}
+	breaker.allow()
+	breaker.record_failure()
+	if breaker.get_state() != circuit_open {
+		t.Error("Expected: ", circuit_open, ", Got: ", breaker.get_state())
+	}
+
+	// Rejects requests while open
+	current_time = current_time.Add(10 * time.Second)
+	allowed, retry_after := breaker.allow()
+	if allowed || retry_after != 20*time.Second {
+		t.Error("Expected: rejected for 20 s, Got: ", allowed, retry_after)
+	}
+
+	// Lets one trial request through when half open. Opens again if it fails.
+	current_time = current_time.Add(20 * time.Second)
+	allowed, _ = breaker.allow()
+	if !allowed {
+		t.Error("Expected: allowed, Got: rejected")
+	}
+	allowed, _ = breaker.allow()
+	if allowed {
+		t.Error("Expected: rejected, Got: allowed")
+	}
+	breaker.record_failure()
+	if breaker.get_state() != circuit_open {
+		t.Error("Expected: ", circuit_open, ", Got: ", breaker.get_state())
+	}
+
+	// A cancelled trial request frees its slot. A successful trial request closes the
+	// circuit.
+	current_time = current_time.Add(30 * time.Second)
+	allowed, _ = breaker.allow()
+	if !allowed {
+		t.Error("Expected: allowed, Got: rejected")
+	}
+	breaker.record_cancelled()
+	allowed, _ = breaker.allow()
+	if !allowed {
+		t.Error("Expected: allowed, Got: rejected")
+	}
+	breaker.record_success()
+	if breaker.get_state() != circuit_closed {
+		t.Error("Expected: ", circuit_closed, ", Got: ", breaker.get_state())
+	}
+
+	// Never opens if disabled
+	disabled_breaker := create_circuit_breaker(func() *config.CircuitBreaker { return &config.CircuitBreaker{} })
+	for i := 0; i < 10; i++ {
+		disabled_breaker.record_failure()
+	}
+	allowed, _ = disabled_breaker.allow()
+	if !allowed {
+		t.Error("Expected: allowed, Got: rejected")
+	}
+}
+
+func Test_Bulkhead(t *testing.T) {
+
+	maximum := 2
+	bulkhead_ := create_bulkhead(func() int { return maximum })
+	if !bulkhead_.try_acquire() || !bulkhead_.try_acquire() {
+		t.Fatal("Expected: acquired, Got: rejected")
+	}
+	if bulkhead_.try_acquire() {
+		t.Error("Expected: rejected, Got: acquired")
+	}
+	bulkhead_.release()
+	if !bulkhead_.try_acquire() {
+		t.Error("Expected: acquired, Got: rejected")
+	}
+
+	// Cap may change while slots are taken
+	maximum = 0
+	for i := 0; i < 1000; i++ {
+		if !bulkhead_.try_acquire() {
+			t.Fatal("Expected: acquired, Got: rejected")
+		}
+	}
+	maximum = 1
+	for i := 0; i < 1001; i++ {
+		bulkhead_.release()
+	}
+	if bulkhead_.try_acquire() {
+		t.Error("Expected: rejected, Got: acquired")
+	}
+	bulkhead_.release()
+	if !bulkhead_.try_acquire() {
+		t.Error("Expected: acquired, Got: rejected")
+	}
+}
+
+func Test_ServiceGuard(t *testing.T) {
+
+	gateway_config := &config.Config{
+		TransferService: config.Service{
+			CircuitBreaker: config.CircuitBreaker{
+				FailureThreshold: 1,
+				OpenDuration:     30,
+				HalfOpenRequests: 1,
+			},
+			MaximumConcurrentRequests: 1,
+		},
+	}
+	get_config := func() *config.Config { return gateway_config }
+	mux := &http_request_multiplexer{
+		metrics: create_gateway_metrics(),
+		service_guards: map[int]*service_guard{
+			service_transfer: create_service_guard(get_config, service_transfer),
+		},
+	}
+	guard := mux.service_guards[service_transfer]
+
+	// Bulkhead is full
+	if !mux.enter_service_guard(service_transfer, httptest.NewRecorder()) {
+		t.Fatal("Expected: allowed, Got: rejected")
+	}
+	{
+		recorder := httptest.NewRecorder()
+		if mux.enter_service_guard(service_transfer, recorder) {
+			t.Fatal("Expected: rejected, Got: allowed")
+		}
+		if recorder.Code != http.StatusServiceUnavailable {
+			t.Error("Expected: ", http.StatusServiceUnavailable, ", Got: ", recorder.Code)
+		}
+	}
+
+	// Circuit is open
+	guard.circuit_breaker.record_failure()
+	guard.bulkhead.release()
+	{
+		recorder := httptest.NewRecorder()
+		if mux.enter_service_guard(service_transfer, recorder) {
+			t.Fatal("Expected: rejected, Got: allowed")
+		}
+		if recorder.Code != http.StatusServiceUnavailable {
+			t.Error("Expected: ", http.StatusServiceUnavailable, ", Got: ", recorder.Code)
+		}
+		if recorder.Header().Get("Retry-After") != "30" {
+			t.Error("Expected: ", "30", ", Got: ", recorder.Header().Get("Retry-After"))
+		}
+		problem := responses.Problem{}
+		err := json.Unmarshal(recorder.Body.Bytes(), &problem)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if problem.Code != responses.Error_code_service_unavailable {
+			t.Error("Expected: ", responses.Error_code_service_unavailable, ", Got: ", problem.Code)
+		}
+	}
+
+	// Rejected requests do not hold a slot of the bulkhead
+	if guard.bulkhead.size() != 0 {
+		t.Error("Expected: ", 0, ", Got: ", guard.bulkhead.size())
+	}
+	if mux.metrics.rejected_requests.Get("transfer", rejected_by_bulkhead) != 1 {
+		t.Error("Expected: ", 1, ", Got: ", mux.metrics.rejected_requests.Get("transfer", rejected_by_bulkhead))
+	}
+	if mux.metrics.rejected_requests.Get("transfer", rejected_by_circuit_breaker) != 1 {
+		t.Error("Expected: ", 1, ", Got: ", mux.metrics.rejected_requests.Get("transfer", rejected_by_circuit_breaker))
+	}
+}
@@ -1,5 +1,9 @@
 package implementation
 
+import (
+	"api_gateway/config"
+)
+
 // Constants are used for quick comparisons when processing responses
 const (
 	service_balance             int = 1
@@ -7,6 +11,7 @@ const (
 	service_transaction_history int = 3
 	service_transfer            int = 4
 	service_withdraw            int = 5
+	service_webhook             int = 6
 )
 
 // Names are used for printing to logs
@@ -23,6 +28,48 @@ func get_service_name(service_type int) string {
 		service_name = "transfer service"
 	case service_withdraw:
 		service_name = "withdraw service"
+	case service_webhook:
+		service_name = "webhook service"
 	}
 	return service_name
 }
+
+// Ids are used as keys in JSON documents
+func get_service_id(service_type int) string {
+	var service_id string = ""
+	switch service_type {
+	case service_balance:
+		service_id = "balance"
+	case service_deposit:
+		service_id = "deposit"
+	case service_transaction_history:
+		service_id = "transaction_history"
+	case service_transfer:
+		service_id = "transfer"
+	case service_withdraw:
+		service_id = "withdraw"
+	case service_webhook:
+		service_id = "webhook"
+	}
+	return service_id
+}
+
+// Settings of the backend service in the configuration of the API gateway
+func get_service_config(gateway_config *config.Config, service_type int) *config.Service {
+	var backend_service *config.Service = nil
+	switch service_type {
+	case service_balance:
+		backend_service = &gateway_config.BalanceService
+	case service_deposit:
+		backend_service = &gateway_config.DepositsService
+	case service_transaction_history:
+		backend_service = &gateway_config.TransactionHistoryService
+	case service_transfer:
+		backend_service = &gateway_config.TransferService
+	case service_withdraw:
+		backend_service = &gateway_config.WithdrawalService
+	case service_webhook:
+		backend_service = &gateway_config.WebhookService
+	}
+	return backend_service
+}
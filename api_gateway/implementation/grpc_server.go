@@ -0,0 +1,292 @@
+package implementation
+
+import (
+	"api_gateway/protos"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	v1 "shared/api/v1"
+	"shared/responses"
+	"shared/tracing"
+	"strconv"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/protoadapt"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// Domain of the google.rpc.ErrorInfo detail of failed calls
+const grpc_error_domain string = "digital_wallet"
+
+// Metadata passed on to the RESTful API as HTTP headers
+var grpc_forwarded_metadata = []string{header_authorization, header_api_key, tracing.Header_traceparent}
+
+// gRPC status code returned to the user for each error code. Unknown error codes are
+// reported as Internal.
+var grpc_code_of_error_codes = map[string]codes.Code{
+	responses.Error_code_invalid_request:           codes.InvalidArgument,
+	responses.Error_code_invalid_amount:            codes.InvalidArgument,
+	responses.Error_code_invalid_currency:          codes.InvalidArgument,
+	responses.Error_code_invalid_date:              codes.InvalidArgument,
+	responses.Error_code_wallet_not_found:          codes.NotFound,
+	responses.Error_code_insufficient_funds:        codes.FailedPrecondition,
+	responses.Error_code_currency_mismatch:         codes.FailedPrecondition,
+	responses.Error_code_idempotency_key_reused:    codes.AlreadyExists,
+	responses.Error_code_idempotency_key_not_found: codes.NotFound,
+	responses.Error_code_webhook_not_found:         codes.NotFound,
+	responses.Error_code_delivery_not_found:        codes.NotFound,
+	responses.Error_code_batch_aborted:             codes.Aborted,
+	responses.Error_code_database_error:            codes.Unavailable,
+	responses.Error_code_internal_error:            codes.Internal,
+	responses.Error_code_unauthenticated:           codes.Unauthenticated,
+	responses.Error_code_forbidden:                 codes.PermissionDenied,
+	responses.Error_code_route_not_found:           codes.NotFound,
+	responses.Error_code_operation_not_found:       codes.NotFound,
+	responses.Error_code_method_not_allowed:        codes.Unimplemented,
+	responses.Error_code_rate_limited:              codes.ResourceExhausted,
+	responses.Error_code_service_unavailable:       codes.Unavailable,
+	responses.Error_code_service_timeout:           codes.DeadlineExceeded,
+	responses.Error_code_request_too_large:         codes.ResourceExhausted,
+}
+
+func get_grpc_code(error_code string) codes.Code {
+	code, exists := grpc_code_of_error_codes[error_code]
+	if !exists {
+		return codes.Internal
+	}
+	return code
+}
+
+// Turns an error code into a gRPC status. The error code itself is kept in an ErrorInfo
+// detail, since several error codes share the same gRPC status code.
+func get_grpc_error(error_code string, detail string, retry_after string) error {
+	status_ := status.New(get_grpc_code(error_code), detail)
+	details := []protoadapt.MessageV1{&errdetails.ErrorInfo{Reason: error_code, Domain: grpc_error_domain}}
+	retry_after_seconds, err := strconv.Atoi(retry_after)
+	if err == nil && retry_after_seconds > 0 {
+		details = append(details, &errdetails.RetryInfo{
+			RetryDelay: durationpb.New(time.Duration(retry_after_seconds) * time.Second),
+		})
+	}
+	status_with_details, err := status_.WithDetails(details...)
+	if err != nil {
+		return status_.Err()
+	}
+	return status_with_details.Err()
+}
+
+/*
+Serves the gRPC API defined in protos/wallet.proto.
+
+Each call is turned into the matching request of version 1 of the RESTful API and served by the
+HTTP multiplexer, so that both APIs authenticate, validate, rate limit and reach the
+backend services in exactly the same way. The deadline of the call is kept in the
+context of the request, so the API gateway stops waiting for the backend service
+when the deadline passes.
+*/
+type grpc_wallet_server struct {
+	protos.UnimplementedWalletServer
+	mux *http_request_multiplexer
+}
+
+func create_grpc_wallet_server(mux *http_request_multiplexer) *grpc_wallet_server {
+	return &grpc_wallet_server{mux: mux}
+}
+
+// Serves the request with the RESTful API. Returns the body of a successful response.
+func (server *grpc_wallet_server) serve(
+	grpc_context context.Context,
+	method string,
+	path string,
+	body any,
+	idempotency_key string) ([]byte, error) {
+
+	var request_body io.Reader = nil
+	if body != nil {
+		bytes_to_send, err := json.Marshal(body)
+		if err != nil {
+			return nil, get_grpc_error(responses.Error_code_internal_error, "Unable to serialise request", "")
+		}
+		request_body = bytes.NewReader(bytes_to_send)
+	}
+	request, err := http.NewRequestWithContext(grpc_context, method, path, request_body)
+	if err != nil {
+		return nil, get_grpc_error(responses.Error_code_invalid_request, "Invalid request", "")
+	}
+
+	// Credentials are sent as metadata instead of HTTP headers
+	incoming_metadata, _ := metadata.FromIncomingContext(grpc_context)
+	for _, key := range grpc_forwarded_metadata {
+		values := incoming_metadata.Get(key)
+		if len(values) > 0 {
+			request.Header.Set(key, values[0])
+		}
+	}
+	if len(idempotency_key) > 0 {
+		request.Header.Set(header_idempotency_key, idempotency_key)
+	}
+	peer_, exists := peer.FromContext(grpc_context)
+	if exists {
+		request.RemoteAddr = peer_.Addr.String()
+	}
+
+	recorder := create_response_recorder()
+	server.mux.ServeHTTP(recorder, request)
+	if recorder.status >= http.StatusOK && recorder.status < http.StatusMultipleChoices {
+		return recorder.body.Bytes(), nil
+	}
+
+	problem := responses.Problem{}
+	err = json.Unmarshal(recorder.body.Bytes(), &problem)
+	if err != nil || len(problem.Code) == 0 {
+		return nil, get_grpc_error(responses.Error_code_internal_error, http.StatusText(recorder.status), "")
+	}
+	return nil, get_grpc_error(problem.Code, problem.Detail, recorder.header.Get("Retry-After"))
+}
+
+func get_wallet_path(wallet_id string, resource string) string {
+	return "/v1/wallets/" + url.PathEscape(wallet_id) + "/" + resource
+}
+
+// Paths with an empty wallet ID do not match any route of the RESTful API
+func check_wallet_id(wallet_id string) error {
+	if len(wallet_id) == 0 {
+		return get_grpc_error(responses.Error_code_invalid_request, "Missing wallet ID", "")
+	}
+	return nil
+}
+
+func (server *grpc_wallet_server) Deposit(grpc_context context.Context, request *protos.DepositRequest) (*protos.DepositResponse, error) {
+	err := check_wallet_id(request.GetWalletId())
+	if err != nil {
+		return nil, err
+	}
+	body := v1.DepositRequest{
+		Amount:   request.GetAmount(),
+		Currency: request.GetCurrency(),
+	}
+	bytes, err := server.serve(grpc_context, http.MethodPost, get_wallet_path(request.GetWalletId(), "deposits"), &body, request.GetIdempotencyKey())
+	if err != nil {
+		return nil, err
+	}
+	response_message := v1.Deposit{}
+	err = json.Unmarshal(bytes, &response_message)
+	if err != nil {
+		return nil, get_grpc_error(responses.Error_code_internal_error, "Invalid response from backend service", "")
+	}
+	return &protos.DepositResponse{
+		Currency:   response_message.Currency,
+		NewBalance: response_message.NewBalance,
+	}, nil
+}
+
+func (server *grpc_wallet_server) Withdraw(grpc_context context.Context, request *protos.WithdrawRequest) (*protos.WithdrawResponse, error) {
+	err := check_wallet_id(request.GetWalletId())
+	if err != nil {
+		return nil, err
+	}
+	body := v1.WithdrawalRequest{
+		Amount:   request.GetAmount(),
+		Currency: request.GetCurrency(),
+	}
+	bytes, err := server.serve(grpc_context, http.MethodPost, get_wallet_path(request.GetWalletId(), "withdrawals"), &body, request.GetIdempotencyKey())
+	if err != nil {
+		return nil, err
+	}
+	response_message := v1.Withdrawal{}
+	err = json.Unmarshal(bytes, &response_message)
+	if err != nil {
+		return nil, get_grpc_error(responses.Error_code_internal_error, "Invalid response from backend service", "")
+	}
+	return &protos.WithdrawResponse{
+		Currency:   response_message.Currency,
+		NewBalance: response_message.NewBalance,
+	}, nil
+}
+
+func (server *grpc_wallet_server) Transfer(grpc_context context.Context, request *protos.TransferRequest) (*protos.TransferResponse, error) {
+	body := v1.TransferRequest{
+		SourceWalletID:      request.GetSourceWalletId(),
+		DestinationWalletID: request.GetDestinationWalletId(),
+		Amount:              request.GetAmount(),
+		Currency:            request.GetCurrency(),
+	}
+	bytes, err := server.serve(grpc_context, http.MethodPost, "/v1/transfer", &body, request.GetIdempotencyKey())
+	if err != nil {
+		return nil, err
+	}
+	response_message := v1.Transfer{}
+	err = json.Unmarshal(bytes, &response_message)
+	if err != nil {
+		return nil, get_grpc_error(responses.Error_code_internal_error, "Invalid response from backend service", "")
+	}
+	return &protos.TransferResponse{
+		Currency:   response_message.Currency,
+		NewBalance: response_message.NewBalance,
+	}, nil
+}
+
+func (server *grpc_wallet_server) GetBalance(grpc_context context.Context, request *protos.GetBalanceRequest) (*protos.GetBalanceResponse, error) {
+	err := check_wallet_id(request.GetWalletId())
+	if err != nil {
+		return nil, err
+	}
+	bytes, err := server.serve(grpc_context, http.MethodGet, get_wallet_path(request.GetWalletId(), "balance"), nil, "")
+	if err != nil {
+		return nil, err
+	}
+	response_message := v1.Balance{}
+	err = json.Unmarshal(bytes, &response_message)
+	if err != nil {
+		return nil, get_grpc_error(responses.Error_code_internal_error, "Invalid response from backend service", "")
+	}
+	return &protos.GetBalanceResponse{
+		Currency: response_message.Currency,
+		Balance:  response_message.Balance,
+	}, nil
+}
+
+func (server *grpc_wallet_server) GetTransactionHistory(grpc_context context.Context, request *protos.GetTransactionHistoryRequest) (*protos.GetTransactionHistoryResponse, error) {
+	err := check_wallet_id(request.GetWalletId())
+	if err != nil {
+		return nil, err
+	}
+	query := url.Values{}
+	if len(request.GetFrom()) > 0 {
+		query.Set("from", request.GetFrom())
+	}
+	if len(request.GetTo()) > 0 {
+		query.Set("to", request.GetTo())
+	}
+	path := get_wallet_path(request.GetWalletId(), "transaction_history")
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	bytes, err := server.serve(grpc_context, http.MethodGet, path, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	response_message := v1.TransactionHistory{}
+	err = json.Unmarshal(bytes, &response_message)
+	if err != nil {
+		return nil, get_grpc_error(responses.Error_code_internal_error, "Invalid response from backend service", "")
+	}
+	response := &protos.GetTransactionHistoryResponse{}
+	for _, transaction := range response_message.Transactions {
+		response.Transactions = append(response.Transactions, &protos.Transaction{
+			Date:     transaction.Date,
+			Type:     transaction.Type,
+			Currency: transaction.Currency,
+			Amount:   transaction.Amount,
+		})
+	}
+	return response, nil
+}
@@ -0,0 +1,193 @@
+package implementation
+
+import (
+	config_ "api_gateway/config"
+	"api_gateway/protos"
+	"context"
+	"shared/queues"
+	"shared/responses"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Returns the reason of the ErrorInfo detail of a failed call
+func get_error_reason(err error) string {
+	for _, detail := range status.Convert(err).Details() {
+		error_info, ok := detail.(*errdetails.ErrorInfo)
+		if ok {
+			return error_info.Reason
+		}
+	}
+	return ""
+}
+
+func Test_GRPCErrors(t *testing.T) {
+
+	// Error codes are mapped to gRPC status codes and kept in an ErrorInfo detail
+	{
+		err := get_grpc_error(responses.Error_code_insufficient_funds, "Insufficient funds in wallet", "")
+		status_ := status.Convert(err)
+		if status_.Code() != codes.FailedPrecondition {
+			t.Error("Expected: ", codes.FailedPrecondition, ", Got: ", status_.Code())
+		}
+		if status_.Message() != "Insufficient funds in wallet" {
+			t.Error("Expected: ", "Insufficient funds in wallet", ", Got: ", status_.Message())
+		}
+		if get_error_reason(err) != responses.Error_code_insufficient_funds {
+			t.Error("Expected: ", responses.Error_code_insufficient_funds, ", Got: ", get_error_reason(err))
+		}
+	}
+
+	// Callers are told when to retry
+	{
+		err := get_grpc_error(responses.Error_code_rate_limited, "Too many requests to deposits", "3")
+		status_ := status.Convert(err)
+		if status_.Code() != codes.ResourceExhausted {
+			t.Error("Expected: ", codes.ResourceExhausted, ", Got: ", status_.Code())
+		}
+		var retry_delay time.Duration
+		for _, detail := range status_.Details() {
+			retry_info, ok := detail.(*errdetails.RetryInfo)
+			if ok {
+				retry_delay = retry_info.RetryDelay.AsDuration()
+			}
+		}
+		if retry_delay != 3*time.Second {
+			t.Error("Expected: ", 3*time.Second, ", Got: ", retry_delay)
+		}
+	}
+
+	// Unknown error codes are reported as Internal
+	if get_grpc_code("SOMETHING_NEW") != codes.Internal {
+		t.Error("Expected: ", codes.Internal, ", Got: ", get_grpc_code("SOMETHING_NEW"))
+	}
+}
+
+func Test_GRPCServer(t *testing.T) {
+
+	config, err := config_.Load("../config.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wallet_id := "grpc_unit_test_wallet"
+	api_key := "grpc_unit_test_key"
+	config.Authentication.APIKeys = []config_.APIKey{
+		{
+			Name:      "grpc_unit_test",
+			Key:       api_key,
+			WalletIDs: []string{wallet_id},
+		},
+	}
+	config.BalanceService.RequestsQueue.QueueName = "api_gateway_requests_queue_test"
+	config.BalanceService.ResponsesQueue.QueueName = "api_gateway_responses_queue_test"
+
+	// Nothing reads deposit requests, so deposits are never answered
+	config.DepositsService.RequestsQueue.QueueName = "grpc_deposit_requests_queue_test"
+	config.DepositsService.ResponsesQueue.QueueName = "grpc_deposit_responses_queue_test"
+
+	// Start running test service
+	test_service_ := create_test_service(&config.BalanceService)
+	test_service_.run()
+	defer test_service_.shutdown()
+
+	// Start running API gateway
+	api_gateway, err := CreateAPIGateway(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api_gateway.Run()
+	defer api_gateway.Shutdown()
+	defer api_gateway.redis_manager.deposit_requests_queue.(*queues.RedisTransport).Client().Del(context.Background(), config.DepositsService.RequestsQueue.QueueName)
+
+	time.Sleep(2 * time.Second)
+
+	connection, err := grpc.NewClient("localhost:"+config.GRPCServer.ListenPort, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connection.Close()
+	client := protos.NewWalletClient(connection)
+	authenticated_context := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", api_key)
+
+	// Calls are passed to the backend service
+	{
+		timeout_context, cancel := context.WithTimeout(authenticated_context, 5*time.Second)
+		_, err := client.GetBalance(timeout_context, &protos.GetBalanceRequest{WalletId: wallet_id})
+		cancel()
+		if err != nil {
+			t.Error("Expected: ", nil, ", Got: ", err)
+		}
+	}
+
+	// Callers must be authenticated
+	{
+		timeout_context, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err := client.GetBalance(timeout_context, &protos.GetBalanceRequest{WalletId: wallet_id})
+		cancel()
+		if status.Code(err) != codes.Unauthenticated {
+			t.Error("Expected: ", codes.Unauthenticated, ", Got: ", err)
+		}
+	}
+
+	// Callers may only touch the wallets they own
+	{
+		timeout_context, cancel := context.WithTimeout(authenticated_context, 5*time.Second)
+		_, err := client.GetBalance(timeout_context, &protos.GetBalanceRequest{WalletId: "someone_elses_wallet"})
+		cancel()
+		if status.Code(err) != codes.PermissionDenied {
+			t.Error("Expected: ", codes.PermissionDenied, ", Got: ", err)
+		}
+		if get_error_reason(err) != responses.Error_code_forbidden {
+			t.Error("Expected: ", responses.Error_code_forbidden, ", Got: ", get_error_reason(err))
+		}
+	}
+
+	// Requests are validated like those of the RESTful API
+	for _, request := range []*protos.DepositRequest{
+		{WalletId: wallet_id, Currency: "SGD"},
+		{WalletId: wallet_id, Amount: "1.00"},
+		{Amount: "1.00", Currency: "SGD"},
+	} {
+		timeout_context, cancel := context.WithTimeout(authenticated_context, 5*time.Second)
+		_, err := client.Deposit(timeout_context, request)
+		cancel()
+		if status.Code(err) != codes.InvalidArgument {
+			t.Error("Expected: ", codes.InvalidArgument, ", Got: ", err)
+		}
+	}
+
+	// The API gateway stops waiting for the backend service when the deadline passes,
+	// long before the configured wait timeout
+	{
+		started_at := time.Now()
+		timeout_context, cancel := context.WithTimeout(authenticated_context, 500*time.Millisecond)
+		_, err := client.Deposit(timeout_context, &protos.DepositRequest{WalletId: wallet_id, Amount: "1.00", Currency: "SGD"})
+		cancel()
+		if status.Code(err) != codes.DeadlineExceeded {
+			t.Error("Expected: ", codes.DeadlineExceeded, ", Got: ", err)
+		}
+		if time.Since(started_at) > 2*time.Second {
+			t.Error("Expected: response within ", 2*time.Second, ", Got: ", time.Since(started_at))
+		}
+
+		// Short deadlines of callers do not count against the backend service
+		time.Sleep(time.Second)
+		if api_gateway.http_multiplexer.deposit_response_waiters.size() != 0 {
+			t.Error("Expected: ", 0, ", Got: ", api_gateway.http_multiplexer.deposit_response_waiters.size())
+		}
+		circuit_breaker := api_gateway.http_multiplexer.service_guards[service_deposit].circuit_breaker
+		circuit_breaker.mutex.Lock()
+		consecutive_failures := circuit_breaker.consecutive_failures
+		circuit_breaker.mutex.Unlock()
+		if consecutive_failures != 0 {
+			t.Error("Expected: ", 0, ", Got: ", consecutive_failures)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package implementation
+
+import (
+	"api_gateway/config"
+	"context"
+	"encoding/json"
+	"net/http"
+	"shared/queues"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	health_status_ok          string = "ok"
+	health_status_unavailable string = "unavailable"
+	health_status_running     string = "running"
+	health_status_stopped     string = "stopped"
+)
+
+// Reported by /healthz and /readyz
+type health_status struct {
+	Status   string                    `json:"status"`
+	Services map[string]service_health `json:"services,omitempty"`
+}
+
+type service_health struct {
+	Status          string `json:"status"`
+	RequestsQueue   string `json:"requests_queue"`
+	ResponsesQueue  string `json:"responses_queue"`
+	ResponsesReader string `json:"responses_reader"`
+}
+
+// Queues and responses thread each backend service depends on
+type service_dependencies struct {
+	service_type    int
+	requests_queue  queues.Transport
+	responses_queue queues.Transport
+
+	// Set while the responses thread of this backend service is running
+	is_reading atomic.Bool
+}
+
+type health_checker struct {
+	context  context.Context
+	services []*service_dependencies
+
+	// Returns the current configuration, which may change when it is reloaded
+	get_config func() *config.Config
+}
+
+func create_health_checker(get_config func() *config.Config, redis_manager *redis_manager, background_context context.Context) *health_checker {
+	return &health_checker{
+		context:    background_context,
+		get_config: get_config,
+		services: []*service_dependencies{
+			{
+				service_type:    service_balance,
+				requests_queue:  redis_manager.balance_requests_queue,
+				responses_queue: redis_manager.balance_responses_queue,
+			},
+			{
+				service_type:    service_deposit,
+				requests_queue:  redis_manager.deposit_requests_queue,
+				responses_queue: redis_manager.deposit_responses_queue,
+			},
+			{
+				service_type:    service_transaction_history,
+				requests_queue:  redis_manager.transaction_history_requests_queue,
+				responses_queue: redis_manager.transaction_history_responses_queue,
+			},
+			{
+				service_type:    service_transfer,
+				requests_queue:  redis_manager.transfer_requests_queue,
+				responses_queue: redis_manager.transfer_responses_queue,
+			},
+			{
+				service_type:    service_withdraw,
+				requests_queue:  redis_manager.withdrawal_requests_queue,
+				responses_queue: redis_manager.withdrawal_responses_queue,
+			},
+			{
+				service_type:    service_webhook,
+				requests_queue:  redis_manager.webhook_requests_queue,
+				responses_queue: redis_manager.webhook_responses_queue,
+			},
+		},
+	}
+}
+
+// Called by the responses thread of each backend service when it starts and stops
+func (checker *health_checker) set_reading(service_type int, is_reading bool) {
+	for _, service := range checker.services {
+		if service.service_type == service_type {
+			service.is_reading.Store(is_reading)
+			return
+		}
+	}
+}
+
+func (checker *health_checker) ping(transport queues.Transport, timeout int) string {
+	timeout_context, cancel := context.WithTimeout(checker.context, time.Duration(timeout)*time.Second)
+	defer cancel()
+	err := transport.Ping(timeout_context)
+	if err != nil {
+		return health_status_unavailable
+	}
+	return health_status_ok
+}
+
+// The API gateway is ready if every Redis server answers PING and the responses thread
+// of every backend service is running. All Redis servers are pinged at the same time,
+// so a single unreachable server does not delay the others.
+func (checker *health_checker) check_readiness() (*health_status, bool) {
+	results := make([]service_health, len(checker.services))
+
+	config := checker.get_config()
+	var waitgroup sync.WaitGroup
+	for i, service := range checker.services {
+		backend_service := get_service_config(config, service.service_type)
+		waitgroup.Add(2)
+		go func() {
+			defer waitgroup.Done()
+			results[i].RequestsQueue = checker.ping(service.requests_queue, backend_service.RequestsQueue.Timeout)
+		}()
+		go func() {
+			defer waitgroup.Done()
+			results[i].ResponsesQueue = checker.ping(service.responses_queue, backend_service.ResponsesQueue.Timeout)
+		}()
+	}
+	waitgroup.Wait()
+
+	status := &health_status{
+		Status:   health_status_ok,
+		Services: make(map[string]service_health, len(checker.services)),
+	}
+	is_ready := true
+	for i, service := range checker.services {
+		result := results[i]
+		result.ResponsesReader = health_status_stopped
+		if service.is_reading.Load() {
+			result.ResponsesReader = health_status_running
+		}
+		result.Status = health_status_ok
+		if result.RequestsQueue != health_status_ok ||
+			result.ResponsesQueue != health_status_ok ||
+			result.ResponsesReader != health_status_running {
+			result.Status = health_status_unavailable
+			status.Status = health_status_unavailable
+			is_ready = false
+		}
+		status.Services[get_service_id(service.service_type)] = result
+	}
+	return status, is_ready
+}
+
+func write_health_status(writer http.ResponseWriter, status *health_status, http_status int) {
+	bytes, err := json.Marshal(status)
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// Load balancers must always see the current status
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.Header().Set("Content-Type", content_type_json)
+	writer.WriteHeader(http_status)
+	writer.Write(bytes)
+}
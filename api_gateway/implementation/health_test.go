@@ -0,0 +1,75 @@
+package implementation
+
+import (
+	config_ "api_gateway/config"
+	"context"
+	"shared/queues"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func Test_HealthChecker(t *testing.T) {
+
+	config, err := config_.Load("../config.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Responses threads are not running yet
+	redis_manager, err := create_redis_manager(config, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checker := create_health_checker(func() *config_.Config { return config }, redis_manager, context.Background())
+
+	{
+		status, is_ready := checker.check_readiness()
+		if is_ready {
+			t.Error("Expected: not ready, Got: ", status)
+		}
+		if status.Services["deposit"].ResponsesReader != health_status_stopped {
+			t.Error("Expected: ", health_status_stopped, ", Got: ", status.Services["deposit"].ResponsesReader)
+		}
+		if status.Services["deposit"].RequestsQueue != health_status_ok {
+			t.Error("Expected: ", health_status_ok, ", Got: ", status.Services["deposit"].RequestsQueue)
+		}
+	}
+
+	for _, service_type := range []int{service_balance, service_deposit, service_transaction_history, service_transfer, service_withdraw, service_webhook} {
+		checker.set_reading(service_type, true)
+	}
+
+	{
+		status, is_ready := checker.check_readiness()
+		if !is_ready {
+			t.Error("Expected: ready, Got: ", status)
+		}
+	}
+
+	// Redis server of the transfer requests queue cannot be reached
+	{
+		unreachable_queue := config.TransferService.RequestsQueue
+		unreachable_queue.Port = "1"
+		unreachable_client := redis.NewClient(unreachable_queue.GetRedisOptions())
+		defer unreachable_client.Close()
+		checker.services[3].requests_queue = queues.CreateRedisTransport(unreachable_client, queues.Transport_list, "", "")
+
+		status, is_ready := checker.check_readiness()
+		if is_ready {
+			t.Error("Expected: not ready, Got: ", status)
+		}
+		expected := service_health{
+			Status:          health_status_unavailable,
+			RequestsQueue:   health_status_unavailable,
+			ResponsesQueue:  health_status_ok,
+			ResponsesReader: health_status_running,
+		}
+		if status.Services["transfer"] != expected {
+			t.Error("Expected: ", expected, ", Got: ", status.Services["transfer"])
+		}
+		if status.Services["deposit"].Status != health_status_ok {
+			t.Error("Expected: ", health_status_ok, ", Got: ", status.Services["deposit"].Status)
+		}
+	}
+}
@@ -7,10 +7,16 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"shared/identifiers"
+	"shared/logging"
 	"shared/messages"
-	"sync"
+	"shared/queues"
+	"shared/responses"
+	"shared/tracing"
+	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -19,361 +25,810 @@ import (
 
 // Used for unit testing only
 type http_request_multiplexer struct {
-	config    *config.Config
-	context   context.Context
-	global_id atomic.Int64
-	// Global unique id for tracking messages. This is required if there are multiple threads
-	// putting items in the queue. The responses may not arrive in order.
-	// should use twitter's snowflake approach or a globally unique identifier but lack of time.
-	// This is ignored for now. Assume only a single thread puts items on the queue.
-
-	// Resource handles to Redis queues
-	deposit_requests_queue             *redis.Client
-	withdrawal_requests_queue          *redis.Client
-	transfer_requests_queue            *redis.Client
-	balance_requests_queue             *redis.Client
-	transaction_history_requests_queue *redis.Client
-
-	// Cache which stores responses
-	deposit_responses_cache             sync.Map
-	withdrawal_responses_cache          sync.Map
-	transfer_responses_cache            sync.Map
-	balance_responses_cache             sync.Map
-	transaction_history_responses_cache sync.Map
+	context context.Context
+
+	// Settings in use. Replaced as a whole when the configuration is reloaded, so that
+	// every request sees either the old or the new settings, never a mix of both.
+	active_config atomic.Pointer[active_config]
+
+	// Error of the last reload, if it failed
+	last_reload_failure atomic.Pointer[reload_failure]
+
+	// Generates globally unique ids for tracking messages. Responses may not arrive in
+	// order and several instances of the API gateway may share the same queues, so
+	// ids must stay unique across threads, instances and restarts.
+	message_ids *identifiers.Generator
+
+	// Finds the handler of each request
+	router *paths.Router
+
+	// Finds the handler of requests which need no authentication, e.g. health checks
+	// by load balancers
+	public_router *paths.Router
+
+	// Checks the Redis servers and responses threads the API gateway depends on
+	health_checker *health_checker
+
+	// Served on /metrics
+	metrics *gateway_metrics
+
+	// Spans of every request
+	tracer *tracing.Tracer
+
+	// Circuit breaker and bulkhead of each backend service, keyed by service type
+	service_guards map[int]*service_guard
+
+	// Limits the rate of requests from each caller
+	rate_limiter *rate_limiter
+
+	// Clients of the live feed of each wallet, and the streams the feed catches up from.
+	// Nil if messages are passed on in memory.
+	wallet_feed   *wallet_feed
+	wallet_events *redis.Client
+
+	// Operations accepted with Prefer: respond-async. Nil if messages are passed on in
+	// memory.
+	operations *redis.Client
+
+	// Requests queues of the backend services
+	deposit_requests_queue             queues.Transport
+	withdrawal_requests_queue          queues.Transport
+	transfer_requests_queue            queues.Transport
+	balance_requests_queue             queues.Transport
+	transaction_history_requests_queue queues.Transport
+	webhook_requests_queue             queues.Transport
+
+	// Responses to requests sent by this instance of the API gateway are put into these queues
+	deposit_reply_queue             string
+	withdrawal_reply_queue          string
+	transfer_reply_queue            string
+	balance_reply_queue             string
+	transaction_history_reply_queue string
+	webhook_reply_queue             string
+
+	// Responses to operations accepted with Prefer: respond-async are put into these
+	// queues, shared by every instance of the API gateway
+	deposit_operations_queue    string
+	withdrawal_operations_queue string
+	transfer_operations_queue   string
+
+	// Requests waiting for a response from each backend service
+	deposit_response_waiters             *response_waiters
+	withdrawal_response_waiters          *response_waiters
+	transfer_response_waiters            *response_waiters
+	balance_response_waiters             *response_waiters
+	transaction_history_response_waiters *response_waiters
+	webhook_response_waiters             *response_waiters
+}
+
+func (mux *http_request_multiplexer) get_requests_queue(service_type int) queues.Transport {
+	var requests_queue queues.Transport = nil
+	switch service_type {
+	case service_balance:
+		requests_queue = mux.balance_requests_queue
+	case service_deposit:
+		requests_queue = mux.deposit_requests_queue
+	case service_transaction_history:
+		requests_queue = mux.transaction_history_requests_queue
+	case service_transfer:
+		requests_queue = mux.transfer_requests_queue
+	case service_withdraw:
+		requests_queue = mux.withdrawal_requests_queue
+	case service_webhook:
+		requests_queue = mux.webhook_requests_queue
+	}
+	return requests_queue
 }
 
 func create_http_request_multiplexer(config *config.Config, redis_manager *redis_manager, background_context context.Context) (*http_request_multiplexer, error) {
 
-	http_multiplexer := http_request_multiplexer{
-		config:                             config,
+	message_ids, err := identifiers.CreateGenerator(config.NodeID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Requests put into a queue the backend service does not read would be lost
+	for service_type := service_balance; service_type <= service_webhook; service_type++ {
+		transport := get_service_config(config, service_type).RequestsQueue.Transport
+		if !queues.IsValidTransport(transport) {
+			return nil, errors.New("unknown transport " + transport + " of the requests queue of the " + get_service_name(service_type))
+		}
+	}
+
+	exporter, err := tracing.CreateExporter(
+		config.Tracing.Exporter,
+		"api_gateway",
+		config.Tracing.Endpoint,
+		time.Duration(config.Tracing.Timeout)*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	http_multiplexer := &http_request_multiplexer{
 		context:                            background_context,
+		message_ids:                        message_ids,
+		rate_limiter:                       create_rate_limiter(background_context),
+		metrics:                            create_gateway_metrics(),
+		tracer:                             tracing.CreateTracer(exporter),
+		wallet_feed:                        create_wallet_feed(),
+		wallet_events:                      redis_manager.wallet_events,
+		operations:                         redis_manager.operations,
 		deposit_requests_queue:             redis_manager.deposit_requests_queue,
 		withdrawal_requests_queue:          redis_manager.withdrawal_requests_queue,
 		transfer_requests_queue:            redis_manager.transfer_requests_queue,
 		balance_requests_queue:             redis_manager.balance_requests_queue,
 		transaction_history_requests_queue: redis_manager.transaction_history_requests_queue,
+		webhook_requests_queue:             redis_manager.webhook_requests_queue,
+
+		deposit_reply_queue:             redis_manager.deposit_reply_queue,
+		withdrawal_reply_queue:          redis_manager.withdrawal_reply_queue,
+		transfer_reply_queue:            redis_manager.transfer_reply_queue,
+		balance_reply_queue:             redis_manager.balance_reply_queue,
+		transaction_history_reply_queue: redis_manager.transaction_history_reply_queue,
+		webhook_reply_queue:             redis_manager.webhook_reply_queue,
+
+		deposit_operations_queue:    redis_manager.deposit_operations_queue,
+		withdrawal_operations_queue: redis_manager.withdrawal_operations_queue,
+		transfer_operations_queue:   redis_manager.transfer_operations_queue,
+
+		deposit_response_waiters:             create_response_waiters(),
+		withdrawal_response_waiters:          create_response_waiters(),
+		transfer_response_waiters:            create_response_waiters(),
+		balance_response_waiters:             create_response_waiters(),
+		transaction_history_response_waiters: create_response_waiters(),
+		webhook_response_waiters:             create_response_waiters(),
+	}
+	http_multiplexer.active_config.Store(create_active_config(config))
+	http_multiplexer.health_checker = create_health_checker(http_multiplexer.get_config, redis_manager, background_context)
+	http_multiplexer.service_guards = make(map[int]*service_guard)
+	for _, service_type := range []int{service_balance, service_deposit, service_transaction_history, service_transfer, service_withdraw, service_webhook} {
+		http_multiplexer.service_guards[service_type] = create_service_guard(http_multiplexer.get_config, service_type)
+	}
+	http_multiplexer.router = http_multiplexer.create_router()
+	http_multiplexer.public_router = http_multiplexer.create_public_router()
+
+	return http_multiplexer, nil
+}
+
+// Returns false and responds with 500 Internal Server Error if no message id could be
+// generated, e.g. because the clock of this machine moved backwards
+func (mux *http_request_multiplexer) next_message_id(writer http.ResponseWriter) (int64, bool) {
+	message_id, err := mux.message_ids.Next()
+	if err != nil {
+		slog.Error("Unable to generate message ID", logging.Key_error, err.Error())
+		write_problem(writer, responses.Error_code_internal_error, "Unable to generate message ID")
+		return 0, false
+	}
+	return message_id, true
+}
+
+// Callers may only touch the wallets they own
+func is_authorised(request *http.Request, wallet_id string) bool {
+	caller_ := get_caller(request)
+	return caller_ != nil && caller_.owns(wallet_id)
+}
+
+const (
+	header_idempotency_key             string = "Idempotency-Key"
+	maximum_length_of_idempotency_keys int    = 255
+)
+
+// Returns the idempotency key of the request, if any. Idempotency keys are chosen by
+// callers, so they are prefixed with the name of the caller to keep callers from
+// seeing each other's requests. Returns false if the idempotency key is invalid.
+func get_idempotency_key(request *http.Request, key string) (string, bool) {
+	if len(key) == 0 {
+		return "", true
+	}
+	if len(key) > maximum_length_of_idempotency_keys {
+		return "", false
 	}
-	http_multiplexer.global_id.Store(0)
+	caller_ := get_caller(request)
+	if caller_ == nil {
+		return "", false
+	}
+	return caller_.name + ":" + key, true
+}
+
+// Largest request body read, so that callers cannot make the API gateway hold bodies of
+// any size in memory
+const maximum_body_size int64 = 64 * 1024 // B
+
+// Reads the JSON body of the request into body. Returns false and responds with the
+// reason if the body is missing, too large or invalid.
+func read_body(writer http.ResponseWriter, request *http.Request, body any) bool {
+	return read_body_up_to(writer, request, body, maximum_body_size)
+}
 
-	return &http_multiplexer, nil
+// Reads a JSON body of up to maximum_size bytes into body
+func read_body_up_to(writer http.ResponseWriter, request *http.Request, body any, maximum_size int64) bool {
+	bytes, err := io.ReadAll(http.MaxBytesReader(writer, request.Body, maximum_size))
+	if err != nil {
+		var too_large *http.MaxBytesError
+		if errors.As(err, &too_large) {
+			write_problem(writer, responses.Error_code_request_too_large, "Request body is larger than "+strconv.FormatInt(maximum_size, 10)+" bytes")
+			return false
+		}
+		write_problem(writer, responses.Error_code_invalid_request, "Unable to read request body")
+		return false
+	}
+	if len(bytes) == 0 {
+		write_problem(writer, responses.Error_code_invalid_request, "Missing request body")
+		return false
+	}
+	err = json.Unmarshal(bytes, body)
+	if err != nil {
+		write_problem(writer, responses.Error_code_invalid_request, "Request body is not valid JSON")
+		return false
+	}
+	return true
+}
+
+// Time to wait for the response of the backend service. Shorter if the request has an
+// earlier deadline, e.g. the deadline of a gRPC call.
+func get_response_timeout(backend_service *config.Service, request *http.Request) time.Duration {
+	response_timeout := time.Duration(backend_service.CacheWaitTimeout) * time.Second
+	deadline, has_deadline := request.Context().Deadline()
+	if has_deadline && time.Until(deadline) < response_timeout {
+		response_timeout = time.Until(deadline)
+	}
+	return response_timeout
+}
+
+/*
+Deadline of a request in its message header. The backend service drops the request if
+it is still in the queue by then. The deadline is the deadline margin before the API
+gateway stops waiting for the response, so that a request taken just before its
+deadline is still answered in time even if the clocks of the API gateway and the
+backend service differ a little. The margin is at most half of the time left, so that
+the deadline is never in the past, e.g. for a gRPC call with a short deadline.
+*/
+func get_deadline(backend_service *config.Service, request *http.Request) int64 {
+	response_timeout := get_response_timeout(backend_service, request)
+	deadline_margin := time.Duration(backend_service.DeadlineMargin) * time.Second
+	if deadline_margin > response_timeout/2 {
+		deadline_margin = response_timeout / 2
+	}
+	return time.Now().Add(response_timeout - deadline_margin).UnixMilli()
 }
 
 func (mux *http_request_multiplexer) send_request_and_return_response(
+	service_type int,
 	message_id int64,
 	bytes_to_send []byte,
 	backend_service *config.Service,
-	requests_queue *redis.Client,
-	responses_cache *sync.Map,
-	writer http.ResponseWriter) {
+	requests_queue queues.Transport,
+	response_waiters *response_waiters,
+	mapper response_mapper,
+	writer http.ResponseWriter,
+	request *http.Request) {
 
 	// Define aliases
 	timeout := time.Duration(backend_service.RequestsQueue.Timeout) * time.Second
 	queue_name := backend_service.RequestsQueue.QueueName
+	service_id := get_service_id(service_type)
+
+	// Fail fast if the backend service is not responding or too busy
+	if !mux.enter_service_guard(service_type, writer) {
+		return
+	}
+	guard := mux.service_guards[service_type]
+	defer guard.bulkhead.release()
+
+	// Wait for the response before sending the request. Otherwise the response may
+	// arrive before anyone is waiting for it.
+	response_channel := response_waiters.register(message_id)
 
 	// Put request in queue
+	get_request_log(request).set_message(bytes_to_send)
 	timeout_context, cancel := context.WithTimeout(mux.context, timeout)
-	_, err := requests_queue.LPush(timeout_context, queue_name, bytes_to_send).Result()
+	pushed_at := time.Now()
+	push_span := get_span(request).StartPushSpan(queue_name)
+	err := requests_queue.PushRequest(timeout_context, queue_name, bytes_to_send)
+	push_span.EndWithError(err)
+	mux.metrics.queue_push_duration.ObserveSince(pushed_at, service_id)
 	if err != nil {
-		writer.WriteHeader(http.StatusInternalServerError)
+		response_waiters.cancel(message_id)
+		guard.circuit_breaker.record_failure()
+		write_problem(writer, responses.Error_code_service_unavailable, "Unable to send request to backend service")
 		cancel()
 		return
 	}
 	cancel()
 
-	// Wait for response to request
-	result, exists := responses_cache.LoadAndDelete(message_id)
-	time_elapsed := 0                                           // ms
-	response_timeout := backend_service.CacheWaitTimeout * 1000 // ms
-	for time_elapsed < response_timeout && !exists {
-		time.Sleep(200 * time.Millisecond)
-		time_elapsed += 200
-		result, exists = responses_cache.LoadAndDelete(message_id)
-	}
+	// Wait for response to request. Stop waiting if the user cancels the request or its
+	// deadline passes, e.g. the deadline of a gRPC call.
+	response_timeout := get_response_timeout(backend_service, request)
+	deadline, has_deadline := request.Context().Deadline()
+	waiting_since := time.Now()
+	wait_span := get_span(request).StartChild("wait for "+get_service_name(service_type)+" response", tracing.Kind_internal)
+	result, err := response_waiters.wait(request.Context(), message_id, response_channel, response_timeout)
+	wait_span.EndWithError(err)
+	mux.metrics.response_wait_duration.ObserveSince(waiting_since, service_id)
 
 	// Send response to user
-	if exists {
-		writer.Write(result.([]byte))
+	if err == nil {
+		guard.circuit_breaker.record_success()
+		write_response(writer, result, mapper)
+	} else if has_deadline && !time.Now().Before(deadline) {
+		// The backend service is not at fault if the user asked for a shorter wait
+		guard.circuit_breaker.record_cancelled()
+		write_problem(writer, responses.Error_code_service_timeout, "Deadline exceeded before response from backend service")
+	} else if errors.Is(err, context.DeadlineExceeded) {
+		guard.circuit_breaker.record_failure()
+		mux.metrics.response_timeouts.Inc(service_id)
+		write_problem(writer, responses.Error_code_service_timeout, "No response from backend service")
 	} else {
-		writer.WriteHeader(http.StatusRequestTimeout)
+		// Nothing to send if the user cancelled the request
+		guard.circuit_breaker.record_cancelled()
 	}
 }
 
 func (mux *http_request_multiplexer) POST_Deposit(input *paths.MatchResult, writer http.ResponseWriter, request *http.Request) {
+	body := messages.POST_Deposit{}
+	if !read_body(writer, request, &body) {
+		return
+	}
+	mux.deposit(input.WildcardSegments["wallet_id"], &body, nil, writer, request)
+}
 
-	// Extract body of message
-	if request.ContentLength <= 0 {
-		writer.WriteHeader(http.StatusBadRequest)
+// Shared by every version of the API
+func (mux *http_request_multiplexer) deposit(
+	wallet_id string,
+	body *messages.POST_Deposit,
+	mapper response_mapper,
+	writer http.ResponseWriter,
+	request *http.Request) {
+
+	// Verify that input is correct. Basic checks only due to time limit.
+	if len(wallet_id) == 0 {
+		write_problem(writer, responses.Error_code_invalid_request, "Missing wallet ID")
 		return
 	}
-	bytes := make([]byte, request.ContentLength)
-	_, err := request.Body.Read(bytes)
-	if err != nil && !errors.Is(err, io.EOF) {
-		writer.WriteHeader(http.StatusInternalServerError)
+	if len(body.Amount) == 0 {
+		write_problem(writer, responses.Error_code_invalid_request, "Missing amount")
 		return
 	}
-	body := messages.POST_Deposit{}
-	err = json.Unmarshal(bytes, &body)
-	if err != nil {
-		writer.WriteHeader(http.StatusBadRequest)
+	if len(body.Currency) == 0 {
+		write_problem(writer, responses.Error_code_invalid_request, "Missing currency")
 		return
 	}
-
-	// Verify that input is correct. Basic checks only due to time limit.
-	wallet_id, exist := input.WildcardSegments["wallet_id"]
-	if !exist {
-		writer.WriteHeader(http.StatusBadRequest)
+	if !is_authorised(request, wallet_id) {
+		write_problem(writer, responses.Error_code_forbidden, "Wallet is not owned by caller")
 		return
 	}
-	if len(wallet_id) == 0 {
-		writer.WriteHeader(http.StatusBadRequest)
+	if !mux.check_rate_limit(
+		"deposits",
+		&mux.get_config().RateLimits.Deposits,
+		&mux.get_config().DepositsService,
+		mux.deposit_requests_queue,
+		wallet_id,
+		writer,
+		request) {
 		return
 	}
-	if len(body.Amount) == 0 {
-		writer.WriteHeader(http.StatusBadRequest)
+
+	idempotency_key, valid := get_idempotency_key(request, request.Header.Get(header_idempotency_key))
+	if !valid {
+		write_problem(writer, responses.Error_code_invalid_request, "Invalid idempotency key")
 		return
 	}
-	if len(body.Currency) == 0 {
-		writer.WriteHeader(http.StatusBadRequest)
+
+	message_id, ok := mux.next_message_id(writer)
+	if !ok {
 		return
 	}
 
+	// Responses to requests sent with Prefer: respond-async are stored in an operation.
+	// The preference is ignored if there is nowhere to store operations.
+	respond_async := prefers_respond_async(request) && mux.operations != nil
+
 	// Prepare redis message
 	body.WalletID = wallet_id
-	body.Header.MessageID = mux.global_id.Add(1)
+	body.Header.MessageID = message_id
+	body.Header.ReplyTo = mux.deposit_reply_queue
+	body.Header.TraceParent = get_trace_parent(request)
+	if respond_async {
+		body.Header.ReplyTo = mux.deposit_operations_queue
+	} else {
+		body.Header.Deadline = get_deadline(&mux.get_config().DepositsService, request)
+	}
 	body.Header.Action = messages.Action_deposit
-	bytes, err = json.Marshal(body)
+	body.Header.IdempotencyKey = idempotency_key
+	bytes, err := json.Marshal(body)
 	if err != nil {
-		writer.WriteHeader(http.StatusInternalServerError)
+		write_problem(writer, responses.Error_code_internal_error, "Unable to serialise request")
+		return
+	}
+
+	if respond_async {
+		mux.send_request_and_accept(
+			service_deposit,
+			body.Header.Action,
+			body.Header.MessageID,
+			bytes,
+			&mux.get_config().DepositsService,
+			mux.deposit_requests_queue,
+			writer,
+			request)
 		return
 	}
 
 	mux.send_request_and_return_response(
+		service_deposit,
 		body.Header.MessageID,
 		bytes,
-		&mux.config.DepositsService,
+		&mux.get_config().DepositsService,
 		mux.deposit_requests_queue,
-		&mux.deposit_responses_cache,
-		writer)
+		mux.deposit_response_waiters,
+		mapper,
+		writer,
+		request)
 }
 
 func (mux *http_request_multiplexer) POST_Withdrawal(input *paths.MatchResult, writer http.ResponseWriter, request *http.Request) {
+	body := messages.POST_Withdraw{}
+	if !read_body(writer, request, &body) {
+		return
+	}
+	mux.withdraw(input.WildcardSegments["wallet_id"], &body, nil, writer, request)
+}
 
-	// Extract body of message
-	if request.ContentLength <= 0 {
-		writer.WriteHeader(http.StatusBadRequest)
+// Shared by every version of the API
+func (mux *http_request_multiplexer) withdraw(
+	wallet_id string,
+	body *messages.POST_Withdraw,
+	mapper response_mapper,
+	writer http.ResponseWriter,
+	request *http.Request) {
+
+	// Verify that input is correct
+	if len(wallet_id) == 0 {
+		write_problem(writer, responses.Error_code_invalid_request, "Missing wallet ID")
 		return
 	}
-	bytes := make([]byte, request.ContentLength)
-	_, err := request.Body.Read(bytes)
-	if err != nil && !errors.Is(err, io.EOF) {
-		writer.WriteHeader(http.StatusInternalServerError)
+	if len(body.Amount) == 0 {
+		write_problem(writer, responses.Error_code_invalid_request, "Missing amount")
 		return
 	}
-	body := messages.POST_Withdraw{}
-	err = json.Unmarshal(bytes, &body)
-	if err != nil {
-		writer.WriteHeader(http.StatusBadRequest)
+	if len(body.Currency) == 0 {
+		write_problem(writer, responses.Error_code_invalid_request, "Missing currency")
 		return
 	}
-
-	// Verify that input is correct
-	wallet_id, exist := input.WildcardSegments["wallet_id"]
-	if !exist {
-		writer.WriteHeader(http.StatusBadRequest)
+	if !is_authorised(request, wallet_id) {
+		write_problem(writer, responses.Error_code_forbidden, "Wallet is not owned by caller")
 		return
 	}
-	if len(wallet_id) == 0 {
-		writer.WriteHeader(http.StatusBadRequest)
+	if !mux.check_rate_limit(
+		"withdrawals",
+		&mux.get_config().RateLimits.Withdrawals,
+		&mux.get_config().WithdrawalService,
+		mux.withdrawal_requests_queue,
+		wallet_id,
+		writer,
+		request) {
 		return
 	}
-	if len(body.Amount) == 0 {
-		writer.WriteHeader(http.StatusBadRequest)
+
+	idempotency_key, valid := get_idempotency_key(request, request.Header.Get(header_idempotency_key))
+	if !valid {
+		write_problem(writer, responses.Error_code_invalid_request, "Invalid idempotency key")
 		return
 	}
-	if len(body.Currency) == 0 {
-		writer.WriteHeader(http.StatusBadRequest)
+
+	message_id, ok := mux.next_message_id(writer)
+	if !ok {
 		return
 	}
 
+	// Responses to requests sent with Prefer: respond-async are stored in an operation.
+	// The preference is ignored if there is nowhere to store operations.
+	respond_async := prefers_respond_async(request) && mux.operations != nil
+
 	// Prepare redis message
 	body.WalletID = wallet_id
-	body.Header.MessageID = mux.global_id.Add(1)
+	body.Header.MessageID = message_id
+	body.Header.ReplyTo = mux.withdrawal_reply_queue
+	body.Header.TraceParent = get_trace_parent(request)
+	if respond_async {
+		body.Header.ReplyTo = mux.withdrawal_operations_queue
+	} else {
+		body.Header.Deadline = get_deadline(&mux.get_config().WithdrawalService, request)
+	}
 	body.Header.Action = messages.Action_withdraw
-	bytes, err = json.Marshal(body)
+	body.Header.IdempotencyKey = idempotency_key
+	bytes, err := json.Marshal(body)
 	if err != nil {
-		writer.WriteHeader(http.StatusInternalServerError)
+		write_problem(writer, responses.Error_code_internal_error, "Unable to serialise request")
+		return
+	}
+
+	if respond_async {
+		mux.send_request_and_accept(
+			service_withdraw,
+			body.Header.Action,
+			body.Header.MessageID,
+			bytes,
+			&mux.get_config().WithdrawalService,
+			mux.withdrawal_requests_queue,
+			writer,
+			request)
 		return
 	}
 
 	mux.send_request_and_return_response(
+		service_withdraw,
 		body.Header.MessageID,
 		bytes,
-		&mux.config.WithdrawalService,
+		&mux.get_config().WithdrawalService,
 		mux.withdrawal_requests_queue,
-		&mux.withdrawal_responses_cache,
-		writer)
+		mux.withdrawal_response_waiters,
+		mapper,
+		writer,
+		request)
 }
 
 func (mux *http_request_multiplexer) POST_Transfer(input *paths.MatchResult, writer http.ResponseWriter, request *http.Request) {
-
-	// Extract body of message
-	if request.ContentLength <= 0 {
-		writer.WriteHeader(http.StatusBadRequest)
-		return
-	}
-	bytes := make([]byte, request.ContentLength)
-	_, err := request.Body.Read(bytes)
-	if err != nil && !errors.Is(err, io.EOF) {
-		writer.WriteHeader(http.StatusInternalServerError)
-		return
-	}
 	body := messages.POST_Transfer{}
-	err = json.Unmarshal(bytes, &body)
-	if err != nil {
-		writer.WriteHeader(http.StatusBadRequest)
+	if !read_body(writer, request, &body) {
 		return
 	}
+	mux.transfer(&body, nil, writer, request)
+}
+
+// Shared by every version of the API
+func (mux *http_request_multiplexer) transfer(
+	body *messages.POST_Transfer,
+	mapper response_mapper,
+	writer http.ResponseWriter,
+	request *http.Request) {
 
 	// Verify that input is correct
 	if len(body.SourceWalletID) == 0 {
-		writer.WriteHeader(http.StatusBadRequest)
+		write_problem(writer, responses.Error_code_invalid_request, "Missing source wallet ID")
 		return
 	}
 	if len(body.DestinationWalletID) == 0 {
-		writer.WriteHeader(http.StatusBadRequest)
+		write_problem(writer, responses.Error_code_invalid_request, "Missing destination wallet ID")
 		return
 	}
 	if len(body.Amount) == 0 {
-		writer.WriteHeader(http.StatusBadRequest)
+		write_problem(writer, responses.Error_code_invalid_request, "Missing amount")
 		return
 	}
 	if len(body.Currency) == 0 {
-		writer.WriteHeader(http.StatusBadRequest)
+		write_problem(writer, responses.Error_code_invalid_request, "Missing currency")
+		return
+	}
+
+	// Money can be transferred to any wallet but only from a wallet owned by the caller
+	if !is_authorised(request, body.SourceWalletID) {
+		write_problem(writer, responses.Error_code_forbidden, "Wallet is not owned by caller")
+		return
+	}
+	if !mux.check_rate_limit(
+		"transfer",
+		&mux.get_config().RateLimits.Transfer,
+		&mux.get_config().TransferService,
+		mux.transfer_requests_queue,
+		body.SourceWalletID,
+		writer,
+		request) {
 		return
 	}
 
+	idempotency_key, valid := get_idempotency_key(request, request.Header.Get(header_idempotency_key))
+	if !valid {
+		write_problem(writer, responses.Error_code_invalid_request, "Invalid idempotency key")
+		return
+	}
+
+	message_id, ok := mux.next_message_id(writer)
+	if !ok {
+		return
+	}
+
+	// Responses to requests sent with Prefer: respond-async are stored in an operation.
+	// The preference is ignored if there is nowhere to store operations.
+	respond_async := prefers_respond_async(request) && mux.operations != nil
+
 	// Prepare redis message
-	body.Header.MessageID = mux.global_id.Add(1)
+	body.Header.MessageID = message_id
+	body.Header.ReplyTo = mux.transfer_reply_queue
+	body.Header.TraceParent = get_trace_parent(request)
+	if respond_async {
+		body.Header.ReplyTo = mux.transfer_operations_queue
+	} else {
+		body.Header.Deadline = get_deadline(&mux.get_config().TransferService, request)
+	}
 	body.Header.Action = messages.Action_transfer
-	bytes, err = json.Marshal(body)
+	body.Header.IdempotencyKey = idempotency_key
+	bytes, err := json.Marshal(body)
 	if err != nil {
-		writer.WriteHeader(http.StatusInternalServerError)
+		write_problem(writer, responses.Error_code_internal_error, "Unable to serialise request")
+		return
+	}
+
+	if respond_async {
+		mux.send_request_and_accept(
+			service_transfer,
+			body.Header.Action,
+			body.Header.MessageID,
+			bytes,
+			&mux.get_config().TransferService,
+			mux.transfer_requests_queue,
+			writer,
+			request)
 		return
 	}
 
 	mux.send_request_and_return_response(
+		service_transfer,
 		body.Header.MessageID,
 		bytes,
-		&mux.config.TransferService,
+		&mux.get_config().TransferService,
 		mux.transfer_requests_queue,
-		&mux.transfer_responses_cache,
-		writer)
+		mux.transfer_response_waiters,
+		mapper,
+		writer,
+		request)
 
 }
 
 func (mux *http_request_multiplexer) POST_Test(input *paths.MatchResult, writer http.ResponseWriter, request *http.Request) {
 
 	// Extract body of message
-	if request.ContentLength <= 0 {
-		writer.WriteHeader(http.StatusBadRequest)
+	body := messages.GET_Balance{}
+	if !read_body(writer, request, &body) {
 		return
 	}
-	bytes := make([]byte, request.ContentLength)
-	_, err := request.Body.Read(bytes)
-	if err != nil && !errors.Is(err, io.EOF) {
-		writer.WriteHeader(http.StatusInternalServerError)
+	if !is_authorised(request, body.WalletID) {
+		write_problem(writer, responses.Error_code_forbidden, "Wallet is not owned by caller")
 		return
 	}
-	body := messages.GET_Balance{}
-	err = json.Unmarshal(bytes, &body)
-	if err != nil {
-		writer.WriteHeader(http.StatusBadRequest)
+
+	message_id, ok := mux.next_message_id(writer)
+	if !ok {
 		return
 	}
 
 	// Prepare redis message
-	body.Header.MessageID = mux.global_id.Add(1)
+	body.Header.MessageID = message_id
+	body.Header.ReplyTo = mux.balance_reply_queue
+	body.Header.TraceParent = get_trace_parent(request)
+	body.Header.Deadline = get_deadline(&mux.get_config().BalanceService, request)
 	body.Header.Action = messages.Action_get_balance
-	bytes, err = json.Marshal(body)
+	bytes, err := json.Marshal(body)
 	if err != nil {
-		writer.WriteHeader(http.StatusInternalServerError)
+		write_problem(writer, responses.Error_code_internal_error, "Unable to serialise request")
 		return
 	}
 
 	mux.send_request_and_return_response(
+		service_balance,
 		body.Header.MessageID,
 		bytes,
-		&mux.config.BalanceService,
+		&mux.get_config().BalanceService,
 		mux.balance_requests_queue,
-		&mux.balance_responses_cache,
-		writer)
+		mux.balance_response_waiters,
+		nil,
+		writer,
+		request)
 }
 
 func (mux *http_request_multiplexer) GET_WalletBalance(input *paths.MatchResult, writer http.ResponseWriter, request *http.Request) {
+	mux.get_balance(input.WildcardSegments["wallet_id"], nil, writer, request)
+}
+
+// Shared by every version of the API
+func (mux *http_request_multiplexer) get_balance(
+	wallet_id string,
+	mapper response_mapper,
+	writer http.ResponseWriter,
+	request *http.Request) {
 
 	// Verify that input is correct
-	wallet_id, exist := input.WildcardSegments["wallet_id"]
-	if !exist {
-		writer.WriteHeader(http.StatusBadRequest)
+	if len(wallet_id) == 0 {
+		write_problem(writer, responses.Error_code_invalid_request, "Missing wallet ID")
 		return
 	}
-	if len(wallet_id) == 0 {
-		writer.WriteHeader(http.StatusBadRequest)
+	if !is_authorised(request, wallet_id) {
+		write_problem(writer, responses.Error_code_forbidden, "Wallet is not owned by caller")
+		return
+	}
+	if !mux.check_rate_limit(
+		"balance",
+		&mux.get_config().RateLimits.Balance,
+		&mux.get_config().BalanceService,
+		mux.balance_requests_queue,
+		wallet_id,
+		writer,
+		request) {
+		return
+	}
+
+	message_id, ok := mux.next_message_id(writer)
+	if !ok {
 		return
 	}
 
 	// Prepare redis message
 	request_message := messages.GET_Balance{
 		Header: messages.Header{
-			MessageID: mux.global_id.Add(1),
-			Action:    messages.Action_get_balance,
+			MessageID:   message_id,
+			ReplyTo:     mux.balance_reply_queue,
+			TraceParent: get_trace_parent(request),
+			Deadline:    get_deadline(&mux.get_config().BalanceService, request),
+			Action:      messages.Action_get_balance,
 		},
 		WalletID: wallet_id,
 	}
 	bytes, err := json.Marshal(request_message)
 	if err != nil {
-		writer.WriteHeader(http.StatusInternalServerError)
+		write_problem(writer, responses.Error_code_internal_error, "Unable to serialise request")
 		return
 	}
 
 	mux.send_request_and_return_response(
+		service_balance,
 		request_message.Header.MessageID,
 		bytes,
-		&mux.config.BalanceService,
+		&mux.get_config().BalanceService,
 		mux.balance_requests_queue,
-		&mux.balance_responses_cache,
-		writer)
+		mux.balance_response_waiters,
+		mapper,
+		writer,
+		request)
 
 }
 
 func (mux *http_request_multiplexer) GET_TransactionHistory(input *paths.MatchResult, writer http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+	mux.get_transaction_history(input.WildcardSegments["wallet_id"], query.Get("from"), query.Get("to"), nil, writer, request)
+}
+
+// Shared by every version of the API. Dates are YYYYMMDD.
+func (mux *http_request_multiplexer) get_transaction_history(
+	wallet_id string,
+	from string,
+	to string,
+	mapper response_mapper,
+	writer http.ResponseWriter,
+	request *http.Request) {
 
 	// Verify that input is correct
-	wallet_id, exist := input.WildcardSegments["wallet_id"]
-	if !exist {
-		writer.WriteHeader(http.StatusBadRequest)
+	if len(wallet_id) == 0 {
+		write_problem(writer, responses.Error_code_invalid_request, "Missing wallet ID")
 		return
 	}
-	if len(wallet_id) == 0 {
-		writer.WriteHeader(http.StatusBadRequest)
+	if !is_authorised(request, wallet_id) {
+		write_problem(writer, responses.Error_code_forbidden, "Wallet is not owned by caller")
 		return
 	}
-	from_slice := request.URL.Query()["from"]
-	from := ""
-	if len(from_slice) > 0 {
-		from = from_slice[0]
+	if !mux.check_rate_limit(
+		"transaction_history",
+		&mux.get_config().RateLimits.TransactionHistory,
+		&mux.get_config().TransactionHistoryService,
+		mux.transaction_history_requests_queue,
+		wallet_id,
+		writer,
+		request) {
+		return
 	}
-	to_slice := request.URL.Query()["to"]
-	to := ""
-	if len(to_slice) > 0 {
-		to = to_slice[0]
+
+	message_id, ok := mux.next_message_id(writer)
+	if !ok {
+		return
 	}
 
 	// Prepare redis message
 	request_message := messages.GET_TransactionHistory{
 		Header: messages.Header{
-			MessageID: mux.global_id.Add(1),
-			Action:    messages.Action_get_transaction_history,
+			MessageID:   message_id,
+			ReplyTo:     mux.transaction_history_reply_queue,
+			TraceParent: get_trace_parent(request),
+			Deadline:    get_deadline(&mux.get_config().TransactionHistoryService, request),
+			Action:      messages.Action_get_transaction_history,
 		},
 		WalletID: wallet_id,
 		From:     from,
@@ -381,114 +836,259 @@ func (mux *http_request_multiplexer) GET_TransactionHistory(input *paths.MatchRe
 	}
 	bytes, err := json.Marshal(request_message)
 	if err != nil {
-		writer.WriteHeader(http.StatusInternalServerError)
+		write_problem(writer, responses.Error_code_internal_error, "Unable to serialise request")
 		return
 	}
 
 	mux.send_request_and_return_response(
+		service_transaction_history,
 		request_message.Header.MessageID,
 		bytes,
-		&mux.config.TransactionHistoryService,
+		&mux.get_config().TransactionHistoryService,
 		mux.transaction_history_requests_queue,
-		&mux.transaction_history_responses_cache,
-		writer)
+		mux.transaction_history_response_waiters,
+		mapper,
+		writer,
+		request)
 
 }
 
-func (mux *http_request_multiplexer) GET_Test(input *paths.MatchResult, writer http.ResponseWriter, request *http.Request) {
+// Reports what happened to a deposit, withdrawal or transfer sent with an idempotency
+// key. Answered by the transaction history service.
+func (mux *http_request_multiplexer) GET_IdempotencyKey(input *paths.MatchResult, writer http.ResponseWriter, request *http.Request) {
+	mux.look_up_idempotency_key(input.WildcardSegments["idempotency_key"], nil, writer, request)
+}
 
-	// Log content of request
-	log.Println("Method: ", request.Method)
-	log.Println("Scheme: ", request.URL.Scheme)
-	log.Println("Host: ", request.URL.Host)
-	log.Println("Path: ", request.URL.Path)
-	log.Println("Header: ", request.Header)
+// Shared by every version of the API
+func (mux *http_request_multiplexer) look_up_idempotency_key(
+	key string,
+	mapper response_mapper,
+	writer http.ResponseWriter,
+	request *http.Request) {
 
-	// Prepare test GET request
-	request_message := messages.GET_Balance{
+	// Verify that input is correct
+	if len(key) == 0 {
+		write_problem(writer, responses.Error_code_invalid_request, "Missing idempotency key")
+		return
+	}
+	idempotency_key, valid := get_idempotency_key(request, key)
+	if !valid {
+		write_problem(writer, responses.Error_code_invalid_request, "Invalid idempotency key")
+		return
+	}
+
+	message_id, ok := mux.next_message_id(writer)
+	if !ok {
+		return
+	}
+
+	// Prepare redis message
+	request_message := messages.GET_IdempotencyKey{
 		Header: messages.Header{
-			MessageID: mux.global_id.Add(1),
-			Action:    messages.Action_get_balance,
+			MessageID:   message_id,
+			ReplyTo:     mux.transaction_history_reply_queue,
+			TraceParent: get_trace_parent(request),
+			Deadline:    get_deadline(&mux.get_config().TransactionHistoryService, request),
+			Action:      messages.Action_get_idempotency_key,
 		},
+		IdempotencyKey: idempotency_key,
 	}
 	bytes, err := json.Marshal(request_message)
 	if err != nil {
-		writer.WriteHeader(http.StatusInternalServerError)
+		write_problem(writer, responses.Error_code_internal_error, "Unable to serialise request")
 		return
 	}
 
 	mux.send_request_and_return_response(
+		service_transaction_history,
 		request_message.Header.MessageID,
 		bytes,
-		&mux.config.BalanceService,
-		mux.balance_requests_queue,
-		&mux.balance_responses_cache,
-		writer)
+		&mux.get_config().TransactionHistoryService,
+		mux.transaction_history_requests_queue,
+		mux.transaction_history_response_waiters,
+		mapper,
+		writer,
+		request)
 }
 
-func (mux *http_request_multiplexer) ProcessGETRequests(writer http.ResponseWriter, request *http.Request) {
+func (mux *http_request_multiplexer) GET_Test(input *paths.MatchResult, writer http.ResponseWriter, request *http.Request) {
 
-	// Request for balance
-	result := paths.MatchAndExtract(request.URL.Path, paths.Wallets_balance)
-	if result.MatchFound {
-		mux.GET_WalletBalance(result, writer, request)
-		return
-	}
+	// Headers are not logged, since they carry the credentials of the caller
+	slog.Debug("Received test request", "method", request.Method, "scheme", request.URL.Scheme, "host", request.URL.Host, "path", request.URL.Path)
 
-	// Request for transaction history
-	result = paths.MatchAndExtract(request.URL.Path, paths.Wallets_transaction_history)
-	if result.MatchFound {
-		mux.GET_TransactionHistory(result, writer, request)
+	message_id, ok := mux.next_message_id(writer)
+	if !ok {
 		return
 	}
 
-	// Test GET request
-	result = paths.MatchAndExtract(request.URL.Path, paths.Test)
-	if result.MatchFound {
-		mux.GET_Test(result, writer, request)
+	// Prepare test GET request
+	request_message := messages.GET_Balance{
+		Header: messages.Header{
+			MessageID:   message_id,
+			ReplyTo:     mux.balance_reply_queue,
+			TraceParent: get_trace_parent(request),
+			Deadline:    get_deadline(&mux.get_config().BalanceService, request),
+			Action:      messages.Action_get_balance,
+		},
+	}
+	bytes, err := json.Marshal(request_message)
+	if err != nil {
+		write_problem(writer, responses.Error_code_internal_error, "Unable to serialise request")
 		return
 	}
+
+	mux.send_request_and_return_response(
+		service_balance,
+		request_message.Header.MessageID,
+		bytes,
+		&mux.get_config().BalanceService,
+		mux.balance_requests_queue,
+		mux.balance_response_waiters,
+		nil,
+		writer,
+		request)
 }
 
-func (mux *http_request_multiplexer) ProcessPOSTRequests(writer http.ResponseWriter, request *http.Request) {
+// Routes served by the API gateway
+func (mux *http_request_multiplexer) create_router() *paths.Router {
+	router := paths.CreateRouter()
 
-	// Deposit money into wallet
-	result := paths.MatchAndExtract(request.URL.Path, paths.Wallets_deposits)
-	if result.MatchFound {
-		mux.POST_Deposit(result, writer, request)
-		return
-	}
+	// Routes without a version prefix pass on the messages of the backend services as
+	// they are. Kept for older clients until they move to /v1.
+	unversioned := api_version_unversioned
+	mux.handle_versioned(router, unversioned, http.MethodPost, paths.Wallets_deposits, mux.POST_Deposit)
+	mux.handle_versioned(router, unversioned, http.MethodPost, paths.Wallets_withdrawals, mux.POST_Withdrawal)
+	mux.handle_versioned(router, unversioned, http.MethodPost, paths.Transfer, mux.POST_Transfer)
+	mux.handle_versioned(router, unversioned, http.MethodPost, paths.Batch, mux.POST_Batch)
+	mux.handle_versioned(router, unversioned, http.MethodGet, paths.Wallets_balance, mux.GET_WalletBalance)
+	mux.handle_versioned(router, unversioned, http.MethodGet, paths.Wallets_transaction_history, mux.GET_TransactionHistory)
+	mux.handle_versioned(router, unversioned, http.MethodGet, paths.Wallets_events, mux.GET_WalletEvents)
+	mux.handle_versioned(router, unversioned, http.MethodGet, paths.Idempotency_keys, mux.GET_IdempotencyKey)
+	mux.handle_versioned(router, unversioned, http.MethodPost, paths.Webhooks, mux.POST_Webhook)
+	mux.handle_versioned(router, unversioned, http.MethodGet, paths.Webhooks, mux.GET_Webhooks)
+	mux.handle_versioned(router, unversioned, http.MethodDelete, paths.Webhook, mux.DELETE_Webhook)
+	mux.handle_versioned(router, unversioned, http.MethodGet, paths.Webhook_deliveries, mux.GET_WebhookDeliveries)
+	mux.handle_versioned(router, unversioned, http.MethodPost, paths.Webhook_redelivery, mux.POST_WebhookRedelivery)
+	mux.handle_versioned(router, unversioned, http.MethodGet, paths.Operation, mux.GET_Operation)
 
-	// Withdraw money from wallet
-	result = paths.MatchAndExtract(request.URL.Path, paths.Wallets_withdrawals)
-	if result.MatchFound {
-		mux.POST_Withdrawal(result, writer, request)
-		return
-	}
+	// Version 1 of the public API. Events of the live feed are already public, so they
+	// are the same in every version.
+	mux.handle_versioned(router, api_version_1, http.MethodPost, paths.Wallets_deposits, mux.POST_DepositV1)
+	mux.handle_versioned(router, api_version_1, http.MethodPost, paths.Wallets_withdrawals, mux.POST_WithdrawalV1)
+	mux.handle_versioned(router, api_version_1, http.MethodPost, paths.Transfer, mux.POST_TransferV1)
+	mux.handle_versioned(router, api_version_1, http.MethodPost, paths.Batch, mux.POST_BatchV1)
+	mux.handle_versioned(router, api_version_1, http.MethodGet, paths.Wallets_balance, mux.GET_WalletBalanceV1)
+	mux.handle_versioned(router, api_version_1, http.MethodGet, paths.Wallets_transaction_history, mux.GET_TransactionHistoryV1)
+	mux.handle_versioned(router, api_version_1, http.MethodGet, paths.Wallets_events, mux.GET_WalletEvents)
+	mux.handle_versioned(router, api_version_1, http.MethodGet, paths.Idempotency_keys, mux.GET_IdempotencyKeyV1)
+	mux.handle_versioned(router, api_version_1, http.MethodPost, paths.Webhooks, mux.POST_WebhookV1)
+	mux.handle_versioned(router, api_version_1, http.MethodGet, paths.Webhooks, mux.GET_WebhooksV1)
+	mux.handle_versioned(router, api_version_1, http.MethodDelete, paths.Webhook, mux.DELETE_WebhookV1)
+	mux.handle_versioned(router, api_version_1, http.MethodGet, paths.Webhook_deliveries, mux.GET_WebhookDeliveriesV1)
+	mux.handle_versioned(router, api_version_1, http.MethodPost, paths.Webhook_redelivery, mux.POST_WebhookRedeliveryV1)
+	mux.handle_versioned(router, api_version_1, http.MethodGet, paths.Operation, mux.GET_Operation)
+
+	// Not part of the public API
+	router.Handle(http.MethodGet, paths.Test, mux.GET_Test)
+	router.Handle(http.MethodPost, paths.Test, mux.POST_Test)
+	router.Handle(http.MethodGet, paths.Admin_config, mux.GET_AdminConfig)
+	return router
+}
+
+// A new goroutine is created to serve each HTTP request
+// The API gateway is alive as long as it serves HTTP requests
+func (mux *http_request_multiplexer) GET_Healthz(input *paths.MatchResult, writer http.ResponseWriter, request *http.Request) {
+	write_health_status(writer, &health_status{Status: health_status_ok}, http.StatusOK)
+}
 
-	// Transfer money from one wallet to another
-	result = paths.MatchAndExtract(request.URL.Path, paths.Transfer)
-	if result.MatchFound {
-		mux.POST_Transfer(result, writer, request)
+// The API gateway is ready if it can pass requests to and responses from every backend
+// service. Load balancers should stop sending requests to it otherwise.
+func (mux *http_request_multiplexer) GET_Readyz(input *paths.MatchResult, writer http.ResponseWriter, request *http.Request) {
+	status, is_ready := mux.health_checker.check_readiness()
+	if !is_ready {
+		write_health_status(writer, status, http.StatusServiceUnavailable)
 		return
 	}
+	write_health_status(writer, status, http.StatusOK)
+}
 
-	// Test POST request
-	result = paths.MatchAndExtract(request.URL.Path, paths.Test)
-	if result.MatchFound {
-		mux.POST_Test(result, writer, request)
-		return
+// Serves metrics in the Prometheus text format
+func (mux *http_request_multiplexer) GET_Metrics(input *paths.MatchResult, writer http.ResponseWriter, request *http.Request) {
+	mux.metrics.response_waiters.Set(float64(mux.balance_response_waiters.size()), get_service_id(service_balance))
+	mux.metrics.response_waiters.Set(float64(mux.deposit_response_waiters.size()), get_service_id(service_deposit))
+	mux.metrics.response_waiters.Set(float64(mux.transaction_history_response_waiters.size()), get_service_id(service_transaction_history))
+	mux.metrics.response_waiters.Set(float64(mux.transfer_response_waiters.size()), get_service_id(service_transfer))
+	mux.metrics.response_waiters.Set(float64(mux.withdrawal_response_waiters.size()), get_service_id(service_withdraw))
+	mux.metrics.response_waiters.Set(float64(mux.webhook_response_waiters.size()), get_service_id(service_webhook))
+	mux.metrics.websocket_connections.Set(float64(mux.wallet_feed.size()))
+	for service_type, guard := range mux.service_guards {
+		mux.metrics.circuit_breaker_state.Set(float64(guard.circuit_breaker.get_state()), get_service_id(service_type))
+		mux.metrics.bulkhead_in_use.Set(float64(guard.bulkhead.size()), get_service_id(service_type))
 	}
+	mux.metrics.registry.ServeHTTP(writer, request)
+}
 
+func (mux *http_request_multiplexer) create_public_router() *paths.Router {
+	router := paths.CreateRouter()
+	router.Handle(http.MethodGet, paths.Healthz, mux.GET_Healthz)
+	router.Handle(http.MethodGet, paths.Readyz, mux.GET_Readyz)
+	router.Handle(http.MethodGet, paths.Metrics, mux.GET_Metrics)
+	return router
 }
 
-// A new goroutine is created to serve each HTTP request
 func (mux *http_request_multiplexer) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
-	if request.Method == http.MethodGet {
-		mux.ProcessGETRequests(writer, request)
-	} else if request.Method == http.MethodPost {
-		mux.ProcessPOSTRequests(writer, request)
-	} else {
-		writer.WriteHeader(http.StatusMethodNotAllowed)
+	started_at := time.Now()
+	span := mux.tracer.StartSpan(request.Method, tracing.Kind_server, request.Header.Get(tracing.Header_traceparent))
+	request_log_ := &request_log{}
+	request = with_request_log(with_span(request, span), request_log_)
+	recorder := &status_recorder{ResponseWriter: writer, status: http.StatusOK}
+	route := mux.serve_http(recorder, request)
+	mux.metrics.count_request(route, request.Method, recorder.status)
+	end_request_span(span, request, route, recorder.status)
+	request_log_.write(request, route, recorder.status, started_at)
+}
+
+// Returns the pattern of the route matched by the request
+func (mux *http_request_multiplexer) serve_http(writer http.ResponseWriter, request *http.Request) string {
+
+	// Load balancers and orchestrators check the health of the API gateway without credentials
+	handler, input, allowed_methods := mux.public_router.Match(request.Method, request.URL.EscapedPath())
+	if handler != nil {
+		handler(input, writer, request)
+		return input.Pattern
+	}
+	if len(allowed_methods) > 0 {
+		writer.Header().Set("Allow", strings.Join(allowed_methods, ", "))
+		write_problem(writer, responses.Error_code_method_not_allowed, "Method "+request.Method+" is not allowed")
+		return input.Pattern
+	}
+
+	// Routes are looked up before authentication, so that rejected requests are counted
+	// under the route they were meant for
+	handler, input, allowed_methods = mux.router.Match(request.Method, request.URL.EscapedPath())
+	route := input.Pattern
+	if len(route) == 0 {
+		route = route_unmatched
+	}
+
+	// Every caller must be authenticated before anything is put on a requests queue
+	caller_, err := mux.active_config.Load().authenticator.authenticate(request)
+	if err != nil {
+		writer.Header().Set("WWW-Authenticate", "Bearer")
+		write_problem(writer, responses.Error_code_unauthenticated, err.Error())
+		return route
+	}
+	request = with_caller(request, caller_)
+
+	if handler == nil {
+		if len(allowed_methods) > 0 {
+			writer.Header().Set("Allow", strings.Join(allowed_methods, ", "))
+			write_problem(writer, responses.Error_code_method_not_allowed, "Method "+request.Method+" is not allowed")
+			return route
+		}
+		write_problem(writer, responses.Error_code_route_not_found, "No route matches "+request.URL.Path)
+		return route
 	}
+	handler(input, writer, request)
+	return route
 }
@@ -0,0 +1,91 @@
+package implementation
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"shared/logging"
+	"shared/messages"
+	"time"
+)
+
+/*
+Every request is logged once when it has been handled, with its route, status and
+duration. Requests sent to a backend service also carry the ID, action, wallet IDs and
+amount of the message, so that they can be joined with the log lines of the backend
+service on message_id.
+*/
+type request_log struct {
+	attributes []any
+}
+
+type request_log_context_key struct{}
+
+// Returns nil if the request is not logged, e.g. in unit tests calling handlers directly
+func get_request_log(request *http.Request) *request_log {
+	request_log_, _ := request.Context().Value(request_log_context_key{}).(*request_log)
+	return request_log_
+}
+
+func with_request_log(request *http.Request, request_log_ *request_log) *http.Request {
+	return request.WithContext(context.WithValue(request.Context(), request_log_context_key{}, request_log_))
+}
+
+// Fields logged of messages to backend services. Fields which a message does not have
+// are left empty.
+type logged_message struct {
+	Header              messages.Header `json:"header"`
+	WalletID            string          `json:"wallet_id"`
+	SourceWalletID      string          `json:"source_wallet_id"`
+	DestinationWalletID string          `json:"destination_wallet_id"`
+	Amount              string          `json:"amount"`
+}
+
+// Adds the attributes of the message sent for the request
+func (request_log_ *request_log) set_message(bytes_sent []byte) {
+	if request_log_ == nil {
+		return
+	}
+	message := logged_message{}
+	err := json.Unmarshal(bytes_sent, &message)
+	if err != nil {
+		return
+	}
+	request_log_.attributes = []any{
+		logging.Key_message_id, message.Header.MessageID,
+		logging.Key_action, messages.GetActionName(message.Header.Action),
+	}
+	fields := []struct {
+		key   string
+		value string
+	}{
+		{logging.Key_wallet_id, message.WalletID},
+		{logging.Key_source_wallet_id, message.SourceWalletID},
+		{logging.Key_destination_wallet_id, message.DestinationWalletID},
+		{logging.Key_amount, message.Amount},
+	}
+	for _, field := range fields {
+		if len(field.value) > 0 {
+			request_log_.attributes = append(request_log_.attributes, field.key, field.value)
+		}
+	}
+}
+
+// Server errors are logged as errors
+func (request_log_ *request_log) write(request *http.Request, route string, status int, started_at time.Time) {
+	attributes := []any{
+		"method", request.Method,
+		"route", route,
+		logging.Key_status, status,
+		logging.Duration(started_at),
+	}
+	if request_log_ != nil {
+		attributes = append(attributes, request_log_.attributes...)
+	}
+	level := slog.LevelInfo
+	if status >= http.StatusInternalServerError {
+		level = slog.LevelError
+	}
+	slog.Log(context.Background(), level, "Handled request", attributes...)
+}
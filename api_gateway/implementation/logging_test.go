@@ -0,0 +1,64 @@
+package implementation
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"shared/logging"
+	"shared/messages"
+	"testing"
+	"time"
+)
+
+func Test_RequestLog(t *testing.T) {
+	default_logger := slog.Default()
+	defer slog.SetDefault(default_logger)
+	buffer := bytes.Buffer{}
+	slog.SetDefault(slog.New(logging.CreateHandler(&buffer, slog.LevelInfo)))
+
+	// Attributes of the message sent to the backend service are logged with the request
+	bytes_sent, err := json.Marshal(&messages.POST_Transfer{
+		Header:              messages.Header{MessageID: 1021, Action: messages.Action_transfer},
+		SourceWalletID:      "wallet_1",
+		DestinationWalletID: "wallet_2",
+		Amount:              "10.00",
+		Currency:            "SGD",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	request_log_ := &request_log{}
+	request := with_request_log(httptest.NewRequest(http.MethodPost, "/v1/transfer", nil), request_log_)
+	get_request_log(request).set_message(bytes_sent)
+	request_log_.write(request, "/v1/transfer", http.StatusServiceUnavailable, time.Now())
+
+	line := map[string]any{}
+	err = json.Unmarshal(buffer.Bytes(), &line)
+	if err != nil {
+		t.Fatal(err, " ", buffer.String())
+	}
+	expected := map[string]any{
+		"level":                           "ERROR",
+		"msg":                             "Handled request",
+		"route":                           "/v1/transfer",
+		logging.Key_status:                float64(http.StatusServiceUnavailable),
+		logging.Key_message_id:            float64(1021),
+		logging.Key_action:                "transfer",
+		logging.Key_source_wallet_id:      "wallet_1",
+		logging.Key_destination_wallet_id: "wallet_2",
+		logging.Key_amount:                logging.Redacted,
+	}
+	for key, value := range expected {
+		if line[key] != value {
+			t.Error("Expected: ", value, ", Got: ", line[key], " for ", key)
+		}
+	}
+	if _, ok := line[logging.Key_wallet_id]; ok {
+		t.Error("Expected: ", "no wallet_id", ", Got: ", line[logging.Key_wallet_id])
+	}
+
+	// Requests which were not logged are ignored
+	get_request_log(httptest.NewRequest(http.MethodGet, "/health", nil)).set_message(bytes_sent)
+}
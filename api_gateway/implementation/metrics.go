@@ -0,0 +1,133 @@
+package implementation
+
+import (
+	"net/http"
+	"shared/metrics"
+	"strconv"
+)
+
+// Route label of requests whose path does not match any route
+const route_unmatched string = "unmatched"
+
+type gateway_metrics struct {
+	registry *metrics.Registry
+
+	// HTTP requests by route, method and HTTP status
+	http_requests *metrics.Counter
+
+	// Time taken to put a request into the requests queue of a backend service
+	queue_push_duration *metrics.Histogram
+
+	// Time from putting a request into the requests queue until its response arrives,
+	// the request times out or the user cancels it
+	response_wait_duration *metrics.Histogram
+
+	// Requests without a response from the backend service in time
+	response_timeouts *metrics.Counter
+
+	// Responses discarded because nobody was waiting for them anymore
+	late_responses *metrics.Counter
+
+	// Responses which are not valid JSON, moved to the dead-letter queue of the backend
+	// service
+	dead_letters *metrics.Counter
+
+	// Requests waiting for a response. Read from the response waiters of each backend
+	// service when the metrics are scraped.
+	response_waiters *metrics.Gauge
+
+	// Requests rejected by the circuit breaker or bulkhead of a backend service
+	rejected_requests *metrics.Counter
+
+	// 0 if closed, 1 if open, 2 if half open. Read when the metrics are scraped.
+	circuit_breaker_state *metrics.Gauge
+
+	// Slots of the bulkhead taken. Read when the metrics are scraped.
+	bulkhead_in_use *metrics.Gauge
+
+	// Clients connected to the live feed of wallet events. Read when the metrics are
+	// scraped.
+	websocket_connections *metrics.Gauge
+}
+
+func create_gateway_metrics() *gateway_metrics {
+	registry := metrics.CreateRegistry()
+	gateway_metrics_ := &gateway_metrics{
+		registry: registry,
+		http_requests: registry.CreateCounter(
+			"api_gateway_http_requests_total",
+			"HTTP requests by route, method and HTTP status.",
+			"route", "method", "status"),
+		queue_push_duration: registry.CreateHistogram(
+			"api_gateway_queue_push_duration_seconds",
+			"Time taken to put a request into the requests queue of a backend service.",
+			metrics.Latency_buckets,
+			"service"),
+		response_wait_duration: registry.CreateHistogram(
+			"api_gateway_response_wait_duration_seconds",
+			"Time from putting a request into the requests queue until its response arrives.",
+			metrics.Latency_buckets,
+			"service"),
+		response_timeouts: registry.CreateCounter(
+			"api_gateway_response_timeouts_total",
+			"Requests without a response from the backend service in time.",
+			"service"),
+		late_responses: registry.CreateCounter(
+			"api_gateway_late_responses_total",
+			"Responses discarded because nobody was waiting for them anymore.",
+			"service"),
+		dead_letters: registry.CreateCounter(
+			"api_gateway_dead_letters_total",
+			"Responses which are not valid JSON, moved to the dead-letter queue of the backend service.",
+			"service"),
+		response_waiters: registry.CreateGauge(
+			"api_gateway_response_waiters",
+			"Requests waiting for a response from a backend service.",
+			"service"),
+		rejected_requests: registry.CreateCounter(
+			"api_gateway_rejected_requests_total",
+			"Requests rejected by the circuit breaker or bulkhead of a backend service.",
+			"service", "reason"),
+		circuit_breaker_state: registry.CreateGauge(
+			"api_gateway_circuit_breaker_state",
+			"State of the circuit breaker of a backend service. 0 if closed, 1 if open, 2 if half open.",
+			"service"),
+		bulkhead_in_use: registry.CreateGauge(
+			"api_gateway_bulkhead_in_use",
+			"Requests holding a slot of the bulkhead of a backend service.",
+			"service"),
+		websocket_connections: registry.CreateGauge(
+			"api_gateway_websocket_connections",
+			"Clients connected to the live feed of wallet events."),
+	}
+	return gateway_metrics_
+}
+
+func (gateway_metrics_ *gateway_metrics) count_request(route string, method string, status int) {
+	gateway_metrics_.http_requests.Inc(route, method, strconv.Itoa(status))
+}
+
+// Records the HTTP status written by a handler
+type status_recorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (recorder *status_recorder) WriteHeader(status int) {
+	recorder.status = status
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+// Lets http.ResponseController reach the underlying response writer
+func (recorder *status_recorder) Unwrap() http.ResponseWriter {
+	return recorder.ResponseWriter
+}
+
+// Records the HTTP status of a response written without the response writer, e.g.
+// after switching to WebSocket
+func record_status(writer http.ResponseWriter, status int) {
+	recorder, ok := writer.(*status_recorder)
+	if ok {
+		recorder.status = status
+	}
+}
@@ -0,0 +1,344 @@
+package implementation
+
+import (
+	"api_gateway/config"
+	"api_gateway/paths"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"shared/logging"
+	"shared/queues"
+	"shared/responses"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+/*
+Deposits, withdrawals and transfers sent with the Prefer header of RFC 7240 are
+answered with 202 Accepted as soon as the request is in the requests queue, instead of
+waiting for the backend service.
+
+	Prefer: respond-async
+
+The caller then polls the operation returned in the body and the Location header until
+it is no longer pending. Operations are kept in Redis, so they can be read from any
+instance of the API gateway and survive restarts.
+*/
+const (
+	header_prefer             string = "Prefer"
+	header_preference_applied string = "Preference-Applied"
+	prefer_respond_async      string = "respond-async"
+)
+
+// Preferences are separated by commas and may have parameters after a semicolon
+func prefers_respond_async(request *http.Request) bool {
+	for _, header := range request.Header.Values(header_prefer) {
+		for _, preference := range strings.Split(header, ",") {
+			token, _, _ := strings.Cut(preference, ";")
+			if strings.EqualFold(strings.TrimSpace(token), prefer_respond_async) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Operations are only returned to the caller who sent the request
+type stored_operation struct {
+	Owner     string              `json:"owner"`
+	Operation responses.Operation `json:"operation"`
+}
+
+func get_operation_key(config *config.Operations, operation_id string) string {
+	return config.KeyPrefix + ":" + operation_id
+}
+
+// Operations are removed once their retention period is over, whether they completed
+// or not
+func create_operation(
+	operations *redis.Client,
+	config *config.Operations,
+	background_context context.Context,
+	operation *stored_operation) error {
+
+	bytes, err := json.Marshal(operation)
+	if err != nil {
+		return err
+	}
+	timeout_context, cancel := context.WithTimeout(background_context, time.Duration(config.Timeout)*time.Second)
+	defer cancel()
+	created, err := operations.SetNX(
+		timeout_context,
+		get_operation_key(config, operation.Operation.OperationID),
+		bytes,
+		time.Duration(config.Retention)*time.Second).Result()
+	if err != nil {
+		return err
+	}
+	if !created {
+		return errors.New("operation " + operation.Operation.OperationID + " already exists")
+	}
+	return nil
+}
+
+// Returns nil if the operation does not exist or has expired
+func load_operation(
+	operations *redis.Client,
+	config *config.Operations,
+	background_context context.Context,
+	operation_id string) (*stored_operation, error) {
+
+	timeout_context, cancel := context.WithTimeout(background_context, time.Duration(config.Timeout)*time.Second)
+	defer cancel()
+	bytes, err := operations.Get(timeout_context, get_operation_key(config, operation_id)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	operation := &stored_operation{}
+	err = json.Unmarshal(bytes, operation)
+	if err != nil {
+		return nil, err
+	}
+	return operation, nil
+}
+
+func delete_operation(
+	operations *redis.Client,
+	config *config.Operations,
+	background_context context.Context,
+	operation_id string) error {
+
+	timeout_context, cancel := context.WithTimeout(background_context, time.Duration(config.Timeout)*time.Second)
+	defer cancel()
+	_, err := operations.Del(timeout_context, get_operation_key(config, operation_id)).Result()
+	return err
+}
+
+// Stores the response of the backend service in its operation. Returns false if the
+// operation has expired. The operation keeps its remaining retention period.
+func complete_operation(
+	operations *redis.Client,
+	config *config.Operations,
+	background_context context.Context,
+	response_message *response_status,
+	response []byte) (bool, error) {
+
+	operation_id := strconv.FormatInt(response_message.Header.MessageID, 10)
+	operation, err := load_operation(operations, config, background_context, operation_id)
+	if err != nil || operation == nil {
+		return false, err
+	}
+
+	operation.Operation.Status = responses.Operation_status_succeeded
+	if response_message.Status == responses.Status_failed {
+		operation.Operation.Status = responses.Operation_status_failed
+	}
+	operation.Operation.CompletedAt = time.Now().UTC().Format(time.RFC3339)
+	operation.Operation.Response = response
+	bytes, err := json.Marshal(operation)
+	if err != nil {
+		return false, err
+	}
+
+	timeout_context, cancel := context.WithTimeout(background_context, time.Duration(config.Timeout)*time.Second)
+	defer cancel()
+	_, err = operations.SetArgs(timeout_context, get_operation_key(config, operation_id), bytes, redis.SetArgs{
+		Mode:    "XX",
+		KeepTTL: true,
+	}).Result()
+	if errors.Is(err, redis.Nil) {
+		// Expired after it was loaded
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Responds with the operation in the body of the version of the API of the request
+func write_operation(writer http.ResponseWriter, request *http.Request, operation *responses.Operation, status_code int) {
+	version := get_api_version(request)
+	var body any = operation
+	if version.map_operation != nil {
+		mapped, err := version.map_operation(operation)
+		if err != nil {
+			write_problem(writer, responses.Error_code_internal_error, "Invalid operation")
+			return
+		}
+		body = mapped
+	}
+	bytes, err := json.Marshal(body)
+	if err != nil {
+		write_problem(writer, responses.Error_code_internal_error, "Unable to serialise response")
+		return
+	}
+	writer.Header().Set("Location", version.prefix+"/operations/"+url.PathEscape(operation.OperationID))
+	writer.Header().Set("Content-Type", content_type_json)
+	writer.WriteHeader(status_code)
+	writer.Write(bytes)
+}
+
+/*
+Puts the request into the requests queue and responds with 202 Accepted and a pending
+operation. The backend service puts its response into the operations queue, from which
+async_complete_operations stores it in the operation.
+
+Only failures to send the request count against the circuit breaker, since nobody waits
+for the response.
+*/
+func (mux *http_request_multiplexer) send_request_and_accept(
+	service_type int,
+	request_action int,
+	message_id int64,
+	bytes_to_send []byte,
+	backend_service *config.Service,
+	requests_queue queues.Transport,
+	writer http.ResponseWriter,
+	request *http.Request) {
+
+	// Define aliases
+	timeout := time.Duration(backend_service.RequestsQueue.Timeout) * time.Second
+	queue_name := backend_service.RequestsQueue.QueueName
+	service_id := get_service_id(service_type)
+	operations_config := &mux.get_config().Operations
+
+	// Fail fast if the backend service is not responding or too busy
+	if !mux.enter_service_guard(service_type, writer) {
+		return
+	}
+	guard := mux.service_guards[service_type]
+	defer guard.bulkhead.release()
+
+	// Store the operation before sending the request. Otherwise the response may
+	// arrive before the operation exists.
+	operation := &stored_operation{
+		Owner: get_caller(request).name,
+		Operation: responses.Operation{
+			OperationID:   strconv.FormatInt(message_id, 10),
+			RequestAction: request_action,
+			Status:        responses.Operation_status_pending,
+			CreatedAt:     time.Now().UTC().Format(time.RFC3339),
+		},
+	}
+	err := create_operation(mux.operations, operations_config, mux.context, operation)
+	if err != nil {
+		slog.Error("Unable to store operation", logging.Key_message_id, message_id, logging.Key_error, err.Error())
+		guard.circuit_breaker.record_cancelled()
+		write_problem(writer, responses.Error_code_service_unavailable, "Unable to store operation")
+		return
+	}
+
+	// Put request in queue
+	get_request_log(request).set_message(bytes_to_send)
+	timeout_context, cancel := context.WithTimeout(mux.context, timeout)
+	pushed_at := time.Now()
+	push_span := get_span(request).StartPushSpan(queue_name)
+	err = requests_queue.PushRequest(timeout_context, queue_name, bytes_to_send)
+	push_span.EndWithError(err)
+	mux.metrics.queue_push_duration.ObserveSince(pushed_at, service_id)
+	cancel()
+	if err != nil {
+		guard.circuit_breaker.record_failure()
+		err = delete_operation(mux.operations, operations_config, mux.context, operation.Operation.OperationID)
+		if err != nil {
+			slog.Error("Unable to delete operation", logging.Key_message_id, message_id, logging.Key_error, err.Error())
+		}
+		write_problem(writer, responses.Error_code_service_unavailable, "Unable to send request to backend service")
+		return
+	}
+	guard.circuit_breaker.record_cancelled()
+
+	writer.Header().Set(header_preference_applied, prefer_respond_async)
+	write_operation(writer, request, &operation.Operation, http.StatusAccepted)
+}
+
+// Routes of every version share this handler. The body depends on the version.
+func (mux *http_request_multiplexer) GET_Operation(input *paths.MatchResult, writer http.ResponseWriter, request *http.Request) {
+	operation_id := input.WildcardSegments["operation_id"]
+	if len(operation_id) == 0 {
+		write_problem(writer, responses.Error_code_invalid_request, "Missing operation ID")
+		return
+	}
+	operation, err := load_operation(mux.operations, &mux.get_config().Operations, mux.context, operation_id)
+	if err != nil {
+		log.Println("Unable to load operation " + operation_id + ": " + err.Error())
+		write_problem(writer, responses.Error_code_service_unavailable, "Unable to load operation")
+		return
+	}
+
+	// Operations of other callers are reported as missing, so that callers cannot
+	// find out about each other's requests
+	caller_ := get_caller(request)
+	if operation == nil || caller_ == nil || operation.Owner != caller_.name {
+		write_problem(writer, responses.Error_code_operation_not_found, "Operation not found")
+		return
+	}
+	write_operation(writer, request, &operation.Operation, http.StatusOK)
+}
+
+// Stores responses to operations accepted by any instance of the API gateway
+func (api_gateway *APIGateway) async_complete_operations(
+	service_type int,
+	responses_queue queues.Transport,
+	operations_queue_name string) {
+
+	service_name := get_service_name(service_type)
+	defer func() {
+		api_gateway.waitgroup.Done()
+		log.Println("Shutdown " + service_name + " operations thread.")
+	}()
+
+	log.Println("Started up " + service_name + " operations thread.")
+
+	mux := api_gateway.http_multiplexer
+	for api_gateway.is_alive.Load() {
+
+		// Timeouts may change when the configuration is reloaded
+		config := mux.get_config()
+		backend_service := get_service_config(config, service_type)
+		timeout := time.Duration(backend_service.ResponsesQueue.Timeout) * time.Second
+
+		timeout_context, cancel := context.WithTimeout(mux.context, timeout)
+		bytes, err := responses_queue.PopResponse(timeout_context, operations_queue_name, timeout)
+		if err != nil {
+			cancel()
+			continue
+		}
+		cancel()
+
+		response_message := response_status{}
+		err = json.Unmarshal(bytes, &response_message)
+		if err != nil {
+			api_gateway.dead_letter(service_type, operations_queue_name, bytes, "Failed to deserialise JSON message: "+err.Error())
+			continue
+		}
+		completed, err := complete_operation(mux.operations, &config.Operations, mux.context, &response_message, bytes)
+		if err != nil {
+			// Put the response back to try again later, so that the operation does not
+			// stay pending while Redis is unavailable
+			slog.Error("Unable to complete operation", logging.Key_message_id, response_message.Header.MessageID, logging.Key_error, err.Error())
+			timeout_context, cancel := context.WithTimeout(mux.context, timeout)
+			err = responses_queue.PushResponse(timeout_context, operations_queue_name, bytes, 0)
+			cancel()
+			if err != nil {
+				slog.Error("Discarded response", "backend_service", service_name, logging.Key_message_id, response_message.Header.MessageID, logging.Key_error, err.Error())
+			}
+			time.Sleep(time.Second)
+			continue
+		}
+		if !completed {
+			slog.Warn("Discarded response to expired operation", "backend_service", service_name, logging.Key_message_id, response_message.Header.MessageID)
+		}
+	}
+}
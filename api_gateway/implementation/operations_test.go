@@ -0,0 +1,199 @@
+package implementation
+
+import (
+	config_ "api_gateway/config"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	v1 "shared/api/v1"
+	"shared/messages"
+	"shared/responses"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func Test_PrefersRespondAsync(t *testing.T) {
+	tests := map[string]bool{
+		"":                                    false,
+		"respond-async":                       true,
+		"Respond-Async":                       true,
+		"wait=10, respond-async":              true,
+		"respond-async; wait=10":              true,
+		"return=minimal":                      false,
+		"respond-asynchronously":              false,
+		"return=representation,respond-async": true,
+	}
+	for header, expected := range tests {
+		request := httptest.NewRequest(http.MethodPost, "/transfer", nil)
+		if len(header) > 0 {
+			request.Header.Set(header_prefer, header)
+		}
+		if prefers_respond_async(request) != expected {
+			t.Error("Expected: ", expected, ", Got: ", !expected, " for ", header)
+		}
+	}
+}
+
+func Test_Operations(t *testing.T) {
+
+	config, err := config_.Load("../config.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wallet_id := "operations_unit_test_wallet"
+	config.Authentication.APIKeys = []config_.APIKey{
+		{
+			Name:      "operations_unit_test",
+			Key:       "operations_unit_test_key",
+			WalletIDs: []string{wallet_id},
+		},
+		{
+			Name:      "operations_unit_test_other",
+			Key:       "operations_unit_test_other_key",
+			WalletIDs: []string{},
+		},
+	}
+	config.DepositsService.RequestsQueue.QueueName = "operations_requests_queue_test"
+	config.DepositsService.ResponsesQueue.QueueName = "operations_responses_queue_test"
+	config.Operations.KeyPrefix = "operations_test"
+
+	// No backend service reads the requests queue, so the test removes it when done
+	requests_queue := redis.NewClient(config.DepositsService.RequestsQueue.GetRedisOptions())
+	defer requests_queue.Close()
+	defer requests_queue.Del(context.Background(), config.DepositsService.RequestsQueue.QueueName)
+
+	// Start running API gateway
+	api_gateway, err := CreateAPIGateway(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api_gateway.Run()
+	defer api_gateway.Shutdown()
+
+	time.Sleep(2 * time.Second)
+
+	send := func(method string, path string, body string, api_key string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(method, path, strings.NewReader(body))
+		request.Header.Set("X-API-Key", api_key)
+		request.Header.Set(header_prefer, prefer_respond_async)
+		api_gateway.http_multiplexer.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	// Deposits are accepted before the deposit service has answered
+	recorder := send(http.MethodPost, "/v1/wallets/"+wallet_id+"/deposits", `{"currency":"SGD","amount":"10.00"}`, "operations_unit_test_key")
+	if recorder.Code != http.StatusAccepted {
+		t.Fatal("Expected: ", http.StatusAccepted, ", Got: ", recorder.Code, " ", recorder.Body.String())
+	}
+	if recorder.Header().Get(header_preference_applied) != prefer_respond_async {
+		t.Error("Expected: ", prefer_respond_async, ", Got: ", recorder.Header().Get(header_preference_applied))
+	}
+	accepted := v1.Operation{}
+	err = json.Unmarshal(recorder.Body.Bytes(), &accepted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accepted.Status != v1.Operation_status_pending || accepted.Operation != v1.Operation_deposit {
+		t.Error("Expected: ", v1.Operation_status_pending, " ", v1.Operation_deposit, ", Got: ", accepted.Status, " ", accepted.Operation)
+	}
+	location := "/v1/operations/" + accepted.OperationID
+	if recorder.Header().Get("Location") != location {
+		t.Error("Expected: ", location, ", Got: ", recorder.Header().Get("Location"))
+	}
+
+	// The request is sent to the deposit service with the operations queue as reply queue
+	request_message := messages.POST_Deposit{}
+	bytes, err := requests_queue.RPop(context.Background(), config.DepositsService.RequestsQueue.QueueName).Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.Unmarshal(bytes, &request_message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request_message.Header.ReplyTo != api_gateway.redis_manager.deposit_operations_queue {
+		t.Error("Expected: ", api_gateway.redis_manager.deposit_operations_queue, ", Got: ", request_message.Header.ReplyTo)
+	}
+	if strconv.FormatInt(request_message.Header.MessageID, 10) != accepted.OperationID {
+		t.Error("Expected: ", accepted.OperationID, ", Got: ", request_message.Header.MessageID)
+	}
+
+	// Operations stay pending until the deposit service answers
+	recorder = send(http.MethodGet, location, "", "operations_unit_test_key")
+	if recorder.Code != http.StatusOK {
+		t.Fatal("Expected: ", http.StatusOK, ", Got: ", recorder.Code, " ", recorder.Body.String())
+	}
+	pending := v1.Operation{}
+	err = json.Unmarshal(recorder.Body.Bytes(), &pending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending.Status != v1.Operation_status_pending || pending.Deposit != nil {
+		t.Error("Expected: ", v1.Operation_status_pending, ", Got: ", pending.Status, " ", pending.Deposit)
+	}
+
+	// Any instance of the API gateway completes the operation with the response
+	response_message := responses.Deposit{
+		Header:     responses.Header{MessageID: request_message.Header.MessageID, Action: messages.Action_deposit},
+		Status:     responses.Status_successful,
+		Currency:   "SGD",
+		NewBalance: "10.00",
+	}
+	bytes, err = json.Marshal(response_message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = api_gateway.redis_manager.deposit_responses_queue.PushResponse(context.Background(), request_message.Header.ReplyTo, bytes, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Second)
+
+	recorder = send(http.MethodGet, location, "", "operations_unit_test_key")
+	completed := v1.Operation{}
+	err = json.Unmarshal(recorder.Body.Bytes(), &completed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if completed.Status != v1.Operation_status_succeeded || len(completed.CompletedAt) == 0 {
+		t.Error("Expected: ", v1.Operation_status_succeeded, ", Got: ", completed.Status, " ", completed.CompletedAt)
+	}
+	if completed.Deposit == nil || completed.Deposit.NewBalance != "10.00" {
+		t.Error("Expected: ", "10.00", ", Got: ", completed.Deposit)
+	}
+
+	// Routes without a version prefix return the response of the deposit service as is
+	recorder = send(http.MethodGet, "/operations/"+accepted.OperationID, "", "operations_unit_test_key")
+	operation := responses.Operation{}
+	err = json.Unmarshal(recorder.Body.Bytes(), &operation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if operation.Status != responses.Operation_status_succeeded || operation.RequestAction != messages.Action_deposit {
+		t.Error("Expected: ", responses.Operation_status_succeeded, ", Got: ", operation.Status)
+	}
+	deposit := responses.Deposit{}
+	err = json.Unmarshal(operation.Response, &deposit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deposit.NewBalance != "10.00" {
+		t.Error("Expected: ", "10.00", ", Got: ", deposit.NewBalance)
+	}
+
+	// Callers cannot see the operations of other callers
+	recorder = send(http.MethodGet, location, "", "operations_unit_test_other_key")
+	if recorder.Code != http.StatusNotFound {
+		t.Error("Expected: ", http.StatusNotFound, ", Got: ", recorder.Code)
+	}
+	recorder = send(http.MethodGet, "/v1/operations/1", "", "operations_unit_test_key")
+	if recorder.Code != http.StatusNotFound {
+		t.Error("Expected: ", http.StatusNotFound, ", Got: ", recorder.Code)
+	}
+}
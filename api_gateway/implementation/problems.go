@@ -0,0 +1,157 @@
+package implementation
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"shared/responses"
+)
+
+const (
+	content_type_json    string = "application/json"
+	content_type_problem string = "application/problem+json"
+)
+
+// HTTP status returned to the user for each error code. Unknown error codes are
+// reported as 500 Internal Server Error.
+var http_status_of_error_codes = map[string]int{
+	responses.Error_code_invalid_request:           http.StatusBadRequest,
+	responses.Error_code_invalid_amount:            http.StatusUnprocessableEntity,
+	responses.Error_code_invalid_currency:          http.StatusUnprocessableEntity,
+	responses.Error_code_invalid_date:              http.StatusUnprocessableEntity,
+	responses.Error_code_wallet_not_found:          http.StatusNotFound,
+	responses.Error_code_insufficient_funds:        http.StatusConflict,
+	responses.Error_code_currency_mismatch:         http.StatusConflict,
+	responses.Error_code_idempotency_key_reused:    http.StatusConflict,
+	responses.Error_code_idempotency_key_not_found: http.StatusNotFound,
+	responses.Error_code_webhook_not_found:         http.StatusNotFound,
+	responses.Error_code_delivery_not_found:        http.StatusNotFound,
+	responses.Error_code_batch_aborted:             http.StatusConflict,
+	responses.Error_code_database_error:            http.StatusServiceUnavailable,
+	responses.Error_code_internal_error:            http.StatusInternalServerError,
+	responses.Error_code_unauthenticated:           http.StatusUnauthorized,
+	responses.Error_code_forbidden:                 http.StatusForbidden,
+	responses.Error_code_route_not_found:           http.StatusNotFound,
+	responses.Error_code_operation_not_found:       http.StatusNotFound,
+	responses.Error_code_method_not_allowed:        http.StatusMethodNotAllowed,
+	responses.Error_code_rate_limited:              http.StatusTooManyRequests,
+	responses.Error_code_service_unavailable:       http.StatusServiceUnavailable,
+	responses.Error_code_service_timeout:           http.StatusGatewayTimeout,
+	responses.Error_code_request_too_large:         http.StatusRequestEntityTooLarge,
+}
+
+func get_http_status(error_code string) int {
+	status, exists := http_status_of_error_codes[error_code]
+	if !exists {
+		return http.StatusInternalServerError
+	}
+	return status
+}
+
+// Responds with the HTTP status of the error code and a problem details body
+func write_problem(writer http.ResponseWriter, error_code string, detail string) {
+	status := get_http_status(error_code)
+	problem := responses.Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Code:   error_code,
+		Detail: detail,
+	}
+	bytes, err := json.Marshal(problem)
+	if err != nil {
+		writer.WriteHeader(status)
+		return
+	}
+	writer.Header().Set("Content-Type", content_type_problem)
+	writer.WriteHeader(status)
+	writer.Write(bytes)
+}
+
+// Common to the responses of all backend services
+type response_status struct {
+	Header       responses.Header `json:"header"`
+	Status       int              `json:"status,omitempty"`
+	ErrorCode    string           `json:"error_code,omitempty"`
+	ErrorMessage string           `json:"error_message,omitempty"`
+
+	// Only set in responses to atomic batches
+	Items json.RawMessage `json:"items,omitempty"`
+}
+
+/*
+Turns the body of a successful response of a backend service into the body sent to
+the user, e.g. a body of version 1 of the public API. Returns nil if there is nothing
+to send. Passing a nil response_mapper sends responses on as is.
+*/
+type response_mapper func(bytes []byte) (any, error)
+
+// Successful responses from backend services are passed through the response mapper.
+// Failed responses are turned into problem details with a matching HTTP status, except
+// aborted batches, whose items are passed through the response mapper too.
+func write_response(writer http.ResponseWriter, bytes []byte, mapper response_mapper) {
+	response_message := response_status{}
+	err := json.Unmarshal(bytes, &response_message)
+	if err != nil {
+		write_problem(writer, responses.Error_code_internal_error, "Invalid response from backend service")
+		return
+	}
+	status := http.StatusOK
+	if response_message.Status == responses.Status_failed {
+		error_code := response_message.ErrorCode
+		if len(error_code) == 0 {
+			error_code = responses.Error_code_internal_error
+		}
+
+		// Aborted batches report the result of every item with the HTTP status of the
+		// failed item
+		if len(response_message.Items) == 0 || mapper == nil {
+			write_problem(writer, error_code, response_message.ErrorMessage)
+			return
+		}
+		status = get_http_status(error_code)
+	}
+	if mapper != nil {
+		body, err := mapper(bytes)
+		if err != nil {
+			write_problem(writer, responses.Error_code_internal_error, "Invalid response from backend service")
+			return
+		}
+		if body == nil {
+			writer.WriteHeader(http.StatusNoContent)
+			return
+		}
+		bytes, err = json.Marshal(body)
+		if err != nil {
+			write_problem(writer, responses.Error_code_internal_error, "Unable to serialise response")
+			return
+		}
+	}
+	writer.Header().Set("Content-Type", content_type_json)
+	writer.WriteHeader(status)
+	writer.Write(bytes)
+}
+
+// Collects the response written by a handler of the RESTful API, e.g. to answer a gRPC
+// call or an item of a batch
+type response_recorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func create_response_recorder() *response_recorder {
+	return &response_recorder{header: http.Header{}, status: http.StatusOK}
+}
+
+func (recorder *response_recorder) Header() http.Header {
+	return recorder.header
+}
+
+func (recorder *response_recorder) Write(bytes []byte) (int, error) {
+	return recorder.body.Write(bytes)
+}
+
+func (recorder *response_recorder) WriteHeader(status int) {
+	recorder.status = status
+}
@@ -0,0 +1,132 @@
+package implementation
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"shared/responses"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func Test_Problems(t *testing.T) {
+
+	// Failed response from backend service is turned into problem details
+	{
+		response_message := responses.Withdraw{
+			Header:       responses.Header{MessageID: 1, Action: 2},
+			Status:       responses.Status_failed,
+			ErrorCode:    responses.Error_code_insufficient_funds,
+			ErrorMessage: "Insufficient funds in wallet",
+		}
+		bytes, err := json.Marshal(response_message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder := httptest.NewRecorder()
+		write_response(recorder, bytes, nil)
+
+		if recorder.Code != http.StatusConflict {
+			t.Error("Expected: ", http.StatusConflict, ", Got: ", recorder.Code)
+		}
+		if recorder.Header().Get("Content-Type") != content_type_problem {
+			t.Error("Expected: ", content_type_problem, ", Got: ", recorder.Header().Get("Content-Type"))
+		}
+		problem := responses.Problem{}
+		err = json.Unmarshal(recorder.Body.Bytes(), &problem)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := responses.Problem{
+			Type:   "about:blank",
+			Title:  "Conflict",
+			Status: http.StatusConflict,
+			Code:   responses.Error_code_insufficient_funds,
+			Detail: "Insufficient funds in wallet",
+		}
+		if !reflect.DeepEqual(problem, expected) {
+			t.Error("Expected: ", expected, ", Got: ", problem)
+		}
+	}
+
+	// Successful response is passed on as is
+	{
+		bytes := []byte(`{"header":{"id":1,"action":4},"status":1,"currency":"SGD","balance":"1.00"}`)
+		recorder := httptest.NewRecorder()
+		write_response(recorder, bytes, nil)
+		if recorder.Code != http.StatusOK {
+			t.Error("Expected: ", http.StatusOK, ", Got: ", recorder.Code)
+		}
+		if !reflect.DeepEqual(recorder.Body.Bytes(), bytes) {
+			t.Error("Expected: ", string(bytes), ", Got: ", recorder.Body.String())
+		}
+	}
+
+	// Failed response without an error code is an internal error
+	{
+		bytes := []byte(`{"header":{"id":1,"action":4},"status":2,"error_message":"Something went wrong"}`)
+		recorder := httptest.NewRecorder()
+		write_response(recorder, bytes, nil)
+		if recorder.Code != http.StatusInternalServerError {
+			t.Error("Expected: ", http.StatusInternalServerError, ", Got: ", recorder.Code)
+		}
+	}
+
+	// Every error code in the catalog maps to an HTTP status
+	{
+		expected := map[string]int{
+			responses.Error_code_invalid_request:           http.StatusBadRequest,
+			responses.Error_code_invalid_amount:            http.StatusUnprocessableEntity,
+			responses.Error_code_wallet_not_found:          http.StatusNotFound,
+			responses.Error_code_currency_mismatch:         http.StatusConflict,
+			responses.Error_code_idempotency_key_not_found: http.StatusNotFound,
+			responses.Error_code_database_error:            http.StatusServiceUnavailable,
+			responses.Error_code_rate_limited:              http.StatusTooManyRequests,
+			responses.Error_code_service_timeout:           http.StatusGatewayTimeout,
+			responses.Error_code_request_too_large:         http.StatusRequestEntityTooLarge,
+			"UNKNOWN_ERROR_CODE":                           http.StatusInternalServerError,
+		}
+		for error_code, status := range expected {
+			if get_http_status(error_code) != status {
+				t.Error("Expected: ", status, ", Got: ", get_http_status(error_code), " for ", error_code)
+			}
+		}
+	}
+}
+
+func Test_ReadBody(t *testing.T) {
+
+	read := func(body io.Reader) (*httptest.ResponseRecorder, map[string]string, bool) {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, "/v1/wallets/wallet_1/deposits", body)
+		values := map[string]string{}
+		ok := read_body(recorder, request, &values)
+		return recorder, values, ok
+	}
+
+	// Bodies arriving in many small reads are read in full
+	padding := strings.Repeat("0", int(maximum_body_size)/2)
+	body := `{"amount":"10.00","padding":"` + padding + `"}`
+	recorder, values, ok := read(iotest.OneByteReader(strings.NewReader(body)))
+	if !ok || values["amount"] != "10.00" || values["padding"] != padding {
+		t.Error("Expected: ", "10.00", ", Got: ", values["amount"], " ", recorder.Body.String())
+	}
+
+	// Bodies larger than the limit are rejected
+	body = `{"padding":"` + strings.Repeat("0", int(maximum_body_size)) + `"}`
+	recorder, _, ok = read(strings.NewReader(body))
+	if ok || recorder.Code != http.StatusRequestEntityTooLarge {
+		t.Error("Expected: ", http.StatusRequestEntityTooLarge, ", Got: ", recorder.Code)
+	}
+
+	// Missing and invalid bodies are bad requests
+	for _, body := range []string{"", "{"} {
+		recorder, _, ok = read(strings.NewReader(body))
+		if ok || recorder.Code != http.StatusBadRequest {
+			t.Error("Expected: ", http.StatusBadRequest, ", Got: ", recorder.Code, " for ", body)
+		}
+	}
+}
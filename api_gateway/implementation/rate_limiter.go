@@ -0,0 +1,195 @@
+package implementation
+
+import (
+	"api_gateway/config"
+	"context"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"shared/queues"
+	"shared/responses"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+/*
+Token buckets are stored in Redis so that the rate limits still hold when requests
+from the same caller are spread over several instances of the API gateway.
+
+The whole bucket update runs as a single Lua script, so concurrent requests from
+several gateways cannot take the same token twice. The time is taken from the Redis
+server instead of each gateway to avoid problems with gateways whose clocks differ.
+
+	KEYS[1]: Name of bucket
+	ARGV[1]: Tokens added per second
+	ARGV[2]: Maximum number of tokens in bucket
+	ARGV[3]: Number of tokens to take, e.g. one for every item of an atomic batch.
+	         Negative to give tokens back.
+
+Returns {1, 0} if the tokens were taken. Otherwise {0, retry_after}, where retry_after
+is the time in ms until enough tokens are available. Either all tokens are taken or none.
+*/
+const token_bucket_script string = `
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local cost = tonumber(ARGV[3])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'timestamp')
+local tokens = tonumber(bucket[1])
+local timestamp = tonumber(bucket[2])
+if tokens == nil or timestamp == nil then
+	tokens = burst
+	timestamp = now
+end
+tokens = math.min(burst, tokens + math.max(0, now - timestamp) * rate / 1000)
+
+local allowed = 0
+local retry_after = 0
+if tokens >= cost then
+	tokens = math.min(burst, tokens - cost)
+	allowed = 1
+else
+	retry_after = math.ceil((cost - tokens) * 1000 / rate)
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'timestamp', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst * 1000 / rate) + 1000)
+return {allowed, retry_after}
+`
+
+const rate_limit_key_prefix string = "rate_limit:"
+
+type rate_limiter struct {
+	context context.Context
+	script  *redis.Script
+}
+
+func create_rate_limiter(background_context context.Context) *rate_limiter {
+	limiter := &rate_limiter{
+		context: background_context,
+		script:  redis.NewScript(token_bucket_script),
+	}
+	return limiter
+}
+
+// Takes a number of tokens from the bucket. Returns the time to wait before retrying if
+// the bucket does not hold enough tokens.
+func (limiter *rate_limiter) allow(
+	client *redis.Client,
+	bucket_name string,
+	limit *config.RateLimit,
+	tokens int,
+	timeout time.Duration) (bool, time.Duration, error) {
+
+	timeout_context, cancel := context.WithTimeout(limiter.context, timeout)
+	defer cancel()
+
+	result, err := limiter.script.Run(
+		timeout_context,
+		client,
+		[]string{rate_limit_key_prefix + bucket_name},
+		strconv.FormatFloat(limit.Rate, 'f', -1, 64),
+		limit.Burst,
+		tokens).Int64Slice()
+	if err != nil {
+		return false, 0, err
+	}
+	if len(result) != 2 {
+		return false, 0, redis.Nil
+	}
+
+	allowed := result[0] == 1
+	retry_after := time.Duration(result[1]) * time.Millisecond
+	return allowed, retry_after, nil
+}
+
+// Returns the identity that requests are counted against. Returns an empty string if
+// the identity cannot be determined.
+func get_rate_limit_identity(request *http.Request, limit *config.RateLimit, wallet_id string) string {
+	switch limit.KeyedBy {
+	case config.Rate_limit_keyed_by_client_ip:
+		host, _, err := net.SplitHostPort(request.RemoteAddr)
+		if err != nil {
+			return request.RemoteAddr
+		}
+		return host
+	case config.Rate_limit_keyed_by_api_key:
+		caller_ := get_caller(request)
+		if caller_ == nil {
+			return ""
+		}
+		return caller_.name
+	case config.Rate_limit_keyed_by_wallet_id:
+		return wallet_id
+	}
+	return ""
+}
+
+// Returns the Redis client and the name of the bucket that a request counts against.
+// Returns false if the request is not limited.
+func get_rate_limit_bucket(
+	route string,
+	limit *config.RateLimit,
+	requests_queue queues.Transport,
+	wallet_id string,
+	request *http.Request) (*redis.Client, string, bool) {
+
+	if limit.Rate <= 0 {
+		return nil, "", false
+	}
+
+	// Buckets are kept on the Redis server of the requests queue of the backend service.
+	// Requests are not limited if messages are passed on in memory.
+	redis_transport, ok := requests_queue.(*queues.RedisTransport)
+	if !ok {
+		return nil, "", false
+	}
+	identity := get_rate_limit_identity(request, limit, wallet_id)
+	if len(identity) == 0 {
+		return nil, "", false
+	}
+	return redis_transport.Client(), route + ":" + limit.KeyedBy + ":" + identity, true
+}
+
+// Returns false and responds with 429 Too Many Requests if the caller has exceeded
+// the rate limit of the route. Requests are allowed if Redis cannot be reached. An
+// unavailable rate limiter must not take the whole API gateway down with it.
+func (mux *http_request_multiplexer) check_rate_limit(
+	route string,
+	limit *config.RateLimit,
+	backend_service *config.Service,
+	requests_queue queues.Transport,
+	wallet_id string,
+	writer http.ResponseWriter,
+	request *http.Request) bool {
+
+	client, bucket_name, limited := get_rate_limit_bucket(route, limit, requests_queue, wallet_id, request)
+	if !limited {
+		return true
+	}
+	timeout := time.Duration(backend_service.RequestsQueue.Timeout) * time.Second
+	allowed, retry_after, err := mux.rate_limiter.allow(client, bucket_name, limit, 1, timeout)
+	if err != nil {
+		log.Println("Unable to check rate limit of " + route + ": " + err.Error())
+		return true
+	}
+	if allowed {
+		return true
+	}
+	write_rate_limited(writer, route, retry_after)
+	return false
+}
+
+func write_rate_limited(writer http.ResponseWriter, route string, retry_after time.Duration) {
+	retry_after_seconds := int(math.Ceil(retry_after.Seconds()))
+	if retry_after_seconds < 1 {
+		retry_after_seconds = 1
+	}
+	writer.Header().Set("Retry-After", strconv.Itoa(retry_after_seconds))
+	write_problem(writer, responses.Error_code_rate_limited, "Too many requests to "+route)
+}
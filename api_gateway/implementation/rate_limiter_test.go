@@ -0,0 +1,152 @@
+package implementation
+
+import (
+	"api_gateway/config"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"shared/queues"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func Test_RateLimiter(t *testing.T) {
+
+	config_, err := config.Load("../config.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	background_context := context.Background()
+	timeout := time.Duration(config_.BalanceService.RequestsQueue.Timeout) * time.Second
+	route := "rate_limiter_unit_test"
+	wallet_id := "unit_test"
+	bucket_name := route + ":" + config.Rate_limit_keyed_by_wallet_id + ":" + wallet_id
+
+	// Two clients and two limiters act as two instances of the API gateway
+	client_1 := redis.NewClient(config_.BalanceService.RequestsQueue.GetRedisOptions())
+	defer client_1.Close()
+	client_2 := redis.NewClient(config_.BalanceService.RequestsQueue.GetRedisOptions())
+	defer client_2.Close()
+	limiter_1 := create_rate_limiter(background_context)
+	limiter_2 := create_rate_limiter(background_context)
+
+	_, err = client_1.Del(background_context, rate_limit_key_prefix+bucket_name).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client_1.Del(background_context, rate_limit_key_prefix+bucket_name)
+
+	limit := config.RateLimit{
+		KeyedBy: config.Rate_limit_keyed_by_wallet_id,
+		Rate:    0.5,
+		Burst:   3,
+	}
+
+	// The burst is shared by both instances
+	for i := 0; i < limit.Burst; i++ {
+		limiter := limiter_1
+		client := client_1
+		if i%2 == 1 {
+			limiter = limiter_2
+			client = client_2
+		}
+		allowed, _, err := limiter.allow(client, bucket_name, &limit, 1, timeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !allowed {
+			t.Fatal("Expected request ", i, " to be allowed.")
+		}
+	}
+
+	// Bucket is empty. Next token is available in about 2 s.
+	{
+		allowed, retry_after, err := limiter_2.allow(client_2, bucket_name, &limit, 1, timeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed {
+			t.Fatal("Expected request to be rejected.")
+		}
+		if retry_after <= 0 || retry_after > 2*time.Second {
+			t.Error("Expected retry after between 0 and 2 s, Got: ", retry_after)
+		}
+	}
+
+	// Over limit requests are rejected with 429 Too Many Requests
+	{
+		mux := &http_request_multiplexer{
+			rate_limiter: limiter_1,
+		}
+		request := httptest.NewRequest(http.MethodPost, "/wallets/{unit_test}/deposits", nil)
+		recorder := httptest.NewRecorder()
+		allowed := mux.check_rate_limit(
+			route,
+			&limit,
+			&config_.BalanceService,
+			queues.CreateRedisTransport(client_1, queues.Transport_list, "", ""),
+			wallet_id,
+			recorder,
+			request)
+		if allowed {
+			t.Fatal("Expected request to be rejected.")
+		}
+		if recorder.Code != http.StatusTooManyRequests {
+			t.Error("Expected: ", http.StatusTooManyRequests, ", Got: ", recorder.Code)
+		}
+		expected := "2"
+		if recorder.Header().Get("Retry-After") != expected {
+			t.Error("Expected: ", expected, ", Got: ", recorder.Header().Get("Retry-After"))
+		}
+
+		// Requests are not limited without a Redis server to keep the buckets
+		allowed = mux.check_rate_limit(
+			route,
+			&limit,
+			&config_.BalanceService,
+			queues.CreateMemory(),
+			wallet_id,
+			httptest.NewRecorder(),
+			request)
+		if !allowed {
+			t.Error("Expected request to be allowed.")
+		}
+	}
+}
+
+func Test_RateLimitIdentity(t *testing.T) {
+
+	request, err := http.NewRequest(http.MethodGet, "http://localhost:1120/wallets/{wallet_1}/balance", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.RemoteAddr = "192.168.1.10:52345"
+	request = with_caller(request, create_caller("api_client", []string{"wallet_1"}))
+
+	{
+		limit := config.RateLimit{KeyedBy: config.Rate_limit_keyed_by_client_ip}
+		identity := get_rate_limit_identity(request, &limit, "wallet_1")
+		expected := "192.168.1.10"
+		if identity != expected {
+			t.Error("Expected: ", expected, ", Got: ", identity)
+		}
+	}
+	{
+		limit := config.RateLimit{KeyedBy: config.Rate_limit_keyed_by_api_key}
+		identity := get_rate_limit_identity(request, &limit, "wallet_1")
+		expected := "api_client"
+		if identity != expected {
+			t.Error("Expected: ", expected, ", Got: ", identity)
+		}
+	}
+	{
+		limit := config.RateLimit{KeyedBy: config.Rate_limit_keyed_by_wallet_id}
+		identity := get_rate_limit_identity(request, &limit, "wallet_1")
+		expected := "wallet_1"
+		if identity != expected {
+			t.Error("Expected: ", expected, ", Got: ", identity)
+		}
+	}
+}
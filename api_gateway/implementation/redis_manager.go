@@ -3,22 +3,77 @@ package implementation
 import (
 	"api_gateway/config"
 	"context"
+	"shared/queues"
+	"strconv"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
 type redis_manager struct {
-	deposit_requests_queue              *redis.Client
-	deposit_responses_queue             *redis.Client
-	withdrawal_requests_queue           *redis.Client
-	withdrawal_responses_queue          *redis.Client
-	transfer_requests_queue             *redis.Client
-	transfer_responses_queue            *redis.Client
-	balance_requests_queue              *redis.Client
-	balance_responses_queue             *redis.Client
-	transaction_history_requests_queue  *redis.Client
-	transaction_history_responses_queue *redis.Client
+	deposit_requests_queue              queues.Transport
+	deposit_responses_queue             queues.Transport
+	withdrawal_requests_queue           queues.Transport
+	withdrawal_responses_queue          queues.Transport
+	transfer_requests_queue             queues.Transport
+	transfer_responses_queue            queues.Transport
+	balance_requests_queue              queues.Transport
+	balance_responses_queue             queues.Transport
+	transaction_history_requests_queue  queues.Transport
+	transaction_history_responses_queue queues.Transport
+	webhook_requests_queue              queues.Transport
+	webhook_responses_queue             queues.Transport
+
+	// Streams and channel of the live feed of wallet events. Nil if messages are
+	// passed on in memory.
+	wallet_events *redis.Client
+
+	// Operations accepted with Prefer: respond-async. Nil if messages are passed on in
+	// memory.
+	operations *redis.Client
+
+	// Several instances of the API gateway share the same backend services. Each
+	// instance puts the name of its own reply queue into every request, and the backend
+	// service puts the response into that queue. Responses can then only be read by
+	// the instance waiting for them.
+	deposit_reply_queue             string
+	withdrawal_reply_queue          string
+	transfer_reply_queue            string
+	balance_reply_queue             string
+	transaction_history_reply_queue string
+	webhook_reply_queue             string
+
+	// Responses to operations accepted with Prefer: respond-async are put into a queue
+	// shared by every instance of the API gateway. Any instance may then complete the
+	// operation, even if the one which accepted it has stopped.
+	deposit_operations_queue    string
+	withdrawal_operations_queue string
+	transfer_operations_queue   string
+}
+
+// Reply queues are kept on the same Redis server as the responses queue of the backend
+// service. The node ID is unique for each instance of the API gateway.
+func get_reply_queue_name(responses_queue *config.RedisMessageQueue, node_id int64) string {
+	return responses_queue.QueueName + ":" + strconv.FormatInt(node_id, 10)
+}
+
+// Kept on the same Redis server as the responses queue of the backend service
+func get_operations_queue_name(responses_queue *config.RedisMessageQueue) string {
+	return responses_queue.QueueName + ":operations"
+}
+
+// Removes responses left in the reply queue by a previous run of this instance. Nobody
+// is waiting for them anymore.
+func clear_reply_queue(
+	responses_queue *redis.Client,
+	reply_queue_name string,
+	config *config.RedisMessageQueue,
+	background_context context.Context) error {
+
+	timeout_context, cancel := context.WithTimeout(background_context, time.Duration(config.Timeout)*time.Second)
+	defer cancel()
+	_, err := responses_queue.Del(timeout_context, reply_queue_name).Result()
+	return err
 }
 
 func create_redis_manager(config *config.Config, background_context context.Context) (*redis_manager, error) {
@@ -36,7 +91,7 @@ func create_redis_manager(config *config.Config, background_context context.Cont
 		}
 		cancel()
 
-		redis_manager.deposit_requests_queue = deposit_requests_queue
+		redis_manager.deposit_requests_queue = queues.CreateRedisTransport(deposit_requests_queue, config.DepositsService.RequestsQueue.Transport, "", "")
 	}
 
 	{
@@ -51,7 +106,14 @@ func create_redis_manager(config *config.Config, background_context context.Cont
 		}
 		cancel()
 
-		redis_manager.deposit_responses_queue = deposit_responses_queue
+		redis_manager.deposit_responses_queue = queues.CreateRedisTransport(deposit_responses_queue, queues.Transport_list, "", "")
+		redis_manager.deposit_reply_queue = get_reply_queue_name(&config.DepositsService.ResponsesQueue, config.NodeID)
+		redis_manager.deposit_operations_queue = get_operations_queue_name(&config.DepositsService.ResponsesQueue)
+
+		err = clear_reply_queue(deposit_responses_queue, redis_manager.deposit_reply_queue, &config.DepositsService.ResponsesQueue, background_context)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	{
@@ -66,7 +128,7 @@ func create_redis_manager(config *config.Config, background_context context.Cont
 		}
 		cancel()
 
-		redis_manager.withdrawal_requests_queue = withdrawal_requests_queue
+		redis_manager.withdrawal_requests_queue = queues.CreateRedisTransport(withdrawal_requests_queue, config.WithdrawalService.RequestsQueue.Transport, "", "")
 	}
 
 	{
@@ -81,7 +143,14 @@ func create_redis_manager(config *config.Config, background_context context.Cont
 		}
 		cancel()
 
-		redis_manager.withdrawal_responses_queue = withdrawal_responses_queue
+		redis_manager.withdrawal_responses_queue = queues.CreateRedisTransport(withdrawal_responses_queue, queues.Transport_list, "", "")
+		redis_manager.withdrawal_reply_queue = get_reply_queue_name(&config.WithdrawalService.ResponsesQueue, config.NodeID)
+		redis_manager.withdrawal_operations_queue = get_operations_queue_name(&config.WithdrawalService.ResponsesQueue)
+
+		err = clear_reply_queue(withdrawal_responses_queue, redis_manager.withdrawal_reply_queue, &config.WithdrawalService.ResponsesQueue, background_context)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	{
@@ -96,7 +165,7 @@ func create_redis_manager(config *config.Config, background_context context.Cont
 		}
 		cancel()
 
-		redis_manager.transfer_requests_queue = transfer_requests_queue
+		redis_manager.transfer_requests_queue = queues.CreateRedisTransport(transfer_requests_queue, config.TransferService.RequestsQueue.Transport, "", "")
 	}
 
 	{
@@ -111,7 +180,14 @@ func create_redis_manager(config *config.Config, background_context context.Cont
 		}
 		cancel()
 
-		redis_manager.transfer_responses_queue = transfer_responses_queue
+		redis_manager.transfer_responses_queue = queues.CreateRedisTransport(transfer_responses_queue, queues.Transport_list, "", "")
+		redis_manager.transfer_reply_queue = get_reply_queue_name(&config.TransferService.ResponsesQueue, config.NodeID)
+		redis_manager.transfer_operations_queue = get_operations_queue_name(&config.TransferService.ResponsesQueue)
+
+		err = clear_reply_queue(transfer_responses_queue, redis_manager.transfer_reply_queue, &config.TransferService.ResponsesQueue, background_context)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	{
@@ -126,7 +202,7 @@ func create_redis_manager(config *config.Config, background_context context.Cont
 		}
 		cancel()
 
-		redis_manager.balance_requests_queue = balance_requests_queue
+		redis_manager.balance_requests_queue = queues.CreateRedisTransport(balance_requests_queue, config.BalanceService.RequestsQueue.Transport, "", "")
 	}
 
 	{
@@ -141,7 +217,13 @@ func create_redis_manager(config *config.Config, background_context context.Cont
 		}
 		cancel()
 
-		redis_manager.balance_responses_queue = balance_responses_queue
+		redis_manager.balance_responses_queue = queues.CreateRedisTransport(balance_responses_queue, queues.Transport_list, "", "")
+		redis_manager.balance_reply_queue = get_reply_queue_name(&config.BalanceService.ResponsesQueue, config.NodeID)
+
+		err = clear_reply_queue(balance_responses_queue, redis_manager.balance_reply_queue, &config.BalanceService.ResponsesQueue, background_context)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	{
@@ -156,7 +238,7 @@ func create_redis_manager(config *config.Config, background_context context.Cont
 		}
 		cancel()
 
-		redis_manager.transaction_history_requests_queue = transaction_history_requests_queue
+		redis_manager.transaction_history_requests_queue = queues.CreateRedisTransport(transaction_history_requests_queue, config.TransactionHistoryService.RequestsQueue.Transport, "", "")
 	}
 
 	{
@@ -171,8 +253,112 @@ func create_redis_manager(config *config.Config, background_context context.Cont
 		}
 		cancel()
 
-		redis_manager.transaction_history_responses_queue = transaction_history_responses_queue
+		redis_manager.transaction_history_responses_queue = queues.CreateRedisTransport(transaction_history_responses_queue, queues.Transport_list, "", "")
+		redis_manager.transaction_history_reply_queue = get_reply_queue_name(&config.TransactionHistoryService.ResponsesQueue, config.NodeID)
+
+		err = clear_reply_queue(transaction_history_responses_queue, redis_manager.transaction_history_reply_queue, &config.TransactionHistoryService.ResponsesQueue, background_context)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	{
+		// Prepare webhook requests queue
+		webhook_requests_queue := redis.NewClient(config.WebhookService.RequestsQueue.GetRedisOptions())
+
+		timeout_context, cancel := context.WithTimeout(background_context, time.Duration(config.WebhookService.RequestsQueue.Timeout)*time.Second)
+		_, err := webhook_requests_queue.Ping(timeout_context).Result()
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		cancel()
+
+		redis_manager.webhook_requests_queue = queues.CreateRedisTransport(webhook_requests_queue, config.WebhookService.RequestsQueue.Transport, "", "")
+	}
+
+	{
+		// Prepare webhook responses queue
+		webhook_responses_queue := redis.NewClient(config.WebhookService.ResponsesQueue.GetRedisOptions())
+
+		timeout_context, cancel := context.WithTimeout(background_context, time.Duration(config.WebhookService.ResponsesQueue.Timeout)*time.Second)
+		_, err := webhook_responses_queue.Ping(timeout_context).Result()
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		cancel()
+
+		redis_manager.webhook_responses_queue = queues.CreateRedisTransport(webhook_responses_queue, queues.Transport_list, "", "")
+		redis_manager.webhook_reply_queue = get_reply_queue_name(&config.WebhookService.ResponsesQueue, config.NodeID)
+
+		err = clear_reply_queue(webhook_responses_queue, redis_manager.webhook_reply_queue, &config.WebhookService.ResponsesQueue, background_context)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	{
+		// Prepare wallet events
+		wallet_events := redis.NewClient(config.WalletEvents.GetRedisOptions())
+
+		timeout_context, cancel := context.WithTimeout(background_context, time.Duration(config.WalletEvents.Timeout)*time.Second)
+		_, err := wallet_events.Ping(timeout_context).Result()
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		cancel()
+
+		redis_manager.wallet_events = wallet_events
+	}
+
+	{
+		// Prepare operations
+		operations := redis.NewClient(config.Operations.GetRedisOptions())
+
+		timeout_context, cancel := context.WithTimeout(background_context, time.Duration(config.Operations.Timeout)*time.Second)
+		_, err := operations.Ping(timeout_context).Result()
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		cancel()
+
+		redis_manager.operations = operations
 	}
 
 	return redis_manager, nil
 }
+
+// Passes requests and responses to backend services through memory instead of Redis,
+// e.g. to test the API gateway and backend services in one process. The live feed of
+// wallet events, operations accepted with Prefer: respond-async and rate limits are
+// not available, as they are kept on Redis servers.
+func create_memory_manager(config *config.Config, memory *queues.Memory) *redis_manager {
+	return &redis_manager{
+		deposit_requests_queue:              memory,
+		deposit_responses_queue:             memory,
+		withdrawal_requests_queue:           memory,
+		withdrawal_responses_queue:          memory,
+		transfer_requests_queue:             memory,
+		transfer_responses_queue:            memory,
+		balance_requests_queue:              memory,
+		balance_responses_queue:             memory,
+		transaction_history_requests_queue:  memory,
+		transaction_history_responses_queue: memory,
+		webhook_requests_queue:              memory,
+		webhook_responses_queue:             memory,
+
+		deposit_reply_queue:             get_reply_queue_name(&config.DepositsService.ResponsesQueue, config.NodeID),
+		withdrawal_reply_queue:          get_reply_queue_name(&config.WithdrawalService.ResponsesQueue, config.NodeID),
+		transfer_reply_queue:            get_reply_queue_name(&config.TransferService.ResponsesQueue, config.NodeID),
+		balance_reply_queue:             get_reply_queue_name(&config.BalanceService.ResponsesQueue, config.NodeID),
+		transaction_history_reply_queue: get_reply_queue_name(&config.TransactionHistoryService.ResponsesQueue, config.NodeID),
+		webhook_reply_queue:             get_reply_queue_name(&config.WebhookService.ResponsesQueue, config.NodeID),
+
+		deposit_operations_queue:    get_operations_queue_name(&config.DepositsService.ResponsesQueue),
+		withdrawal_operations_queue: get_operations_queue_name(&config.WithdrawalService.ResponsesQueue),
+		transfer_operations_queue:   get_operations_queue_name(&config.TransferService.ResponsesQueue),
+	}
+}
@@ -0,0 +1,123 @@
+package implementation
+
+import (
+	"api_gateway/config"
+	"api_gateway/paths"
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+	shared_config "shared/config"
+	"shared/logging"
+	"shared/responses"
+	"time"
+)
+
+// Settings in use by the API gateway and everything built from them
+type active_config struct {
+	config           *config.Config
+	authenticator    *authenticator
+	api_deprecations map[*api_version]api_deprecation
+	version          string
+	loaded_at        time.Time
+}
+
+func create_active_config(config *config.Config) *active_config {
+	active := &active_config{
+		config:           config,
+		authenticator:    create_authenticator(&config.Authentication),
+		api_deprecations: create_api_deprecations(config),
+		version:          shared_config.GetVersion(config),
+		loaded_at:        time.Now().UTC(),
+	}
+	return active
+}
+
+type reload_failure struct {
+	error     string
+	failed_at time.Time
+}
+
+// Returns the settings in use. Settings which need a restart, e.g. ports and Redis
+// servers, are the same for as long as the API gateway runs.
+func (mux *http_request_multiplexer) get_config() *config.Config {
+	return mux.active_config.Load().config
+}
+
+/*
+Applies a new configuration without a restart. Requests already being processed finish
+with the old settings. Returns an error and keeps the old settings if any setting that
+needs a restart was changed.
+*/
+func (api_gateway *APIGateway) Reload(next *config.Config) error {
+	mux := api_gateway.http_multiplexer
+	current := mux.active_config.Load()
+
+	err := config.CheckReload(current.config, next)
+	if err == nil {
+		err = logging.SetLevel(next.Logging.Level)
+	}
+	if err != nil {
+		mux.last_reload_failure.Store(&reload_failure{error: err.Error(), failed_at: time.Now().UTC()})
+		return err
+	}
+	mux.last_reload_failure.Store(nil)
+
+	version := shared_config.GetVersion(next)
+	if version == current.version {
+		log.Println("Configuration version " + version + " is already in use.")
+		return nil
+	}
+
+	active := &active_config{
+		config:           next,
+		authenticator:    current.authenticator,
+		api_deprecations: create_api_deprecations(next),
+		version:          version,
+		loaded_at:        time.Now().UTC(),
+	}
+	if !reflect.DeepEqual(current.config.Authentication, next.Authentication) {
+		active.authenticator = create_authenticator(&next.Authentication)
+	}
+	mux.active_config.Store(active)
+	log.Println("Reloaded configuration. Version " + current.version + " was replaced by version " + version + ".")
+	return nil
+}
+
+// Reported by /admin/config
+type config_status struct {
+	Version            string `json:"version"`
+	LoadedAt           string `json:"loaded_at"`
+	LastReloadError    string `json:"last_reload_error,omitempty"`
+	LastReloadFailedAt string `json:"last_reload_failed_at,omitempty"`
+}
+
+// Shows which configuration is in use, so that operators can check whether a new
+// configuration file was applied
+func (mux *http_request_multiplexer) GET_AdminConfig(input *paths.MatchResult, writer http.ResponseWriter, request *http.Request) {
+	caller_ := get_caller(request)
+	if caller_ == nil || !caller_.is_admin {
+		write_problem(writer, responses.Error_code_forbidden, "Only administrators may see the configuration")
+		return
+	}
+
+	active := mux.active_config.Load()
+	status := config_status{
+		Version:  active.version,
+		LoadedAt: active.loaded_at.Format(time.RFC3339),
+	}
+	failure := mux.last_reload_failure.Load()
+	if failure != nil {
+		status.LastReloadError = failure.error
+		status.LastReloadFailedAt = failure.failed_at.Format(time.RFC3339)
+	}
+
+	bytes, err := json.Marshal(status)
+	if err != nil {
+		write_problem(writer, responses.Error_code_internal_error, "Unable to serialise configuration status")
+		return
+	}
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.Header().Set("Content-Type", content_type_json)
+	writer.Write(bytes)
+}
@@ -0,0 +1,116 @@
+package implementation
+
+import (
+	config_ "api_gateway/config"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	shared_config "shared/config"
+	"testing"
+)
+
+func Test_Reload(t *testing.T) {
+
+	config, err := config_.Load("../config.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Authentication.APIKeys = []config_.APIKey{
+		{Name: "admin", Key: "admin_key", Admin: true},
+	}
+	api_gateway, err := CreateAPIGateway(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := api_gateway.http_multiplexer
+
+	get_config_status := func(api_key string) (int, config_status) {
+		request := httptest.NewRequest(http.MethodGet, "/admin/config", nil)
+		request.Header.Set("X-API-Key", api_key)
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, request)
+		status := config_status{}
+		json.Unmarshal(recorder.Body.Bytes(), &status)
+		return recorder.Code, status
+	}
+
+	code, first_status := get_config_status("admin_key")
+	if code != http.StatusOK {
+		t.Fatal("Expected: ", http.StatusOK, ", Got: ", code)
+	}
+	if first_status.Version != shared_config.GetVersion(config) {
+		t.Error("Expected: ", shared_config.GetVersion(config), ", Got: ", first_status.Version)
+	}
+
+	// Timeouts, limits and API keys are applied at once
+	{
+		next, err := config_.Load("../config.yml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		next.Authentication.APIKeys = []config_.APIKey{
+			{Name: "admin", Key: "admin_key", Admin: true},
+			{Name: "new_client", Key: "new_client_key"},
+		}
+		next.RateLimits.Transfer.Rate = 100
+		next.TransferService.CacheWaitTimeout = 3
+		next.TransferService.RequestsQueue.QueueName = "new_transfer_requests_queue"
+		next.TransferService.CircuitBreaker.FailureThreshold = 0
+
+		err = api_gateway.Reload(next)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(mux.get_config(), next) {
+			t.Error("Expected: ", next, ", Got: ", mux.get_config())
+		}
+		if mux.service_guards[service_transfer].circuit_breaker.is_enabled() {
+			t.Error("Expected circuit breaker of transfer service to be disabled.")
+		}
+
+		// New API key is accepted. It is not an administrator.
+		code, _ := get_config_status("new_client_key")
+		if code != http.StatusForbidden {
+			t.Error("Expected: ", http.StatusForbidden, ", Got: ", code)
+		}
+		code, status := get_config_status("admin_key")
+		if code != http.StatusOK {
+			t.Fatal("Expected: ", http.StatusOK, ", Got: ", code)
+		}
+		if status.Version != shared_config.GetVersion(next) || status.Version == first_status.Version {
+			t.Error("Expected: ", shared_config.GetVersion(next), ", Got: ", status.Version)
+		}
+	}
+
+	// Changes which need a restart are rejected as a whole
+	{
+		current := mux.get_config()
+		next, err := config_.Load("../config.yml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		next.HTTPServer.ListenPort = "1999"
+		next.BalanceService.ResponsesQueue.Port = "1999"
+		next.RateLimits.Balance.Rate = 1000
+
+		err = api_gateway.Reload(next)
+		restart_required := &shared_config.RestartRequiredError{}
+		if !errors.As(err, &restart_required) {
+			t.Fatal("Expected: ", restart_required, ", Got: ", err)
+		}
+		expected := []string{"http_server", "balance_service.redis_responses_queue"}
+		if !reflect.DeepEqual(restart_required.Settings, expected) {
+			t.Error("Expected: ", expected, ", Got: ", restart_required.Settings)
+		}
+		if mux.get_config() != current {
+			t.Error("Expected configuration to be kept.")
+		}
+
+		_, status := get_config_status("admin_key")
+		if status.LastReloadError != err.Error() {
+			t.Error("Expected: ", err.Error(), ", Got: ", status.LastReloadError)
+		}
+	}
+}
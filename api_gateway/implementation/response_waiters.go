@@ -0,0 +1,105 @@
+package implementation
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+/*
+A response_waiters registry connects a HTTP request waiting for a response with the
+thread reading responses from the Redis responses queue of a backend service.
+
+A waiter is registered under the message ID of a request before the request is put
+on the requests queue. When the response arrives, async_read_responses hands it to
+the waiter directly through a channel, so the HTTP request is completed as soon as
+the response is read from the queue.
+
+A waiter is removed from the registry when it receives its response, times out or
+when the HTTP request is cancelled by the user. Responses arriving after that are
+orphaned. Nobody will ever ask for them again, so they are discarded instead of
+being kept in memory.
+*/
+type response_waiters struct {
+	mutex   sync.Mutex
+	waiters map[int64]chan []byte
+}
+
+func create_response_waiters() *response_waiters {
+	registry := &response_waiters{
+		waiters: make(map[int64]chan []byte),
+	}
+	return registry
+}
+
+// Must be called before the request is put on the requests queue. Otherwise the
+// response may arrive before anyone is waiting for it.
+func (registry *response_waiters) register(message_id int64) chan []byte {
+	// Buffered so that deliver never blocks the thread reading responses
+	channel := make(chan []byte, 1)
+	registry.mutex.Lock()
+	registry.waiters[message_id] = channel
+	registry.mutex.Unlock()
+	return channel
+}
+
+func (registry *response_waiters) cancel(message_id int64) {
+	registry.mutex.Lock()
+	delete(registry.waiters, message_id)
+	registry.mutex.Unlock()
+}
+
+// Returns false if no one is waiting for the response. The response is orphaned and
+// the caller should discard it. The response is put into the channel while the lock is
+// held, so that a waiter that was cancelled never gets a response afterwards.
+func (registry *response_waiters) deliver(message_id int64, bytes []byte) bool {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	channel, exists := registry.waiters[message_id]
+	if !exists {
+		return false
+	}
+	delete(registry.waiters, message_id)
+
+	// Never blocks, since the channel is buffered and only one response is delivered
+	channel <- bytes
+	return true
+}
+
+// Blocks until the response arrives, the timeout expires or the context is cancelled.
+// The waiter is always removed from the registry when this function returns.
+func (registry *response_waiters) wait(
+	request_context context.Context,
+	message_id int64,
+	channel chan []byte,
+	timeout time.Duration) ([]byte, error) {
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var err error = nil
+	select {
+	case bytes := <-channel:
+		return bytes, nil
+	case <-timer.C:
+		err = context.DeadlineExceeded
+	case <-request_context.Done():
+		err = request_context.Err()
+	}
+
+	// A response delivered at the same time as the timeout or cancellation is not lost.
+	// No response can be delivered once the waiter is removed.
+	registry.cancel(message_id)
+	select {
+	case bytes := <-channel:
+		return bytes, nil
+	default:
+		return nil, err
+	}
+}
+
+func (registry *response_waiters) size() int {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	return len(registry.waiters)
+}
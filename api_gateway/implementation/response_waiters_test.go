@@ -0,0 +1,149 @@
+package implementation
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_ResponseWaiters(t *testing.T) {
+
+	// Response is delivered to the waiter as soon as it arrives
+	{
+		registry := create_response_waiters()
+		message_id := int64(1)
+		channel := registry.register(message_id)
+
+		expected_data := []byte("response 1")
+		start := time.Now()
+		go func() {
+			time.Sleep(5 * time.Millisecond)
+			registry.deliver(message_id, expected_data)
+		}()
+		data, err := registry.wait(context.Background(), message_id, channel, 10*time.Second)
+		elapsed := time.Since(start)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(data, expected_data) {
+			t.Error("Expected: ", string(expected_data), ", Got: ", string(data))
+		}
+
+		// Used to be rounded up to the next 200 ms by the polling loop
+		if elapsed >= 100*time.Millisecond {
+			t.Error("Expected response within 100 ms, Got: ", elapsed)
+		}
+		if registry.size() != 0 {
+			t.Error("Expected: ", 0, ", Got: ", registry.size())
+		}
+	}
+
+	// Response that arrives before waiting starts is not lost
+	{
+		registry := create_response_waiters()
+		message_id := int64(2)
+		channel := registry.register(message_id)
+		expected_data := []byte("response 2")
+		if !registry.deliver(message_id, expected_data) {
+			t.Fatal("Expected response to be delivered.")
+		}
+		data, err := registry.wait(context.Background(), message_id, channel, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(data, expected_data) {
+			t.Error("Expected: ", string(expected_data), ", Got: ", string(data))
+		}
+	}
+
+	// Waiter times out and late response is discarded
+	{
+		registry := create_response_waiters()
+		message_id := int64(3)
+		channel := registry.register(message_id)
+		_, err := registry.wait(context.Background(), message_id, channel, 10*time.Millisecond)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Error("Expected: ", context.DeadlineExceeded, ", Got: ", err)
+		}
+		if registry.deliver(message_id, []byte("late response")) {
+			t.Error("Expected late response to be discarded.")
+		}
+		if registry.size() != 0 {
+			t.Error("Expected: ", 0, ", Got: ", registry.size())
+		}
+	}
+
+	// Waiter stops waiting when the HTTP request is cancelled
+	{
+		registry := create_response_waiters()
+		message_id := int64(4)
+		channel := registry.register(message_id)
+		request_context, cancel := context.WithCancel(context.Background())
+		go func() {
+			time.Sleep(5 * time.Millisecond)
+			cancel()
+		}()
+		start := time.Now()
+		_, err := registry.wait(request_context, message_id, channel, 10*time.Second)
+		elapsed := time.Since(start)
+		if !errors.Is(err, context.Canceled) {
+			t.Error("Expected: ", context.Canceled, ", Got: ", err)
+		}
+		if elapsed >= time.Second {
+			t.Error("Expected cancellation within 1 s, Got: ", elapsed)
+		}
+		if registry.size() != 0 {
+			t.Error("Expected: ", 0, ", Got: ", registry.size())
+		}
+	}
+
+	// Response that arrives together with the cancellation is returned instead of the
+	// error. Repeated, since select picks one of the ready cases at random.
+	for message_id := int64(5); message_id < 105; message_id++ {
+		registry := create_response_waiters()
+		channel := registry.register(message_id)
+		expected_data := []byte("response 5")
+		registry.deliver(message_id, expected_data)
+		request_context, cancel := context.WithCancel(context.Background())
+		cancel()
+		data, err := registry.wait(request_context, message_id, channel, 10*time.Second)
+		if err != nil || !reflect.DeepEqual(data, expected_data) {
+			t.Fatal("Expected: ", string(expected_data), ", Got: ", string(data), " ", err)
+		}
+	}
+}
+
+func Test_ResponseWaitersUnderLoad(t *testing.T) {
+
+	registry := create_response_waiters()
+	number_of_requests := 10000
+
+	// Half the requests get a response, the other half time out and receive a late
+	// response afterwards. The registry must be empty once all requests complete.
+	var waitgroup sync.WaitGroup
+	for i := 0; i < number_of_requests; i++ {
+		waitgroup.Add(1)
+		go func(message_id int64) {
+			defer waitgroup.Done()
+			channel := registry.register(message_id)
+			if message_id%2 == 0 {
+				go registry.deliver(message_id, []byte("response"))
+				_, err := registry.wait(context.Background(), message_id, channel, 10*time.Second)
+				if err != nil {
+					t.Error("Expected: nil, Got: ", err)
+				}
+			} else {
+				registry.wait(context.Background(), message_id, channel, time.Millisecond)
+				registry.deliver(message_id, []byte("late response"))
+			}
+		}(int64(i))
+	}
+	waitgroup.Wait()
+
+	if registry.size() != 0 {
+		t.Error("Expected: ", 0, ", Got: ", registry.size())
+	}
+}
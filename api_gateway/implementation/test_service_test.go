@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"log"
 	"shared/messages"
+	"shared/queues"
 	"shared/responses"
 	"sync"
 	"sync/atomic"
@@ -20,8 +21,8 @@ type test_service struct {
 	is_alive           atomic.Bool
 	waitgroup          sync.WaitGroup
 	background_context context.Context
-	requests_queue     *redis.Client
-	responses_queue    *redis.Client
+	requests_queue     queues.Transport
+	responses_queue    queues.Transport
 }
 
 func create_test_service(config *config.Service) *test_service {
@@ -32,7 +33,17 @@ func create_test_service(config *config.Service) *test_service {
 	return service
 }
 
+// Requests and responses are passed on through the transport instead of the Redis
+// servers in the configuration
+func (service *test_service) set_transport(transport queues.Transport) {
+	service.requests_queue = transport
+	service.responses_queue = transport
+}
+
 func (service *test_service) prepare_redis_clients() error {
+	if service.requests_queue != nil {
+		return nil
+	}
 
 	{
 		// Prepare requests queue
@@ -46,7 +57,7 @@ func (service *test_service) prepare_redis_clients() error {
 		}
 		cancel()
 
-		service.requests_queue = requests_queue
+		service.requests_queue = queues.CreateRedisTransport(requests_queue, service.config.RequestsQueue.Transport, "test_service", queues.CreateConsumerName())
 	}
 
 	{
@@ -61,13 +72,13 @@ func (service *test_service) prepare_redis_clients() error {
 		}
 		cancel()
 
-		service.responses_queue = responses_queue
+		service.responses_queue = queues.CreateRedisTransport(responses_queue, queues.Transport_list, "", "")
 	}
 
 	return nil
 }
 
-func (service *test_service) send_response(response_message *responses.Balance) {
+func (service *test_service) send_response(response_message *responses.Balance, request_header *messages.Header) {
 	bytes_to_send, err := json.Marshal(response_message)
 	if err != nil {
 		log.Println("Failed to serialise response message. Should not happen in production.")
@@ -76,11 +87,11 @@ func (service *test_service) send_response(response_message *responses.Balance)
 		return
 	}
 
-	// Put response into responses queue
+	// Put response into the reply queue of the API gateway that sent the request
 	timeout := time.Duration(service.config.ResponsesQueue.Timeout) * time.Second
-	queue_name := service.config.ResponsesQueue.QueueName
+	queue_name := request_header.GetReplyQueueName(service.config.ResponsesQueue.QueueName)
 	timeout_context, cancel := context.WithTimeout(service.background_context, timeout)
-	_, err = service.responses_queue.LPush(timeout_context, queue_name, bytes_to_send).Result()
+	err = service.responses_queue.PushResponse(timeout_context, queue_name, bytes_to_send, 0)
 	if err != nil {
 		cancel()
 		log.Println("Failed to put response into responses queue.")
@@ -89,16 +100,17 @@ func (service *test_service) send_response(response_message *responses.Balance)
 	cancel()
 }
 
-func (service *test_service) send_failed_response(message string, request_message *messages.GET_Balance) {
+func (service *test_service) send_failed_response(error_code string, message string, request_message *messages.GET_Balance) {
 	response_message := responses.Balance{
 		Header: responses.Header{
 			MessageID: request_message.Header.MessageID,
 			Action:    request_message.Header.Action,
 		},
 		Status:       responses.Status_failed,
+		ErrorCode:    error_code,
 		ErrorMessage: message,
 	}
-	service.send_response(&response_message)
+	service.send_response(&response_message, &request_message.Header)
 }
 
 func (service *test_service) async_run() {
@@ -122,19 +134,16 @@ func (service *test_service) async_run() {
 		timeout := time.Duration(service.config.RequestsQueue.Timeout) * time.Second
 		queue_name := service.config.RequestsQueue.QueueName
 		timeout_context, cancel := context.WithTimeout(service.background_context, timeout)
-		string_slice, err := service.requests_queue.BRPop(timeout_context, timeout, queue_name).Result()
+		message, err := service.requests_queue.PopRequest(timeout_context, queue_name, timeout, 0)
 		if err != nil {
 			cancel()
 			continue
 		}
 		cancel()
 
-		// string_slice[0] gives the name of the queue
-		// string_slice[1] gives the data retrieved from the queue
-
 		// Deserialise JSON data received
 		request_message := messages.GET_Balance{}
-		err = json.Unmarshal([]byte(string_slice[1]), &request_message)
+		err = json.Unmarshal(message.Data, &request_message)
 		if err != nil {
 			log.Println("Failed to deserialise JSON message. Should not happen in production.")
 			// In practice, we will need an error notification system. I have skipped
@@ -154,10 +163,10 @@ func (service *test_service) async_run() {
 		case messages.Action_get_balance:
 			response_message.ErrorMessage = "Test service: I received your message: " + request_message.WalletID
 		default:
-			service.send_failed_response("Test service: Unknown message received.", &request_message)
+			service.send_failed_response(responses.Error_code_internal_error, "Test service: Unknown message received.", &request_message)
 			continue
 		}
-		service.send_response(&response_message)
+		service.send_response(&response_message, &request_message.Header)
 	}
 }
 
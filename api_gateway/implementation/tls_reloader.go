@@ -0,0 +1,161 @@
+package implementation
+
+import (
+	"api_gateway/config"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Files are checked for changes at most this often
+const tls_reload_check_interval time.Duration = time.Second
+
+var errInvalidTLSVersion = errors.New("Minimum TLS version must be 1.2 or 1.3")
+var errInvalidClientCA = errors.New("No certificates found in client CA file")
+
+func get_tls_version(version string) (uint16, error) {
+	switch version {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, errInvalidTLSVersion
+}
+
+// Certificates currently in use and the modification times of the files they were
+// loaded from
+type tls_files struct {
+	certificate            *tls.Certificate
+	client_cas             *x509.CertPool
+	certificate_changed_at time.Time
+	key_changed_at         time.Time
+	client_ca_changed_at   time.Time
+}
+
+/*
+Serves the certificate and client CA from the files in the configuration, and
+reloads them when the files change. Certificates can then be renewed without
+restarting the API gateway. If the new files cannot be loaded, e.g. because the
+certificate was replaced but not its key yet, the old certificates stay in use.
+
+The files are checked when a client connects, at most once every second.
+*/
+type tls_reloader struct {
+	config          *config.TLS
+	minimum_version uint16
+	files           atomic.Pointer[tls_files]
+
+	mutex         sync.Mutex // Only one connection checks the files at a time
+	last_check_at time.Time
+}
+
+func create_tls_reloader(config *config.TLS) (*tls_reloader, error) {
+	minimum_version, err := get_tls_version(config.MinimumVersion)
+	if err != nil {
+		return nil, err
+	}
+	reloader := &tls_reloader{
+		config:          config,
+		minimum_version: minimum_version,
+		last_check_at:   time.Now(),
+	}
+	files, err := reloader.load()
+	if err != nil {
+		return nil, err
+	}
+	reloader.files.Store(files)
+	return reloader, nil
+}
+
+func get_modification_time(file_path string) time.Time {
+	info, err := os.Stat(file_path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+func (reloader *tls_reloader) load() (*tls_files, error) {
+	files := &tls_files{
+		certificate_changed_at: get_modification_time(reloader.config.CertificateFile),
+		key_changed_at:         get_modification_time(reloader.config.KeyFile),
+	}
+
+	certificate, err := tls.LoadX509KeyPair(reloader.config.CertificateFile, reloader.config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	files.certificate = &certificate
+
+	if len(reloader.config.ClientCAFile) > 0 {
+		files.client_ca_changed_at = get_modification_time(reloader.config.ClientCAFile)
+		bytes, err := os.ReadFile(reloader.config.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		files.client_cas = x509.NewCertPool()
+		if !files.client_cas.AppendCertsFromPEM(bytes) {
+			return nil, errInvalidClientCA
+		}
+	}
+	return files, nil
+}
+
+func (reloader *tls_reloader) reload_if_changed() {
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+
+	if time.Since(reloader.last_check_at) < tls_reload_check_interval {
+		return
+	}
+	reloader.last_check_at = time.Now()
+
+	current := reloader.files.Load()
+	changed := !get_modification_time(reloader.config.CertificateFile).Equal(current.certificate_changed_at) ||
+		!get_modification_time(reloader.config.KeyFile).Equal(current.key_changed_at)
+	if len(reloader.config.ClientCAFile) > 0 {
+		changed = changed || !get_modification_time(reloader.config.ClientCAFile).Equal(current.client_ca_changed_at)
+	}
+	if !changed {
+		return
+	}
+
+	files, err := reloader.load()
+	if err != nil {
+		log.Println("Unable to reload TLS certificates. Old certificates remain in use: " + err.Error())
+		return
+	}
+	reloader.files.Store(files)
+	log.Println("Reloaded TLS certificates.")
+}
+
+func (reloader *tls_reloader) get_config_for_client(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	reloader.reload_if_changed()
+	files := reloader.files.Load()
+
+	tls_config := &tls.Config{
+		MinVersion:   reloader.minimum_version,
+		Certificates: []tls.Certificate{*files.certificate},
+	}
+	if files.client_cas != nil {
+		tls_config.ClientCAs = files.client_cas
+		tls_config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tls_config, nil
+}
+
+// Configuration of the listener. The actual configuration is chosen for each client
+// when it connects, so that it always uses the latest certificates.
+func (reloader *tls_reloader) get_config() *tls.Config {
+	tls_config := &tls.Config{
+		MinVersion:         reloader.minimum_version,
+		GetConfigForClient: reloader.get_config_for_client,
+	}
+	return tls_config
+}
@@ -0,0 +1,207 @@
+package implementation
+
+import (
+	"api_gateway/config"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Creates a certificate signed by the parent. Creates a self signed CA if the parent
+// is nil.
+func create_test_certificate(t *testing.T, common_name string, parent *tls.Certificate) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial_number, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial_number,
+		Subject:      pkix.Name{CommonName: common_name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer_template := template
+	var signer_key any = key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer_template = parent.Leaf
+		signer_key = parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer_template, &key.PublicKey, signer_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func write_test_certificate(t *testing.T, certificate *tls.Certificate, certificate_file string, key_file string) {
+	certificate_pem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Certificate[0]})
+	err := os.WriteFile(certificate_file, certificate_pem, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key_file) == 0 {
+		return
+	}
+	key_der, err := x509.MarshalPKCS8PrivateKey(certificate.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key_pem := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key_der})
+	err = os.WriteFile(key_file, key_pem, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_TLSReloader(t *testing.T) {
+
+	directory := t.TempDir()
+	tls_config := config.TLS{
+		CertificateFile: filepath.Join(directory, "server.crt"),
+		KeyFile:         filepath.Join(directory, "server.key"),
+		MinimumVersion:  "1.2",
+		ClientCAFile:    filepath.Join(directory, "client_ca.crt"),
+	}
+
+	server_ca := create_test_certificate(t, "server CA", nil)
+	client_ca := create_test_certificate(t, "client CA", nil)
+	client_certificate := create_test_certificate(t, "api_client", client_ca)
+	write_test_certificate(t, create_test_certificate(t, "server 1", server_ca), tls_config.CertificateFile, tls_config.KeyFile)
+	write_test_certificate(t, client_ca, tls_config.ClientCAFile, "")
+
+	reloader, err := create_tls_reloader(&tls_config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Start HTTPS server
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {}),
+	}
+	go server.Serve(tls.NewListener(listener, reloader.get_config()))
+	defer server.Close()
+	url := "https://" + listener.Addr().String() + "/"
+
+	root_cas := x509.NewCertPool()
+	root_cas.AddCert(server_ca.Leaf)
+	create_client := func(certificates []tls.Certificate) *http.Client {
+		return &http.Client{
+			Timeout: 5 * time.Second,
+			Transport: &http.Transport{
+				DisableKeepAlives: true,
+				TLSClientConfig: &tls.Config{
+					RootCAs:      root_cas,
+					Certificates: certificates,
+				},
+			},
+		}
+	}
+	get_server_name := func(client *http.Client) string {
+		response, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		return response.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	expire_last_check := func() {
+		reloader.mutex.Lock()
+		reloader.last_check_at = time.Time{}
+		reloader.mutex.Unlock()
+	}
+	client := create_client([]tls.Certificate{*client_certificate})
+
+	// Client with a certificate signed by the client CA is accepted
+	{
+		server_name := get_server_name(client)
+		if server_name != "server 1" {
+			t.Error("Expected: server 1, Got: ", server_name)
+		}
+	}
+
+	// Client without a certificate is rejected
+	{
+		_, err := create_client(nil).Get(url)
+		if err == nil {
+			t.Error("Expected client without certificate to be rejected.")
+		}
+	}
+
+	// Renewed certificate is used without restarting the server
+	{
+		write_test_certificate(t, create_test_certificate(t, "server 2", server_ca), tls_config.CertificateFile, tls_config.KeyFile)
+		changed_at := time.Now().Add(time.Minute)
+		os.Chtimes(tls_config.CertificateFile, changed_at, changed_at)
+		os.Chtimes(tls_config.KeyFile, changed_at, changed_at)
+		expire_last_check()
+
+		server_name := get_server_name(client)
+		if server_name != "server 2" {
+			t.Error("Expected: server 2, Got: ", server_name)
+		}
+	}
+
+	// Old certificate stays in use if the new files are invalid
+	{
+		err := os.WriteFile(tls_config.CertificateFile, []byte("not a certificate"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		changed_at := time.Now().Add(2 * time.Minute)
+		os.Chtimes(tls_config.CertificateFile, changed_at, changed_at)
+		expire_last_check()
+
+		server_name := get_server_name(client)
+		if server_name != "server 2" {
+			t.Error("Expected: server 2, Got: ", server_name)
+		}
+	}
+
+	// Minimum TLS version is enforced
+	{
+		reloader.minimum_version = tls.VersionTLS13
+		old_client := create_client([]tls.Certificate{*client_certificate})
+		old_client.Transport.(*http.Transport).TLSClientConfig.MaxVersion = tls.VersionTLS12
+		_, err := old_client.Get(url)
+		if err == nil {
+			t.Error("Expected TLS 1.2 client to be rejected.")
+		}
+	}
+	{
+		_, err := get_tls_version("1.0")
+		if err != errInvalidTLSVersion {
+			t.Error("Expected: ", errInvalidTLSVersion, ", Got: ", err)
+		}
+	}
+}
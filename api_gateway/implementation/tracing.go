@@ -0,0 +1,52 @@
+package implementation
+
+import (
+	"context"
+	"net/http"
+	"shared/tracing"
+	"strconv"
+)
+
+/*
+Every request is traced with W3C Trace Context. The API gateway continues the trace of
+the traceparent header or gRPC metadata of the caller, or starts a new one, and passes
+it on to the backend services in the header of each message.
+
+	POST /v1/transfer                     API gateway
+	├── LPUSH transfer_requests_queue     API gateway
+	├── wait for transfer response        API gateway
+	├── postgres transaction              Transfer service
+	└── LPUSH transfer_responses_queue:... Transfer service
+
+The time between the push of the API gateway and the database transaction of the
+backend service is the time the request spent in the requests queue.
+*/
+type span_context_key struct{}
+
+// Returns nil if the request is not traced, e.g. in unit tests calling handlers directly
+func get_span(request *http.Request) *tracing.Span {
+	span, _ := request.Context().Value(span_context_key{}).(*tracing.Span)
+	return span
+}
+
+func with_span(request *http.Request, span *tracing.Span) *http.Request {
+	return request.WithContext(context.WithValue(request.Context(), span_context_key{}, span))
+}
+
+// Trace context to put into the header of messages to backend services
+func get_trace_parent(request *http.Request) string {
+	return get_span(request).TraceParent()
+}
+
+// Names the span of a request after its route, so that spans of the same route can
+// be compared, and records its outcome
+func end_request_span(span *tracing.Span, request *http.Request, route string, status int) {
+	span.SetName(request.Method + " " + route)
+	span.SetAttribute("http.request.method", request.Method)
+	span.SetAttribute("http.route", route)
+	span.SetAttribute("http.response.status_code", strconv.Itoa(status))
+	if status >= http.StatusInternalServerError {
+		span.SetError(http.StatusText(status))
+	}
+	span.End()
+}
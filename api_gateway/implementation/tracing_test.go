@@ -0,0 +1,114 @@
+package implementation
+
+import (
+	config_ "api_gateway/config"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"shared/messages"
+	"shared/tracing"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Collects exported spans in memory
+type test_exporter struct {
+	mutex sync.Mutex
+	spans []tracing.SpanData
+}
+
+func (exporter *test_exporter) Export(spans []tracing.SpanData) error {
+	exporter.mutex.Lock()
+	defer exporter.mutex.Unlock()
+	exporter.spans = append(exporter.spans, spans...)
+	return nil
+}
+
+func Test_Tracing(t *testing.T) {
+
+	config, err := config_.Load("../config.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wallet_id := "tracing_unit_test_wallet"
+	config.Authentication.APIKeys = []config_.APIKey{
+		{
+			Name:      "tracing_unit_test",
+			Key:       "tracing_unit_test_key",
+			WalletIDs: []string{wallet_id},
+		},
+	}
+	config.DepositsService.RequestsQueue.QueueName = "tracing_requests_queue_test"
+	config.DepositsService.ResponsesQueue.QueueName = "tracing_responses_queue_test"
+	config.Operations.KeyPrefix = "tracing_test"
+
+	// No backend service reads the requests queue, so the test removes it when done
+	requests_queue := redis.NewClient(config.DepositsService.RequestsQueue.GetRedisOptions())
+	defer requests_queue.Close()
+	defer requests_queue.Del(context.Background(), config.DepositsService.RequestsQueue.QueueName)
+
+	api_gateway, err := CreateAPIGateway(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter := &test_exporter{}
+	api_gateway.http_multiplexer.tracer = tracing.CreateTracer(exporter)
+	api_gateway.Run()
+	defer api_gateway.Shutdown()
+
+	time.Sleep(2 * time.Second)
+
+	// The deposit is accepted without waiting for the deposit service
+	traceparent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, "/v1/wallets/"+wallet_id+"/deposits", strings.NewReader(`{"currency":"SGD","amount":"10.00"}`))
+	request.Header.Set("X-API-Key", "tracing_unit_test_key")
+	request.Header.Set(header_prefer, prefer_respond_async)
+	request.Header.Set(tracing.Header_traceparent, traceparent)
+	api_gateway.http_multiplexer.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusAccepted {
+		t.Fatal("Expected: ", http.StatusAccepted, ", Got: ", recorder.Code, " ", recorder.Body.String())
+	}
+
+	// The trace of the caller is passed on to the deposit service
+	bytes, err := requests_queue.RPop(context.Background(), config.DepositsService.RequestsQueue.QueueName).Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	request_message := messages.POST_Deposit{}
+	err = json.Unmarshal(bytes, &request_message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caller_context, _ := tracing.ParseTraceParent(traceparent)
+	sent_context, ok := tracing.ParseTraceParent(request_message.Header.TraceParent)
+	if !ok || sent_context.TraceID != caller_context.TraceID || !sent_context.Sampled {
+		t.Fatal("Expected: ", caller_context.TraceID, ", Got: ", request_message.Header.TraceParent)
+	}
+
+	// The span of the request is named after its route, and the push to the requests
+	// queue is its child
+	api_gateway.http_multiplexer.tracer.Flush()
+	exporter.mutex.Lock()
+	spans := exporter.spans
+	exporter.mutex.Unlock()
+	if len(spans) != 2 {
+		t.Fatal("Expected: ", 2, ", Got: ", len(spans))
+	}
+	push_span, request_span := spans[0], spans[1]
+	if request_span.Name != "POST /v1/wallets/{wallet_id}/deposits" || request_span.ParentSpanID != caller_context.SpanID {
+		t.Error("Expected: ", "POST /v1/wallets/{wallet_id}/deposits", ", Got: ", request_span.Name)
+	}
+	if request_span.SpanID != sent_context.SpanID {
+		t.Error("Expected: ", request_span.SpanID, ", Got: ", sent_context.SpanID)
+	}
+	expected := "LPUSH " + config.DepositsService.RequestsQueue.QueueName
+	if push_span.Name != expected || push_span.ParentSpanID != request_span.SpanID {
+		t.Error("Expected: ", expected, ", Got: ", push_span.Name)
+	}
+}
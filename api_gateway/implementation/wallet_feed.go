@@ -0,0 +1,368 @@
+package implementation
+
+import (
+	"api_gateway/paths"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"shared/events"
+	"shared/responses"
+	"shared/websocket"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Sent to clients of the live feed besides events. Events have the types in
+// shared/events, e.g. deposit.completed.
+const (
+	feed_message_heartbeat       string = "heartbeat"
+	feed_message_resync_required string = "resync_required"
+)
+
+type feed_message struct {
+	Type string `json:"type"`
+}
+
+// A client of the live feed of a wallet
+type wallet_feed_subscriber struct {
+	wallet_id string
+
+	// Closed when the API gateway shuts down
+	events chan events.Event
+
+	// Set if events were dropped because the client fell behind. The client is then
+	// sent the events it missed from the stream of the wallet.
+	lagged bool
+}
+
+/*
+Passes the events published by the deposit, withdraw and transfer services to the
+clients of the live feed of each wallet. Publishing never waits for a client. Events
+that do not fit into the buffer of a client are dropped, and the client catches up
+from the stream of its wallet instead.
+*/
+type wallet_feed struct {
+	mutex       sync.Mutex
+	subscribers map[string]map[*wallet_feed_subscriber]bool // Keyed by wallet ID
+	is_closed   bool
+}
+
+func create_wallet_feed() *wallet_feed {
+	return &wallet_feed{
+		subscribers: make(map[string]map[*wallet_feed_subscriber]bool),
+	}
+}
+
+// Returns nil if the API gateway is shutting down
+func (feed *wallet_feed) subscribe(wallet_id string, buffer_size int) *wallet_feed_subscriber {
+	feed.mutex.Lock()
+	defer feed.mutex.Unlock()
+	if feed.is_closed {
+		return nil
+	}
+	subscriber := &wallet_feed_subscriber{
+		wallet_id: wallet_id,
+		events:    make(chan events.Event, buffer_size),
+	}
+	if feed.subscribers[wallet_id] == nil {
+		feed.subscribers[wallet_id] = make(map[*wallet_feed_subscriber]bool)
+	}
+	feed.subscribers[wallet_id][subscriber] = true
+	return subscriber
+}
+
+func (feed *wallet_feed) unsubscribe(subscriber *wallet_feed_subscriber) {
+	feed.mutex.Lock()
+	defer feed.mutex.Unlock()
+	delete(feed.subscribers[subscriber.wallet_id], subscriber)
+	if len(feed.subscribers[subscriber.wallet_id]) == 0 {
+		delete(feed.subscribers, subscriber.wallet_id)
+	}
+}
+
+func (feed *wallet_feed) publish(event *events.Event) {
+	feed.mutex.Lock()
+	defer feed.mutex.Unlock()
+	for subscriber := range feed.subscribers[event.WalletID] {
+		select {
+		case subscriber.events <- *event:
+		default:
+			subscriber.lagged = true
+		}
+	}
+}
+
+// Makes every client catch up from the streams, e.g. because events may have been
+// published while the API gateway was not subscribed
+func (feed *wallet_feed) set_all_lagged() {
+	feed.mutex.Lock()
+	defer feed.mutex.Unlock()
+	for _, subscribers := range feed.subscribers {
+		for subscriber := range subscribers {
+			subscriber.lagged = true
+		}
+	}
+}
+
+// Returns true once if the subscriber fell behind since it was last asked
+func (feed *wallet_feed) take_lagged(subscriber *wallet_feed_subscriber) bool {
+	feed.mutex.Lock()
+	defer feed.mutex.Unlock()
+	lagged := subscriber.lagged
+	subscriber.lagged = false
+	return lagged
+}
+
+// Clients currently connected to the live feed
+func (feed *wallet_feed) size() int {
+	feed.mutex.Lock()
+	defer feed.mutex.Unlock()
+	size := 0
+	for _, subscribers := range feed.subscribers {
+		size += len(subscribers)
+	}
+	return size
+}
+
+// Tells every client that the API gateway is going away. WebSocket connections are not
+// closed by http.Server.Shutdown.
+func (feed *wallet_feed) close() {
+	feed.mutex.Lock()
+	defer feed.mutex.Unlock()
+	feed.is_closed = true
+	for _, subscribers := range feed.subscribers {
+		for subscriber := range subscribers {
+			close(subscriber.events)
+		}
+	}
+	feed.subscribers = make(map[string]map[*wallet_feed_subscriber]bool)
+}
+
+func is_timeout(err error) bool {
+	var net_error net.Error
+	return errors.As(err, &net_error) && net_error.Timeout()
+}
+
+// Receives the events published by the deposit, withdraw and transfer services and
+// passes them to the clients of the live feed
+func (api_gateway *APIGateway) async_read_wallet_events() {
+	defer func() {
+		api_gateway.waitgroup.Done()
+		log.Println("Shutdown wallet events thread.")
+	}()
+
+	mux := api_gateway.http_multiplexer
+	stream_name := api_gateway.config.WalletEvents.StreamName
+	subscription := api_gateway.redis_manager.wallet_events.Subscribe(mux.context, stream_name)
+	defer subscription.Close()
+
+	log.Println("Started up wallet events thread.")
+
+	for api_gateway.is_alive.Load() {
+
+		// Timeouts may change when the configuration is reloaded
+		timeout := time.Duration(mux.get_config().WalletEvents.Timeout) * time.Second
+		message, err := subscription.ReceiveTimeout(mux.context, timeout)
+		if err != nil {
+			if !is_timeout(err) {
+				// Events published until the subscription is restored are only in the
+				// streams
+				log.Println("Unable to receive wallet events: ", err.Error())
+				mux.wallet_feed.set_all_lagged()
+				time.Sleep(time.Second)
+			}
+			continue
+		}
+
+		switch message := message.(type) {
+		case *redis.Subscription:
+			// Subscribed again after the connection to Redis was lost
+			mux.wallet_feed.set_all_lagged()
+		case *redis.Message:
+			event := events.Event{}
+			err = json.Unmarshal([]byte(message.Payload), &event)
+			if err != nil {
+				log.Println("Error deserialising wallet event. Must not happen in production.")
+				continue
+			}
+			mux.wallet_feed.publish(&event)
+		}
+	}
+}
+
+// Sends a JSON message as a text frame. Returns false if the client is gone.
+func write_feed_message(conn *websocket.Conn, message any, write_timeout time.Duration) bool {
+	bytes, err := json.Marshal(message)
+	if err != nil {
+		log.Println("Unable to serialise live feed message. Should not happen in production.")
+		return false
+	}
+	err = conn.WriteText(bytes, time.Now().Add(write_timeout))
+	return err == nil
+}
+
+/*
+Sends the events of the wallet which came after the event with the given ID. Tells
+the client to fetch the balance again if events were already trimmed from the stream
+or too many were missed. Returns the ID of the last event sent and false if the
+client is gone.
+*/
+func (mux *http_request_multiplexer) send_missed_events(conn *websocket.Conn, wallet_id string, last_event_id string) (string, bool) {
+	wallet_events := &mux.get_config().WalletEvents
+	write_timeout := time.Duration(wallet_events.WriteTimeout) * time.Second
+	timeout := time.Duration(wallet_events.Timeout) * time.Second
+	client := mux.wallet_events
+
+	timeout_context, cancel := context.WithTimeout(mux.context, timeout)
+	oldest_id, err := events.OldestStreamID(timeout_context, client, wallet_events.StreamName, wallet_id)
+	cancel()
+	if err != nil {
+		log.Println("Unable to read wallet events: ", err.Error())
+		return last_event_id, write_feed_message(conn, feed_message{Type: feed_message_resync_required}, write_timeout)
+	}
+
+	// The stream holds no event the client has not seen
+	if len(oldest_id) == 0 {
+		return last_event_id, true
+	}
+
+	// Events after the last one seen by the client may have been trimmed
+	if events.CompareStreamIDs(oldest_id, last_event_id) > 0 {
+		return "", write_feed_message(conn, feed_message{Type: feed_message_resync_required}, write_timeout)
+	}
+
+	timeout_context, cancel = context.WithTimeout(mux.context, timeout)
+	missed_events, err := events.ReadStream(timeout_context, client, wallet_events.StreamName, wallet_id, last_event_id, wallet_events.MaximumResumedEvents+1)
+	cancel()
+	if err != nil {
+		log.Println("Unable to read wallet events: ", err.Error())
+		return last_event_id, write_feed_message(conn, feed_message{Type: feed_message_resync_required}, write_timeout)
+	}
+	if int64(len(missed_events)) > wallet_events.MaximumResumedEvents {
+		return "", write_feed_message(conn, feed_message{Type: feed_message_resync_required}, write_timeout)
+	}
+
+	for i := range missed_events {
+		if !write_feed_message(conn, &missed_events[i], write_timeout) {
+			return last_event_id, false
+		}
+		last_event_id = missed_events[i].EventID
+	}
+	return last_event_id, true
+}
+
+/*
+Pushes the events of the wallet to the client over WebSocket as they happen. Clients
+that reconnect pass the ID of the last event they received in the Last-Event-ID
+header or the last_event_id query parameter, and are sent the events they missed
+first. Events are never sent twice on the same connection.
+*/
+func (mux *http_request_multiplexer) GET_WalletEvents(input *paths.MatchResult, writer http.ResponseWriter, request *http.Request) {
+
+	// Verify that input is correct
+	wallet_id, exist := input.WildcardSegments["wallet_id"]
+	if !exist || len(wallet_id) == 0 {
+		write_problem(writer, responses.Error_code_invalid_request, "Missing wallet ID")
+		return
+	}
+	if !is_authorised(request, wallet_id) {
+		write_problem(writer, responses.Error_code_forbidden, "Wallet is not owned by caller")
+		return
+	}
+	if !websocket.IsUpgradeRequest(request) {
+		write_problem(writer, responses.Error_code_invalid_request, "Expected a WebSocket upgrade request")
+		return
+	}
+	last_event_id := request.Header.Get("Last-Event-ID")
+	if len(last_event_id) == 0 {
+		last_event_id = request.URL.Query().Get("last_event_id")
+	}
+	if len(last_event_id) > 0 && !events.IsValidStreamID(last_event_id) {
+		write_problem(writer, responses.Error_code_invalid_request, "Invalid last event ID")
+		return
+	}
+
+	if mux.wallet_events == nil {
+		write_problem(writer, responses.Error_code_service_unavailable, "Live wallet feed is not available")
+		return
+	}
+
+	// Subscribe before reading missed events, so that no event falls in between
+	wallet_events := mux.get_config().WalletEvents
+	subscriber := mux.wallet_feed.subscribe(wallet_id, wallet_events.BufferSize)
+	if subscriber == nil {
+		write_problem(writer, responses.Error_code_service_unavailable, "API gateway is shutting down")
+		return
+	}
+	defer mux.wallet_feed.unsubscribe(subscriber)
+
+	conn, err := websocket.Upgrade(writer, request)
+	if errors.Is(err, websocket.ErrNotWebSocket) {
+		write_problem(writer, responses.Error_code_invalid_request, "Invalid WebSocket handshake")
+		return
+	}
+	if err != nil {
+		log.Println("Unable to upgrade to WebSocket: ", err.Error())
+		return
+	}
+	defer conn.Close()
+	record_status(writer, http.StatusSwitchingProtocols)
+
+	heartbeat_interval := time.Duration(wallet_events.HeartbeatInterval) * time.Second
+	write_timeout := time.Duration(wallet_events.WriteTimeout) * time.Second
+
+	// Clients answer pings with pongs. Anything else they send is ignored.
+	client_gone := make(chan struct{})
+	go func() {
+		defer close(client_gone)
+		for {
+			_, _, err := conn.ReadMessage(time.Now().Add(2 * heartbeat_interval))
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	ok := true
+	if len(last_event_id) > 0 {
+		last_event_id, ok = mux.send_missed_events(conn, wallet_id, last_event_id)
+	}
+
+	heartbeat := time.NewTicker(heartbeat_interval)
+	defer heartbeat.Stop()
+	for ok {
+		select {
+		case event, is_open := <-subscriber.events:
+			if !is_open {
+				conn.WriteClose(websocket.Close_going_away, "API gateway is shutting down", time.Now().Add(write_timeout))
+				return
+			}
+			if mux.wallet_feed.take_lagged(subscriber) {
+				last_event_id, ok = mux.send_missed_events(conn, wallet_id, last_event_id)
+				if !ok {
+					break
+				}
+			}
+			if events.CompareStreamIDs(event.EventID, last_event_id) > 0 {
+				ok = write_feed_message(conn, &event, write_timeout)
+				last_event_id = event.EventID
+			}
+		case <-heartbeat.C:
+			if mux.wallet_feed.take_lagged(subscriber) {
+				last_event_id, ok = mux.send_missed_events(conn, wallet_id, last_event_id)
+				if !ok {
+					break
+				}
+			}
+			ok = conn.WritePing(nil, time.Now().Add(write_timeout)) == nil &&
+				write_feed_message(conn, feed_message{Type: feed_message_heartbeat}, write_timeout)
+		case <-client_gone:
+			return
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package implementation
+
+import (
+	"api_gateway/authentication"
+	config_ "api_gateway/config"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"reflect"
+	"shared/events"
+	"shared/websocket"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_WalletFeed(t *testing.T) {
+
+	feed := create_wallet_feed()
+	subscriber_1 := feed.subscribe("wallet_1", 2)
+	subscriber_2 := feed.subscribe("wallet_2", 2)
+	if feed.size() != 2 {
+		t.Error("Expected: ", 2, ", Got: ", feed.size())
+	}
+
+	// Events only go to the subscribers of their wallet
+	event := events.Event{EventID: "1-0", WalletID: "wallet_1"}
+	feed.publish(&event)
+	result := <-subscriber_1.events
+	if !reflect.DeepEqual(result, event) {
+		t.Error("Expected: ", event, ", Got: ", result)
+	}
+	if len(subscriber_2.events) != 0 {
+		t.Error("Expected: ", 0, ", Got: ", len(subscriber_2.events))
+	}
+
+	// Publishing does not wait for a subscriber that fell behind
+	for i := 0; i < 3; i++ {
+		feed.publish(&event)
+	}
+	if len(subscriber_1.events) != 2 {
+		t.Error("Expected: ", 2, ", Got: ", len(subscriber_1.events))
+	}
+	if !feed.take_lagged(subscriber_1) {
+		t.Error("Expected subscriber to have fallen behind.")
+	}
+	if feed.take_lagged(subscriber_1) {
+		t.Error("Expected lagged to be reported once.")
+	}
+	if feed.take_lagged(subscriber_2) {
+		t.Error("Expected subscriber not to have fallen behind.")
+	}
+
+	feed.unsubscribe(subscriber_2)
+	if feed.size() != 1 {
+		t.Error("Expected: ", 1, ", Got: ", feed.size())
+	}
+
+	// Subscribers are told when the API gateway shuts down
+	feed.close()
+	<-subscriber_1.events
+	<-subscriber_1.events
+	_, is_open := <-subscriber_1.events
+	if is_open {
+		t.Error("Expected events of subscriber to be closed.")
+	}
+	if feed.subscribe("wallet_1", 2) != nil {
+		t.Error("Expected no new subscribers after shutdown.")
+	}
+	feed.unsubscribe(subscriber_1)
+}
+
+// Reads the next text message, skipping pings and pongs
+func read_feed_message(t *testing.T, conn *websocket.Conn) events.Event {
+	for {
+		opcode, message, err := conn.ReadMessage(time.Now().Add(5 * time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opcode != websocket.Opcode_text {
+			continue
+		}
+		event := events.Event{}
+		err = json.Unmarshal(message, &event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return event
+	}
+}
+
+// Reads the next message other than a heartbeat
+func read_feed_event(t *testing.T, conn *websocket.Conn) events.Event {
+	for {
+		event := read_feed_message(t, conn)
+		if event.EventType != feed_message_heartbeat {
+			return event
+		}
+	}
+}
+
+func Test_WalletEvents(t *testing.T) {
+
+	config, err := config_.Load("../config.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wallet_id := "wallet_events_unit_test"
+	api_key := "wallet_events_unit_test_key"
+	config.Authentication.APIKeys = []config_.APIKey{
+		{
+			Name:      "wallet_events_unit_test",
+			Key:       api_key,
+			WalletIDs: []string{wallet_id},
+		},
+	}
+	config.Authentication.TokenSigningKey = "wallet_events_unit_test_signing_key"
+	config.WalletEvents.StreamName = "wallet_events_test"
+	config.WalletEvents.HeartbeatInterval = 1
+
+	api_gateway, err := CreateAPIGateway(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api_gateway.Run()
+	defer api_gateway.Shutdown()
+
+	// Ensure the stream of the wallet only has the events of this unit test
+	background_context := context.Background()
+	client := api_gateway.redis_manager.wallet_events
+	_, err = client.Del(background_context, events.GetStreamName(config.WalletEvents.StreamName, wallet_id)).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Del(background_context, events.GetStreamName(config.WalletEvents.StreamName, wallet_id))
+
+	time.Sleep(2 * time.Second)
+
+	base_url := "ws://localhost:" + config.HTTPServer.ListenPort + "/wallets/"
+	header := http.Header{}
+	header.Set("X-API-Key", api_key)
+	publish := func(new_balance string) events.Event {
+		event := events.Event{
+			EventType: events.Event_type_deposit_completed,
+			WalletID:  wallet_id,
+			CreatedAt: "2025-10-09T08:00:00Z",
+			Data: events.Data{
+				Currency:   "SGD",
+				Amount:     "1.00",
+				NewBalance: new_balance,
+			},
+		}
+		timeout_context, cancel := context.WithTimeout(background_context, 5*time.Second)
+		defer cancel()
+		err := events.Publish(timeout_context, client, config.WalletEvents.StreamName, 1000, &event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return event
+	}
+
+	// Callers may only watch the wallets they own
+	_, err = websocket.Dial(base_url+"someone_elses_wallet/events", header, nil, 5*time.Second)
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Error("Expected: handshake error with status 403, Got: ", err)
+	}
+
+	// The live feed is only served over WebSocket
+	{
+		request, err := http.NewRequest(http.MethodGet, "http://localhost:"+config.HTTPServer.ListenPort+"/wallets/"+wallet_id+"/events", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set("X-API-Key", api_key)
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusBadRequest {
+			t.Error("Expected: ", http.StatusBadRequest, ", Got: ", response.StatusCode)
+		}
+	}
+
+	// Events are pushed as they happen, with heartbeats in between
+	conn, err := websocket.Dial(base_url+wallet_id+"/events", header, nil, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event_1 := publish("1.00")
+	result := read_feed_event(t, conn)
+	if !reflect.DeepEqual(result, event_1) {
+		t.Error("Expected: ", event_1, ", Got: ", result)
+	}
+	result = read_feed_message(t, conn)
+	if result.EventType != feed_message_heartbeat {
+		t.Error("Expected: ", feed_message_heartbeat, ", Got: ", result.EventType)
+	}
+	conn.Close()
+
+	// Events missed while disconnected are sent first after reconnecting. Browsers pass
+	// a bearer token in the query string.
+	event_2 := publish("2.00")
+	event_3 := publish("3.00")
+	{
+		claims := authentication.Claims{
+			Subject:   "wallet_events_unit_test",
+			WalletIDs: []string{wallet_id},
+			ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		}
+		token, err := authentication.SignToken(&claims, []byte(config.Authentication.TokenSigningKey))
+		if err != nil {
+			t.Fatal(err)
+		}
+		query := url.Values{}
+		query.Set("access_token", token)
+		query.Set("last_event_id", event_1.EventID)
+		conn, err = websocket.Dial(base_url+wallet_id+"/events?"+query.Encode(), nil, nil, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, expected := range []events.Event{event_2, event_3} {
+			result = read_feed_event(t, conn)
+			if !reflect.DeepEqual(result, expected) {
+				t.Error("Expected: ", expected, ", Got: ", result)
+			}
+		}
+		event_4 := publish("4.00")
+		result = read_feed_event(t, conn)
+		if !reflect.DeepEqual(result, event_4) {
+			t.Error("Expected: ", event_4, ", Got: ", result)
+		}
+		conn.Close()
+	}
+
+	// Clients are told to fetch the balance again if events they missed were trimmed
+	{
+		resume_header := header.Clone()
+		resume_header.Set("Last-Event-ID", "0-1")
+		conn, err = websocket.Dial(base_url+wallet_id+"/events", resume_header, nil, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result = read_feed_event(t, conn)
+		if result.EventType != feed_message_resync_required {
+			t.Error("Expected: ", feed_message_resync_required, ", Got: ", result.EventType)
+		}
+	}
+
+	// Clients are told when the API gateway shuts down
+	api_gateway.Shutdown()
+	for {
+		_, _, err = conn.ReadMessage(time.Now().Add(5 * time.Second))
+		if err != nil {
+			break
+		}
+	}
+	close_error := &websocket.CloseError{}
+	if !errors.As(err, &close_error) || close_error.Code != websocket.Close_going_away {
+		t.Error("Expected: close error with status ", websocket.Close_going_away, ", Got: ", err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,322 @@
+package implementation
+
+import (
+	"api_gateway/paths"
+	"encoding/json"
+	"net/http"
+	"shared/messages"
+	"shared/responses"
+)
+
+// Webhooks belong to the caller that created them. Other callers cannot see them.
+func get_webhook_owner(request *http.Request) string {
+	caller_ := get_caller(request)
+	if caller_ == nil {
+		return ""
+	}
+	return caller_.name
+}
+
+// Returns false and responds with the reason if the caller may not be sent the events
+// of the wallet. Webhooks without a wallet ID receive the events of every wallet, so
+// only administrators may create them.
+func is_authorised_for_webhook(request *http.Request, wallet_id string, writer http.ResponseWriter) bool {
+	caller_ := get_caller(request)
+	if caller_ == nil {
+		write_problem(writer, responses.Error_code_unauthenticated, "Missing credentials")
+		return false
+	}
+	if len(wallet_id) == 0 {
+		if !caller_.is_admin {
+			write_problem(writer, responses.Error_code_forbidden, "Only administrators may subscribe to events of every wallet")
+			return false
+		}
+		return true
+	}
+	if !caller_.owns(wallet_id) {
+		write_problem(writer, responses.Error_code_forbidden, "Wallet is not owned by caller")
+		return false
+	}
+	return true
+}
+
+func (mux *http_request_multiplexer) check_webhooks_rate_limit(writer http.ResponseWriter, request *http.Request) bool {
+	return mux.check_rate_limit(
+		"webhooks",
+		&mux.get_config().RateLimits.Webhooks,
+		&mux.get_config().WebhookService,
+		mux.webhook_requests_queue,
+		"",
+		writer,
+		request)
+}
+
+func (mux *http_request_multiplexer) send_webhook_request(message_id int64, bytes []byte, mapper response_mapper, writer http.ResponseWriter, request *http.Request) {
+	mux.send_request_and_return_response(
+		service_webhook,
+		message_id,
+		bytes,
+		&mux.get_config().WebhookService,
+		mux.webhook_requests_queue,
+		mux.webhook_response_waiters,
+		mapper,
+		writer,
+		request)
+}
+
+// Subscribes a URL to the events of a wallet, or of every wallet if no wallet ID is
+// given. The response holds the secret used to sign the webhooks.
+func (mux *http_request_multiplexer) POST_Webhook(input *paths.MatchResult, writer http.ResponseWriter, request *http.Request) {
+	body := messages.POST_Webhook{}
+	if !read_body(writer, request, &body) {
+		return
+	}
+	mux.create_webhook(&body, nil, writer, request)
+}
+
+// Shared by every version of the API
+func (mux *http_request_multiplexer) create_webhook(
+	body *messages.POST_Webhook,
+	mapper response_mapper,
+	writer http.ResponseWriter,
+	request *http.Request) {
+
+	// Verify that input is correct. The URL and event types are checked by the webhook
+	// service.
+	if len(body.URL) == 0 {
+		write_problem(writer, responses.Error_code_invalid_request, "Missing URL")
+		return
+	}
+	if len(body.EventTypes) == 0 {
+		write_problem(writer, responses.Error_code_invalid_request, "Missing event types")
+		return
+	}
+	if !is_authorised_for_webhook(request, body.WalletID, writer) {
+		return
+	}
+	if !mux.check_webhooks_rate_limit(writer, request) {
+		return
+	}
+
+	message_id, ok := mux.next_message_id(writer)
+	if !ok {
+		return
+	}
+
+	// Prepare redis message
+	body.Owner = get_webhook_owner(request)
+	body.Header.MessageID = message_id
+	body.Header.ReplyTo = mux.webhook_reply_queue
+	body.Header.TraceParent = get_trace_parent(request)
+	body.Header.Deadline = get_deadline(&mux.get_config().WebhookService, request)
+	body.Header.Action = messages.Action_create_webhook
+	bytes, err := json.Marshal(body)
+	if err != nil {
+		write_problem(writer, responses.Error_code_internal_error, "Unable to serialise request")
+		return
+	}
+
+	mux.send_webhook_request(body.Header.MessageID, bytes, mapper, writer, request)
+}
+
+func (mux *http_request_multiplexer) GET_Webhooks(input *paths.MatchResult, writer http.ResponseWriter, request *http.Request) {
+	mux.get_webhooks(nil, writer, request)
+}
+
+// Shared by every version of the API
+func (mux *http_request_multiplexer) get_webhooks(mapper response_mapper, writer http.ResponseWriter, request *http.Request) {
+
+	owner := get_webhook_owner(request)
+	if len(owner) == 0 {
+		write_problem(writer, responses.Error_code_unauthenticated, "Missing credentials")
+		return
+	}
+	if !mux.check_webhooks_rate_limit(writer, request) {
+		return
+	}
+
+	message_id, ok := mux.next_message_id(writer)
+	if !ok {
+		return
+	}
+
+	// Prepare redis message
+	request_message := messages.GET_Webhooks{
+		Header: messages.Header{
+			MessageID:   message_id,
+			ReplyTo:     mux.webhook_reply_queue,
+			TraceParent: get_trace_parent(request),
+			Deadline:    get_deadline(&mux.get_config().WebhookService, request),
+			Action:      messages.Action_get_webhooks,
+		},
+		Owner: owner,
+	}
+	bytes, err := json.Marshal(request_message)
+	if err != nil {
+		write_problem(writer, responses.Error_code_internal_error, "Unable to serialise request")
+		return
+	}
+
+	mux.send_webhook_request(request_message.Header.MessageID, bytes, mapper, writer, request)
+}
+
+func (mux *http_request_multiplexer) DELETE_Webhook(input *paths.MatchResult, writer http.ResponseWriter, request *http.Request) {
+	mux.delete_webhook(input.WildcardSegments["webhook_id"], nil, writer, request)
+}
+
+// Shared by every version of the API
+func (mux *http_request_multiplexer) delete_webhook(
+	webhook_id string,
+	mapper response_mapper,
+	writer http.ResponseWriter,
+	request *http.Request) {
+
+	// Verify that input is correct
+	if len(webhook_id) == 0 {
+		write_problem(writer, responses.Error_code_invalid_request, "Missing webhook ID")
+		return
+	}
+	owner := get_webhook_owner(request)
+	if len(owner) == 0 {
+		write_problem(writer, responses.Error_code_unauthenticated, "Missing credentials")
+		return
+	}
+	if !mux.check_webhooks_rate_limit(writer, request) {
+		return
+	}
+
+	message_id, ok := mux.next_message_id(writer)
+	if !ok {
+		return
+	}
+
+	// Prepare redis message
+	request_message := messages.DELETE_Webhook{
+		Header: messages.Header{
+			MessageID:   message_id,
+			ReplyTo:     mux.webhook_reply_queue,
+			TraceParent: get_trace_parent(request),
+			Deadline:    get_deadline(&mux.get_config().WebhookService, request),
+			Action:      messages.Action_delete_webhook,
+		},
+		Owner:     owner,
+		WebhookID: webhook_id,
+	}
+	bytes, err := json.Marshal(request_message)
+	if err != nil {
+		write_problem(writer, responses.Error_code_internal_error, "Unable to serialise request")
+		return
+	}
+
+	mux.send_webhook_request(request_message.Header.MessageID, bytes, mapper, writer, request)
+}
+
+// The delivery log of a webhook, newest deliveries first
+func (mux *http_request_multiplexer) GET_WebhookDeliveries(input *paths.MatchResult, writer http.ResponseWriter, request *http.Request) {
+	mux.get_webhook_deliveries(input.WildcardSegments["webhook_id"], nil, writer, request)
+}
+
+// Shared by every version of the API
+func (mux *http_request_multiplexer) get_webhook_deliveries(
+	webhook_id string,
+	mapper response_mapper,
+	writer http.ResponseWriter,
+	request *http.Request) {
+
+	// Verify that input is correct
+	if len(webhook_id) == 0 {
+		write_problem(writer, responses.Error_code_invalid_request, "Missing webhook ID")
+		return
+	}
+	owner := get_webhook_owner(request)
+	if len(owner) == 0 {
+		write_problem(writer, responses.Error_code_unauthenticated, "Missing credentials")
+		return
+	}
+	if !mux.check_webhooks_rate_limit(writer, request) {
+		return
+	}
+
+	message_id, ok := mux.next_message_id(writer)
+	if !ok {
+		return
+	}
+
+	// Prepare redis message
+	request_message := messages.GET_WebhookDeliveries{
+		Header: messages.Header{
+			MessageID:   message_id,
+			ReplyTo:     mux.webhook_reply_queue,
+			TraceParent: get_trace_parent(request),
+			Deadline:    get_deadline(&mux.get_config().WebhookService, request),
+			Action:      messages.Action_get_webhook_deliveries,
+		},
+		Owner:     owner,
+		WebhookID: webhook_id,
+	}
+	bytes, err := json.Marshal(request_message)
+	if err != nil {
+		write_problem(writer, responses.Error_code_internal_error, "Unable to serialise request")
+		return
+	}
+
+	mux.send_webhook_request(request_message.Header.MessageID, bytes, mapper, writer, request)
+}
+
+// Sends the event of a delivery again, e.g. after the receiver has fixed a bug
+func (mux *http_request_multiplexer) POST_WebhookRedelivery(input *paths.MatchResult, writer http.ResponseWriter, request *http.Request) {
+	mux.redeliver_webhook(input.WildcardSegments["webhook_id"], input.WildcardSegments["delivery_id"], nil, writer, request)
+}
+
+// Shared by every version of the API
+func (mux *http_request_multiplexer) redeliver_webhook(
+	webhook_id string,
+	delivery_id string,
+	mapper response_mapper,
+	writer http.ResponseWriter,
+	request *http.Request) {
+
+	// Verify that input is correct
+	if len(webhook_id) == 0 {
+		write_problem(writer, responses.Error_code_invalid_request, "Missing webhook ID")
+		return
+	}
+	if len(delivery_id) == 0 {
+		write_problem(writer, responses.Error_code_invalid_request, "Missing delivery ID")
+		return
+	}
+	owner := get_webhook_owner(request)
+	if len(owner) == 0 {
+		write_problem(writer, responses.Error_code_unauthenticated, "Missing credentials")
+		return
+	}
+	if !mux.check_webhooks_rate_limit(writer, request) {
+		return
+	}
+
+	message_id, ok := mux.next_message_id(writer)
+	if !ok {
+		return
+	}
+
+	// Prepare redis message
+	request_message := messages.POST_WebhookRedelivery{
+		Header: messages.Header{
+			MessageID:   message_id,
+			ReplyTo:     mux.webhook_reply_queue,
+			TraceParent: get_trace_parent(request),
+			Deadline:    get_deadline(&mux.get_config().WebhookService, request),
+			Action:      messages.Action_redeliver_webhook,
+		},
+		Owner:      owner,
+		WebhookID:  webhook_id,
+		DeliveryID: delivery_id,
+	}
+	bytes, err := json.Marshal(request_message)
+	if err != nil {
+		write_problem(writer, responses.Error_code_internal_error, "Unable to serialise request")
+		return
+	}
+
+	mux.send_webhook_request(request_message.Header.MessageID, bytes, mapper, writer, request)
+}
@@ -6,6 +6,8 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	shared_config "shared/config"
+	"shared/logging"
 	"syscall"
 )
 
@@ -19,24 +21,46 @@ func main() {
 	if len(os.Args) > 1 {
 		config_file_path = os.Args[1]
 	}
-	config, err := config.Load(config_file_path)
+	initial_config, err := config.Load(config_file_path)
 	if err != nil {
 		log.Fatal("Unable to load configuration file at ", config_file_path)
 	}
+
+	// Log JSON lines from now on
+	logs, err := logging.Setup("api_gateway", initial_config.Logging.Level, initial_config.Logging.File)
+	if err != nil {
+		log.Fatal("Unable to set up logging: ", err)
+	}
+	defer logs.Close()
 	log.Println("Successfully loaded configuration file at ", config_file_path)
 
 	// Start running API gateway
-	api_gateway, err := implementation.CreateAPIGateway(config)
+	api_gateway, err := implementation.CreateAPIGateway(initial_config)
 	if err != nil {
 		log.Fatal("Unable to start API gateway.")
 	}
 	api_gateway.Run()
 
+	// Reload configuration file on SIGHUP or whenever it is changed
+	watcher := shared_config.CreateWatcher(config_file_path, func() {
+		next_config, err := config.Load(config_file_path)
+		if err != nil {
+			log.Println("Configuration not reloaded. Unable to load configuration file at ", config_file_path)
+			return
+		}
+		err = api_gateway.Reload(next_config)
+		if err != nil {
+			log.Println("Configuration not reloaded. " + err.Error())
+		}
+	})
+	watcher.Run()
+
 	// Listen for abort signal to terminate the api_gateway
 	// Pressing CTRL + C while the application is running
 	abort_channel := make(chan os.Signal, 1)
 	signal.Notify(abort_channel, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 	<-abort_channel
+	watcher.Shutdown()
 
 	// Shutdown the HTTP server gracefully
 	api_gateway.Shutdown()
@@ -5,13 +5,25 @@ const (
 	Wallets_withdrawals         string = "/wallets/{wallet_id}/withdrawals"
 	Wallets_balance             string = "/wallets/{wallet_id}/balance"
 	Wallets_transaction_history string = "/wallets/{wallet_id}/transaction_history"
+	Wallets_events              string = "/wallets/{wallet_id}/events"
 	Transfer                    string = "/transfer"
+	Batch                       string = "/batch"
+	Idempotency_keys            string = "/idempotency_keys/{idempotency_key}"
 	Test                        string = "/test"
+	Healthz                     string = "/healthz"
+	Readyz                      string = "/readyz"
+	Metrics                     string = "/metrics"
+	Admin_config                string = "/admin/config"
+	Webhooks                    string = "/webhooks"
+	Webhook                     string = "/webhooks/{webhook_id}"
+	Webhook_deliveries          string = "/webhooks/{webhook_id}/deliveries"
+	Webhook_redelivery          string = "/webhooks/{webhook_id}/deliveries/{delivery_id}/redeliver"
+	Operation                   string = "/operations/{operation_id}"
 )
 
 // These can be determined by the patterns specified above
 const (
-	maximum_number_of_wildcard_segments int = 1
+	maximum_number_of_wildcard_segments int = 2
 	maximum_number_of_keyvalue_pairs    int = 2
 )
 
@@ -19,6 +31,7 @@ const (
 // Key value pairs are specified in the query string section of a URL
 type MatchResult struct {
 	MatchFound       bool
+	Pattern          string // Pattern of the route found by Router.Match
 	WildcardSegments map[string]string
 	KeyValuePairs    map[string]string
 }
@@ -0,0 +1,160 @@
+package paths
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Handles a request whose method and path matched a route
+type Handler func(input *MatchResult, writer http.ResponseWriter, request *http.Request)
+
+/*
+Maps a method and a pattern to a handler. Patterns are made of segments separated by
+a slash /. A segment wrapped in curly braces {} is a wildcard segment, which matches
+any single segment of the path.
+
+	router.Handle(http.MethodGet, "/wallets/{wallet_id}/balance", handler)
+
+Routes are kept in a tree with one level per segment, so looking up a path takes
+O(n) time where n is the length of the path, no matter how many routes there are.
+Segments of the path are percent-decoded before they are matched, so wildcard
+segments may contain any unicode character, including an encoded slash %2F.
+
+For backward compatibility with older clients, wildcard segments may still be wrapped
+in curly braces, e.g. /wallets/{abc}/balance is the same as /wallets/abc/balance.
+*/
+type Router struct {
+	root *router_node
+}
+
+type router_node struct {
+	// Children with a fixed segment, keyed by the segment
+	children map[string]*router_node
+
+	// Child matching any segment. All routes must use the same name for a wildcard
+	// segment at the same position.
+	wildcard      *router_node
+	wildcard_name string
+
+	// Handlers of routes ending at this node, keyed by method
+	handlers map[string]Handler
+
+	// Pattern of the routes ending at this node
+	pattern string
+}
+
+func create_router_node() *router_node {
+	node := &router_node{
+		children: make(map[string]*router_node),
+		handlers: make(map[string]Handler),
+	}
+	return node
+}
+
+func CreateRouter() *Router {
+	router := &Router{
+		root: create_router_node(),
+	}
+	return router
+}
+
+func split_into_segments(path string) []string {
+	path = strings.Trim(path, "/")
+	if len(path) == 0 {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+func is_wildcard_segment(segment string) bool {
+	return len(segment) >= 2 && segment[0] == '{' && segment[len(segment)-1] == '}'
+}
+
+// Panics if the pattern conflicts with a route added before. Routes are added on
+// startup, so conflicts are found before the API gateway accepts any requests.
+func (router *Router) Handle(method string, pattern string, handler Handler) {
+	node := router.root
+	for _, segment := range split_into_segments(pattern) {
+		if is_wildcard_segment(segment) {
+			name := segment[1 : len(segment)-1]
+			if node.wildcard == nil {
+				node.wildcard = create_router_node()
+				node.wildcard_name = name
+			} else if node.wildcard_name != name {
+				panic("Conflicting wildcard segment names in pattern " + pattern)
+			}
+			node = node.wildcard
+			continue
+		}
+		child, exists := node.children[segment]
+		if !exists {
+			child = create_router_node()
+			node.children[segment] = child
+		}
+		node = child
+	}
+	if _, exists := node.handlers[method]; exists {
+		panic("Route already exists: " + method + " " + pattern)
+	}
+	node.handlers[method] = handler
+	node.pattern = pattern
+}
+
+/*
+Looks up the handler for the method and the escaped path of a request. Pass
+request.URL.EscapedPath() instead of request.URL.Path, so that an encoded slash %2F
+in a wallet ID does not split the wallet ID into two segments.
+
+Returns the handler and the wildcard segments extracted from the path. If no handler
+was found, returns nil and the methods allowed for the path. No methods are returned
+if the path does not exist at all.
+*/
+func (router *Router) Match(method string, escaped_path string) (Handler, *MatchResult, []string) {
+
+	result := &MatchResult{
+		MatchFound:       false,
+		WildcardSegments: make(map[string]string, maximum_number_of_wildcard_segments),
+	}
+
+	node := router.root
+	for _, escaped_segment := range split_into_segments(escaped_path) {
+		segment, err := url.PathUnescape(escaped_segment)
+		if err != nil {
+			return nil, result, nil
+		}
+
+		// Fixed segments take priority over wildcard segments
+		child, exists := node.children[segment]
+		if exists {
+			node = child
+			continue
+		}
+		if node.wildcard == nil {
+			return nil, result, nil
+		}
+		if is_wildcard_segment(segment) {
+			segment = segment[1 : len(segment)-1]
+		}
+		if len(segment) == 0 {
+			return nil, result, nil
+		}
+		result.WildcardSegments[node.wildcard_name] = segment
+		node = node.wildcard
+	}
+
+	result.Pattern = node.pattern
+	handler, exists := node.handlers[method]
+	if !exists {
+		allowed := make([]string, 0, len(node.handlers))
+		for allowed_method := range node.handlers {
+			allowed = append(allowed, allowed_method)
+		}
+		sort.Strings(allowed)
+		return nil, result, allowed
+	}
+
+	result.MatchFound = true
+	return handler, result, nil
+}
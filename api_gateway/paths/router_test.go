@@ -0,0 +1,162 @@
+package paths
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+// Records which handler was called
+func create_test_handler(name string, called *string) Handler {
+	return func(input *MatchResult, writer http.ResponseWriter, request *http.Request) {
+		*called = name
+	}
+}
+
+func create_test_router(called *string) *Router {
+	router := CreateRouter()
+	router.Handle(http.MethodPost, Wallets_deposits, create_test_handler("deposits", called))
+	router.Handle(http.MethodPost, Wallets_withdrawals, create_test_handler("withdrawals", called))
+	router.Handle(http.MethodPost, Transfer, create_test_handler("transfer", called))
+	router.Handle(http.MethodGet, Wallets_balance, create_test_handler("balance", called))
+	router.Handle(http.MethodGet, Wallets_transaction_history, create_test_handler("transaction_history", called))
+	router.Handle(http.MethodGet, Idempotency_keys, create_test_handler("idempotency_keys", called))
+	router.Handle(http.MethodGet, Test, create_test_handler("get_test", called))
+	router.Handle(http.MethodPost, Test, create_test_handler("post_test", called))
+	return router
+}
+
+func Test_Router(t *testing.T) {
+
+	called := ""
+	router := create_test_router(&called)
+
+	// Test with valid paths
+	{
+		handler, result, _ := router.Match(http.MethodGet, "/wallets/abc/balance")
+		if handler == nil {
+			t.Fatal("Expected handler to be found.")
+		}
+		handler(result, nil, nil)
+		if called != "balance" {
+			t.Error("Expected: balance, Got: ", called)
+		}
+		expected := map[string]string{"wallet_id": "abc"}
+		if !reflect.DeepEqual(result.WildcardSegments, expected) {
+			t.Error("Expected: ", expected, ", Got: ", result.WildcardSegments)
+		}
+	}
+	{
+		// Wallet IDs wrapped in curly braces are still accepted
+		_, result, _ := router.Match(http.MethodPost, "/wallets/%7Babc%7D/deposits")
+		expected := map[string]string{"wallet_id": "abc"}
+		if !reflect.DeepEqual(result.WildcardSegments, expected) {
+			t.Error("Expected: ", expected, ", Got: ", result.WildcardSegments)
+		}
+	}
+	{
+		// Percent encoded unicode characters and slashes in wallet IDs
+		wallet_id := "钱包/été 1"
+		path := "/wallets/" + url.PathEscape(wallet_id) + "/transaction_history/"
+		handler, result, _ := router.Match(http.MethodGet, path)
+		if handler == nil {
+			t.Fatal("Expected handler to be found for ", path)
+		}
+		expected := map[string]string{"wallet_id": wallet_id}
+		if !reflect.DeepEqual(result.WildcardSegments, expected) {
+			t.Error("Expected: ", expected, ", Got: ", result.WildcardSegments)
+		}
+	}
+	{
+		handler, _, _ := router.Match(http.MethodPost, "/transfer")
+		if handler == nil {
+			t.Fatal("Expected handler to be found.")
+		}
+	}
+
+	// Test with paths that do not exist
+	for _, path := range []string{"/", "/wallets", "/wallets/abc", "/wallets/abc/balance/extra", "/wallets//balance", "/wallets/%zz/balance", "/transfers"} {
+		handler, _, allowed := router.Match(http.MethodGet, path)
+		if handler != nil {
+			t.Error("Expected no handler for ", path)
+		}
+		if len(allowed) != 0 {
+			t.Error("Expected no allowed methods for ", path, ", Got: ", allowed)
+		}
+	}
+
+	// Test with methods that are not allowed
+	{
+		handler, _, allowed := router.Match(http.MethodDelete, "/wallets/abc/deposits")
+		if handler != nil {
+			t.Error("Expected no handler.")
+		}
+		expected := []string{http.MethodPost}
+		if !reflect.DeepEqual(allowed, expected) {
+			t.Error("Expected: ", expected, ", Got: ", allowed)
+		}
+	}
+	{
+		_, _, allowed := router.Match(http.MethodPut, "/test")
+		expected := []string{http.MethodGet, http.MethodPost}
+		if !reflect.DeepEqual(allowed, expected) {
+			t.Error("Expected: ", expected, ", Got: ", allowed)
+		}
+	}
+}
+
+/*
+Compares the route table with the chain of MatchAndExtract calls it replaced. The chain
+tried each pattern in turn, so the last route in the chain was the slowest to find.
+*/
+
+var benchmark_paths = []struct {
+	method string
+	path   string
+}{
+	{http.MethodPost, "/wallets/{wallet_1}/deposits"},
+	{http.MethodPost, "/transfer"},
+	{http.MethodGet, "/wallets/{wallet_1}/balance"},
+	{http.MethodGet, "/wallets/{wallet_1}/transaction_history"},
+	{http.MethodGet, "/idempotency_keys/{abc}"},
+}
+
+func match_with_chain(method string, path string) *MatchResult {
+	var patterns []string
+	if method == http.MethodGet {
+		patterns = []string{Wallets_balance, Wallets_transaction_history, Idempotency_keys, Test}
+	} else {
+		patterns = []string{Wallets_deposits, Wallets_withdrawals, Transfer, Test}
+	}
+	for _, pattern := range patterns {
+		result := MatchAndExtract(path, pattern)
+		if result.MatchFound {
+			return result
+		}
+	}
+	return nil
+}
+
+func Benchmark_MatchAndExtract(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		for _, benchmark_path := range benchmark_paths {
+			if match_with_chain(benchmark_path.method, benchmark_path.path) == nil {
+				b.Fatal("Expected match for ", benchmark_path.path)
+			}
+		}
+	}
+}
+
+func Benchmark_Router(b *testing.B) {
+	called := ""
+	router := create_test_router(&called)
+	for i := 0; i < b.N; i++ {
+		for _, benchmark_path := range benchmark_paths {
+			handler, _, _ := router.Match(benchmark_path.method, benchmark_path.path)
+			if handler == nil {
+				b.Fatal("Expected match for ", benchmark_path.path)
+			}
+		}
+	}
+}
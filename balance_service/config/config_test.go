@@ -16,12 +16,17 @@ func Test_LoadConfig(t *testing.T) {
 
 	expected_config := Config{
 		RequestsQueue: shared_config.RedisMessageQueue{
-			Host:      "localhost",
-			Port:      "1640",
-			Username:  "default",
-			Password:  "",
-			QueueName: "balance_requests_queue",
-			Timeout:   5,
+			Host:              "localhost",
+			Port:              "1640",
+			Username:          "default",
+			Password:          "",
+			QueueName:         "balance_requests_queue",
+			Timeout:           5,
+			Transport:         "list",
+			ConsumerGroup:     "balance_service",
+			ClaimIdleTime:     30,
+			DeadLetterQueue:   "balance_dead_letter_queue",
+			MaximumDeliveries: 5,
 		},
 		ResponsesQueue: shared_config.RedisMessageQueue{
 			Host:      "localhost",
@@ -40,6 +45,18 @@ func Test_LoadConfig(t *testing.T) {
 			BalanceTable:      "postgres.wallet.balances",
 			TransactionsTable: "postgres.wallet.transactions",
 		},
+		MetricsServer: shared_config.MetricsServer{
+			ListenPort: "1134",
+		},
+		Tracing: shared_config.Tracing{
+			Exporter: "none",
+			Endpoint: "http://localhost:4318/v1/traces",
+			Timeout:  5,
+		},
+		Logging: shared_config.Logging{
+			Level: "info",
+			File:  "",
+		},
 	}
 	if !reflect.DeepEqual(*config, expected_config) {
 		t.Fatal("Expected: ", expected_config, " Got: ", *config)
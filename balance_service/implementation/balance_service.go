@@ -7,9 +7,16 @@ import (
 	"encoding/json"
 	"errors"
 	"log"
+	"log/slog"
+	shared_config "shared/config"
+	"shared/logging"
 	"shared/messages"
+	"shared/metrics"
+	"shared/queues"
 	"shared/responses"
+	"shared/tracing"
 	"shared/utilities"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -19,29 +26,73 @@ import (
 )
 
 type BalanceService struct {
-	config             *config.Config
+	config             atomic.Pointer[config.Config]
 	is_alive           atomic.Bool
 	waitgroup          sync.WaitGroup
 	background_context context.Context
-	requests_queue     *redis.Client
-	responses_queue    *redis.Client
+	requests_queue     queues.Transport
+	responses_queue    queues.Transport
+	metrics            *metrics.ServiceMetrics
+	tracer             *tracing.Tracer
+
+	// Nil if metrics are not served
+	metrics_server *metrics.Server
 }
 
 func CreateBalanceService(config *config.Config) *BalanceService {
 	service := &BalanceService{
-		config:             config,
 		background_context: context.Background(),
+		metrics:            metrics.CreateServiceMetrics("balance_service"),
+	}
+	service.config.Store(config)
+	exporter, err := tracing.CreateExporter(
+		config.Tracing.Exporter,
+		"balance_service",
+		config.Tracing.Endpoint,
+		time.Duration(config.Tracing.Timeout)*time.Second)
+	if err != nil {
+		log.Println("Unable to export spans: ", err.Error())
 	}
+	service.tracer = tracing.CreateTracer(exporter)
 	return service
 }
 
+func (service *BalanceService) get_config() *config.Config {
+	return service.config.Load()
+}
+
+// Applies a new configuration without a restart. Returns an error and keeps the old
+// settings if any setting that needs a restart was changed.
+func (service *BalanceService) Reload(next *config.Config) error {
+	current := service.get_config()
+	err := config.CheckReload(current, next)
+	if err != nil {
+		return err
+	}
+	err = logging.SetLevel(next.Logging.Level)
+	if err != nil {
+		return err
+	}
+	service.config.Store(next)
+	log.Println("Reloaded configuration. Version " + shared_config.GetVersion(current) + " was replaced by version " + shared_config.GetVersion(next) + ".")
+	return nil
+}
+
+// Requests and responses are passed on through the transport instead of the Redis
+// servers in the configuration file, e.g. in memory shared with the API gateway in
+// tests. Must be called before Run.
+func (service *BalanceService) SetTransport(transport queues.Transport) {
+	service.requests_queue = transport
+	service.responses_queue = transport
+}
+
 func (service *BalanceService) prepare_redis_clients() error {
 
-	{
+	if service.requests_queue == nil {
 		// Prepare requests queue
-		requests_queue := redis.NewClient(service.config.RequestsQueue.GetRedisOptions())
+		requests_queue := redis.NewClient(service.get_config().RequestsQueue.GetRedisOptions())
 
-		timeout_context, cancel := context.WithTimeout(service.background_context, time.Duration(service.config.RequestsQueue.Timeout)*time.Second)
+		timeout_context, cancel := context.WithTimeout(service.background_context, time.Duration(service.get_config().RequestsQueue.Timeout)*time.Second)
 		_, err := requests_queue.Ping(timeout_context).Result()
 		if err != nil {
 			cancel()
@@ -49,14 +100,20 @@ func (service *BalanceService) prepare_redis_clients() error {
 		}
 		cancel()
 
-		service.requests_queue = requests_queue
+		// Requests are taken by this consumer of the group if the requests queue is a stream
+		requests_queue_config := &service.get_config().RequestsQueue
+		service.requests_queue = queues.CreateRedisTransport(
+			requests_queue,
+			requests_queue_config.Transport,
+			requests_queue_config.ConsumerGroup,
+			queues.CreateConsumerName())
 	}
 
-	{
+	if service.responses_queue == nil {
 		// Prepare responses queue
-		responses_queue := redis.NewClient(service.config.ResponsesQueue.GetRedisOptions())
+		responses_queue := redis.NewClient(service.get_config().ResponsesQueue.GetRedisOptions())
 
-		timeout_context, cancel := context.WithTimeout(service.background_context, time.Duration(service.config.ResponsesQueue.Timeout)*time.Second)
+		timeout_context, cancel := context.WithTimeout(service.background_context, time.Duration(service.get_config().ResponsesQueue.Timeout)*time.Second)
 		_, err := responses_queue.Ping(timeout_context).Result()
 		if err != nil {
 			cancel()
@@ -64,44 +121,98 @@ func (service *BalanceService) prepare_redis_clients() error {
 		}
 		cancel()
 
-		service.responses_queue = responses_queue
+		service.responses_queue = queues.CreateRedisTransport(responses_queue, queues.Transport_list, "", "")
 	}
 
 	return nil
 }
 
-func (service *BalanceService) send_response(response_message *responses.Balance) {
+// Returns an error if the response could not be put into the responses queue. The request
+// is then not acknowledged, so that it is processed again.
+func (service *BalanceService) send_response(response_message *responses.Balance, request_header *messages.Header, request_log *logging.Request) error {
+	service.metrics.CountMessage(response_message.Status == responses.Status_successful, response_message.ErrorCode)
+	request_log.Done(response_message.ErrorCode, response_message.ErrorMessage)
+
 	bytes_to_send, err := json.Marshal(response_message)
 	if err != nil {
-		log.Println("Failed to serialise response message. Should not happen in production.")
+		request_log.Logger().Error("Failed to serialise response message. Should not happen in production.", logging.Key_error, err.Error())
 		// In practice, we will need an error notification system. I have skipped
 		// building an error notification system due to time constraints.
-		return
+		return err
 	}
 
-	// Put response into responses queue
-	timeout := time.Duration(service.config.ResponsesQueue.Timeout) * time.Second
-	queue_name := service.config.ResponsesQueue.QueueName
+	// Put response into the reply queue of the API gateway that sent the request
+	responses_queue_config := &service.get_config().ResponsesQueue
+	timeout := time.Duration(responses_queue_config.Timeout) * time.Second
+	queue_name := request_header.GetReplyQueueName(responses_queue_config.QueueName)
+	time_to_live := time.Duration(0)
+	if len(request_header.ReplyTo) > 0 {
+		time_to_live = shared_config.Reply_queue_time_to_live
+	}
 	timeout_context, cancel := context.WithTimeout(service.background_context, timeout)
-	_, err = service.responses_queue.LPush(timeout_context, queue_name, bytes_to_send).Result()
+	push_span := service.tracer.StartPushSpan(queue_name, request_header.TraceParent)
+	err = service.responses_queue.PushResponse(timeout_context, queue_name, bytes_to_send, time_to_live)
+	push_span.EndWithError(err)
 	if err != nil {
 		cancel()
-		log.Println("Failed to put response into responses queue.")
-		return
+		request_log.Logger().Error("Failed to put response into responses queue.", logging.Key_error, err.Error())
+		return err
 	}
 	cancel()
+	return nil
 }
 
-func (service *BalanceService) send_failed_response(message string, request_message *messages.GET_Balance) {
+func (service *BalanceService) send_failed_response(error_code string, message string, request_message *messages.GET_Balance, request_log *logging.Request) error {
 	response_message := responses.Balance{
 		Header: responses.Header{
 			MessageID: request_message.Header.MessageID,
 			Action:    request_message.Header.Action,
 		},
 		Status:       responses.Status_failed,
+		ErrorCode:    error_code,
 		ErrorMessage: message,
 	}
-	service.send_response(&response_message)
+	return service.send_response(&response_message, &request_message.Header, request_log)
+}
+
+// Requests taken from a stream are processed again by another consumer unless they
+// are acknowledged. Failures are logged with the message ID from the log of the request,
+// if the request was read.
+func (service *BalanceService) acknowledge(message *queues.Message, request_log *logging.Request) {
+	if message == nil {
+		return
+	}
+	timeout := time.Duration(service.get_config().RequestsQueue.Timeout) * time.Second
+	timeout_context, cancel := context.WithTimeout(service.background_context, timeout)
+	defer cancel()
+	err := service.requests_queue.AckRequest(timeout_context, message)
+	if err != nil {
+		request_log.Logger().Error("Unable to acknowledge request", logging.Key_error, err.Error())
+	}
+}
+
+// Moves a request that cannot be processed to the dead-letter queue, where it can be
+// inspected and re-enqueued with the dlq command. Returns false if the request could not
+// be moved, so that it is not acknowledged.
+func (service *BalanceService) dead_letter(message *queues.Message, reason string, metrics_reason string) bool {
+	requests_queue_config := &service.get_config().RequestsQueue
+	if len(requests_queue_config.DeadLetterQueue) == 0 {
+		slog.Error("Dropped request", logging.Key_error, reason)
+		service.metrics.DeadLetters.Inc(metrics_reason)
+		return true
+	}
+	timeout := time.Duration(requests_queue_config.Timeout) * time.Second
+	timeout_context, cancel := context.WithTimeout(service.background_context, timeout)
+	defer cancel()
+	dead_letter := queues.CreateDeadLetter(queues.Kind_request, requests_queue_config.QueueName, reason, message.Data)
+	err := service.requests_queue.PushDeadLetter(timeout_context, requests_queue_config.DeadLetterQueue, dead_letter)
+	if err != nil {
+		slog.Error("Unable to move request to dead-letter queue", logging.Key_error, err.Error())
+		return false
+	}
+	slog.Warn("Moved request to dead-letter queue", logging.Key_error, reason)
+	service.metrics.DeadLetters.Inc(metrics_reason)
+	return true
 }
 
 func (service *BalanceService) async_run() {
@@ -118,8 +229,15 @@ func (service *BalanceService) async_run() {
 	}
 	log.Println("Created clients for Redis message queues.")
 
+	// Requests are taken by a consumer of the group if the requests queue is a stream
+	requests_queue_config := &service.get_config().RequestsQueue
+	err = queues.CheckConsumer(requests_queue_config.Transport, requests_queue_config.ConsumerGroup)
+	if err != nil {
+		log.Fatal("Unable to read requests queue: ", err)
+	}
+
 	// Open connection to PostgreSQL database
-	db, err := sql.Open("postgres", service.config.WalletDatabase.GetConnectionString())
+	db, err := sql.Open("postgres", service.get_config().WalletDatabase.GetConnectionString())
 	if err != nil {
 		log.Fatal("Could not create PostgreSQL database object.", err)
 	}
@@ -131,54 +249,102 @@ func (service *BalanceService) async_run() {
 	log.Println("Connected to PostgreSQL database.")
 
 	// Prepare commonly used SQL statements
-	get_balance, err := db.Prepare("select currency, balance from " + service.config.WalletDatabase.BalanceTable + " where wallet_id=$1")
+	get_balance, err := db.Prepare("select currency, balance from " + service.get_config().WalletDatabase.BalanceTable + " where wallet_id=$1")
 	if err != nil {
 		log.Fatal("Unable to prepare SQL statement.")
 	}
 	defer get_balance.Close()
 
 	// Service continues running until terminated by user
+	var message *queues.Message = nil
+
+	// Log of the request in message, kept until the request is acknowledged
+	var request_log *logging.Request = nil
 	for service.is_alive.Load() {
 
+		// The previous request was processed and its response was put into the
+		// responses queue, so it is not processed again
+		service.acknowledge(message, request_log)
+		request_log = nil
+
 		// Get next request from requests queue
-		timeout := time.Duration(service.config.RequestsQueue.Timeout) * time.Second
-		queue_name := service.config.RequestsQueue.QueueName
+		// Read on every request, so that a reloaded configuration is applied at once
+		requests_queue_config := &service.get_config().RequestsQueue
+		timeout := time.Duration(requests_queue_config.Timeout) * time.Second
+		claim_idle_time := time.Duration(requests_queue_config.ClaimIdleTime) * time.Second
+		queue_name := requests_queue_config.QueueName
 		timeout_context, cancel := context.WithTimeout(service.background_context, timeout)
-		string_slice, err := service.requests_queue.BRPop(timeout_context, timeout, queue_name).Result()
+		popped_at := time.Now()
+		message, err = service.requests_queue.PopRequest(timeout_context, queue_name, timeout, claim_idle_time)
 		if err != nil {
 			cancel()
 			continue
 		}
 		cancel()
+		service.metrics.QueuePopDuration.ObserveSince(popped_at)
 
-		// string_slice[0] gives the name of the queue
-		// string_slice[1] gives the data retrieved from the queue
+		// Requests taken over again and again without being acknowledged, e.g. because
+		// processing them stops the service, are not processed any more
+		maximum_deliveries := requests_queue_config.MaximumDeliveries
+		if maximum_deliveries > 0 && message.Deliveries > maximum_deliveries {
+			reason := "Delivered " + strconv.FormatInt(message.Deliveries, 10) + " times without being acknowledged"
+			if !service.dead_letter(message, reason, metrics.Reason_too_many_deliveries) {
+				message = nil
+			}
+			continue
+		}
 
 		// Deserialise JSON data received
 		request_message := messages.GET_Balance{}
-		err = json.Unmarshal([]byte(string_slice[1]), &request_message)
+		err = json.Unmarshal(message.Data, &request_message)
 		if err != nil {
-			log.Println("Failed to deserialise JSON message. Should not happen in production.")
-			// In practice, we will need an error notification system. I have skipped
-			// building an error notification system due to time constraints.
+			service.metrics.CountMessage(false, responses.Error_code_invalid_request)
+			if !service.dead_letter(message, "Failed to deserialise JSON message: "+err.Error(), metrics.Reason_invalid_message) {
+				message = nil
+			}
 			continue
 		}
+		request_log = logging.StartRequest(request_message.Header.MessageID, messages.GetActionName(request_message.Header.Action),
+			logging.Key_wallet_id, request_message.WalletID)
 
 		// Verify that the correct message was received
 		if request_message.Header.Action != messages.Action_get_balance {
-			service.send_failed_response("Message received by wrong service", &request_message)
+			if service.send_failed_response(responses.Error_code_internal_error, "Message received by wrong service", &request_message, request_log) != nil {
+				message = nil
+			}
+			continue
+		}
+
+		// Nobody is waiting for the response anymore, so the request is not applied
+		if request_message.Header.IsExpired() {
+			service.metrics.CountExpired()
+			request_log.Expired(request_message.Header.Deadline)
 			continue
 		}
 
 		// Query PostgreSQL database. Assume inputs are correct.
 		var currency string = ""
 		var balance int64 = 0
+		// A single statement runs in a database transaction of its own
+		query_started_at := time.Now()
+		database_span := service.tracer.StartDatabaseSpan(request_message.Header.TraceParent)
 		err = get_balance.QueryRow(request_message.WalletID).Scan(&currency, &balance)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			service.metrics.DatabaseTransactionDuration.ObserveSince(query_started_at, metrics.Outcome_rollback)
+			database_span.EndDatabaseSpan(metrics.Outcome_rollback)
+		} else {
+			service.metrics.DatabaseTransactionDuration.ObserveSince(query_started_at, metrics.Outcome_commit)
+			database_span.EndDatabaseSpan(metrics.Outcome_commit)
+		}
 		if err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
-				service.send_failed_response("Wallet does not exist", &request_message)
+				if service.send_failed_response(responses.Error_code_wallet_not_found, "Wallet does not exist", &request_message, request_log) != nil {
+					message = nil
+				}
 			} else {
-				service.send_failed_response("Database error", &request_message)
+				if service.send_failed_response(responses.Error_code_database_error, "Database error", &request_message, request_log) != nil {
+					message = nil
+				}
 			}
 			continue
 		}
@@ -193,12 +359,28 @@ func (service *BalanceService) async_run() {
 			Currency: currency,
 			Balance:  utilities.Convert_database_to_display_format(balance),
 		}
-		service.send_response(&response_message)
+		if service.send_response(&response_message, &request_message.Header, request_log) != nil {
+			message = nil
+		}
 	}
+
+	// The last request was processed before the service was shut down
+	service.acknowledge(message, request_log)
 }
 
 func (service *BalanceService) Run() {
 	service.is_alive.Store(true)
+
+	if len(service.get_config().MetricsServer.ListenPort) > 0 {
+		metrics_server := metrics.CreateServer(service.get_config().MetricsServer.ListenPort, service.metrics.Registry)
+		err := metrics_server.Run()
+		if err != nil {
+			log.Println("Unable to serve metrics: ", err.Error())
+		} else {
+			service.metrics_server = metrics_server
+		}
+	}
+
 	service.waitgroup.Add(1)
 	go service.async_run()
 }
@@ -206,4 +388,8 @@ func (service *BalanceService) Run() {
 func (service *BalanceService) Shutdown() {
 	service.is_alive.Store(false)
 	service.waitgroup.Wait()
+	service.tracer.Shutdown()
+	if service.metrics_server != nil {
+		service.metrics_server.Shutdown()
+	}
 }
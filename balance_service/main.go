@@ -6,6 +6,8 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	shared_config "shared/config"
+	"shared/logging"
 	"syscall"
 )
 
@@ -19,21 +21,43 @@ func main() {
 	if len(os.Args) > 1 {
 		config_file_path = os.Args[1]
 	}
-	config, err := config.Load(config_file_path)
+	initial_config, err := config.Load(config_file_path)
 	if err != nil {
 		log.Fatal("Unable to load configuration file at ", config_file_path)
 	}
+
+	// Log JSON lines from now on
+	logs, err := logging.Setup("balance_service", initial_config.Logging.Level, initial_config.Logging.File)
+	if err != nil {
+		log.Fatal("Unable to set up logging: ", err)
+	}
+	defer logs.Close()
 	log.Println("Successfully loaded configuration file at ", config_file_path)
 
 	// Start running balance service
-	balance_service := implementation.CreateBalanceService(config)
+	balance_service := implementation.CreateBalanceService(initial_config)
 	balance_service.Run()
 
+	// Reload configuration file on SIGHUP or whenever it is changed
+	watcher := shared_config.CreateWatcher(config_file_path, func() {
+		next_config, err := config.Load(config_file_path)
+		if err != nil {
+			log.Println("Configuration not reloaded. Unable to load configuration file at ", config_file_path)
+			return
+		}
+		err = balance_service.Reload(next_config)
+		if err != nil {
+			log.Println("Configuration not reloaded. " + err.Error())
+		}
+	})
+	watcher.Run()
+
 	// Listen for abort signal to terminate the balance service
 	// Pressing CTRL + C while the application is running
 	abort_channel := make(chan os.Signal, 1)
 	signal.Notify(abort_channel, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 	<-abort_channel
+	watcher.Shutdown()
 
 	// Shutdown the balance service gracefully
 	balance_service.Shutdown()
@@ -33,4 +33,14 @@ go get all
 go mod tidy
 go build
 
+cd ../webhook_service
+go get all
+go mod tidy
+go build
+
+cd ../dlq
+go get all
+go mod tidy
+go build
+
 cd ..
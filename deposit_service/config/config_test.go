@@ -16,12 +16,17 @@ func Test_LoadConfig(t *testing.T) {
 
 	expected_config := Config{
 		RequestsQueue: shared_config.RedisMessageQueue{
-			Host:      "localhost",
-			Port:      "1640",
-			Username:  "default",
-			Password:  "",
-			QueueName: "deposit_requests_queue",
-			Timeout:   5,
+			Host:              "localhost",
+			Port:              "1640",
+			Username:          "default",
+			Password:          "",
+			QueueName:         "deposit_requests_queue",
+			Timeout:           5,
+			Transport:         "list",
+			ConsumerGroup:     "deposit_service",
+			ClaimIdleTime:     30,
+			DeadLetterQueue:   "deposit_dead_letter_queue",
+			MaximumDeliveries: 5,
 		},
 		ResponsesQueue: shared_config.RedisMessageQueue{
 			Host:      "localhost",
@@ -32,13 +37,36 @@ func Test_LoadConfig(t *testing.T) {
 			Timeout:   5,
 		},
 		WalletDatabase: shared_config.PostgreSQLDatabase{
-			Host:              "localhost",
-			Port:              "5432",
-			Username:          "postgres",
-			Password:          "postgres",
-			Database:          "postgres",
-			BalanceTable:      "postgres.wallet.balances",
-			TransactionsTable: "postgres.wallet.transactions",
+			Host:                 "localhost",
+			Port:                 "5432",
+			Username:             "postgres",
+			Password:             "postgres",
+			Database:             "postgres",
+			BalanceTable:         "postgres.wallet.balances",
+			TransactionsTable:    "postgres.wallet.transactions",
+			IdempotencyKeysTable: "postgres.wallet.idempotency_keys",
+			EventsTable:          "postgres.wallet.events",
+		},
+		MetricsServer: shared_config.MetricsServer{
+			ListenPort: "1131",
+		},
+		Tracing: shared_config.Tracing{
+			Exporter: "none",
+			Endpoint: "http://localhost:4318/v1/traces",
+			Timeout:  5,
+		},
+		Logging: shared_config.Logging{
+			Level: "info",
+			File:  "",
+		},
+		EventsStream: shared_config.RedisEventsStream{
+			Host:          "localhost",
+			Port:          "1640",
+			Username:      "default",
+			Password:      "",
+			StreamName:    "wallet_events",
+			MaximumLength: 1000,
+			Timeout:       5,
 		},
 	}
 	if !reflect.DeepEqual(*config, expected_config) {
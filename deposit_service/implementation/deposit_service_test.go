@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"log"
 	"reflect"
+	"shared/events"
 	"shared/messages"
 	"shared/responses"
 	"testing"
@@ -39,6 +40,9 @@ func Test_DepositService(t *testing.T) {
 	config.ResponsesQueue.QueueName = "deposit_responses_queue_test"
 	config.WalletDatabase.BalanceTable = "postgres.test_deposit_service.balances"
 	config.WalletDatabase.TransactionsTable = "postgres.test_deposit_service.transactions"
+	config.WalletDatabase.IdempotencyKeysTable = "postgres.test_deposit_service.idempotency_keys"
+	config.WalletDatabase.EventsTable = "postgres.test_deposit_service.events"
+	config.EventsStream.StreamName = "wallet_events_test"
 
 	// Start running balance service
 	service := CreateDepositService(config)
@@ -66,6 +70,17 @@ func Test_DepositService(t *testing.T) {
 	}
 	cancel()
 
+	// Ensure the events stream of the wallet only has the events of this unit test
+	events_stream_name := events.GetStreamName(config.EventsStream.StreamName, wallet_id)
+	timeout_context, cancel = context.WithTimeout(background_context, time.Duration(config.EventsStream.Timeout)*time.Second)
+	_, err = requests_queue.Del(timeout_context, events_stream_name).Result()
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	cancel()
+	defer requests_queue.Del(background_context, events_stream_name)
+
 	// Prepare connection to PostgreSQL database
 	db, err := sql.Open("postgres", config.WalletDatabase.GetConnectionString())
 	if err != nil {
@@ -87,6 +102,14 @@ func Test_DepositService(t *testing.T) {
 		if err != nil {
 			log.Fatal(err)
 		}
+		_, err = db.Exec("delete from " + config.WalletDatabase.IdempotencyKeysTable)
+		if err != nil {
+			log.Fatal(err)
+		}
+		_, err = db.Exec("delete from " + config.WalletDatabase.EventsTable)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}()
 
 	// Deposit 1
@@ -267,6 +290,7 @@ func Test_DepositService(t *testing.T) {
 				Action:    request_message.Header.Action,
 			},
 			Status:       responses.Status_failed,
+			ErrorCode:    responses.Error_code_currency_mismatch,
 			ErrorMessage: "Currency of deposit does not match currency of wallet",
 			Currency:     "",
 			NewBalance:   "",
@@ -276,4 +300,148 @@ func Test_DepositService(t *testing.T) {
 		}
 	}
 
+	// Deposit 4 is retried with the same idempotency key. It must only be applied once.
+	idempotency_key := "deposit_service_unit_test_key"
+	deposit_4_amount := "1"
+	expected_balance_4 := "112.11"
+	for attempt := 0; attempt < 2; attempt++ {
+		// Put message into requests queue
+		request_message := messages.POST_Deposit{
+			Header: messages.Header{
+				MessageID:      message_id + int64(attempt),
+				Action:         messages.Action_deposit,
+				IdempotencyKey: idempotency_key,
+			},
+			WalletID: wallet_id,
+			Amount:   deposit_4_amount,
+			Currency: currency,
+		}
+		bytes_to_send, err := json.Marshal(request_message)
+		if err != nil {
+			t.Fatal("Could not serialise message.", err)
+		}
+		timeout := time.Duration(config.RequestsQueue.Timeout) * time.Second
+		queue_name := config.RequestsQueue.QueueName
+		timeout_context, cancel = context.WithTimeout(background_context, timeout)
+		_, err = requests_queue.LPush(timeout_context, queue_name, bytes_to_send).Result()
+		if err != nil {
+			cancel()
+			t.Fatal(err)
+		}
+		cancel()
+
+		// Wait for response from response queue
+		timeout = time.Duration(config.ResponsesQueue.Timeout) * time.Second
+		queue_name = config.ResponsesQueue.QueueName
+		timeout_context, cancel = context.WithTimeout(background_context, timeout)
+		string_slice, err := responses_queue.BRPop(timeout_context, timeout, queue_name).Result()
+		if err != nil {
+			cancel()
+			t.Fatal(err)
+		}
+		cancel()
+
+		// Deserialise JSON data received
+		response_message := responses.Deposit{}
+		err = json.Unmarshal([]byte(string_slice[1]), &response_message)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Verify response. The retry gets the response to the original request.
+		expected_response := responses.Deposit{
+			Header: responses.Header{
+				MessageID: request_message.Header.MessageID,
+				Action:    request_message.Header.Action,
+			},
+			Status:     responses.Status_successful,
+			Currency:   request_message.Currency,
+			NewBalance: expected_balance_4,
+		}
+		if !reflect.DeepEqual(response_message, expected_response) {
+			t.Fatal("Expected: ", expected_response, ", Got: ", response_message)
+		}
+	}
+
+	// Deposit 5 reuses the idempotency key of deposit 4 for a different amount
+	{
+		// Put message into requests queue
+		request_message := messages.POST_Deposit{
+			Header: messages.Header{
+				MessageID:      message_id,
+				Action:         messages.Action_deposit,
+				IdempotencyKey: idempotency_key,
+			},
+			WalletID: wallet_id,
+			Amount:   deposit_3_amount,
+			Currency: currency,
+		}
+		bytes_to_send, err := json.Marshal(request_message)
+		if err != nil {
+			t.Fatal("Could not serialise message.", err)
+		}
+		timeout := time.Duration(config.RequestsQueue.Timeout) * time.Second
+		queue_name := config.RequestsQueue.QueueName
+		timeout_context, cancel = context.WithTimeout(background_context, timeout)
+		_, err = requests_queue.LPush(timeout_context, queue_name, bytes_to_send).Result()
+		if err != nil {
+			cancel()
+			t.Fatal(err)
+		}
+		cancel()
+
+		// Wait for response from response queue
+		timeout = time.Duration(config.ResponsesQueue.Timeout) * time.Second
+		queue_name = config.ResponsesQueue.QueueName
+		timeout_context, cancel = context.WithTimeout(background_context, timeout)
+		string_slice, err := responses_queue.BRPop(timeout_context, timeout, queue_name).Result()
+		if err != nil {
+			cancel()
+			t.Fatal(err)
+		}
+		cancel()
+
+		// Deserialise JSON data received
+		response_message := responses.Deposit{}
+		err = json.Unmarshal([]byte(string_slice[1]), &response_message)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Verify response
+		expected_response := responses.Deposit{
+			Header: responses.Header{
+				MessageID: request_message.Header.MessageID,
+				Action:    request_message.Header.Action,
+			},
+			Status:       responses.Status_failed,
+			ErrorCode:    responses.Error_code_idempotency_key_reused,
+			ErrorMessage: "Idempotency key was already used for a different request",
+		}
+		if !reflect.DeepEqual(response_message, expected_response) {
+			t.Fatal("Expected: ", expected_response, ", Got: ", response_message)
+		}
+	}
+
+	// Only committed deposits are published to the live feed. The retry of deposit 4
+	// and the failed deposits are not.
+	{
+		timeout_context, cancel = context.WithTimeout(background_context, time.Duration(config.EventsStream.Timeout)*time.Second)
+		result, err := events.ReadStream(timeout_context, requests_queue, config.EventsStream.StreamName, wallet_id, "", 10)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		new_balances := []string{}
+		for _, event := range result {
+			if event.EventType != events.Event_type_deposit_completed {
+				t.Error("Expected: ", events.Event_type_deposit_completed, ", Got: ", event.EventType)
+			}
+			new_balances = append(new_balances, event.Data.NewBalance)
+		}
+		expected_new_balances := []string{expected_balance_1, expected_balance_2, expected_balance_4}
+		if !reflect.DeepEqual(new_balances, expected_new_balances) {
+			t.Error("Expected: ", expected_new_balances, ", Got: ", new_balances)
+		}
+	}
 }
@@ -0,0 +1,40 @@
+package config
+
+import (
+	"os"
+
+	shared_config "shared/config"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Only the Redis servers, the transport and the dead-letter queue of the requests queue
+// are used. The names of the queues are kept in each dead letter.
+type Service struct {
+	RequestsQueue  shared_config.RedisMessageQueue `yaml:"redis_requests_queue"`
+	ResponsesQueue shared_config.RedisMessageQueue `yaml:"redis_responses_queue"`
+}
+
+type Config struct {
+	// By the name of the backend service without the _service suffix, e.g. deposit
+	Services map[string]Service `yaml:"services"`
+
+	ListCount int64 `yaml:"list_count"`
+}
+
+func Load(filepath string) (*Config, error) {
+
+	bytes, err := os.ReadFile(filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	config := Config{}
+
+	err = yaml.Unmarshal(bytes, &config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
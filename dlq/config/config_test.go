@@ -0,0 +1,52 @@
+package config
+
+import (
+	"reflect"
+	shared_config "shared/config"
+	"testing"
+)
+
+func Test_LoadConfig(t *testing.T) {
+
+	test_file_path := "../config.yml"
+	config, err := Load(test_file_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	create_service := func(dead_letter_queue string) Service {
+		return Service{
+			RequestsQueue: shared_config.RedisMessageQueue{
+				Host:            "localhost",
+				Port:            "1640",
+				Username:        "default",
+				Password:        "",
+				Timeout:         5, // s
+				Transport:       "list",
+				DeadLetterQueue: dead_letter_queue,
+			},
+			ResponsesQueue: shared_config.RedisMessageQueue{
+				Host:     "localhost",
+				Port:     "1640",
+				Username: "default",
+				Password: "",
+				Timeout:  5, // s
+			},
+		}
+	}
+	expected_config := Config{
+		Services: map[string]Service{
+			"balance":             create_service("balance_dead_letter_queue"),
+			"deposit":             create_service("deposit_dead_letter_queue"),
+			"transaction_history": create_service("transaction_history_dead_letter_queue"),
+			"transfer":            create_service("transfer_dead_letter_queue"),
+			"webhook":             create_service("webhook_dead_letter_queue"),
+			"withdraw":            create_service("withdrawal_dead_letter_queue"),
+		},
+		ListCount: 100,
+	}
+	if !reflect.DeepEqual(*config, expected_config) {
+		t.Fatal("Expected: ", expected_config, " Got: ", *config)
+	}
+
+}
@@ -0,0 +1,24 @@
+package implementation
+
+const (
+	action_list    string = "list"
+	action_inspect string = "inspect"
+	action_edit    string = "edit"
+	action_requeue string = "requeue"
+	action_purge   string = "purge"
+
+	minimum_number_of_arguments_list int = 3
+	number_of_arguments_inspect      int = 4
+	number_of_arguments_edit         int = 5
+	number_of_arguments_requeue      int = 4
+	number_of_arguments_purge        int = 4
+
+	// Re-enqueues or purges every dead letter instead of one
+	argument_all string = "all"
+
+	// Edits the message read from the standard input instead of a file
+	argument_standard_input string = "-"
+
+	// Dead letters read at a time when all of them are re-enqueued
+	requeue_batch_size int64 = 100
+)
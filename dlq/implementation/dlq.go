@@ -0,0 +1,308 @@
+package implementation
+
+import (
+	"context"
+	"dlq/config"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"shared/queues"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+type DLQ struct {
+	config *config.Config
+}
+
+func CreateDLQ(config *config.Config) *DLQ {
+	dlq := &DLQ{
+		config: config,
+	}
+	return dlq
+}
+
+// Dead letters of one backend service
+type dead_letter_queue struct {
+	service *config.Service
+
+	// Dead letters are kept on the Redis server of the requests queue
+	requests_queue  *redis.Client
+	responses_queue *redis.Client
+}
+
+func create_dead_letter_queue(service *config.Service) *dead_letter_queue {
+	return &dead_letter_queue{
+		service:         service,
+		requests_queue:  redis.NewClient(service.RequestsQueue.GetRedisOptions()),
+		responses_queue: redis.NewClient(service.ResponsesQueue.GetRedisOptions()),
+	}
+}
+
+func (queue *dead_letter_queue) close() {
+	queue.requests_queue.Close()
+	queue.responses_queue.Close()
+}
+
+func (queue *dead_letter_queue) get_name() string {
+	return queue.service.RequestsQueue.DeadLetterQueue
+}
+
+func (queue *dead_letter_queue) create_context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), time.Duration(queue.service.RequestsQueue.Timeout)*time.Second)
+}
+
+// Replaces the message of a dead letter. Returns the ID of the edited dead letter.
+func (queue *dead_letter_queue) edit(id string, message []byte) (string, error) {
+	timeout_context, cancel := queue.create_context()
+	defer cancel()
+	dead_letter, err := queues.ReadDeadLetter(timeout_context, queue.requests_queue, queue.get_name(), id)
+	if err != nil {
+		return "", err
+	}
+	dead_letter.Message = string(message)
+	return queues.ReplaceDeadLetter(timeout_context, queue.requests_queue, queue.get_name(), dead_letter)
+}
+
+// Puts a dead letter back into the queue it was taken from and removes it from the
+// dead-letter queue
+func (queue *dead_letter_queue) requeue(dead_letter *queues.DeadLetter) error {
+	timeout_context, cancel := queue.create_context()
+	defer cancel()
+	var err error = nil
+	switch dead_letter.Kind {
+	case queues.Kind_request:
+		err = queues.Push(timeout_context, queue.requests_queue, queue.service.RequestsQueue.Transport, dead_letter.QueueName, []byte(dead_letter.Message))
+	case queues.Kind_response:
+		err = queue.responses_queue.LPush(timeout_context, dead_letter.QueueName, dead_letter.Message).Err()
+	default:
+		err = errors.New("unknown kind " + dead_letter.Kind)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = queues.DeleteDeadLetters(timeout_context, queue.requests_queue, queue.get_name(), dead_letter.ID)
+	return err
+}
+
+// Re-enqueues the dead letter with the ID, or every dead letter if the ID is all.
+// Returns the number of dead letters re-enqueued.
+func (queue *dead_letter_queue) requeue_dead_letters(id string) (int, error) {
+	requeued := 0
+	for {
+		timeout_context, cancel := queue.create_context()
+		var dead_letters []*queues.DeadLetter = nil
+		var err error = nil
+		if id == argument_all {
+			dead_letters, err = queues.ReadDeadLetters(timeout_context, queue.requests_queue, queue.get_name(), requeue_batch_size)
+		} else {
+			var dead_letter *queues.DeadLetter = nil
+			dead_letter, err = queues.ReadDeadLetter(timeout_context, queue.requests_queue, queue.get_name(), id)
+			dead_letters = []*queues.DeadLetter{dead_letter}
+		}
+		cancel()
+		if err != nil {
+			return requeued, err
+		}
+		if len(dead_letters) == 0 {
+			return requeued, nil
+		}
+		for _, dead_letter := range dead_letters {
+			err = queue.requeue(dead_letter)
+			if err != nil {
+				return requeued, err
+			}
+			requeued++
+		}
+		if id != argument_all {
+			return requeued, nil
+		}
+	}
+}
+
+// Removes the dead letter with the ID, or every dead letter if the ID is all. Returns
+// the number of dead letters removed.
+func (queue *dead_letter_queue) purge(id string) (int64, error) {
+	timeout_context, cancel := queue.create_context()
+	defer cancel()
+	if id == argument_all {
+		return queues.PurgeDeadLetters(timeout_context, queue.requests_queue, queue.get_name())
+	}
+	return queues.DeleteDeadLetters(timeout_context, queue.requests_queue, queue.get_name(), id)
+}
+
+func print_error(err error) {
+	if errors.Is(err, redis.Nil) {
+		fmt.Println("Dead letter not found.")
+		return
+	}
+	fmt.Println("Redis error occurred: ", err.Error())
+}
+
+func (dlq *DLQ) list(queue *dead_letter_queue) {
+
+	// dlq list <service> [count]
+
+	// Verify that inputs are correct
+	count := dlq.config.ListCount
+	if len(os.Args) > minimum_number_of_arguments_list {
+		parsed, err := strconv.ParseInt(os.Args[3], 10, 64)
+		if err != nil || parsed <= 0 {
+			fmt.Println("Please enter a positive count.")
+			fmt.Println()
+			fmt.Println("dlq list <service> [count]")
+			return
+		}
+		count = parsed
+	}
+
+	timeout_context, cancel := queue.create_context()
+	defer cancel()
+	dead_letters, err := queues.ReadDeadLetters(timeout_context, queue.requests_queue, queue.get_name(), count)
+	if err != nil {
+		print_error(err)
+		return
+	}
+	if len(dead_letters) == 0 {
+		fmt.Println("No dead letters in ", queue.get_name())
+		return
+	}
+	fmt.Printf("%-20s  %-20s  %-8s  %-40s  %s\n", "ID", "Failed at", "Kind", "Queue", "Reason")
+	for _, dead_letter := range dead_letters {
+		fmt.Printf("%-20s  %-20s  %-8s  %-40s  %s\n", dead_letter.ID, dead_letter.FailedAt, dead_letter.Kind, dead_letter.QueueName, dead_letter.Reason)
+	}
+}
+
+func (dlq *DLQ) inspect(queue *dead_letter_queue) {
+
+	// dlq inspect <service> <id>
+
+	// Verify that inputs are correct
+	if len(os.Args) != number_of_arguments_inspect {
+		fmt.Println("Incorrect number of arguments for inspect command. Please review the help menu for assistance. It can be accessed just by entering dlq.")
+		return
+	}
+
+	timeout_context, cancel := queue.create_context()
+	defer cancel()
+	dead_letter, err := queues.ReadDeadLetter(timeout_context, queue.requests_queue, queue.get_name(), os.Args[3])
+	if err != nil {
+		print_error(err)
+		return
+	}
+	bytes, err := json.MarshalIndent(dead_letter, "", "  ")
+	if err != nil {
+		fmt.Println("Error serialising dead letter.")
+		return
+	}
+	fmt.Println(string(bytes))
+}
+
+func (dlq *DLQ) edit(queue *dead_letter_queue) {
+
+	// dlq edit <service> <id> <file>
+
+	// Verify that inputs are correct
+	if len(os.Args) != number_of_arguments_edit {
+		fmt.Println("Incorrect number of arguments for edit command. Please review the help menu for assistance. It can be accessed just by entering dlq.")
+		return
+	}
+	var message []byte = nil
+	var err error = nil
+	if os.Args[4] == argument_standard_input {
+		message, err = io.ReadAll(os.Stdin)
+	} else {
+		message, err = os.ReadFile(os.Args[4])
+	}
+	if err != nil {
+		fmt.Println("Unable to read message: ", err.Error())
+		return
+	}
+	if !json.Valid(message) {
+		fmt.Println("Warning: the message is not valid JSON and will fail again if it is re-enqueued.")
+	}
+
+	id, err := queue.edit(os.Args[3], message)
+	if err != nil {
+		print_error(err)
+		return
+	}
+	fmt.Println("Edited dead letter. New ID: ", id)
+}
+
+func (dlq *DLQ) requeue(queue *dead_letter_queue) {
+
+	// dlq requeue <service> <id|all>
+
+	// Verify that inputs are correct
+	if len(os.Args) != number_of_arguments_requeue {
+		fmt.Println("Incorrect number of arguments for requeue command. Please review the help menu for assistance. It can be accessed just by entering dlq.")
+		return
+	}
+
+	requeued, err := queue.requeue_dead_letters(os.Args[3])
+	if err != nil {
+		fmt.Println("Re-enqueued ", requeued, " dead letters before an error.")
+		print_error(err)
+		return
+	}
+	fmt.Println("Re-enqueued ", requeued, " dead letters.")
+}
+
+func (dlq *DLQ) purge(queue *dead_letter_queue) {
+
+	// dlq purge <service> <id|all>
+
+	// Verify that inputs are correct
+	if len(os.Args) != number_of_arguments_purge {
+		fmt.Println("Incorrect number of arguments for purge command. Please review the help menu for assistance. It can be accessed just by entering dlq.")
+		return
+	}
+
+	purged, err := queue.purge(os.Args[3])
+	if err != nil {
+		print_error(err)
+		return
+	}
+	fmt.Println("Purged ", purged, " dead letters.")
+}
+
+func (dlq *DLQ) Run() {
+	if len(os.Args) < minimum_number_of_arguments_list {
+		fmt.Println("Please enter a command and a service. Please review the help menu for assistance. It can be accessed just by entering dlq.")
+		return
+	}
+	verb := os.Args[1]
+	service, ok := dlq.config.Services[os.Args[2]]
+	if !ok {
+		fmt.Println("Unknown service ", os.Args[2], ". Please enter one of the services in the configuration file.")
+		return
+	}
+	if len(service.RequestsQueue.DeadLetterQueue) == 0 {
+		fmt.Println("The ", os.Args[2], " service has no dead-letter queue.")
+		return
+	}
+	queue := create_dead_letter_queue(&service)
+	defer queue.close()
+
+	switch verb {
+	case action_list:
+		dlq.list(queue)
+	case action_inspect:
+		dlq.inspect(queue)
+	case action_edit:
+		dlq.edit(queue)
+	case action_requeue:
+		dlq.requeue(queue)
+	case action_purge:
+		dlq.purge(queue)
+	default:
+		fmt.Println("Invalid command. Please review the help menu for assistance. It can be accessed by entering this command without any arguments.")
+		fmt.Println()
+		fmt.Println("dlq")
+	}
+}
@@ -0,0 +1,77 @@
+package implementation
+
+import (
+	"context"
+	"dlq/config"
+	"errors"
+	shared_config "shared/config"
+	"shared/queues"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func Test_RequeueDeadLetters(t *testing.T) {
+	redis_queue := shared_config.RedisMessageQueue{
+		Host:            "localhost",
+		Port:            "1640",
+		Timeout:         5,
+		Transport:       queues.Transport_list,
+		DeadLetterQueue: "dlq_unit_test_dead_letter_queue",
+	}
+	queue := create_dead_letter_queue(&config.Service{RequestsQueue: redis_queue, ResponsesQueue: redis_queue})
+	defer queue.close()
+	ctx := context.Background()
+	client := queue.requests_queue
+	requests_queue := "dlq_unit_test_requests_queue"
+	responses_queue := "dlq_unit_test_responses_queue"
+	client.Del(ctx, queue.get_name(), requests_queue, responses_queue)
+	defer client.Del(ctx, queue.get_name(), requests_queue, responses_queue)
+
+	request_id, err := queues.AddDeadLetter(ctx, client, queue.get_name(), queues.CreateDeadLetter(queues.Kind_request, requests_queue, "Invalid JSON", []byte("{")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = queues.AddDeadLetter(ctx, client, queue.get_name(), queues.CreateDeadLetter(queues.Kind_response, responses_queue, "Invalid JSON", []byte("}")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Edited requests are re-enqueued with the new message
+	edited_id, err := queue.edit(request_id, []byte("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = queue.edit(request_id, []byte("{}"))
+	if !errors.Is(err, redis.Nil) {
+		t.Error("Expected: ", redis.Nil, ", Got: ", err)
+	}
+	requeued, err := queue.requeue_dead_letters(edited_id)
+	if err != nil || requeued != 1 {
+		t.Fatal("Expected: ", 1, ", Got: ", requeued, " ", err)
+	}
+	request, err := client.RPop(ctx, requests_queue).Result()
+	if err != nil || request != "{}" {
+		t.Error("Expected: ", "{}", ", Got: ", request, " ", err)
+	}
+
+	// Responses go back into the responses queue they were taken from
+	requeued, err = queue.requeue_dead_letters(argument_all)
+	if err != nil || requeued != 1 {
+		t.Fatal("Expected: ", 1, ", Got: ", requeued, " ", err)
+	}
+	response, err := client.RPop(ctx, responses_queue).Result()
+	if err != nil || response != "}" {
+		t.Error("Expected: ", "}", ", Got: ", response, " ", err)
+	}
+	length, err := client.XLen(ctx, queue.get_name()).Result()
+	if err != nil || length != 0 {
+		t.Error("Expected: ", 0, ", Got: ", length, " ", err)
+	}
+
+	// Purging an empty dead-letter queue removes nothing
+	purged, err := queue.purge(argument_all)
+	if err != nil || purged != 0 {
+		t.Error("Expected: ", 0, ", Got: ", purged, " ", err)
+	}
+}
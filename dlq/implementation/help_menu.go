@@ -0,0 +1,42 @@
+package implementation
+
+import "fmt"
+
+func PrintHelpMenu() {
+
+	fmt.Println("DIGITAL WALLET INC DEAD-LETTER QUEUES")
+	fmt.Println()
+
+	fmt.Println("Requests and responses which cannot be processed are moved to the dead-letter queue of their backend service. The service is one of balance, deposit, transaction_history, transfer, webhook or withdraw.")
+	fmt.Println()
+
+	fmt.Println("This command allows you to list the dead letters of the specified service, oldest first, with the reason they failed.")
+	fmt.Println()
+
+	fmt.Println("\tdlq list <service> [count]")
+	fmt.Println()
+
+	fmt.Println("This command allows you to print the specified dead letter, including its message.")
+	fmt.Println()
+
+	fmt.Println("\tdlq inspect <service> <id>")
+	fmt.Println()
+
+	fmt.Println("This command allows you to replace the message of the specified dead letter with the contents of a file, or of the standard input if the file is -. The edited dead letter is given a new ID.")
+	fmt.Println()
+
+	fmt.Println("\tdlq edit <service> <id> <file>")
+	fmt.Println()
+
+	fmt.Println("This command allows you to put the specified dead letter, or all of them, back into the queue it was taken from. Re-enqueued dead letters are removed from the dead-letter queue.")
+	fmt.Println()
+
+	fmt.Println("\tdlq requeue <service> <id|all>")
+	fmt.Println()
+
+	fmt.Println("This command allows you to remove the specified dead letter, or all of them, without re-enqueuing them.")
+	fmt.Println()
+
+	fmt.Println("\tdlq purge <service> <id|all>")
+	fmt.Println()
+}
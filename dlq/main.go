@@ -0,0 +1,26 @@
+package main
+
+import (
+	"dlq/config"
+	"dlq/implementation"
+	"log"
+	"os"
+)
+
+func main() {
+
+	if len(os.Args) == 1 {
+		implementation.PrintHelpMenu()
+		return
+	}
+
+	// Load configuration file
+	config_file_path := "config.yml"
+	config, err := config.Load(config_file_path)
+	if err != nil {
+		log.Fatal("Unable to load configuration file at ", config_file_path)
+	}
+
+	dlq := implementation.CreateDLQ(config)
+	dlq.Run()
+}
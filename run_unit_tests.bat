@@ -14,6 +14,10 @@ cd ../deposit_service
 go clean --testcache
 go test ./...
 
+cd ../dlq
+go clean --testcache
+go test ./...
+
 cd ../shared
 go clean --testcache
 go test ./...
@@ -26,6 +30,10 @@ cd ../transfer_service
 go clean --testcache
 go test ./...
 
+cd ../webhook_service
+go clean --testcache
+go test ./...
+
 cd ../withdraw_service
 go clean --testcache
 go test ./...
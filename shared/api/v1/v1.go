@@ -0,0 +1,210 @@
+package v1
+
+/*
+Bodies of the requests and responses of version 1 of the public API, served by the
+API gateway under /v1. They are kept apart from the messages passed between the API
+gateway and the backend services, so that backend services can change their messages
+without breaking clients. Fields are only ever added to a version. Anything else
+needs a new version. Failed requests are answered with responses.Problem.
+
+Amounts are decimal strings, e.g. "10.50", so that no precision is lost.
+*/
+
+// Types of transactions
+const (
+	Transaction_type_deposit    string = "deposit"
+	Transaction_type_withdrawal string = "withdrawal"
+)
+
+// Operations that can be sent with an idempotency key
+const (
+	Operation_deposit    string = "deposit"
+	Operation_withdrawal string = "withdrawal"
+	Operation_transfer   string = "transfer"
+	Operation_batch      string = "batch" // Only atomic batches
+)
+
+// POST /v1/wallets/{wallet_id}/deposits
+type DepositRequest struct {
+	Amount   string `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+type Deposit struct {
+	Currency   string `json:"currency"`
+	NewBalance string `json:"new_balance"`
+}
+
+// POST /v1/wallets/{wallet_id}/withdrawals
+type WithdrawalRequest struct {
+	Amount   string `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+type Withdrawal struct {
+	Currency   string `json:"currency"`
+	NewBalance string `json:"new_balance"`
+}
+
+// POST /v1/transfer
+type TransferRequest struct {
+	SourceWalletID      string `json:"source_wallet_id"`
+	DestinationWalletID string `json:"destination_wallet_id"`
+	Amount              string `json:"amount"`
+	Currency            string `json:"currency"`
+}
+
+// New balance of the source wallet
+type Transfer struct {
+	Currency   string `json:"currency"`
+	NewBalance string `json:"new_balance"`
+}
+
+// GET /v1/wallets/{wallet_id}/balance
+type Balance struct {
+	Currency string `json:"currency"`
+	Balance  string `json:"balance"`
+}
+
+type Transaction struct {
+	Date     string `json:"date"` // YYYY-MM-DD
+	Type     string `json:"type"`
+	Currency string `json:"currency"`
+	Amount   string `json:"amount"`
+}
+
+// GET /v1/wallets/{wallet_id}/transaction_history?from=YYYY-MM-DD&to=YYYY-MM-DD
+type TransactionHistory struct {
+	Transactions []Transaction `json:"transactions"`
+}
+
+// Error code and message of a failed request
+type Error struct {
+	Code   string `json:"code"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Response to a deposit, withdrawal, transfer or atomic batch. Exactly one of the
+// fields is set.
+type Result struct {
+	Deposit    *Deposit    `json:"deposit,omitempty"`
+	Withdrawal *Withdrawal `json:"withdrawal,omitempty"`
+	Transfer   *Transfer   `json:"transfer,omitempty"`
+	Batch      *Batch      `json:"batch,omitempty"`
+	Error      *Error      `json:"error,omitempty"`
+}
+
+/*
+POST /v1/batch
+
+Items are sent to the backend services at the same time and applied independently of
+each other, unless Atomic is set. Atomic batches are applied by the transfer service in a
+single database transaction, so either every item is applied or none. Items of atomic
+batches cannot have their own idempotency keys. Use the Idempotency-Key header of the
+batch instead.
+*/
+type BatchRequest struct {
+	Atomic bool        `json:"atomic,omitempty"`
+	Items  []BatchItem `json:"items"`
+}
+
+// Deposits and withdrawals need a wallet ID, transfers a source and destination wallet ID
+type BatchItem struct {
+	ItemID              string `json:"item_id"`   // Unique within the batch
+	Operation           string `json:"operation"` // deposit, withdrawal or transfer
+	WalletID            string `json:"wallet_id,omitempty"`
+	SourceWalletID      string `json:"source_wallet_id,omitempty"`
+	DestinationWalletID string `json:"destination_wallet_id,omitempty"`
+	Amount              string `json:"amount"`
+	Currency            string `json:"currency"`
+	IdempotencyKey      string `json:"idempotency_key,omitempty"`
+}
+
+// Status is the HTTP status the item would have been answered with on its own
+type BatchItemResult struct {
+	ItemID string `json:"item_id"`
+	Status int    `json:"status"`
+	Result
+}
+
+// Items are in the same order as in the request
+type Batch struct {
+	Items []BatchItemResult `json:"items"`
+}
+
+// GET /v1/idempotency_keys/{idempotency_key}
+type RequestOutcome struct {
+	Operation   string `json:"operation"`
+	ProcessedAt string `json:"processed_at"` // RFC 3339
+	Result
+}
+
+// Statuses of operations
+const (
+	Operation_status_pending   string = "pending"
+	Operation_status_succeeded string = "succeeded"
+	Operation_status_failed    string = "failed"
+)
+
+/*
+GET /v1/operations/{operation_id}
+
+Returned with 202 Accepted by deposits, withdrawals and transfers sent with
+Prefer: respond-async. The result is set once the operation is no longer pending.
+*/
+type Operation struct {
+	OperationID string `json:"operation_id"`
+	Operation   string `json:"operation"`
+	Status      string `json:"status"`
+	CreatedAt   string `json:"created_at"`             // RFC 3339
+	CompletedAt string `json:"completed_at,omitempty"` // RFC 3339
+	Result
+}
+
+// POST /v1/webhooks. Events of every wallet are sent if no wallet ID is given.
+type WebhookRequest struct {
+	URL        string   `json:"url"`
+	WalletID   string   `json:"wallet_id,omitempty"`
+	EventTypes []string `json:"event_types"`
+}
+
+// The secret is only returned when the webhook is created
+type Webhook struct {
+	WebhookID  string   `json:"webhook_id"`
+	URL        string   `json:"url"`
+	WalletID   string   `json:"wallet_id,omitempty"`
+	EventTypes []string `json:"event_types"`
+	Secret     string   `json:"secret,omitempty"`
+	CreatedAt  string   `json:"created_at"` // RFC 3339
+}
+
+// GET /v1/webhooks
+type Webhooks struct {
+	Webhooks []Webhook `json:"webhooks"`
+}
+
+// A single attempt to deliver an event. StatusCode is 0 if no HTTP response was received.
+type WebhookDeliveryAttempt struct {
+	Attempt     int    `json:"attempt"`
+	AttemptedAt string `json:"attempted_at"` // RFC 3339
+	StatusCode  int    `json:"status_code,omitempty"`
+	Error       string `json:"error,omitempty"`
+	Duration    int64  `json:"duration"` // ms
+}
+
+// POST /v1/webhooks/{webhook_id}/deliveries/{delivery_id}/redeliver
+type WebhookDelivery struct {
+	DeliveryID    string                   `json:"delivery_id"`
+	EventID       string                   `json:"event_id"`
+	EventType     string                   `json:"event_type"`
+	Status        string                   `json:"status"`
+	NextAttemptAt string                   `json:"next_attempt_at,omitempty"`
+	RedeliveryOf  string                   `json:"redelivery_of,omitempty"`
+	CreatedAt     string                   `json:"created_at"`
+	Attempts      []WebhookDeliveryAttempt `json:"attempts"`
+}
+
+// GET /v1/webhooks/{webhook_id}/deliveries. Newest deliveries come first.
+type WebhookDeliveries struct {
+	Deliveries []WebhookDelivery `json:"deliveries"`
+}
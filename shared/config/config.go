@@ -2,6 +2,7 @@ package config
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/redis/go-redis/v9"
 )
@@ -13,6 +14,35 @@ type RedisMessageQueue struct {
 	Password  string `yaml:"password"`
 	QueueName string `yaml:"queue_name"`
 	Timeout   int    `yaml:"timeout"`
+
+	// Requests queues are lists unless the transport is stream. Requests in a stream are
+	// read by the consumer group and acknowledged once processed. Requests pending for
+	// longer than the claim idle time are processed again by another consumer.
+	Transport     string `yaml:"transport"`       // list or stream
+	ConsumerGroup string `yaml:"consumer_group"`  // stream only
+	ClaimIdleTime int    `yaml:"claim_idle_time"` // s, stream only
+
+	// Requests which are not valid JSON, or which were delivered more than the maximum
+	// deliveries without being acknowledged, are moved to the dead-letter queue on the
+	// same Redis server. They are dropped if there is no dead-letter queue.
+	DeadLetterQueue   string `yaml:"dead_letter_queue"`
+	MaximumDeliveries int64  `yaml:"maximum_deliveries"` // stream only, 0 for no limit
+}
+
+/*
+Redis streams holding the latest events of each wallet, one stream per wallet. New
+events are also published on the channel named after the streams, so that API
+gateways can push them to clients as they happen. Streams are trimmed to roughly the
+maximum length.
+*/
+type RedisEventsStream struct {
+	Host          string `yaml:"host"`
+	Port          string `yaml:"port"`
+	Username      string `yaml:"username"`
+	Password      string `yaml:"password"`
+	StreamName    string `yaml:"stream_name"`
+	MaximumLength int64  `yaml:"maximum_length"`
+	Timeout       int    `yaml:"timeout"`
 }
 
 type PostgreSQLDatabase struct {
@@ -23,6 +53,12 @@ type PostgreSQLDatabase struct {
 	Database          string `yaml:"database"`
 	BalanceTable      string `yaml:"balance_table"`
 	TransactionsTable string `yaml:"transactions_table"`
+
+	// Requests processed with an idempotency key and their responses
+	IdempotencyKeysTable string `yaml:"idempotency_keys_table"`
+
+	// Deposits, withdrawals and transfers committed, waiting to be sent to webhooks
+	EventsTable string `yaml:"events_table"`
 }
 
 func (message_queue *RedisMessageQueue) GetRedisOptions() *redis.Options {
@@ -34,8 +70,69 @@ func (message_queue *RedisMessageQueue) GetRedisOptions() *redis.Options {
 	return options
 }
 
+// The Redis server and transport of a queue without the name of the queue and the
+// timeouts
+func (message_queue *RedisMessageQueue) GetServer() RedisMessageQueue {
+	return RedisMessageQueue{
+		Host:          message_queue.Host,
+		Port:          message_queue.Port,
+		Username:      message_queue.Username,
+		Password:      message_queue.Password,
+		Transport:     message_queue.Transport,
+		ConsumerGroup: message_queue.ConsumerGroup,
+	}
+}
+
+func (events_stream *RedisEventsStream) GetRedisOptions() *redis.Options {
+	options := &redis.Options{
+		Addr:     events_stream.Host + ":" + events_stream.Port,
+		Username: events_stream.Username,
+		Password: events_stream.Password,
+	}
+	return options
+}
+
+// The Redis server of the streams without the name, maximum length and timeout
+func (events_stream *RedisEventsStream) GetServer() RedisEventsStream {
+	return RedisEventsStream{
+		Host:     events_stream.Host,
+		Port:     events_stream.Port,
+		Username: events_stream.Username,
+		Password: events_stream.Password,
+	}
+}
+
 func (postgres *PostgreSQLDatabase) GetConnectionString() string {
 	return fmt.Sprintf("host=%s port=%s user=%s "+
 		"password=%s dbname=%s sslmode=disable",
 		postgres.Host, postgres.Port, postgres.Username, postgres.Password, postgres.Database)
 }
+
+// Reply queues of API gateways that are no longer running are deleted by Redis after
+// this time without any responses being put into them
+const Reply_queue_time_to_live time.Duration = 10 * time.Minute
+
+// Backend services serve Prometheus metrics on /metrics of this port. Metrics are not
+// served if the port is empty.
+type MetricsServer struct {
+	ListenPort string `yaml:"listen_port"`
+}
+
+/*
+Spans of requests are exported to an OpenTelemetry collector over OTLP/HTTP with the
+otlp exporter, or written to standard output with the stdout exporter for local
+debugging. Trace context is still passed on with the none exporter.
+*/
+type Tracing struct {
+	Exporter string `yaml:"exporter"` // none, stdout or otlp
+	Endpoint string `yaml:"endpoint"` // URL of the OTLP/HTTP traces endpoint
+	Timeout  int    `yaml:"timeout"`
+}
+
+// Logs are JSON lines of the given level and above, written to standard error if no
+// file is set. Amounts are only logged at the debug level. The level is applied when
+// the configuration is reloaded, the file only by a restart.
+type Logging struct {
+	Level string `yaml:"level"` // debug, info, warn or error
+	File  string `yaml:"file"`
+}
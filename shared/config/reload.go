@@ -0,0 +1,143 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Identifies the content of a configuration. Two configurations have the same version
+// if and only if all their settings are the same.
+func GetVersion(config any) string {
+	bytes, err := json.Marshal(config)
+	if err != nil {
+		return ""
+	}
+	hash := sha256.Sum256(bytes)
+	return hex.EncodeToString(hash[:6])
+}
+
+/*
+Collects the settings that were changed in a new configuration file but cannot be
+applied without a restart, e.g. ports and database credentials.
+
+	restart_required := config.RestartRequired{}
+	restart_required.Compare("node_id", current.NodeID, next.NodeID)
+	err := restart_required.Err()
+*/
+type RestartRequired struct {
+	settings []string
+}
+
+func (restart_required *RestartRequired) Compare(setting string, current any, next any) {
+	if !reflect.DeepEqual(current, next) {
+		restart_required.settings = append(restart_required.settings, setting)
+	}
+}
+
+// Returns nil if all changed settings can be applied without a restart
+func (restart_required *RestartRequired) Err() error {
+	if len(restart_required.settings) == 0 {
+		return nil
+	}
+	return &RestartRequiredError{Settings: restart_required.settings}
+}
+
+type RestartRequiredError struct {
+	Settings []string
+}
+
+func (err *RestartRequiredError) Error() string {
+	return "Restart required to change " + strings.Join(err.Settings, ", ")
+}
+
+// Time between checks whether the configuration file was changed
+const Watch_interval time.Duration = time.Second
+
+/*
+A Watcher calls a function whenever its configuration file is changed or the process
+receives SIGHUP, so that the configuration can be reloaded without a restart. Files
+are checked for changes by their modification time, which works on every platform
+without any external library.
+*/
+type Watcher struct {
+	file_path   string
+	reload      func()
+	modified_at time.Time
+
+	is_alive  atomic.Bool
+	waitgroup sync.WaitGroup
+	signals   chan os.Signal
+	stop      chan struct{}
+}
+
+func CreateWatcher(file_path string, reload func()) *Watcher {
+	watcher := &Watcher{
+		file_path:   file_path,
+		reload:      reload,
+		modified_at: get_modification_time(file_path),
+		signals:     make(chan os.Signal, 1),
+		stop:        make(chan struct{}),
+	}
+	return watcher
+}
+
+// Returns the zero time if the file cannot be read
+func get_modification_time(file_path string) time.Time {
+	info, err := os.Stat(file_path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+func (watcher *Watcher) Run() {
+	watcher.is_alive.Store(true)
+	signal.Notify(watcher.signals, syscall.SIGHUP)
+	watcher.waitgroup.Add(1)
+	go watcher.async_watch()
+}
+
+func (watcher *Watcher) Shutdown() {
+	if !watcher.is_alive.Swap(false) {
+		return
+	}
+	signal.Stop(watcher.signals)
+	close(watcher.stop)
+	watcher.waitgroup.Wait()
+}
+
+func (watcher *Watcher) async_watch() {
+	defer watcher.waitgroup.Done()
+
+	ticker := time.NewTicker(Watch_interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-watcher.stop:
+			return
+		case <-watcher.signals:
+			log.Println("Received SIGHUP. Reloading configuration file at ", watcher.file_path)
+			watcher.modified_at = get_modification_time(watcher.file_path)
+			watcher.reload()
+		case <-ticker.C:
+			modified_at := get_modification_time(watcher.file_path)
+			if modified_at.IsZero() || modified_at.Equal(watcher.modified_at) {
+				continue
+			}
+			log.Println("Configuration file at ", watcher.file_path, " was changed. Reloading.")
+			watcher.modified_at = modified_at
+			watcher.reload()
+		}
+	}
+}
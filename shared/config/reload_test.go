@@ -0,0 +1,83 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func Test_RestartRequired(t *testing.T) {
+
+	restart_required := RestartRequired{}
+	restart_required.Compare("port", "1120", "1120")
+	if restart_required.Err() != nil {
+		t.Error("Expected: ", nil, ", Got: ", restart_required.Err())
+	}
+
+	restart_required.Compare("host", "localhost", "redis")
+	restart_required.Compare("database", PostgreSQLDatabase{Port: "5432"}, PostgreSQLDatabase{Port: "5433"})
+	expected := "Restart required to change host, database"
+	err := restart_required.Err()
+	if err == nil || err.Error() != expected {
+		t.Error("Expected: ", expected, ", Got: ", err)
+	}
+
+	if GetVersion(PostgreSQLDatabase{Port: "5432"}) != GetVersion(PostgreSQLDatabase{Port: "5432"}) {
+		t.Error("Expected the same version for the same settings.")
+	}
+	if GetVersion(PostgreSQLDatabase{Port: "5432"}) == GetVersion(PostgreSQLDatabase{Port: "5433"}) {
+		t.Error("Expected different versions for different settings.")
+	}
+}
+
+func Test_Watcher(t *testing.T) {
+
+	file_path := filepath.Join(t.TempDir(), "config.yml")
+	err := os.WriteFile(file_path, []byte("node_id: 1\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reloads := make(chan struct{}, 10)
+	watcher := CreateWatcher(file_path, func() {
+		reloads <- struct{}{}
+	})
+	watcher.Run()
+	defer watcher.Shutdown()
+
+	wait_for_reload := func(reason string) {
+		select {
+		case <-reloads:
+		case <-time.After(5 * Watch_interval):
+			t.Fatal("Expected configuration to be reloaded after ", reason)
+		}
+	}
+
+	// Changed file
+	{
+		modified_at := time.Now().Add(time.Minute)
+		err := os.Chtimes(file_path, modified_at, modified_at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wait_for_reload("file was changed")
+	}
+
+	// SIGHUP
+	{
+		err := syscall.Kill(os.Getpid(), syscall.SIGHUP)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wait_for_reload("SIGHUP")
+	}
+
+	// Nothing changed
+	select {
+	case <-reloads:
+		t.Error("Expected no reload if the file was not changed.")
+	case <-time.After(2 * Watch_interval):
+	}
+}
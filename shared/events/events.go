@@ -0,0 +1,49 @@
+package events
+
+// Event types produced by the deposit, withdraw and transfer services
+const (
+	Event_type_deposit_completed    string = "deposit.completed"
+	Event_type_withdrawal_completed string = "withdrawal.completed"
+	Event_type_transfer_sent        string = "transfer.sent"
+	Event_type_transfer_received    string = "transfer.received"
+)
+
+var Event_types = []string{
+	Event_type_deposit_completed,
+	Event_type_withdrawal_completed,
+	Event_type_transfer_sent,
+	Event_type_transfer_received,
+}
+
+func IsValidEventType(event_type string) bool {
+	for _, valid_event_type := range Event_types {
+		if event_type == valid_event_type {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Details of a committed deposit, withdrawal or transfer. Stored as JSON in the events
+table in the same database transaction that moves the money, so that an event exists
+if and only if the money was moved.
+
+Amounts are in display format, e.g. 10.50. The amount of a withdrawal or a transfer
+sent is positive. The counterparty is the other wallet of a transfer.
+*/
+type Data struct {
+	Currency             string `json:"currency"`
+	Amount               string `json:"amount"`
+	NewBalance           string `json:"new_balance"`
+	CounterpartyWalletID string `json:"counterparty_wallet_id,omitempty"`
+}
+
+// Body of every webhook delivered by the webhook service
+type Event struct {
+	EventID   string `json:"id"`
+	EventType string `json:"type"`
+	WalletID  string `json:"wallet_id"`
+	CreatedAt string `json:"created_at"` // RFC 3339, UTC
+	Data      Data   `json:"data"`
+}
@@ -0,0 +1,145 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+/*
+The latest events of each wallet are kept in a Redis stream of their own, so that
+clients of the live feed can catch up with the events they missed while they were
+disconnected. The ID of an event in the stream is used as its ID in the live feed.
+It is not the ID of the event in webhooks.
+
+New events are also published on the channel named after the streams, so that every
+API gateway receives them as they happen.
+*/
+
+// Name of the field holding the event in stream entries
+const stream_field_event string = "event"
+
+func GetStreamName(stream_name string, wallet_id string) string {
+	return stream_name + ":" + wallet_id
+}
+
+// Adds the event to the stream of its wallet and publishes it. The event ID is set to
+// the ID of the new stream entry.
+func Publish(ctx context.Context, client *redis.Client, stream_name string, maximum_length int64, event *Event) error {
+	event.EventID = ""
+	bytes, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	event_id, err := client.XAdd(ctx, &redis.XAddArgs{
+		Stream: GetStreamName(stream_name, event.WalletID),
+		MaxLen: maximum_length,
+		Approx: true,
+		Values: []string{stream_field_event, string(bytes)},
+	}).Result()
+	if err != nil {
+		return err
+	}
+	event.EventID = event_id
+
+	bytes, err = json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return client.Publish(ctx, stream_name, string(bytes)).Err()
+}
+
+/*
+Reads up to count events of the wallet that came after the event with the given ID,
+oldest first. All events still in the stream are read if the ID is empty.
+*/
+func ReadStream(ctx context.Context, client *redis.Client, stream_name string, wallet_id string, after_id string, count int64) ([]Event, error) {
+	start := "-"
+	if len(after_id) > 0 {
+		start = "(" + after_id
+	}
+	entries, err := client.XRangeN(ctx, GetStreamName(stream_name, wallet_id), start, "+", count).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]Event, 0, len(entries))
+	for _, entry := range entries {
+		value, ok := entry.Values[stream_field_event].(string)
+		if !ok {
+			continue
+		}
+		event := Event{}
+		err = json.Unmarshal([]byte(value), &event)
+		if err != nil {
+			continue
+		}
+		event.EventID = entry.ID
+		result = append(result, event)
+	}
+	return result, nil
+}
+
+// Returns the ID of the oldest event still in the stream of the wallet, or an empty
+// string if the stream is empty
+func OldestStreamID(ctx context.Context, client *redis.Client, stream_name string, wallet_id string) (string, error) {
+	entries, err := client.XRangeN(ctx, GetStreamName(stream_name, wallet_id), "-", "+", 1).Result()
+	if err != nil {
+		return "", err
+	}
+	if len(entries) == 0 {
+		return "", nil
+	}
+	return entries[0].ID, nil
+}
+
+// Returns false if the ID is not a stream ID, e.g. 1760000000000-0
+func IsValidStreamID(id string) bool {
+	_, _, ok := parse_stream_id(id)
+	return ok
+}
+
+func parse_stream_id(id string) (uint64, uint64, bool) {
+	milliseconds, sequence, found := strings.Cut(id, "-")
+	if !found {
+		return 0, 0, false
+	}
+	milliseconds_, err := strconv.ParseUint(milliseconds, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	sequence_, err := strconv.ParseUint(sequence, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return milliseconds_, sequence_, true
+}
+
+// Returns -1, 0 or 1 if the first stream ID comes before, is the same as, or comes
+// after the second. IDs that are not stream IDs come before all others.
+func CompareStreamIDs(first string, second string) int {
+	first_milliseconds, first_sequence, first_ok := parse_stream_id(first)
+	second_milliseconds, second_sequence, second_ok := parse_stream_id(second)
+	switch {
+	case !first_ok && !second_ok:
+		return 0
+	case !first_ok:
+		return -1
+	case !second_ok:
+		return 1
+	case first_milliseconds != second_milliseconds:
+		if first_milliseconds < second_milliseconds {
+			return -1
+		}
+		return 1
+	case first_sequence != second_sequence:
+		if first_sequence < second_sequence {
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,154 @@
+package events
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func Test_CompareStreamIDs(t *testing.T) {
+
+	test_cases := []struct {
+		first    string
+		second   string
+		expected int
+	}{
+		{"1-0", "1-0", 0},
+		{"1-0", "1-1", -1},
+		{"2-0", "1-5", 1},
+		{"10-0", "9-0", 1},
+		{"", "1-0", -1},
+		{"1-0", "abc", 1},
+		{"abc", "", 0},
+	}
+	for _, test_case := range test_cases {
+		result := CompareStreamIDs(test_case.first, test_case.second)
+		if result != test_case.expected {
+			t.Error("Expected: ", test_case.expected, ", Got: ", result, " for ", test_case.first, " and ", test_case.second)
+		}
+	}
+
+	if !IsValidStreamID("1760000000000-0") {
+		t.Error("Expected: ", true, ", Got: ", false)
+	}
+	for _, id := range []string{"", "1760000000000", "a-0", "1-b", "-1-0"} {
+		if IsValidStreamID(id) {
+			t.Error("Expected ", id, " to be rejected.")
+		}
+	}
+}
+
+// Needs the Redis server used by the other unit tests
+func Test_Stream(t *testing.T) {
+
+	background_context := context.Background()
+	client := redis.NewClient(&redis.Options{Addr: "localhost:1640"})
+	defer client.Close()
+	timeout_context, cancel := context.WithTimeout(background_context, 5*time.Second)
+	defer cancel()
+
+	stream_name := "wallet_events_unit_test"
+	wallet_id := "unit_test"
+	err := client.Del(timeout_context, GetStreamName(stream_name, wallet_id)).Err()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Del(background_context, GetStreamName(stream_name, wallet_id))
+
+	subscription := client.Subscribe(timeout_context, stream_name)
+	defer subscription.Close()
+	_, err = subscription.Receive(timeout_context)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldest_id, err := OldestStreamID(timeout_context, client, stream_name, wallet_id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oldest_id != "" {
+		t.Error("Expected: ", "", ", Got: ", oldest_id)
+	}
+
+	published := []Event{}
+	for i := 0; i < 3; i++ {
+		event := Event{
+			EventID:   "ignored",
+			EventType: Event_type_deposit_completed,
+			WalletID:  wallet_id,
+			CreatedAt: "2025-10-09T08:00:00Z",
+			Data: Data{
+				Currency:   "SGD",
+				Amount:     "1.00",
+				NewBalance: []string{"1.00", "2.00", "3.00"}[i],
+			},
+		}
+		err = Publish(timeout_context, client, stream_name, 1000, &event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !IsValidStreamID(event.EventID) {
+			t.Fatal("Expected a stream ID, Got: ", event.EventID)
+		}
+		published = append(published, event)
+
+		message, err := subscription.ReceiveMessage(timeout_context)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message.Channel != stream_name {
+			t.Error("Expected: ", stream_name, ", Got: ", message.Channel)
+		}
+		if !strings.Contains(message.Payload, `"id":"`+event.EventID+`"`) {
+			t.Error("Expected published event to contain ", event.EventID, ", Got: ", message.Payload)
+		}
+	}
+
+	// Whole stream
+	result, err := ReadStream(timeout_context, client, stream_name, wallet_id, "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result, published) {
+		t.Error("Expected: ", published, ", Got: ", result)
+	}
+
+	// Events after the first
+	result, err = ReadStream(timeout_context, client, stream_name, wallet_id, published[0].EventID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result, published[1:]) {
+		t.Error("Expected: ", published[1:], ", Got: ", result)
+	}
+
+	// Limited count
+	result, err = ReadStream(timeout_context, client, stream_name, wallet_id, "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result, published[:1]) {
+		t.Error("Expected: ", published[:1], ", Got: ", result)
+	}
+
+	// Nothing after the last
+	result, err = ReadStream(timeout_context, client, stream_name, wallet_id, published[2].EventID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 0 {
+		t.Error("Expected: ", 0, ", Got: ", len(result))
+	}
+
+	oldest_id, err = OldestStreamID(timeout_context, client, stream_name, wallet_id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oldest_id != published[0].EventID {
+		t.Error("Expected: ", published[0].EventID, ", Got: ", oldest_id)
+	}
+}
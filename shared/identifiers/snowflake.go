@@ -0,0 +1,119 @@
+package identifiers
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+/*
+Message IDs are generated with Twitter's snowflake approach. Each ID is a 64 bit
+integer made of these parts, from the most to the least significant bit.
+
+	1 bit   Always 0 so that IDs are positive
+	41 bits Milliseconds since the epoch below. Lasts for about 69 years.
+	10 bits Node ID. Each generator running at the same time needs its own node ID.
+	12 bits Sequence number. Up to 4096 IDs per millisecond per node.
+
+IDs generated by the same node are strictly increasing. IDs generated by different
+nodes are roughly sorted by time. No coordination between nodes is required, so IDs
+stay unique across multiple instances and restarts of the API gateway as long as
+every instance is configured with a different node ID.
+
+The guard against a clock moving backwards only holds within one generator. The time
+of the last ID is kept in memory and not persisted, so a generator created after a
+restart cannot tell that the clock is behind the time of the last ID of the previous
+run with the same node ID. IDs of the previous run may then be generated again. This
+cannot happen if the restart takes longer than the clock moved backwards, which is
+usually the case for clocks adjusted by NTP.
+*/
+
+const (
+	node_id_bits  uint = 10
+	sequence_bits uint = 12
+
+	Maximum_node_id  int64 = (1 << node_id_bits) - 1
+	maximum_sequence int64 = (1 << sequence_bits) - 1
+
+	// Generators wait for the clock to catch up if it moves backwards by up to this
+	// much, e.g. when the clock is adjusted by NTP. Larger jumps are reported as errors.
+	maximum_clock_skew time.Duration = 1 * time.Second
+)
+
+// 2025-01-01 00:00:00 UTC in milliseconds since the Unix epoch
+const epoch int64 = 1735689600000
+
+var ErrInvalidNodeID = errors.New("Node ID must be between 0 and 1023")
+var ErrClockMovedBackwards = errors.New("Clock moved backwards. Refusing to generate IDs.")
+
+type Generator struct {
+	mutex          sync.Mutex
+	node_id        int64
+	last_timestamp int64 // ms since epoch
+	sequence       int64
+	now            func() time.Time
+	sleep          func(time.Duration)
+}
+
+func CreateGenerator(node_id int64) (*Generator, error) {
+	if node_id < 0 || node_id > Maximum_node_id {
+		return nil, ErrInvalidNodeID
+	}
+	generator := &Generator{
+		node_id:        node_id,
+		last_timestamp: -1,
+		now:            time.Now,
+		sleep:          time.Sleep,
+	}
+	return generator, nil
+}
+
+func (generator *Generator) get_timestamp() int64 {
+	return generator.now().UnixMilli() - epoch
+}
+
+func (generator *Generator) Next() (int64, error) {
+	generator.mutex.Lock()
+	defer generator.mutex.Unlock()
+
+	timestamp := generator.get_timestamp()
+
+	// Wait for the clock to catch up if it moved backwards slightly. Otherwise the
+	// same IDs could be generated twice.
+	if timestamp < generator.last_timestamp {
+		skew := time.Duration(generator.last_timestamp-timestamp) * time.Millisecond
+		if skew > maximum_clock_skew {
+			return 0, ErrClockMovedBackwards
+		}
+		generator.sleep(skew)
+		timestamp = generator.get_timestamp()
+		if timestamp < generator.last_timestamp {
+			return 0, ErrClockMovedBackwards
+		}
+	}
+
+	if timestamp == generator.last_timestamp {
+		generator.sequence = (generator.sequence + 1) & maximum_sequence
+		if generator.sequence == 0 {
+			// Sequence numbers used up for this millisecond. Wait for the next one.
+			for timestamp <= generator.last_timestamp {
+				generator.sleep(100 * time.Microsecond)
+				timestamp = generator.get_timestamp()
+			}
+		}
+	} else {
+		generator.sequence = 0
+	}
+	generator.last_timestamp = timestamp
+
+	id := (timestamp << (node_id_bits + sequence_bits)) |
+		(generator.node_id << sequence_bits) |
+		generator.sequence
+	return id, nil
+}
+
+// Extracts the node ID from an ID. Useful for finding out which instance of the API
+// gateway sent a message.
+func GetNodeID(id int64) int64 {
+	return (id >> sequence_bits) & Maximum_node_id
+}
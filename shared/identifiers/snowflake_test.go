@@ -0,0 +1,173 @@
+package identifiers
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_Snowflake(t *testing.T) {
+
+	// Node IDs out of range are rejected
+	{
+		_, err := CreateGenerator(-1)
+		if err != ErrInvalidNodeID {
+			t.Error("Expected: ", ErrInvalidNodeID, ", Got: ", err)
+		}
+		_, err = CreateGenerator(Maximum_node_id + 1)
+		if err != ErrInvalidNodeID {
+			t.Error("Expected: ", ErrInvalidNodeID, ", Got: ", err)
+		}
+	}
+
+	// IDs from the same generator are strictly increasing and carry the node ID
+	{
+		node_id := int64(5)
+		generator, err := CreateGenerator(node_id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		previous := int64(0)
+		for i := 0; i < 10000; i++ {
+			id, err := generator.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id <= previous {
+				t.Fatal("Expected ID greater than ", previous, ", Got: ", id)
+			}
+			if GetNodeID(id) != node_id {
+				t.Fatal("Expected: ", node_id, ", Got: ", GetNodeID(id))
+			}
+			previous = id
+		}
+	}
+
+	// A restarted generator does not reuse IDs of the previous one
+	{
+		generator_1, _ := CreateGenerator(1)
+		id_1, err := generator_1.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * time.Millisecond)
+		generator_2, _ := CreateGenerator(1)
+		id_2, err := generator_2.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id_2 <= id_1 {
+			t.Error("Expected ID greater than ", id_1, ", Got: ", id_2)
+		}
+	}
+}
+
+func Test_SnowflakeClockSkew(t *testing.T) {
+
+	current_time := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	generator, _ := CreateGenerator(1)
+	generator.now = func() time.Time { return current_time }
+	slept := time.Duration(0)
+	generator.sleep = func(duration time.Duration) {
+		slept += duration
+		current_time = current_time.Add(duration)
+	}
+
+	id_1, err := generator.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Clock moves back slightly. Generator waits for it to catch up.
+	{
+		current_time = current_time.Add(-10 * time.Millisecond)
+		id_2, err := generator.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id_2 <= id_1 {
+			t.Error("Expected ID greater than ", id_1, ", Got: ", id_2)
+		}
+		if slept != 10*time.Millisecond {
+			t.Error("Expected: ", 10*time.Millisecond, ", Got: ", slept)
+		}
+	}
+
+	// Clock moves back too far. No IDs are generated.
+	{
+		current_time = current_time.Add(-time.Minute)
+		_, err := generator.Next()
+		if err != ErrClockMovedBackwards {
+			t.Error("Expected: ", ErrClockMovedBackwards, ", Got: ", err)
+		}
+	}
+
+	// Sequence numbers run out within the same millisecond. Generator waits for the
+	// next millisecond.
+	{
+		current_time = current_time.Add(time.Minute + time.Second)
+		slept = 0
+		previous := int64(0)
+		for i := int64(0); i <= maximum_sequence+1; i++ {
+			id, err := generator.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id <= previous {
+				t.Fatal("Expected ID greater than ", previous, ", Got: ", id)
+			}
+			previous = id
+		}
+		if slept == 0 {
+			t.Error("Expected generator to wait for the next millisecond.")
+		}
+	}
+}
+
+func Test_SnowflakeConcurrentInstances(t *testing.T) {
+
+	// Several instances of the API gateway, each with several goroutines handling
+	// requests at the same time
+	number_of_instances := 8
+	goroutines_per_instance := 8
+	ids_per_goroutine := 2000
+
+	var mutex sync.Mutex
+	ids := make(map[int64]bool, number_of_instances*goroutines_per_instance*ids_per_goroutine)
+	var waitgroup sync.WaitGroup
+	for node_id := 0; node_id < number_of_instances; node_id++ {
+		generator, err := CreateGenerator(int64(node_id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < goroutines_per_instance; i++ {
+			waitgroup.Add(1)
+			go func() {
+				defer waitgroup.Done()
+				generated := make([]int64, 0, ids_per_goroutine)
+				for j := 0; j < ids_per_goroutine; j++ {
+					id, err := generator.Next()
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					generated = append(generated, id)
+				}
+				mutex.Lock()
+				defer mutex.Unlock()
+				for _, id := range generated {
+					if ids[id] {
+						t.Error("Duplicate ID: ", id)
+					}
+					ids[id] = true
+				}
+			}()
+		}
+	}
+	waitgroup.Wait()
+
+	expected := number_of_instances * goroutines_per_instance * ids_per_goroutine
+	if len(ids) != expected {
+		t.Error("Expected: ", expected, ", Got: ", len(ids))
+	}
+}
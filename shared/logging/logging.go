@@ -0,0 +1,183 @@
+package logging
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+)
+
+/*
+Every service logs JSON objects, one per line, with log/slog. Log lines about a
+message carry its ID, action and wallet IDs, so that the log lines of the API gateway
+and the backend service for the same message can be joined on message_id.
+
+	{"time":"2026-10-18T09:30:00.1Z","level":"INFO","msg":"Processed message","service":"deposit_service",
+	 "message_id":1021,"action":"deposit","wallet_id":"wallet_1","amount":"[REDACTED]","duration_ms":3.2}
+
+Amounts are redacted unless the level is debug. Lines of the standard log package are
+logged at the info level.
+*/
+
+// Levels in configuration files
+const (
+	Level_debug string = "debug"
+	Level_info  string = "info"
+	Level_warn  string = "warn"
+	Level_error string = "error"
+)
+
+// Keys of attributes shared by all services
+const (
+	Key_service               string = "service"
+	Key_message_id            string = "message_id"
+	Key_action                string = "action"
+	Key_wallet_id             string = "wallet_id"
+	Key_source_wallet_id      string = "source_wallet_id"
+	Key_destination_wallet_id string = "destination_wallet_id"
+	Key_amount                string = "amount"
+	Key_duration_ms           string = "duration_ms"
+	Key_status                string = "status"
+	Key_error_code            string = "error_code"
+	Key_error                 string = "error"
+	Key_deadline              string = "deadline"
+)
+
+// Replaces the values of redacted attributes
+const Redacted string = "[REDACTED]"
+
+// Info is used if the level is empty
+func ParseLevel(level string) (slog.Level, error) {
+	switch level {
+	case Level_debug:
+		return slog.LevelDebug, nil
+	case "", Level_info:
+		return slog.LevelInfo, nil
+	case Level_warn:
+		return slog.LevelWarn, nil
+	case Level_error:
+		return slog.LevelError, nil
+	}
+	return slog.LevelInfo, errors.New("unknown log level " + level)
+}
+
+// Writes JSON lines of the given level and above. Amounts are redacted unless the
+// level is debug. The level may change while logging, e.g. if it is a slog.LevelVar.
+func CreateHandler(writer io.Writer, level slog.Leveler) slog.Handler {
+	return slog.NewJSONHandler(writer, &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, attribute slog.Attr) slog.Attr {
+			if attribute.Key == Key_amount && level.Level() > slog.LevelDebug {
+				return slog.String(Key_amount, Redacted)
+			}
+			return attribute
+		},
+	})
+}
+
+// Level of the default logs of the service. Changed when the configuration is reloaded.
+var level = new(slog.LevelVar)
+
+// Closes the log file, if logs are written to a file
+type Output struct {
+	file *os.File
+}
+
+/*
+Makes JSON lines of the given level the default logs of the service. Logs are
+appended to the file at file_path, or written to standard error if file_path is empty.
+*/
+func Setup(service_name string, level_ string, file_path string) (*Output, error) {
+	err := SetLevel(level_)
+	if err != nil {
+		return nil, err
+	}
+	output := &Output{}
+	var writer io.Writer = os.Stderr
+	if len(file_path) > 0 {
+		output.file, err = os.OpenFile(file_path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		writer = output.file
+	}
+	slog.SetDefault(slog.New(CreateHandler(writer, level)).With(Key_service, service_name))
+	return output, nil
+}
+
+// Changes the level of the default logs of the service at once, e.g. when the
+// configuration is reloaded. The file logs are written to cannot be changed.
+func SetLevel(level_ string) error {
+	parsed_level, err := ParseLevel(level_)
+	if err != nil {
+		return err
+	}
+	level.Set(parsed_level)
+	return nil
+}
+
+func (output *Output) Close() {
+	if output != nil && output.file != nil {
+		output.file.Close()
+	}
+}
+
+// Time since started_at in milliseconds
+func Duration(started_at time.Time) slog.Attr {
+	return slog.Float64(Key_duration_ms, float64(time.Since(started_at).Microseconds())/1000)
+}
+
+/*
+Logs the processing of a message by a backend service. Every line carries the ID and
+action of the message and the attributes it was started with, e.g. its wallet IDs and
+amount.
+*/
+type Request struct {
+	logger      *slog.Logger
+	received_at time.Time
+}
+
+func StartRequest(message_id int64, action string, attributes ...any) *Request {
+	request := &Request{
+		logger:      slog.With(append([]any{Key_message_id, message_id, Key_action, action}, attributes...)...),
+		received_at: time.Now(),
+	}
+	request.logger.Debug("Received message")
+	return request
+}
+
+// Logs with the attributes of the message. Lines of a nil request have none.
+func (request *Request) Logger() *slog.Logger {
+	if request == nil {
+		return slog.Default()
+	}
+	return request.logger
+}
+
+// Logs the outcome of the message with the time taken to process it. Failed messages
+// are logged as warnings.
+func (request *Request) Done(error_code string, error_message string) {
+	if request == nil {
+		return
+	}
+	if len(error_code) == 0 {
+		request.logger.Info("Processed message", Duration(request.received_at))
+		return
+	}
+	request.logger.Warn("Failed to process message",
+		Key_error_code, error_code,
+		Key_error, error_message,
+		Duration(request.received_at))
+}
+
+// Logs that the message was dropped because its deadline passed before it was
+// processed
+func (request *Request) Expired(deadline int64) {
+	if request == nil {
+		return
+	}
+	request.logger.Warn("Dropped expired message",
+		Key_deadline, time.UnixMilli(deadline).UTC().Format(time.RFC3339Nano),
+		Duration(request.received_at))
+}
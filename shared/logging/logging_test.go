@@ -0,0 +1,153 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_ParseLevel(t *testing.T) {
+	tests := map[string]slog.Level{
+		"":          slog.LevelInfo,
+		Level_debug: slog.LevelDebug,
+		Level_info:  slog.LevelInfo,
+		Level_warn:  slog.LevelWarn,
+		Level_error: slog.LevelError,
+	}
+	for level, expected := range tests {
+		parsed, err := ParseLevel(level)
+		if err != nil || parsed != expected {
+			t.Error("Expected: ", expected, ", Got: ", parsed, " ", err)
+		}
+	}
+	_, err := ParseLevel("verbose")
+	if err == nil {
+		t.Error("Expected: ", "error", ", Got: ", err)
+	}
+}
+
+func Test_Request(t *testing.T) {
+	default_logger := slog.Default()
+	defer slog.SetDefault(default_logger)
+
+	// Amounts are redacted unless the level is debug
+	buffer := bytes.Buffer{}
+	slog.SetDefault(slog.New(CreateHandler(&buffer, slog.LevelInfo)))
+	request := StartRequest(1021, "deposit", Key_wallet_id, "wallet_1", Key_amount, "10.00")
+	request.Done("", "")
+	line := map[string]any{}
+	err := json.Unmarshal(buffer.Bytes(), &line)
+	if err != nil {
+		t.Fatal(err, " ", buffer.String())
+	}
+	if line["msg"] != "Processed message" || line[Key_message_id] != float64(1021) || line[Key_action] != "deposit" || line[Key_wallet_id] != "wallet_1" {
+		t.Error("Expected: ", "Processed message 1021 deposit wallet_1", ", Got: ", buffer.String())
+	}
+	if line[Key_amount] != Redacted {
+		t.Error("Expected: ", Redacted, ", Got: ", line[Key_amount])
+	}
+	if _, ok := line[Key_duration_ms].(float64); !ok {
+		t.Error("Expected: ", Key_duration_ms, ", Got: ", buffer.String())
+	}
+
+	// Received messages and amounts are logged at the debug level
+	buffer.Reset()
+	slog.SetDefault(slog.New(CreateHandler(&buffer, slog.LevelDebug)))
+	request = StartRequest(1022, "withdraw", Key_wallet_id, "wallet_1", Key_amount, "5.00")
+	request.Done("insufficient_balance", "Insufficient balance")
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatal("Expected: ", 2, ", Got: ", len(lines), " ", buffer.String())
+	}
+	line = map[string]any{}
+	err = json.Unmarshal([]byte(lines[1]), &line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line["level"] != "WARN" || line[Key_error_code] != "insufficient_balance" || line[Key_amount] != "5.00" {
+		t.Error("Expected: ", "WARN insufficient_balance 5.00", ", Got: ", lines[1])
+	}
+
+	// Expired messages are logged as warnings with their deadline
+	buffer.Reset()
+	slog.SetDefault(slog.New(CreateHandler(&buffer, slog.LevelInfo)))
+	request = StartRequest(1023, "transfer")
+	request.Expired(time.Date(2026, 10, 18, 9, 30, 0, 0, time.UTC).UnixMilli())
+	line = map[string]any{}
+	err = json.Unmarshal(buffer.Bytes(), &line)
+	if err != nil {
+		t.Fatal(err, " ", buffer.String())
+	}
+	if line["level"] != "WARN" || line["msg"] != "Dropped expired message" || line[Key_deadline] != "2026-10-18T09:30:00Z" {
+		t.Error("Expected: ", "WARN Dropped expired message 2026-10-18T09:30:00Z", ", Got: ", buffer.String())
+	}
+
+	// Nil requests log without the attributes of a message
+	var nil_request *Request
+	nil_request.Done("", "")
+	nil_request.Expired(0)
+	if nil_request.Logger() != slog.Default() {
+		t.Error("Expected: ", "default logger", ", Got: ", nil_request.Logger())
+	}
+}
+
+func Test_Setup(t *testing.T) {
+	default_logger := slog.Default()
+	defer slog.SetDefault(default_logger)
+
+	file_path := filepath.Join(t.TempDir(), "deposit_service.log")
+	output, err := Setup("deposit_service", Level_warn, file_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slog.Info("Not logged")
+	slog.Error("Logged", Key_amount, "10.00")
+
+	// The level is changed at once, e.g. when the configuration is reloaded
+	err = SetLevel(Level_debug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slog.Debug("Logged at debug level", Key_amount, "5.00")
+	err = SetLevel("verbose")
+	if err == nil {
+		t.Error("Expected: ", "error", ", Got: ", err)
+	}
+	slog.Debug("Still logged at debug level")
+	output.Close()
+
+	bytes, err := os.ReadFile(file_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(bytes)), "\n")
+	if len(lines) != 3 {
+		t.Fatal("Expected: ", 3, ", Got: ", len(lines), " ", string(bytes))
+	}
+	line := map[string]any{}
+	err = json.Unmarshal([]byte(lines[0]), &line)
+	if err != nil {
+		t.Fatal(err, " ", lines[0])
+	}
+	if line["msg"] != "Logged" || line[Key_service] != "deposit_service" || line[Key_amount] != Redacted {
+		t.Error("Expected: ", "Logged deposit_service", ", Got: ", lines[0])
+	}
+	line = map[string]any{}
+	err = json.Unmarshal([]byte(lines[1]), &line)
+	if err != nil {
+		t.Fatal(err, " ", lines[1])
+	}
+	if line["msg"] != "Logged at debug level" || line[Key_amount] != "5.00" {
+		t.Error("Expected: ", "Logged at debug level 5.00", ", Got: ", lines[1])
+	}
+
+	_, err = Setup("deposit_service", "verbose", "")
+	if err == nil {
+		t.Error("Expected: ", "error", ", Got: ", err)
+	}
+}
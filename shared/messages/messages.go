@@ -1,5 +1,10 @@
 package messages
 
+import (
+	"strconv"
+	"time"
+)
+
 const (
 	Action_unknown                 int = 0
 	Action_deposit                 int = 1
@@ -7,11 +12,90 @@ const (
 	Action_transfer                int = 3
 	Action_get_balance             int = 4
 	Action_get_transaction_history int = 5
+	Action_get_idempotency_key     int = 6
+	Action_create_webhook          int = 7
+	Action_get_webhooks            int = 8
+	Action_delete_webhook          int = 9
+	Action_get_webhook_deliveries  int = 10
+	Action_redeliver_webhook       int = 11
+	Action_batch                   int = 12
 )
 
+// Names of actions in logs
+var action_names = map[int]string{
+	Action_deposit:                 "deposit",
+	Action_withdraw:                "withdraw",
+	Action_transfer:                "transfer",
+	Action_get_balance:             "get_balance",
+	Action_get_transaction_history: "get_transaction_history",
+	Action_get_idempotency_key:     "get_idempotency_key",
+	Action_create_webhook:          "create_webhook",
+	Action_get_webhooks:            "get_webhooks",
+	Action_delete_webhook:          "delete_webhook",
+	Action_get_webhook_deliveries:  "get_webhook_deliveries",
+	Action_redeliver_webhook:       "redeliver_webhook",
+	Action_batch:                   "batch",
+}
+
+// Returns "unknown" for unknown actions
+func GetActionName(action int) string {
+	name, ok := action_names[action]
+	if !ok {
+		return "unknown"
+	}
+	return name
+}
+
 type Header struct {
 	MessageID int64 `json:"id"`
 	Action    int   `json:"action"`
+
+	// Requests with the same idempotency key are only processed once. Retries return
+	// the response to the original request.
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+
+	// Name of the queue the response must be put into. Each instance of the API gateway
+	// reads responses from its own reply queue, so that responses always reach the
+	// instance waiting for them. Responses to requests without a reply queue are put
+	// into the responses queue of the service.
+	ReplyTo string `json:"reply_to,omitempty"`
+
+	// W3C trace context of the API gateway, so that the spans of the backend service
+	// are part of the same trace
+	TraceParent string `json:"traceparent,omitempty"`
+
+	// Unix time in milliseconds after which the API gateway no longer waits for the
+	// response. Backend services drop requests found in the queue after their deadline
+	// instead of applying them. Requests without a deadline never expire.
+	Deadline int64 `json:"deadline,omitempty"`
+}
+
+// Returns true if the deadline of the request has passed
+func (header *Header) IsExpired() bool {
+	return header.Deadline > 0 && time.Now().UnixMilli() > header.Deadline
+}
+
+/*
+Returns the key the response to the request is recorded under, in the database
+transaction that applies the request. Requests taken from a stream are delivered again
+if the service stopped before acknowledging them, even after they were applied.
+Requests without an idempotency key are then recorded under their message ID, so that
+they are applied only once. Keys of callers are prefixed with the name of the caller
+and a colon, so they never collide with keys made from message IDs.
+*/
+func (header *Header) GetIdempotencyKey(may_be_redelivered bool) string {
+	if len(header.IdempotencyKey) > 0 || !may_be_redelivered || header.MessageID == 0 {
+		return header.IdempotencyKey
+	}
+	return "message_" + strconv.FormatInt(header.MessageID, 10)
+}
+
+// Returns the name of the queue the response to this request must be put into
+func (header *Header) GetReplyQueueName(responses_queue_name string) string {
+	if len(header.ReplyTo) > 0 {
+		return header.ReplyTo
+	}
+	return responses_queue_name
 }
 
 type POST_Deposit struct {
@@ -36,6 +120,24 @@ type POST_Transfer struct {
 	Currency            string `json:"currency,omitempty"`
 }
 
+// Deposit, withdrawal or transfer of a batch, as indicated by Action
+type BatchItem struct {
+	ItemID              string `json:"item_id,omitempty"`
+	Action              int    `json:"action,omitempty"`
+	WalletID            string `json:"wallet_id,omitempty"`
+	SourceWalletID      string `json:"source_wallet_id,omitempty"`
+	DestinationWalletID string `json:"destination_wallet_id,omitempty"`
+	Amount              string `json:"amount,omitempty"`
+	Currency            string `json:"currency,omitempty"`
+}
+
+// Applied by the transfer service in a single database transaction. Either every item
+// is applied or none.
+type POST_Batch struct {
+	Header Header      `json:"header"`
+	Items  []BatchItem `json:"items,omitempty"`
+}
+
 type GET_Balance struct {
 	Header   Header `json:"header"`
 	WalletID string `json:"wallet_id,omitempty"`
@@ -47,3 +149,46 @@ type GET_TransactionHistory struct {
 	From     string `json:"from,omitempty"` // YYYYMMDD
 	To       string `json:"to,omitempty"`   // YYYYMMDD
 }
+
+type GET_IdempotencyKey struct {
+	Header         Header `json:"header"`
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+}
+
+/*
+Subscribes a URL to events of the given types. Events of every wallet are sent if no
+wallet ID is given. Owner is the name of the caller set by the API gateway. Webhooks
+can only be seen and changed by their owner.
+*/
+type POST_Webhook struct {
+	Header     Header   `json:"header"`
+	Owner      string   `json:"owner,omitempty"`
+	URL        string   `json:"url,omitempty"`
+	WalletID   string   `json:"wallet_id,omitempty"`
+	EventTypes []string `json:"event_types,omitempty"`
+}
+
+type GET_Webhooks struct {
+	Header Header `json:"header"`
+	Owner  string `json:"owner,omitempty"`
+}
+
+type DELETE_Webhook struct {
+	Header    Header `json:"header"`
+	Owner     string `json:"owner,omitempty"`
+	WebhookID string `json:"webhook_id,omitempty"`
+}
+
+type GET_WebhookDeliveries struct {
+	Header    Header `json:"header"`
+	Owner     string `json:"owner,omitempty"`
+	WebhookID string `json:"webhook_id,omitempty"`
+}
+
+// Sends the event of a delivery again, regardless of whether it was delivered
+type POST_WebhookRedelivery struct {
+	Header     Header `json:"header"`
+	Owner      string `json:"owner,omitempty"`
+	WebhookID  string `json:"webhook_id,omitempty"`
+	DeliveryID string `json:"delivery_id,omitempty"`
+}
@@ -0,0 +1,38 @@
+package messages
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_IsExpired(t *testing.T) {
+	headers := map[string]Header{
+		"without deadline": {},
+		"future deadline":  {Deadline: time.Now().Add(time.Minute).UnixMilli()},
+		"past deadline":    {Deadline: time.Now().Add(-time.Second).UnixMilli()},
+	}
+	for name, header := range headers {
+		expected := name == "past deadline"
+		if header.IsExpired() != expected {
+			t.Error("Expected: ", expected, ", Got: ", header.IsExpired(), " for ", name)
+		}
+	}
+}
+
+func Test_GetIdempotencyKey(t *testing.T) {
+
+	// Keys of callers are kept as they are
+	header := Header{MessageID: 1021, IdempotencyKey: "api_client:key_1"}
+	if header.GetIdempotencyKey(true) != "api_client:key_1" {
+		t.Error("Expected: ", "api_client:key_1", ", Got: ", header.GetIdempotencyKey(true))
+	}
+
+	// Requests which may be delivered again are recorded under their message ID
+	header = Header{MessageID: 1021}
+	if header.GetIdempotencyKey(true) != "message_1021" {
+		t.Error("Expected: ", "message_1021", ", Got: ", header.GetIdempotencyKey(true))
+	}
+	if header.GetIdempotencyKey(false) != "" {
+		t.Error("Expected: ", "", ", Got: ", header.GetIdempotencyKey(false))
+	}
+}
@@ -0,0 +1,351 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+A Registry holds counters, histograms and gauges and writes them in the Prometheus
+text exposition format, so that they can be scraped by Prometheus directly without
+any external collector.
+
+	registry := metrics.CreateRegistry()
+	requests := registry.CreateCounter("http_requests_total", "HTTP requests.", "route", "status")
+	requests.Inc("/transfer", "200")
+
+Metrics are created on startup. Label values are passed in the same order as the label
+names given when the metric was created.
+*/
+type Registry struct {
+	mutex   sync.Mutex
+	metrics []metric
+	names   map[string]bool
+}
+
+type metric interface {
+	write(writer *bufio.Writer)
+}
+
+func CreateRegistry() *Registry {
+	registry := &Registry{
+		names: make(map[string]bool),
+	}
+	return registry
+}
+
+// Panics if a metric with the same name exists. Metrics are created on startup, so
+// duplicate names are found before anything is measured.
+func (registry *Registry) add(name string, metric_ metric) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	if registry.names[name] {
+		panic("Metric already exists: " + name)
+	}
+	registry.names[name] = true
+	registry.metrics = append(registry.metrics, metric_)
+}
+
+// Writes all metrics in the order they were created
+func (registry *Registry) Write(writer io.Writer) error {
+	registry.mutex.Lock()
+	metrics := registry.metrics
+	registry.mutex.Unlock()
+
+	buffered_writer := bufio.NewWriter(writer)
+	for _, metric_ := range metrics {
+		metric_.write(buffered_writer)
+	}
+	return buffered_writer.Flush()
+}
+
+const Content_type string = "text/plain; version=0.0.4; charset=utf-8"
+
+func (registry *Registry) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", Content_type)
+	registry.Write(writer)
+}
+
+// Label values of each series are joined with a character that cannot appear in
+// valid UTF-8 text
+const label_separator string = "\xff"
+
+func get_series_key(label_names []string, label_values []string) string {
+	if len(label_values) != len(label_names) {
+		panic("Expected " + strconv.Itoa(len(label_names)) + " label values, got " + strconv.Itoa(len(label_values)))
+	}
+	return strings.Join(label_values, label_separator)
+}
+
+func get_sorted_keys[V any](series map[string]V) []string {
+	keys := make([]string, 0, len(series))
+	for key := range series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func escape_label_value(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, "\n", `\n`)
+	return strings.ReplaceAll(value, `"`, `\"`)
+}
+
+func escape_help(help string) string {
+	help = strings.ReplaceAll(help, `\`, `\\`)
+	return strings.ReplaceAll(help, "\n", `\n`)
+}
+
+func format_value(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	if math.IsInf(value, -1) {
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Writes {name="value",...}. Nothing is written if there are no labels.
+func write_labels(writer *bufio.Writer, label_names []string, label_values []string) {
+	if len(label_names) == 0 {
+		return
+	}
+	writer.WriteString("{")
+	for i, name := range label_names {
+		if i > 0 {
+			writer.WriteString(",")
+		}
+		writer.WriteString(name)
+		writer.WriteString(`="`)
+		writer.WriteString(escape_label_value(label_values[i]))
+		writer.WriteString(`"`)
+	}
+	writer.WriteString("}")
+}
+
+func write_header(writer *bufio.Writer, name string, help string, metric_type string) {
+	writer.WriteString("# HELP " + name + " " + escape_help(help) + "\n")
+	writer.WriteString("# TYPE " + name + " " + metric_type + "\n")
+}
+
+func write_sample(writer *bufio.Writer, name string, label_names []string, label_values []string, value float64) {
+	writer.WriteString(name)
+	write_labels(writer, label_names, label_values)
+	writer.WriteString(" " + format_value(value) + "\n")
+}
+
+// A value that only goes up, e.g. the number of requests processed
+type Counter struct {
+	name        string
+	help        string
+	label_names []string
+
+	mutex  sync.Mutex
+	series map[string]*counter_series
+}
+
+type counter_series struct {
+	label_values []string
+	value        float64
+}
+
+func (registry *Registry) CreateCounter(name string, help string, label_names ...string) *Counter {
+	counter := &Counter{
+		name:        name,
+		help:        help,
+		label_names: label_names,
+		series:      make(map[string]*counter_series),
+	}
+	registry.add(name, counter)
+	return counter
+}
+
+func (counter *Counter) Inc(label_values ...string) {
+	counter.Add(1, label_values...)
+}
+
+// Negative values are ignored because counters never go down
+func (counter *Counter) Add(value float64, label_values ...string) {
+	if value < 0 {
+		return
+	}
+	key := get_series_key(counter.label_names, label_values)
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	series, exists := counter.series[key]
+	if !exists {
+		series = &counter_series{label_values: append([]string(nil), label_values...)}
+		counter.series[key] = series
+	}
+	series.value += value
+}
+
+// Returns 0 if nothing was counted with these label values
+func (counter *Counter) Get(label_values ...string) float64 {
+	key := get_series_key(counter.label_names, label_values)
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	series, exists := counter.series[key]
+	if !exists {
+		return 0
+	}
+	return series.value
+}
+
+func (counter *Counter) write(writer *bufio.Writer) {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	write_header(writer, counter.name, counter.help, "counter")
+	for _, key := range get_sorted_keys(counter.series) {
+		series := counter.series[key]
+		write_sample(writer, counter.name, counter.label_names, series.label_values, series.value)
+	}
+}
+
+// A value that goes up and down, e.g. the number of requests waiting for a response
+type Gauge struct {
+	name        string
+	help        string
+	label_names []string
+
+	mutex  sync.Mutex
+	series map[string]*counter_series
+}
+
+func (registry *Registry) CreateGauge(name string, help string, label_names ...string) *Gauge {
+	gauge := &Gauge{
+		name:        name,
+		help:        help,
+		label_names: label_names,
+		series:      make(map[string]*counter_series),
+	}
+	registry.add(name, gauge)
+	return gauge
+}
+
+func (gauge *Gauge) Set(value float64, label_values ...string) {
+	key := get_series_key(gauge.label_names, label_values)
+	gauge.mutex.Lock()
+	defer gauge.mutex.Unlock()
+	series, exists := gauge.series[key]
+	if !exists {
+		series = &counter_series{label_values: append([]string(nil), label_values...)}
+		gauge.series[key] = series
+	}
+	series.value = value
+}
+
+func (gauge *Gauge) write(writer *bufio.Writer) {
+	gauge.mutex.Lock()
+	defer gauge.mutex.Unlock()
+	write_header(writer, gauge.name, gauge.help, "gauge")
+	for _, key := range get_sorted_keys(gauge.series) {
+		series := gauge.series[key]
+		write_sample(writer, gauge.name, gauge.label_names, series.label_values, series.value)
+	}
+}
+
+// Upper bounds in s suitable for the latency of Redis and PostgreSQL calls
+var Latency_buckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Counts observed values, e.g. latencies, in buckets with the given upper bounds
+type Histogram struct {
+	name        string
+	help        string
+	label_names []string
+	buckets     []float64
+
+	mutex  sync.Mutex
+	series map[string]*histogram_series
+}
+
+type histogram_series struct {
+	label_values []string
+	counts       []uint64 // Not cumulative. One more than the number of buckets for +Inf.
+	sum          float64
+	count        uint64
+}
+
+func (registry *Registry) CreateHistogram(name string, help string, buckets []float64, label_names ...string) *Histogram {
+	sorted_buckets := append([]float64(nil), buckets...)
+	sort.Float64s(sorted_buckets)
+	histogram := &Histogram{
+		name:        name,
+		help:        help,
+		label_names: label_names,
+		buckets:     sorted_buckets,
+		series:      make(map[string]*histogram_series),
+	}
+	registry.add(name, histogram)
+	return histogram
+}
+
+func (histogram *Histogram) Observe(value float64, label_values ...string) {
+	key := get_series_key(histogram.label_names, label_values)
+
+	// Index of the first bucket whose upper bound is not less than the value
+	index := sort.SearchFloat64s(histogram.buckets, value)
+
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+	series, exists := histogram.series[key]
+	if !exists {
+		series = &histogram_series{
+			label_values: append([]string(nil), label_values...),
+			counts:       make([]uint64, len(histogram.buckets)+1),
+		}
+		histogram.series[key] = series
+	}
+	series.counts[index]++
+	series.sum += value
+	series.count++
+}
+
+// Observes the time elapsed since start in s
+func (histogram *Histogram) ObserveSince(start time.Time, label_values ...string) {
+	histogram.Observe(time.Since(start).Seconds(), label_values...)
+}
+
+// Returns the number of values observed with these label values
+func (histogram *Histogram) GetCount(label_values ...string) uint64 {
+	key := get_series_key(histogram.label_names, label_values)
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+	series, exists := histogram.series[key]
+	if !exists {
+		return 0
+	}
+	return series.count
+}
+
+func (histogram *Histogram) write(writer *bufio.Writer) {
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+	write_header(writer, histogram.name, histogram.help, "histogram")
+
+	label_names := append(append([]string(nil), histogram.label_names...), "le")
+	for _, key := range get_sorted_keys(histogram.series) {
+		series := histogram.series[key]
+		label_values := append(append([]string(nil), series.label_values...), "")
+
+		var cumulative_count uint64 = 0
+		for i, upper_bound := range histogram.buckets {
+			cumulative_count += series.counts[i]
+			label_values[len(label_values)-1] = format_value(upper_bound)
+			write_sample(writer, histogram.name+"_bucket", label_names, label_values, float64(cumulative_count))
+		}
+		label_values[len(label_values)-1] = "+Inf"
+		write_sample(writer, histogram.name+"_bucket", label_names, label_values, float64(series.count))
+		write_sample(writer, histogram.name+"_sum", histogram.label_names, series.label_values, series.sum)
+		write_sample(writer, histogram.name+"_count", histogram.label_names, series.label_values, float64(series.count))
+	}
+}
@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func Test_Registry(t *testing.T) {
+
+	registry := CreateRegistry()
+	requests := registry.CreateCounter("http_requests_total", "HTTP requests.", "route", "status")
+	waiters := registry.CreateGauge("response_waiters", "Requests waiting.")
+	latency := registry.CreateHistogram("latency_seconds", "Latency.", []float64{1, 0.1}, "service")
+
+	requests.Inc("/transfer", "200")
+	requests.Add(2, "/transfer", "200")
+	requests.Inc(`/"quoted"`, "404")
+	requests.Add(-1, "/transfer", "200")
+	waiters.Set(3)
+	latency.Observe(0.05, "deposit")
+	latency.Observe(0.5, "deposit")
+	latency.Observe(5, "deposit")
+
+	if requests.Get("/transfer", "200") != 3 {
+		t.Error("Expected: ", 3, ", Got: ", requests.Get("/transfer", "200"))
+	}
+	if latency.GetCount("deposit") != 3 {
+		t.Error("Expected: ", 3, ", Got: ", latency.GetCount("deposit"))
+	}
+
+	buffer := bytes.Buffer{}
+	err := registry.Write(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP http_requests_total HTTP requests.
+# TYPE http_requests_total counter
+http_requests_total{route="/\"quoted\"",status="404"} 1
+http_requests_total{route="/transfer",status="200"} 3
+# HELP response_waiters Requests waiting.
+# TYPE response_waiters gauge
+response_waiters 3
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{service="deposit",le="0.1"} 1
+latency_seconds_bucket{service="deposit",le="1"} 2
+latency_seconds_bucket{service="deposit",le="+Inf"} 3
+latency_seconds_sum{service="deposit"} 5.55
+latency_seconds_count{service="deposit"} 3
+`
+	if buffer.String() != expected {
+		t.Error("Expected: ", expected, ", Got: ", buffer.String())
+	}
+}
+
+func Test_ServiceMetrics(t *testing.T) {
+
+	service_metrics := CreateServiceMetrics("deposit_service")
+	service_metrics.CountMessage(true, "")
+	service_metrics.CountMessage(false, "INSUFFICIENT_FUNDS")
+	service_metrics.CountMessage(false, "")
+	service_metrics.CountExpired()
+
+	if service_metrics.MessagesProcessed.Get("successful") != 1 {
+		t.Error("Expected: ", 1, ", Got: ", service_metrics.MessagesProcessed.Get("successful"))
+	}
+	if service_metrics.MessagesProcessed.Get("failed") != 2 {
+		t.Error("Expected: ", 2, ", Got: ", service_metrics.MessagesProcessed.Get("failed"))
+	}
+	if service_metrics.MessagesProcessed.Get("expired") != 1 {
+		t.Error("Expected: ", 1, ", Got: ", service_metrics.MessagesProcessed.Get("expired"))
+	}
+	if service_metrics.Failures.Get("INSUFFICIENT_FUNDS") != 1 {
+		t.Error("Expected: ", 1, ", Got: ", service_metrics.Failures.Get("INSUFFICIENT_FUNDS"))
+	}
+	if service_metrics.Failures.Get("UNKNOWN") != 1 {
+		t.Error("Expected: ", 1, ", Got: ", service_metrics.Failures.Get("UNKNOWN"))
+	}
+}
@@ -0,0 +1,62 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Path on which Prometheus scrapes the metrics
+const Path string = "/metrics"
+
+// Serves the metrics of a registry on a port of its own. Used by backend services,
+// which do not serve HTTP otherwise.
+type Server struct {
+	http_server *http.Server
+	waitgroup   sync.WaitGroup
+}
+
+func CreateServer(listen_port string, registry *Registry) *Server {
+	http_multiplexer := http.NewServeMux()
+	http_multiplexer.Handle(Path, registry)
+	server := &Server{
+		http_server: &http.Server{
+			Addr:         ":" + listen_port,
+			Handler:      http_multiplexer,
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 10 * time.Second,
+		},
+	}
+	return server
+}
+
+// Returns an error if the port cannot be listened on. Metrics are served in the
+// background otherwise.
+func (server *Server) Run() error {
+	listener, err := net.Listen("tcp", server.http_server.Addr)
+	if err != nil {
+		return err
+	}
+	log.Println("Serving metrics on port: ", server.http_server.Addr)
+
+	server.waitgroup.Add(1)
+	go func() {
+		defer server.waitgroup.Done()
+		err := server.http_server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Println("Error with metrics server: ", err.Error())
+		}
+	}()
+	return nil
+}
+
+func (server *Server) Shutdown() {
+	context_with_timeout, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server.http_server.Shutdown(context_with_timeout)
+	server.waitgroup.Wait()
+}
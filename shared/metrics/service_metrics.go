@@ -0,0 +1,81 @@
+package metrics
+
+const (
+	Outcome_commit   string = "commit"
+	Outcome_rollback string = "rollback"
+)
+
+// Reasons for moving messages to the dead-letter queue
+const (
+	Reason_invalid_message     string = "invalid_message"
+	Reason_too_many_deliveries string = "too_many_deliveries"
+)
+
+// Metrics common to all backend services. Names are prefixed with the name of the
+// service, e.g. deposit_service_messages_processed_total.
+type ServiceMetrics struct {
+	Registry *Registry
+
+	// Messages read from the requests queue by status of the response, or expired if
+	// they were dropped because their deadline passed
+	MessagesProcessed *Counter
+
+	// Failed messages by error code
+	Failures *Counter
+
+	// Time from the start of a database transaction to its commit or rollback
+	DatabaseTransactionDuration *Histogram
+
+	// Time spent waiting for a message to arrive in the requests queue
+	QueuePopDuration *Histogram
+
+	// Requests moved to the dead-letter queue by reason
+	DeadLetters *Counter
+}
+
+func CreateServiceMetrics(service_name string) *ServiceMetrics {
+	registry := CreateRegistry()
+	service_metrics := &ServiceMetrics{
+		Registry: registry,
+		MessagesProcessed: registry.CreateCounter(
+			service_name+"_messages_processed_total",
+			"Messages read from the requests queue by status of the response, or expired.",
+			"status"),
+		Failures: registry.CreateCounter(
+			service_name+"_failures_total",
+			"Failed messages by error code.",
+			"error_code"),
+		DatabaseTransactionDuration: registry.CreateHistogram(
+			service_name+"_database_transaction_duration_seconds",
+			"Time from the start of a database transaction to its commit or rollback.",
+			Latency_buckets,
+			"outcome"),
+		QueuePopDuration: registry.CreateHistogram(
+			service_name+"_queue_pop_duration_seconds",
+			"Time spent waiting for a message to arrive in the requests queue.",
+			Latency_buckets),
+		DeadLetters: registry.CreateCounter(
+			service_name+"_dead_letters_total",
+			"Requests moved to the dead-letter queue by reason.",
+			"reason"),
+	}
+	return service_metrics
+}
+
+// Counts a message by the status and error code of its response
+func (service_metrics *ServiceMetrics) CountMessage(is_successful bool, error_code string) {
+	if is_successful {
+		service_metrics.MessagesProcessed.Inc("successful")
+		return
+	}
+	service_metrics.MessagesProcessed.Inc("failed")
+	if len(error_code) == 0 {
+		error_code = "UNKNOWN"
+	}
+	service_metrics.Failures.Inc(error_code)
+}
+
+// Counts a message dropped because its deadline passed before it was processed
+func (service_metrics *ServiceMetrics) CountExpired() {
+	service_metrics.MessagesProcessed.Inc("expired")
+}
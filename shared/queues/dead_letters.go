@@ -0,0 +1,164 @@
+package queues
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+/*
+Messages that cannot be processed are moved to the dead-letter queue of their backend
+service instead of being dropped, e.g. requests and responses that are not valid JSON
+and requests that stopped the service too many times. They are kept with the reason
+until they are re-enqueued or purged with the dlq command.
+
+Dead-letter queues are Redis streams, so that dead letters are listed in the order
+they failed. Edited dead letters are added again with a new ID.
+*/
+
+// Kinds of messages in dead-letter queues
+const (
+	Kind_request  string = "request"
+	Kind_response string = "response"
+)
+
+// Fields of the entries of dead-letter queues
+const (
+	dead_letter_field_kind       string = "kind"
+	dead_letter_field_queue_name string = "queue_name"
+	dead_letter_field_reason     string = "reason"
+	dead_letter_field_failed_at  string = "failed_at"
+	dead_letter_field_message    string = "message"
+)
+
+type DeadLetter struct {
+	// Set when the dead letter is added to a dead-letter queue
+	ID string `json:"id"`
+
+	Kind string `json:"kind"`
+
+	// Queue the message was taken from. Re-enqueued messages are put back into it.
+	QueueName string `json:"queue_name"`
+
+	Reason   string `json:"reason"`
+	FailedAt string `json:"failed_at"` // RFC 3339
+
+	// The message as it was taken from the queue, which may not be valid JSON
+	Message string `json:"message"`
+}
+
+func CreateDeadLetter(kind string, queue_name string, reason string, message []byte) *DeadLetter {
+	return &DeadLetter{
+		Kind:      kind,
+		QueueName: queue_name,
+		Reason:    reason,
+		FailedAt:  time.Now().UTC().Format(time.RFC3339),
+		Message:   string(message),
+	}
+}
+
+func (dead_letter *DeadLetter) get_values() []string {
+	return []string{
+		dead_letter_field_kind, dead_letter.Kind,
+		dead_letter_field_queue_name, dead_letter.QueueName,
+		dead_letter_field_reason, dead_letter.Reason,
+		dead_letter_field_failed_at, dead_letter.FailedAt,
+		dead_letter_field_message, dead_letter.Message,
+	}
+}
+
+func create_dead_letter(entry *redis.XMessage) *DeadLetter {
+	get := func(field string) string {
+		value, _ := entry.Values[field].(string)
+		return value
+	}
+	return &DeadLetter{
+		ID:        entry.ID,
+		Kind:      get(dead_letter_field_kind),
+		QueueName: get(dead_letter_field_queue_name),
+		Reason:    get(dead_letter_field_reason),
+		FailedAt:  get(dead_letter_field_failed_at),
+		Message:   get(dead_letter_field_message),
+	}
+}
+
+// Returns the ID of the dead letter
+func AddDeadLetter(ctx context.Context, client *redis.Client, dead_letter_queue string, dead_letter *DeadLetter) (string, error) {
+	return client.XAdd(ctx, &redis.XAddArgs{
+		Stream: dead_letter_queue,
+		Values: dead_letter.get_values(),
+	}).Result()
+}
+
+// Returns up to count dead letters, oldest first
+func ReadDeadLetters(ctx context.Context, client *redis.Client, dead_letter_queue string, count int64) ([]*DeadLetter, error) {
+	entries, err := client.XRangeN(ctx, dead_letter_queue, "-", "+", count).Result()
+	if err != nil {
+		return nil, err
+	}
+	dead_letters := make([]*DeadLetter, 0, len(entries))
+	for _, entry := range entries {
+		dead_letters = append(dead_letters, create_dead_letter(&entry))
+	}
+	return dead_letters, nil
+}
+
+// Returns redis.Nil if there is no dead letter with the ID
+func ReadDeadLetter(ctx context.Context, client *redis.Client, dead_letter_queue string, id string) (*DeadLetter, error) {
+	entries, err := client.XRange(ctx, dead_letter_queue, id, id).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, redis.Nil
+	}
+	return create_dead_letter(&entries[0]), nil
+}
+
+// Replaces a dead letter with an edited copy in one transaction. Returns the ID of the
+// copy.
+func ReplaceDeadLetter(ctx context.Context, client *redis.Client, dead_letter_queue string, dead_letter *DeadLetter) (string, error) {
+	var added *redis.StringCmd = nil
+	var deleted *redis.IntCmd = nil
+	_, err := client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		added = pipe.XAdd(ctx, &redis.XAddArgs{
+			Stream: dead_letter_queue,
+			Values: dead_letter.get_values(),
+		})
+		deleted = pipe.XDel(ctx, dead_letter_queue, dead_letter.ID)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if deleted.Val() == 0 {
+		// Purged or re-enqueued in the meantime
+		client.XDel(ctx, dead_letter_queue, added.Val())
+		return "", redis.Nil
+	}
+	return added.Val(), nil
+}
+
+// Returns the number of dead letters deleted
+func DeleteDeadLetters(ctx context.Context, client *redis.Client, dead_letter_queue string, ids ...string) (int64, error) {
+	if len(ids) == 0 {
+		return 0, errors.New("no dead letters to delete")
+	}
+	return client.XDel(ctx, dead_letter_queue, ids...).Result()
+}
+
+// Removes every dead letter of the queue. Returns the number of dead letters removed.
+func PurgeDeadLetters(ctx context.Context, client *redis.Client, dead_letter_queue string) (int64, error) {
+	var length *redis.IntCmd = nil
+	_, err := client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		length = pipe.XLen(ctx, dead_letter_queue)
+		pipe.Del(ctx, dead_letter_queue)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return length.Val(), nil
+}
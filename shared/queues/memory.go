@@ -0,0 +1,109 @@
+package queues
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Messages a queue in memory holds before pushing waits for space
+const Memory_queue_capacity int = 1000
+
+/*
+Passes requests and responses through channels within one process, so that the API
+gateway and backend services can be tested together without Redis. Queues are created
+when first used. Requests are taken once, so they need not be acknowledged, and
+responses queues are never removed.
+*/
+type Memory struct {
+	mutex        sync.Mutex
+	queues       map[string]chan []byte
+	dead_letters map[string][]*DeadLetter
+}
+
+func CreateMemory() *Memory {
+	return &Memory{
+		queues:       make(map[string]chan []byte),
+		dead_letters: make(map[string][]*DeadLetter),
+	}
+}
+
+func (memory *Memory) get_queue(queue_name string) chan []byte {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	queue, ok := memory.queues[queue_name]
+	if !ok {
+		queue = make(chan []byte, Memory_queue_capacity)
+		memory.queues[queue_name] = queue
+	}
+	return queue
+}
+
+func (memory *Memory) push(ctx context.Context, queue_name string, message []byte) error {
+	// The sender may reuse its buffer once the message was pushed
+	copied := make([]byte, len(message))
+	copy(copied, message)
+	select {
+	case memory.get_queue(queue_name) <- copied:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (memory *Memory) pop(ctx context.Context, queue_name string, timeout time.Duration) ([]byte, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case message := <-memory.get_queue(queue_name):
+		return message, nil
+	case <-timer.C:
+		return nil, redis.Nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (memory *Memory) PushRequest(ctx context.Context, queue_name string, message []byte) error {
+	return memory.push(ctx, queue_name, message)
+}
+
+func (memory *Memory) PopRequest(ctx context.Context, queue_name string, timeout time.Duration, claim_idle_time time.Duration) (*Message, error) {
+	message, err := memory.pop(ctx, queue_name, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{Data: message, Deliveries: 1}, nil
+}
+
+func (memory *Memory) AckRequest(ctx context.Context, message *Message) error {
+	return nil
+}
+
+func (memory *Memory) PushResponse(ctx context.Context, queue_name string, message []byte, time_to_live time.Duration) error {
+	return memory.push(ctx, queue_name, message)
+}
+
+func (memory *Memory) PopResponse(ctx context.Context, queue_name string, timeout time.Duration) ([]byte, error) {
+	return memory.pop(ctx, queue_name, timeout)
+}
+
+func (memory *Memory) PushDeadLetter(ctx context.Context, dead_letter_queue string, dead_letter *DeadLetter) error {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	memory.dead_letters[dead_letter_queue] = append(memory.dead_letters[dead_letter_queue], dead_letter)
+	return nil
+}
+
+// Returns the dead letters pushed to the dead-letter queue, oldest first
+func (memory *Memory) GetDeadLetters(dead_letter_queue string) []*DeadLetter {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	return append([]*DeadLetter{}, memory.dead_letters[dead_letter_queue]...)
+}
+
+func (memory *Memory) Ping(ctx context.Context) error {
+	return nil
+}
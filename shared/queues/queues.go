@@ -0,0 +1,247 @@
+package queues
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+/*
+Requests queues are Redis lists or Redis streams.
+
+With lists, the API gateway puts requests at the head of the list with LPUSH and a
+backend service takes them from the tail with BRPOP. A request is gone from Redis as
+soon as it was taken, so it is lost if the service stops before it was processed.
+
+With streams, the API gateway adds requests to the stream with XADD and the backend
+services read them as a consumer group with XREADGROUP. A request stays pending until
+the service acknowledges it with XACK after its response was put into the responses
+queue. Requests that stay pending for longer than the claim idle time, e.g. because
+the service reading them was killed, are claimed by another consumer with XAUTOCLAIM
+and processed again.
+
+	requests stream ──XREADGROUP──> consumer ──commit, push response──> XACK
+	                 <──XAUTOCLAIM── pending for longer than the claim idle time
+*/
+
+// Transports of requests queues in configuration files
+const (
+	Transport_list   string = "list"
+	Transport_stream string = "stream"
+)
+
+// Name of the field holding the message in stream entries
+const stream_field_message string = "message"
+
+// Lists are used if the transport is empty
+func IsValidTransport(transport string) bool {
+	return transport == "" || transport == Transport_list || transport == Transport_stream
+}
+
+// Puts a message into a requests queue
+func Push(ctx context.Context, client *redis.Client, transport string, queue_name string, message []byte) error {
+	if transport == Transport_stream {
+		return client.XAdd(ctx, &redis.XAddArgs{
+			Stream: queue_name,
+			Values: []string{stream_field_message, string(message)},
+		}).Err()
+	}
+	return client.LPush(ctx, queue_name, message).Err()
+}
+
+// A message taken from a requests queue. Messages taken from a stream must be
+// acknowledged once they were processed.
+type Message struct {
+	Data []byte
+
+	// Times the message was taken from the stream, including this time. Always 1 for
+	// messages taken from a list.
+	Deliveries int64
+
+	// Empty for messages taken from a list
+	queue_name string
+	entry_id   string
+}
+
+/*
+Takes messages from a requests queue. Each consumer of a stream must have a name of
+its own, so that messages pending for a consumer that stopped can be told apart from
+messages it is still processing. A consumer is used by one thread at a time.
+*/
+type Consumer struct {
+	client        *redis.Client
+	transport     string
+	group_name    string
+	consumer_name string
+
+	// Consumer groups are created when a stream is first read, which is again if the
+	// name of the requests queue changes
+	created_groups map[string]bool
+
+	// Pending messages are looked for at most once per second, starting from where
+	// the last search ended
+	claim_cursor  string
+	next_claim_at time.Time
+}
+
+// Returns an error if messages could not be taken from a requests queue with these
+// settings
+func CheckConsumer(transport string, group_name string) error {
+	if !IsValidTransport(transport) {
+		return errors.New("unknown transport " + transport)
+	}
+	if transport == Transport_stream && len(group_name) == 0 {
+		return errors.New("missing consumer group")
+	}
+	return nil
+}
+
+// Differs for every process, so that messages pending for a service that was restarted
+// are claimed like the messages of any other consumer that stopped
+func CreateConsumerName() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return hostname + ":" + strconv.Itoa(os.Getpid())
+}
+
+func CreateConsumer(client *redis.Client, transport string, group_name string, consumer_name string) *Consumer {
+	return &Consumer{
+		client:         client,
+		transport:      transport,
+		group_name:     group_name,
+		consumer_name:  consumer_name,
+		created_groups: make(map[string]bool),
+		claim_cursor:   "0-0",
+	}
+}
+
+/*
+Waits up to timeout for the next message. Returns redis.Nil if there was none.
+Messages of a stream that were pending for longer than claim_idle_time are taken
+before new messages.
+*/
+func (consumer *Consumer) Pop(ctx context.Context, queue_name string, timeout time.Duration, claim_idle_time time.Duration) (*Message, error) {
+	if consumer.transport != Transport_stream {
+		string_slice, err := consumer.client.BRPop(ctx, timeout, queue_name).Result()
+		if err != nil {
+			return nil, err
+		}
+		// string_slice[0] gives the name of the queue
+		// string_slice[1] gives the data retrieved from the queue
+		return &Message{Data: []byte(string_slice[1]), Deliveries: 1}, nil
+	}
+
+	err := consumer.create_group(ctx, queue_name)
+	if err != nil {
+		return nil, err
+	}
+
+	message, err := consumer.claim(ctx, queue_name, claim_idle_time)
+	if message != nil || err != nil {
+		return message, err
+	}
+
+	streams, err := consumer.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    consumer.group_name,
+		Consumer: consumer.consumer_name,
+		Streams:  []string{queue_name, ">"},
+		Count:    1,
+		Block:    timeout,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, stream := range streams {
+		for _, entry := range stream.Messages {
+			return create_message(queue_name, &entry), nil
+		}
+	}
+	return nil, redis.Nil
+}
+
+// Creates the consumer group reading the stream, and the stream if it does not exist
+func (consumer *Consumer) create_group(ctx context.Context, queue_name string) error {
+	if consumer.created_groups[queue_name] {
+		return nil
+	}
+	err := consumer.client.XGroupCreateMkStream(ctx, queue_name, consumer.group_name, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	consumer.created_groups[queue_name] = true
+	return nil
+}
+
+// Takes over a message that was pending for another consumer for too long
+func (consumer *Consumer) claim(ctx context.Context, queue_name string, claim_idle_time time.Duration) (*Message, error) {
+	if claim_idle_time <= 0 || time.Now().Before(consumer.next_claim_at) {
+		return nil, nil
+	}
+	entries, next_cursor, err := consumer.client.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+		Stream:   queue_name,
+		Group:    consumer.group_name,
+		Consumer: consumer.consumer_name,
+		MinIdle:  claim_idle_time,
+		Start:    consumer.claim_cursor,
+		Count:    1,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	consumer.claim_cursor = next_cursor
+	for _, entry := range entries {
+		// Entries deleted from the stream while pending have no values
+		if len(entry.Values) == 0 {
+			continue
+		}
+		message := create_message(queue_name, &entry)
+		pending, err := consumer.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream: queue_name,
+			Group:  consumer.group_name,
+			Start:  entry.ID,
+			End:    entry.ID,
+			Count:  1,
+		}).Result()
+		if err != nil {
+			return nil, err
+		}
+		if len(pending) > 0 {
+			message.Deliveries = pending[0].RetryCount
+		}
+		return message, nil
+	}
+	if next_cursor == "0-0" {
+		consumer.next_claim_at = time.Now().Add(time.Second)
+	}
+	return nil, nil
+}
+
+func create_message(queue_name string, entry *redis.XMessage) *Message {
+	value, _ := entry.Values[stream_field_message].(string)
+	return &Message{
+		Data:       []byte(value),
+		Deliveries: 1,
+		queue_name: queue_name,
+		entry_id:   entry.ID,
+	}
+}
+
+// Removes a processed message from its stream. Does nothing for messages of lists.
+func (consumer *Consumer) Ack(ctx context.Context, message *Message) error {
+	if message == nil || len(message.entry_id) == 0 {
+		return nil
+	}
+	_, err := consumer.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.XAck(ctx, message.queue_name, consumer.group_name, message.entry_id)
+		pipe.XDel(ctx, message.queue_name, message.entry_id)
+		return nil
+	})
+	return err
+}
@@ -0,0 +1,327 @@
+package queues
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func Test_ListTransport(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: "localhost:1640"})
+	defer client.Close()
+	ctx := context.Background()
+	queue_name := "queues_unit_test_list"
+	defer client.Del(ctx, queue_name)
+
+	// Messages are taken in the order they were put in
+	for _, message := range []string{"first", "second"} {
+		err := Push(ctx, client, Transport_list, queue_name, []byte(message))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	consumer := CreateConsumer(client, "", "", "")
+	for _, expected := range []string{"first", "second"} {
+		message, err := consumer.Pop(ctx, queue_name, time.Second, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(message.Data) != expected {
+			t.Error("Expected: ", expected, ", Got: ", string(message.Data))
+		}
+		err = consumer.Ack(ctx, message)
+		if err != nil {
+			t.Error("Expected: ", nil, ", Got: ", err)
+		}
+	}
+	_, err := consumer.Pop(ctx, queue_name, 100*time.Millisecond, time.Second)
+	if !errors.Is(err, redis.Nil) {
+		t.Error("Expected: ", redis.Nil, ", Got: ", err)
+	}
+}
+
+func Test_StreamTransport(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: "localhost:1640"})
+	defer client.Close()
+	ctx := context.Background()
+	queue_name := "queues_unit_test_stream"
+	group_name := "deposit_service"
+	client.Del(ctx, queue_name)
+	defer client.Del(ctx, queue_name)
+
+	err := Push(ctx, client, Transport_stream, queue_name, []byte("deposit"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first consumer is killed while processing the message, so the message is
+	// never acknowledged
+	killed_client := redis.NewClient(&redis.Options{Addr: "localhost:1640"})
+	killed := CreateConsumer(killed_client, Transport_stream, group_name, "killed")
+	message, err := killed.Pop(ctx, queue_name, time.Second, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(message.Data) != "deposit" {
+		t.Fatal("Expected: ", "deposit", ", Got: ", string(message.Data))
+	}
+	killed_client.Close()
+
+	// Other consumers do not get the message while it may still be processed
+	survivor := CreateConsumer(client, Transport_stream, group_name, "survivor")
+	claim_idle_time := 200 * time.Millisecond
+	_, err = survivor.Pop(ctx, queue_name, 50*time.Millisecond, claim_idle_time)
+	if !errors.Is(err, redis.Nil) {
+		t.Fatal("Expected: ", redis.Nil, ", Got: ", err)
+	}
+
+	// The message is claimed once it was pending for longer than the claim idle time
+	time.Sleep(2 * claim_idle_time)
+	survivor.next_claim_at = time.Time{}
+	claimed, err := survivor.Pop(ctx, queue_name, 50*time.Millisecond, claim_idle_time)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(claimed.Data) != "deposit" || claimed.entry_id != message.entry_id {
+		t.Error("Expected: ", message.entry_id, ", Got: ", claimed.entry_id, " ", string(claimed.Data))
+	}
+	if message.Deliveries != 1 || claimed.Deliveries != 2 {
+		t.Error("Expected: ", "1 and 2 deliveries", ", Got: ", message.Deliveries, " and ", claimed.Deliveries)
+	}
+
+	// Acknowledged messages are removed and not claimed again
+	err = survivor.Ack(ctx, claimed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending, err := client.XPending(ctx, queue_name, group_name).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending.Count != 0 {
+		t.Error("Expected: ", 0, ", Got: ", pending.Count)
+	}
+	length, err := client.XLen(ctx, queue_name).Result()
+	if err != nil || length != 0 {
+		t.Error("Expected: ", 0, ", Got: ", length, " ", err)
+	}
+	time.Sleep(2 * claim_idle_time)
+	survivor.next_claim_at = time.Time{}
+	_, err = survivor.Pop(ctx, queue_name, 50*time.Millisecond, claim_idle_time)
+	if !errors.Is(err, redis.Nil) {
+		t.Error("Expected: ", redis.Nil, ", Got: ", err)
+	}
+
+	// New messages are read by the next consumer of the group
+	err = Push(ctx, client, Transport_stream, queue_name, []byte("withdrawal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err = survivor.Pop(ctx, queue_name, time.Second, claim_idle_time)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(message.Data) != "withdrawal" {
+		t.Error("Expected: ", "withdrawal", ", Got: ", string(message.Data))
+	}
+	survivor.Ack(ctx, message)
+
+	if !IsValidTransport("") || !IsValidTransport(Transport_stream) || IsValidTransport("kafka") {
+		t.Error("Expected: ", "list and stream", ", Got: ", "other transports")
+	}
+}
+
+func Test_Transports(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: "localhost:1640"})
+	defer client.Close()
+	ctx := context.Background()
+	requests_queue := "queues_unit_test_transport_requests"
+	responses_queue := "queues_unit_test_transport_responses"
+	defer client.Del(ctx, requests_queue, responses_queue)
+
+	transports := map[string]Transport{
+		"list":   CreateRedisTransport(client, Transport_list, "", ""),
+		"memory": CreateMemory(),
+	}
+	for name, transport := range transports {
+		err := transport.Ping(ctx)
+		if err != nil {
+			t.Fatal(name, ": ", err)
+		}
+
+		// Requests and responses are passed on as they were pushed
+		err = transport.PushRequest(ctx, requests_queue, []byte("request"))
+		if err != nil {
+			t.Fatal(name, ": ", err)
+		}
+		request, err := transport.PopRequest(ctx, requests_queue, time.Second, time.Minute)
+		if err != nil {
+			t.Fatal(name, ": ", err)
+		}
+		if string(request.Data) != "request" {
+			t.Error("Expected: ", "request", ", Got: ", string(request.Data), " for ", name)
+		}
+		err = transport.AckRequest(ctx, request)
+		if err != nil {
+			t.Error("Expected: ", nil, ", Got: ", err, " for ", name)
+		}
+		err = transport.PushResponse(ctx, responses_queue, []byte("response"), time.Minute)
+		if err != nil {
+			t.Fatal(name, ": ", err)
+		}
+		response, err := transport.PopResponse(ctx, responses_queue, time.Second)
+		if err != nil {
+			t.Fatal(name, ": ", err)
+		}
+		if string(response) != "response" {
+			t.Error("Expected: ", "response", ", Got: ", string(response), " for ", name)
+		}
+
+		// Empty queues time out the same way
+		_, err = transport.PopRequest(ctx, requests_queue, 100*time.Millisecond, time.Minute)
+		if !errors.Is(err, redis.Nil) {
+			t.Error("Expected: ", redis.Nil, ", Got: ", err, " for ", name)
+		}
+		_, err = transport.PopResponse(ctx, responses_queue, 100*time.Millisecond)
+		if !errors.Is(err, redis.Nil) {
+			t.Error("Expected: ", redis.Nil, ", Got: ", err, " for ", name)
+		}
+	}
+}
+
+func Test_FailedResponse(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: "localhost:1640"})
+	defer client.Close()
+	ctx := context.Background()
+	requests_queue := "queues_unit_test_failed_response_requests"
+	responses_queue := "queues_unit_test_failed_response_responses"
+	group_name := "deposit_service"
+	client.Del(ctx, requests_queue, responses_queue)
+	defer client.Del(ctx, requests_queue, responses_queue)
+
+	requests := CreateRedisTransport(client, Transport_stream, group_name, "consumer")
+	err := requests.PushRequest(ctx, requests_queue, []byte("deposit"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	claim_idle_time := 200 * time.Millisecond
+	message, err := requests.PopRequest(ctx, requests_queue, time.Second, claim_idle_time)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Services only acknowledge a request once its response was pushed, so a request
+	// whose response could not be pushed stays pending
+	unreachable_client := redis.NewClient(&redis.Options{Addr: "localhost:1640"})
+	unreachable_client.Close()
+	unreachable := CreateRedisTransport(unreachable_client, Transport_list, "", "")
+	err = unreachable.PushResponse(ctx, responses_queue, []byte("response"), time.Minute)
+	if err == nil {
+		t.Fatal("Expected: ", "error", ", Got: ", err)
+	}
+	pending, err := client.XPending(ctx, requests_queue, group_name).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending.Count != 1 {
+		t.Error("Expected: ", 1, ", Got: ", pending.Count)
+	}
+
+	// The request is delivered again and acknowledged once its response was pushed
+	time.Sleep(2 * claim_idle_time)
+	requests.consumer.next_claim_at = time.Time{}
+	redelivered, err := requests.PopRequest(ctx, requests_queue, 50*time.Millisecond, claim_idle_time)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if redelivered.entry_id != message.entry_id || redelivered.Deliveries != 2 {
+		t.Error("Expected: ", message.entry_id, " delivered 2 times, Got: ", redelivered.entry_id, " delivered ", redelivered.Deliveries, " times")
+	}
+	err = requests.PushResponse(ctx, responses_queue, []byte("response"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = requests.AckRequest(ctx, redelivered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending, err = client.XPending(ctx, requests_queue, group_name).Result()
+	if err != nil || pending.Count != 0 {
+		t.Error("Expected: ", 0, ", Got: ", pending, " ", err)
+	}
+}
+
+func Test_DeadLetters(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: "localhost:1640"})
+	defer client.Close()
+	ctx := context.Background()
+	dead_letter_queue := "queues_unit_test_dead_letters"
+	client.Del(ctx, dead_letter_queue)
+	defer client.Del(ctx, dead_letter_queue)
+
+	// Dead letters are listed in the order they failed
+	transport := CreateRedisTransport(client, Transport_list, "", "")
+	for _, message := range []string{"{", "}"} {
+		err := transport.PushDeadLetter(ctx, dead_letter_queue, CreateDeadLetter(Kind_request, "deposit_requests_queue", "Invalid JSON", []byte(message)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	dead_letters, err := ReadDeadLetters(ctx, client, dead_letter_queue, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dead_letters) != 2 || dead_letters[0].Message != "{" || dead_letters[1].Message != "}" {
+		t.Fatal("Expected: ", "{ and }", ", Got: ", dead_letters)
+	}
+	first := dead_letters[0]
+	if first.Kind != Kind_request || first.QueueName != "deposit_requests_queue" || first.Reason != "Invalid JSON" || len(first.FailedAt) == 0 || len(first.ID) == 0 {
+		t.Error("Expected: ", "request from deposit_requests_queue", ", Got: ", *first)
+	}
+
+	// Edited dead letters replace the original
+	first.Message = "{}"
+	id, err := ReplaceDeadLetter(ctx, client, dead_letter_queue, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ReadDeadLetter(ctx, client, dead_letter_queue, first.ID)
+	if !errors.Is(err, redis.Nil) {
+		t.Error("Expected: ", redis.Nil, ", Got: ", err)
+	}
+	edited, err := ReadDeadLetter(ctx, client, dead_letter_queue, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if edited.Message != "{}" || edited.Reason != first.Reason {
+		t.Error("Expected: ", "{}", ", Got: ", edited.Message)
+	}
+	_, err = ReplaceDeadLetter(ctx, client, dead_letter_queue, first)
+	if !errors.Is(err, redis.Nil) {
+		t.Error("Expected: ", redis.Nil, ", Got: ", err)
+	}
+
+	// Dead letters are deleted one by one or all at once
+	deleted, err := DeleteDeadLetters(ctx, client, dead_letter_queue, id)
+	if err != nil || deleted != 1 {
+		t.Error("Expected: ", 1, ", Got: ", deleted, " ", err)
+	}
+	purged, err := PurgeDeadLetters(ctx, client, dead_letter_queue)
+	if err != nil || purged != 1 {
+		t.Error("Expected: ", 1, ", Got: ", purged, " ", err)
+	}
+	dead_letters, err = ReadDeadLetters(ctx, client, dead_letter_queue, 10)
+	if err != nil || len(dead_letters) != 0 {
+		t.Error("Expected: ", 0, ", Got: ", len(dead_letters), " ", err)
+	}
+
+	// Dead letters in memory are kept for tests
+	memory := CreateMemory()
+	memory.PushDeadLetter(ctx, dead_letter_queue, CreateDeadLetter(Kind_response, "deposit_responses_queue:1", "Invalid JSON", []byte("{")))
+	if len(memory.GetDeadLetters(dead_letter_queue)) != 1 {
+		t.Error("Expected: ", 1, ", Got: ", len(memory.GetDeadLetters(dead_letter_queue)))
+	}
+}
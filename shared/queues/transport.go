@@ -0,0 +1,106 @@
+package queues
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+/*
+Carries requests from the API gateway to a backend service and responses back. Every
+Pop returns redis.Nil if nothing arrived before the timeout, whichever the transport.
+
+	API gateway ──PushRequest──> requests queue ──PopRequest──> backend service
+	API gateway <──PopResponse── responses queue <──PushResponse── backend service
+*/
+type Transport interface {
+	PushRequest(ctx context.Context, queue_name string, message []byte) error
+
+	// Requests pending for longer than claim_idle_time are taken again by transports
+	// that wait for requests to be acknowledged
+	PopRequest(ctx context.Context, queue_name string, timeout time.Duration, claim_idle_time time.Duration) (*Message, error)
+
+	// Called once the response to the request was pushed
+	AckRequest(ctx context.Context, message *Message) error
+
+	// Responses queues are removed after time_to_live without new responses. They are
+	// kept if time_to_live is 0.
+	PushResponse(ctx context.Context, queue_name string, message []byte, time_to_live time.Duration) error
+
+	PopResponse(ctx context.Context, queue_name string, timeout time.Duration) ([]byte, error)
+
+	// Keeps a message that cannot be processed in the dead-letter queue
+	PushDeadLetter(ctx context.Context, dead_letter_queue string, dead_letter *DeadLetter) error
+
+	// Returns an error if messages cannot be passed on at the moment
+	Ping(ctx context.Context) error
+}
+
+// Requests and responses queues on a Redis server
+type RedisTransport struct {
+	client    *redis.Client
+	transport string
+
+	// Only used to pop requests
+	consumer *Consumer
+}
+
+// Requests queues are lists or streams as given by transport. Responses queues are
+// always lists. The names of the consumer group and consumer are only needed by backend
+// services popping requests from a stream.
+func CreateRedisTransport(client *redis.Client, transport string, group_name string, consumer_name string) *RedisTransport {
+	return &RedisTransport{
+		client:    client,
+		transport: transport,
+		consumer:  CreateConsumer(client, transport, group_name, consumer_name),
+	}
+}
+
+// Other data, such as rate limits, may be kept on the same Redis server
+func (transport *RedisTransport) Client() *redis.Client {
+	return transport.client
+}
+
+func (transport *RedisTransport) PushRequest(ctx context.Context, queue_name string, message []byte) error {
+	return Push(ctx, transport.client, transport.transport, queue_name, message)
+}
+
+// Only used by one thread at a time
+func (transport *RedisTransport) PopRequest(ctx context.Context, queue_name string, timeout time.Duration, claim_idle_time time.Duration) (*Message, error) {
+	return transport.consumer.Pop(ctx, queue_name, timeout, claim_idle_time)
+}
+
+func (transport *RedisTransport) AckRequest(ctx context.Context, message *Message) error {
+	return transport.consumer.Ack(ctx, message)
+}
+
+func (transport *RedisTransport) PushResponse(ctx context.Context, queue_name string, message []byte, time_to_live time.Duration) error {
+	_, err := transport.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LPush(ctx, queue_name, message)
+		if time_to_live > 0 {
+			pipe.Expire(ctx, queue_name, time_to_live)
+		}
+		return nil
+	})
+	return err
+}
+
+func (transport *RedisTransport) PopResponse(ctx context.Context, queue_name string, timeout time.Duration) ([]byte, error) {
+	string_slice, err := transport.client.BRPop(ctx, timeout, queue_name).Result()
+	if err != nil {
+		return nil, err
+	}
+	// string_slice[0] gives the name of the queue
+	// string_slice[1] gives the data retrieved from the queue
+	return []byte(string_slice[1]), nil
+}
+
+func (transport *RedisTransport) PushDeadLetter(ctx context.Context, dead_letter_queue string, dead_letter *DeadLetter) error {
+	_, err := AddDeadLetter(ctx, transport.client, dead_letter_queue, dead_letter)
+	return err
+}
+
+func (transport *RedisTransport) Ping(ctx context.Context) error {
+	return transport.client.Ping(ctx).Err()
+}
@@ -0,0 +1,55 @@
+package responses
+
+/*
+Stable error codes reported with every failed response. Callers may rely on these
+codes to decide what to do next. Error messages are meant for people and may change
+at any time.
+*/
+const (
+	// Reported by the backend services
+	Error_code_invalid_request           string = "INVALID_REQUEST"
+	Error_code_invalid_amount            string = "INVALID_AMOUNT"
+	Error_code_invalid_currency          string = "INVALID_CURRENCY"
+	Error_code_invalid_date              string = "INVALID_DATE"
+	Error_code_wallet_not_found          string = "WALLET_NOT_FOUND"
+	Error_code_insufficient_funds        string = "INSUFFICIENT_FUNDS"
+	Error_code_currency_mismatch         string = "CURRENCY_MISMATCH"
+	Error_code_idempotency_key_reused    string = "IDEMPOTENCY_KEY_REUSED"
+	Error_code_idempotency_key_not_found string = "IDEMPOTENCY_KEY_NOT_FOUND"
+	Error_code_webhook_not_found         string = "WEBHOOK_NOT_FOUND"
+	Error_code_delivery_not_found        string = "DELIVERY_NOT_FOUND"
+	Error_code_batch_aborted             string = "BATCH_ABORTED"
+	Error_code_database_error            string = "DATABASE_ERROR"
+	Error_code_internal_error            string = "INTERNAL_ERROR"
+
+	// Reported by the API gateway
+	Error_code_unauthenticated     string = "UNAUTHENTICATED"
+	Error_code_forbidden           string = "FORBIDDEN"
+	Error_code_route_not_found     string = "ROUTE_NOT_FOUND"
+	Error_code_method_not_allowed  string = "METHOD_NOT_ALLOWED"
+	Error_code_rate_limited        string = "RATE_LIMITED"
+	Error_code_service_unavailable string = "SERVICE_UNAVAILABLE"
+	Error_code_service_timeout     string = "SERVICE_TIMEOUT"
+	Error_code_operation_not_found string = "OPERATION_NOT_FOUND"
+	Error_code_request_too_large   string = "REQUEST_TOO_LARGE"
+)
+
+/*
+Body of every failed HTTP response returned by the API gateway, following the problem
+details format of RFC 9457. Sent with the content type application/problem+json.
+
+	{
+		"type": "about:blank",
+		"title": "Conflict",
+		"status": 409,
+		"code": "INSUFFICIENT_FUNDS",
+		"detail": "Insufficient funds in wallet"
+	}
+*/
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Code   string `json:"code"`
+	Detail string `json:"detail,omitempty"`
+}
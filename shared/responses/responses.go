@@ -1,5 +1,7 @@
 package responses
 
+import "encoding/json"
+
 const (
 	Status_unknown    int = 0
 	Status_successful int = 1
@@ -20,6 +22,7 @@ type Header struct {
 type Deposit struct {
 	Header       Header `json:"header"`
 	Status       int    `json:"status,omitempty"`
+	ErrorCode    string `json:"error_code,omitempty"`
 	ErrorMessage string `json:"error_message,omitempty"`
 	Currency     string `json:"currency,omitempty"`
 	NewBalance   string `json:"new_balance,omitempty"`
@@ -28,6 +31,7 @@ type Deposit struct {
 type Withdraw struct {
 	Header       Header `json:"header"`
 	Status       int    `json:"status,omitempty"`
+	ErrorCode    string `json:"error_code,omitempty"`
 	ErrorMessage string `json:"error_message,omitempty"`
 	Currency     string `json:"currency,omitempty"`
 	NewBalance   string `json:"new_balance,omitempty"`
@@ -36,6 +40,7 @@ type Withdraw struct {
 type Transfer struct {
 	Header       Header `json:"header"`
 	Status       int    `json:"status,omitempty"`
+	ErrorCode    string `json:"error_code,omitempty"`
 	ErrorMessage string `json:"error_message,omitempty"`
 	Currency     string `json:"currency,omitempty"`
 	NewBalance   string `json:"new_balance,omitempty"`
@@ -44,6 +49,7 @@ type Transfer struct {
 type Balance struct {
 	Header       Header `json:"header"`
 	Status       int    `json:"status,omitempty"`
+	ErrorCode    string `json:"error_code,omitempty"`
 	ErrorMessage string `json:"error_message,omitempty"`
 	Currency     string `json:"currency,omitempty"`
 	Balance      string `json:"balance,omitempty"`
@@ -59,6 +65,117 @@ type Transaction struct {
 type TransactionHistory struct {
 	Header       Header        `json:"header"`
 	Status       int           `json:"status,omitempty"`
+	ErrorCode    string        `json:"error_code,omitempty"`
 	ErrorMessage string        `json:"error_message,omitempty"`
 	History      []Transaction `json:"history,omitempty"`
 }
+
+// Outcome of the request processed with an idempotency key. Response holds the
+// original Deposit, Withdraw or Transfer response, as indicated by RequestAction.
+type IdempotencyKey struct {
+	Header        Header          `json:"header"`
+	Status        int             `json:"status,omitempty"`
+	ErrorCode     string          `json:"error_code,omitempty"`
+	ErrorMessage  string          `json:"error_message,omitempty"`
+	RequestAction int             `json:"request_action,omitempty"`
+	DateAndTime   string          `json:"date_and_time,omitempty"`
+	Response      json.RawMessage `json:"response,omitempty"`
+}
+
+// Response to an item of a batch. Response holds the Deposit, Withdraw or Transfer
+// response, as indicated by Action.
+type BatchItem struct {
+	ItemID   string          `json:"item_id"`
+	Action   int             `json:"action"`
+	Response json.RawMessage `json:"response"`
+}
+
+/*
+Answers a batch applied in a single database transaction. The batch is successful if
+every item was applied. If an item failed, none of the items were applied and the batch
+fails with the error code of the failed item. The failed item reports why, and every
+other item reports BATCH_ABORTED.
+*/
+type Batch struct {
+	Header       Header      `json:"header"`
+	Status       int         `json:"status,omitempty"`
+	ErrorCode    string      `json:"error_code,omitempty"`
+	ErrorMessage string      `json:"error_message,omitempty"`
+	Items        []BatchItem `json:"items,omitempty"`
+}
+
+const (
+	Operation_status_pending   string = "pending"   // Waiting for the backend service
+	Operation_status_succeeded string = "succeeded" // Response holds the successful response
+	Operation_status_failed    string = "failed"    // Response holds the failed response
+)
+
+/*
+Status of a deposit, withdrawal or transfer accepted by the API gateway without waiting
+for the backend service, i.e. sent with Prefer: respond-async. Reported by the API
+gateway. Once the backend service has answered, Response holds the Deposit, Withdraw
+or Transfer response, as indicated by RequestAction.
+*/
+type Operation struct {
+	OperationID   string          `json:"operation_id"`
+	RequestAction int             `json:"request_action"`
+	Status        string          `json:"status"`
+	CreatedAt     string          `json:"created_at"`
+	CompletedAt   string          `json:"completed_at,omitempty"`
+	Response      json.RawMessage `json:"response,omitempty"`
+}
+
+const (
+	Delivery_status_pending   string = "pending"   // Waiting for its next attempt
+	Delivery_status_delivered string = "delivered" // The URL answered with 2xx
+	Delivery_status_failed    string = "failed"    // No attempts left
+	Delivery_status_cancelled string = "cancelled" // The webhook was deleted
+)
+
+// The secret is only returned when the webhook is created
+type Webhook struct {
+	WebhookID  string   `json:"webhook_id"`
+	URL        string   `json:"url"`
+	WalletID   string   `json:"wallet_id,omitempty"`
+	EventTypes []string `json:"event_types"`
+	Secret     string   `json:"secret,omitempty"`
+	CreatedAt  string   `json:"created_at"`
+}
+
+// Answers the requests to create, list and delete webhooks
+type Webhooks struct {
+	Header       Header    `json:"header"`
+	Status       int       `json:"status,omitempty"`
+	ErrorCode    string    `json:"error_code,omitempty"`
+	ErrorMessage string    `json:"error_message,omitempty"`
+	Webhooks     []Webhook `json:"webhooks,omitempty"`
+}
+
+// A single attempt to deliver an event. StatusCode is 0 if no HTTP response was received.
+type WebhookDeliveryAttempt struct {
+	Attempt     int    `json:"attempt"`
+	DateAndTime string `json:"date_and_time"`
+	StatusCode  int    `json:"status_code,omitempty"`
+	Error       string `json:"error,omitempty"`
+	Duration    int64  `json:"duration"` // ms
+}
+
+type WebhookDelivery struct {
+	DeliveryID    string                   `json:"delivery_id"`
+	EventID       string                   `json:"event_id"`
+	EventType     string                   `json:"event_type"`
+	Status        string                   `json:"status"`
+	NextAttemptAt string                   `json:"next_attempt_at,omitempty"`
+	RedeliveryOf  string                   `json:"redelivery_of,omitempty"`
+	CreatedAt     string                   `json:"created_at"`
+	Attempts      []WebhookDeliveryAttempt `json:"attempts,omitempty"`
+}
+
+// Answers the requests to list and redeliver deliveries. Newest deliveries come first.
+type WebhookDeliveries struct {
+	Header       Header            `json:"header"`
+	Status       int               `json:"status,omitempty"`
+	ErrorCode    string            `json:"error_code,omitempty"`
+	ErrorMessage string            `json:"error_message,omitempty"`
+	Deliveries   []WebhookDelivery `json:"deliveries,omitempty"`
+}
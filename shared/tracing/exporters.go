@@ -0,0 +1,229 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Names of exporters in configuration files
+const (
+	Exporter_none   string = "none"
+	Exporter_stdout string = "stdout"
+	Exporter_otlp   string = "otlp"
+)
+
+/*
+Creates the exporter of the given name. Spans are sent to the endpoint by the OTLP
+exporter and written to standard output by the stdout exporter. No exporter is
+returned for "none" or an empty name.
+*/
+func CreateExporter(exporter_name string, service_name string, endpoint string, timeout time.Duration) (Exporter, error) {
+	switch exporter_name {
+	case "", Exporter_none:
+		return nil, nil
+	case Exporter_stdout:
+		return CreateStdoutExporter(service_name, os.Stdout), nil
+	case Exporter_otlp:
+		if len(endpoint) == 0 {
+			return nil, errors.New("missing endpoint of OTLP exporter")
+		}
+		return CreateOTLPExporter(service_name, endpoint, timeout), nil
+	}
+	return nil, errors.New("unknown exporter " + exporter_name)
+}
+
+// OpenTelemetry protocol with JSON encoding over HTTP. Trace and span IDs are hex
+// strings and times are nanoseconds since the Unix epoch as decimal strings.
+type otlp_request struct {
+	ResourceSpans []otlp_resource_spans `json:"resourceSpans"`
+}
+
+type otlp_resource_spans struct {
+	Resource   otlp_resource     `json:"resource"`
+	ScopeSpans []otlp_scope_span `json:"scopeSpans"`
+}
+
+type otlp_resource struct {
+	Attributes []otlp_attribute `json:"attributes"`
+}
+
+type otlp_scope_span struct {
+	Scope otlp_scope  `json:"scope"`
+	Spans []otlp_span `json:"spans"`
+}
+
+type otlp_scope struct {
+	Name string `json:"name"`
+}
+
+type otlp_span struct {
+	TraceID           string           `json:"traceId"`
+	SpanID            string           `json:"spanId"`
+	ParentSpanID      string           `json:"parentSpanId,omitempty"`
+	Name              string           `json:"name"`
+	Kind              int              `json:"kind"`
+	StartTimeUnixNano string           `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string           `json:"endTimeUnixNano"`
+	Attributes        []otlp_attribute `json:"attributes,omitempty"`
+	Status            otlp_status      `json:"status"`
+}
+
+type otlp_attribute struct {
+	Key   string     `json:"key"`
+	Value otlp_value `json:"value"`
+}
+
+type otlp_value struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlp_status struct {
+	Code    int    `json:"code,omitempty"` // 0 for unset, 2 for error
+	Message string `json:"message,omitempty"`
+}
+
+const (
+	otlp_status_error int    = 2
+	otlp_scope_name   string = "shared/tracing"
+)
+
+func convert_spans_to_otlp(service_name string, spans []SpanData) *otlp_request {
+	converted := make([]otlp_span, 0, len(spans))
+	for index := range spans {
+		span := &spans[index]
+		parent_span_id := ""
+		if span.ParentSpanID != [8]byte{} {
+			parent_span_id = hex.EncodeToString(span.ParentSpanID[:])
+		}
+		attributes := make([]otlp_attribute, 0, len(span.Attributes))
+		for _, attribute := range span.Attributes {
+			attributes = append(attributes, otlp_attribute{Key: attribute.Key, Value: otlp_value{StringValue: attribute.Value}})
+		}
+		status := otlp_status{}
+		if len(span.Error) > 0 {
+			status = otlp_status{Code: otlp_status_error, Message: span.Error}
+		}
+		converted = append(converted, otlp_span{
+			TraceID:           hex.EncodeToString(span.TraceID[:]),
+			SpanID:            hex.EncodeToString(span.SpanID[:]),
+			ParentSpanID:      parent_span_id,
+			Name:              span.Name,
+			Kind:              span.Kind,
+			StartTimeUnixNano: strconv.FormatInt(span.StartTime.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.EndTime.UnixNano(), 10),
+			Attributes:        attributes,
+			Status:            status,
+		})
+	}
+	return &otlp_request{
+		ResourceSpans: []otlp_resource_spans{
+			{
+				Resource: otlp_resource{
+					Attributes: []otlp_attribute{
+						{Key: "service.name", Value: otlp_value{StringValue: service_name}},
+					},
+				},
+				ScopeSpans: []otlp_scope_span{
+					{Scope: otlp_scope{Name: otlp_scope_name}, Spans: converted},
+				},
+			},
+		},
+	}
+}
+
+// Sends spans to an OpenTelemetry collector, e.g. http://localhost:4318/v1/traces
+type OTLPExporter struct {
+	service_name string
+	endpoint     string
+	http_client  *http.Client
+}
+
+func CreateOTLPExporter(service_name string, endpoint string, timeout time.Duration) *OTLPExporter {
+	return &OTLPExporter{
+		service_name: service_name,
+		endpoint:     endpoint,
+		http_client:  &http.Client{Timeout: timeout},
+	}
+}
+
+func (exporter *OTLPExporter) Export(spans []SpanData) error {
+	body, err := json.Marshal(convert_spans_to_otlp(exporter.service_name, spans))
+	if err != nil {
+		return err
+	}
+	response, err := exporter.http_client.Post(exporter.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return errors.New("OTLP endpoint responded with " + response.Status)
+	}
+	return nil
+}
+
+// One JSON object per line, for local debugging
+type stdout_span struct {
+	Service      string            `json:"service"`
+	TraceID      string            `json:"trace_id"`
+	SpanID       string            `json:"span_id"`
+	ParentSpanID string            `json:"parent_span_id,omitempty"`
+	Name         string            `json:"name"`
+	Start        string            `json:"start"` // RFC 3339 with nanoseconds
+	DurationMS   float64           `json:"duration_ms"`
+	Attributes   map[string]string `json:"attributes,omitempty"`
+	Error        string            `json:"error,omitempty"`
+}
+
+type StdoutExporter struct {
+	service_name string
+	mutex        sync.Mutex
+	writer       io.Writer
+}
+
+func CreateStdoutExporter(service_name string, writer io.Writer) *StdoutExporter {
+	return &StdoutExporter{service_name: service_name, writer: writer}
+}
+
+func (exporter *StdoutExporter) Export(spans []SpanData) error {
+	buffer := bytes.Buffer{}
+	encoder := json.NewEncoder(&buffer)
+	for index := range spans {
+		span := &spans[index]
+		line := stdout_span{
+			Service:    exporter.service_name,
+			TraceID:    hex.EncodeToString(span.TraceID[:]),
+			SpanID:     hex.EncodeToString(span.SpanID[:]),
+			Name:       span.Name,
+			Start:      span.StartTime.UTC().Format(time.RFC3339Nano),
+			DurationMS: float64(span.EndTime.Sub(span.StartTime).Microseconds()) / 1000,
+			Error:      span.Error,
+		}
+		if span.ParentSpanID != [8]byte{} {
+			line.ParentSpanID = hex.EncodeToString(span.ParentSpanID[:])
+		}
+		if len(span.Attributes) > 0 {
+			line.Attributes = make(map[string]string, len(span.Attributes))
+			for _, attribute := range span.Attributes {
+				line.Attributes[attribute.Key] = attribute.Value
+			}
+		}
+		err := encoder.Encode(&line)
+		if err != nil {
+			return err
+		}
+	}
+	exporter.mutex.Lock()
+	defer exporter.mutex.Unlock()
+	_, err := exporter.writer.Write(buffer.Bytes())
+	return err
+}
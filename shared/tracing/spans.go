@@ -0,0 +1,42 @@
+package tracing
+
+// Spans common to the API gateway and the backend services, named the same everywhere
+// so that they can be compared across services
+
+func set_push_attributes(span *Span, queue_name string) *Span {
+	span.SetAttribute("messaging.system", "redis")
+	span.SetAttribute("messaging.destination.name", queue_name)
+	return span
+}
+
+// Times putting a message into a Redis queue
+func (span *Span) StartPushSpan(queue_name string) *Span {
+	return set_push_attributes(span.StartChild("LPUSH "+queue_name, Kind_producer), queue_name)
+}
+
+// Times putting a response into a Redis queue as part of the trace of the request
+func (tracer *Tracer) StartPushSpan(queue_name string, traceparent string) *Span {
+	return set_push_attributes(tracer.StartSpan("LPUSH "+queue_name, Kind_producer, traceparent), queue_name)
+}
+
+// Times a database transaction as part of the trace of the request. End it with
+// EndDatabaseSpan.
+func (tracer *Tracer) StartDatabaseSpan(traceparent string) *Span {
+	span := tracer.StartSpan("postgres transaction", Kind_client, traceparent)
+	span.SetAttribute("db.system", "postgresql")
+	return span
+}
+
+// Outcome is commit or rollback, the same as the outcome of the database metrics
+func (span *Span) EndDatabaseSpan(outcome string) {
+	span.SetAttribute("db.transaction.outcome", outcome)
+	span.End()
+}
+
+// Marks the span as failed if there was an error
+func (span *Span) EndWithError(err error) {
+	if err != nil {
+		span.SetError(err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,373 @@
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Trace context of W3C Trace Context, sent between the API gateway and the backend
+services in the traceparent header of HTTP requests and in the header of messages.
+
+	traceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+
+The fields are the version, trace ID, ID of the parent span and flags. Only version 00
+is created. Later versions are read as version 00, as the specification requires.
+*/
+type TraceContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+const (
+	traceparent_version string = "00"
+	traceparent_length  int    = 55
+	flag_sampled        byte   = 0x01
+	invalid_version     string = "ff"
+	Header_traceparent  string = "traceparent"
+)
+
+// Returns false if the trace context is missing or invalid
+func ParseTraceParent(traceparent string) (TraceContext, bool) {
+	trace_context := TraceContext{}
+	traceparent = strings.TrimSpace(traceparent)
+	if len(traceparent) < traceparent_length {
+		return trace_context, false
+	}
+	fields := strings.SplitN(traceparent, "-", 5)
+	if len(fields) < 4 {
+		return trace_context, false
+	}
+	version, trace_id, span_id, flags := fields[0], fields[1], fields[2], fields[3]
+	if len(version) != 2 || version == invalid_version || !is_lower_hex(version) {
+		return trace_context, false
+	}
+
+	// Version 00 has nothing after the flags. Later versions may add fields.
+	if version == traceparent_version && len(traceparent) != traceparent_length {
+		return trace_context, false
+	}
+	if len(trace_id) != 32 || len(span_id) != 16 || len(flags) != 2 {
+		return trace_context, false
+	}
+	if !is_lower_hex(trace_id) || !is_lower_hex(span_id) || !is_lower_hex(flags) {
+		return trace_context, false
+	}
+	hex.Decode(trace_context.TraceID[:], []byte(trace_id))
+	hex.Decode(trace_context.SpanID[:], []byte(span_id))
+	var flag_bytes [1]byte
+	hex.Decode(flag_bytes[:], []byte(flags))
+	trace_context.Sampled = flag_bytes[0]&flag_sampled != 0
+
+	// IDs of all zeroes are invalid
+	if trace_context.TraceID == [16]byte{} || trace_context.SpanID == [8]byte{} {
+		return TraceContext{}, false
+	}
+	return trace_context, true
+}
+
+func is_lower_hex(value string) bool {
+	for _, character := range value {
+		if (character < '0' || character > '9') && (character < 'a' || character > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func (trace_context TraceContext) String() string {
+	flags := "00"
+	if trace_context.Sampled {
+		flags = "01"
+	}
+	return traceparent_version + "-" +
+		hex.EncodeToString(trace_context.TraceID[:]) + "-" +
+		hex.EncodeToString(trace_context.SpanID[:]) + "-" +
+		flags
+}
+
+func create_trace_id() [16]byte {
+	var id [16]byte
+	for id == [16]byte{} {
+		rand.Read(id[:])
+	}
+	return id
+}
+
+func create_span_id() [8]byte {
+	var id [8]byte
+	for id == [8]byte{} {
+		rand.Read(id[:])
+	}
+	return id
+}
+
+// Kinds of spans of OpenTelemetry
+const (
+	Kind_internal int = 1
+	Kind_server   int = 2
+	Kind_client   int = 3
+	Kind_producer int = 4
+	Kind_consumer int = 5
+)
+
+type Attribute struct {
+	Key   string
+	Value string
+}
+
+// A span once it has ended, as handed to exporters
+type SpanData struct {
+	TraceID      [16]byte
+	SpanID       [8]byte
+	ParentSpanID [8]byte // All zeroes for the root span of a trace
+	Name         string
+	Kind         int
+	StartTime    time.Time
+	EndTime      time.Time
+	Attributes   []Attribute
+	Error        string // Empty unless the operation failed
+}
+
+/*
+A Span times one operation of a trace. Spans are created by a Tracer or as children
+of other spans and are exported once they end.
+
+	span := tracer.StartSpan("POST /v1/transfer", tracing.Kind_server, request.Header.Get(tracing.Header_traceparent))
+	defer span.End()
+	push := span.StartChild("LPUSH transfer_requests_queue", tracing.Kind_producer)
+	...
+	push.End()
+
+All methods may be called on a nil span, which does nothing. Spans are not safe to
+use from several goroutines at once, except for End.
+*/
+type Span struct {
+	tracer  *Tracer
+	context TraceContext
+	data    SpanData
+	ended   atomic.Bool
+}
+
+// Trace context to send to the next service, so that its spans become children of
+// this span. Empty for nil spans.
+func (span *Span) TraceParent() string {
+	if span == nil {
+		return ""
+	}
+	return span.context.String()
+}
+
+// Names may only be known once the operation is done, e.g. the route of a request
+func (span *Span) SetName(name string) {
+	if span == nil {
+		return
+	}
+	span.data.Name = name
+}
+
+func (span *Span) SetAttribute(key string, value string) {
+	if span == nil {
+		return
+	}
+	span.data.Attributes = append(span.data.Attributes, Attribute{Key: key, Value: value})
+}
+
+// Marks the operation of the span as failed
+func (span *Span) SetError(message string) {
+	if span == nil {
+		return
+	}
+	if len(message) == 0 {
+		message = "error"
+	}
+	span.data.Error = message
+}
+
+func (span *Span) StartChild(name string, kind int) *Span {
+	if span == nil {
+		return nil
+	}
+	return span.tracer.start_span(name, kind, span.context, true)
+}
+
+// Spans are only exported once, however often they are ended
+func (span *Span) End() {
+	if span == nil || span.ended.Swap(true) {
+		return
+	}
+	span.data.EndTime = time.Now()
+	if span.context.Sampled {
+		span.tracer.export(&span.data)
+	}
+}
+
+// Exporters send batches of spans to wherever they are collected
+type Exporter interface {
+	Export(spans []SpanData) error
+}
+
+const (
+	queue_size      int           = 4096
+	batch_size      int           = 512
+	export_interval time.Duration = 5 * time.Second
+)
+
+/*
+A Tracer creates the spans of one service and exports them in batches in the
+background. Spans are dropped if they are created faster than they can be exported,
+so that tracing never slows down requests.
+
+Traces are still propagated if there is no exporter, so that the spans of other
+services stay connected.
+*/
+type Tracer struct {
+	exporter  Exporter
+	queue     chan SpanData
+	flush     chan chan struct{}
+	stop      chan struct{}
+	waitgroup sync.WaitGroup
+	is_alive  atomic.Bool
+	dropped   atomic.Int64
+}
+
+// Exporter may be nil, in which case no span is exported
+func CreateTracer(exporter Exporter) *Tracer {
+	tracer := &Tracer{
+		exporter: exporter,
+		queue:    make(chan SpanData, queue_size),
+		flush:    make(chan chan struct{}),
+		stop:     make(chan struct{}),
+	}
+	if exporter != nil {
+		tracer.is_alive.Store(true)
+		tracer.waitgroup.Add(1)
+		go tracer.async_export()
+	}
+	return tracer
+}
+
+/*
+Starts a span continuing the trace of the given traceparent. A new trace is started if
+the traceparent is missing or invalid. New traces are sampled if spans are exported.
+*/
+func (tracer *Tracer) StartSpan(name string, kind int, traceparent string) *Span {
+	if tracer == nil {
+		return nil
+	}
+	parent, valid := ParseTraceParent(traceparent)
+	return tracer.start_span(name, kind, parent, valid)
+}
+
+func (tracer *Tracer) start_span(name string, kind int, parent TraceContext, has_parent bool) *Span {
+	span := &Span{
+		tracer: tracer,
+		data: SpanData{
+			Name:      name,
+			Kind:      kind,
+			StartTime: time.Now(),
+		},
+	}
+	if has_parent {
+		span.context = TraceContext{TraceID: parent.TraceID, SpanID: create_span_id(), Sampled: parent.Sampled}
+		span.data.ParentSpanID = parent.SpanID
+	} else {
+		span.context = TraceContext{TraceID: create_trace_id(), SpanID: create_span_id(), Sampled: tracer.exporter != nil}
+	}
+	span.data.TraceID = span.context.TraceID
+	span.data.SpanID = span.context.SpanID
+	return span
+}
+
+func (tracer *Tracer) export(span *SpanData) {
+	if !tracer.is_alive.Load() {
+		return
+	}
+	select {
+	case tracer.queue <- *span:
+	default:
+		tracer.dropped.Add(1)
+	}
+}
+
+// Exports the spans ended so far. Used by unit tests.
+func (tracer *Tracer) Flush() {
+	if tracer == nil || !tracer.is_alive.Load() {
+		return
+	}
+	done := make(chan struct{})
+	select {
+	case tracer.flush <- done:
+		<-done
+	case <-tracer.stop:
+	}
+}
+
+func (tracer *Tracer) async_export() {
+	defer tracer.waitgroup.Done()
+
+	batch := make([]SpanData, 0, batch_size)
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+		err := tracer.exporter.Export(batch)
+		if err != nil {
+			log.Println("Unable to export spans: ", err.Error())
+		}
+		dropped := tracer.dropped.Swap(0)
+		if dropped > 0 {
+			log.Println("Dropped spans: ", dropped)
+		}
+		batch = make([]SpanData, 0, batch_size)
+	}
+	drain := func() {
+		for {
+			select {
+			case span := <-tracer.queue:
+				batch = append(batch, span)
+				if len(batch) >= batch_size {
+					send()
+				}
+			default:
+				send()
+				return
+			}
+		}
+	}
+
+	ticker := time.NewTicker(export_interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case span := <-tracer.queue:
+			batch = append(batch, span)
+			if len(batch) >= batch_size {
+				send()
+			}
+		case done := <-tracer.flush:
+			drain()
+			close(done)
+		case <-ticker.C:
+			send()
+		case <-tracer.stop:
+			// Spans ended before the shutdown are still exported
+			drain()
+			return
+		}
+	}
+}
+
+func (tracer *Tracer) Shutdown() {
+	if tracer == nil || !tracer.is_alive.Swap(false) {
+		return
+	}
+	close(tracer.stop)
+	tracer.waitgroup.Wait()
+}
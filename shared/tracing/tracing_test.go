@@ -0,0 +1,202 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_ParseTraceParent(t *testing.T) {
+	valid := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	trace_context, ok := ParseTraceParent(valid)
+	if !ok || !trace_context.Sampled {
+		t.Fatal("Expected: ", true, ", Got: ", ok, " ", trace_context.Sampled)
+	}
+	if trace_context.String() != valid {
+		t.Error("Expected: ", valid, ", Got: ", trace_context.String())
+	}
+
+	tests := map[string]bool{
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00":       true,
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra": true,
+		"": false,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra":    false,
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01":          false,
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01":          false,
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01":          false,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01":          false,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7":             false,
+		"00_4bf92f3577b34da6a3ce929d0e0e4736_00f067aa0ba902b7_01":          false,
+		"00-4bf92f3577b34da6a3ce929d0e0e473-600f067aa0ba902b7-01":          false,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-0g":          false,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-":         false,
+		"000-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01":         false,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01 trailing": false,
+	}
+	for traceparent, expected := range tests {
+		_, ok := ParseTraceParent(traceparent)
+		if ok != expected {
+			t.Error("Expected: ", expected, ", Got: ", ok, " for ", traceparent)
+		}
+	}
+}
+
+// Collects exported spans in memory
+type test_exporter struct {
+	spans []SpanData
+}
+
+func (exporter *test_exporter) Export(spans []SpanData) error {
+	exporter.spans = append(exporter.spans, spans...)
+	return nil
+}
+
+func Test_Tracer(t *testing.T) {
+	exporter := &test_exporter{}
+	tracer := CreateTracer(exporter)
+	defer tracer.Shutdown()
+
+	// Spans continue the trace of the traceparent they were started with
+	parent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	span := tracer.StartSpan("POST /v1/transfer", Kind_server, parent)
+	child := span.StartChild("LPUSH transfer_requests_queue", Kind_producer)
+	child.SetAttribute("messaging.destination.name", "transfer_requests_queue")
+	child.SetError("connection refused")
+	child.End()
+	span.End()
+	span.End()
+
+	// Traces which were not sampled by the caller are not exported
+	unsampled := tracer.StartSpan("GET /v1/wallets/{wallet_id}/balance", Kind_server, "00-4bf92f3577b34da6a3ce929d0e0e4737-00f067aa0ba902b7-00")
+	unsampled.End()
+
+	// New traces are started if there is no valid traceparent
+	root := tracer.StartSpan("POST /v1/batch", Kind_server, "invalid")
+	root.End()
+
+	tracer.Flush()
+	if len(exporter.spans) != 3 {
+		t.Fatal("Expected: ", 3, ", Got: ", len(exporter.spans))
+	}
+	child_data, span_data, root_data := exporter.spans[0], exporter.spans[1], exporter.spans[2]
+	if child_data.TraceID != span_data.TraceID || child_data.ParentSpanID != span_data.SpanID {
+		t.Error("Expected: ", span_data.SpanID, ", Got: ", child_data.ParentSpanID)
+	}
+	parent_context, _ := ParseTraceParent(parent)
+	if span_data.TraceID != parent_context.TraceID || span_data.ParentSpanID != parent_context.SpanID {
+		t.Error("Expected: ", parent_context.SpanID, ", Got: ", span_data.ParentSpanID)
+	}
+	if child_data.Error != "connection refused" || len(child_data.Attributes) != 1 {
+		t.Error("Expected: ", "connection refused", ", Got: ", child_data.Error, " ", child_data.Attributes)
+	}
+	if root_data.TraceID == parent_context.TraceID || root_data.ParentSpanID != [8]byte{} {
+		t.Error("Expected new trace, Got: ", root_data.TraceID, " ", root_data.ParentSpanID)
+	}
+
+	// The trace context sent on is that of the span
+	context, ok := ParseTraceParent(child.TraceParent())
+	if !ok || context.SpanID != child_data.SpanID || !context.Sampled {
+		t.Error("Expected: ", child_data.SpanID, ", Got: ", child.TraceParent())
+	}
+
+	// Traces are propagated without an exporter, but not sampled
+	untraced := CreateTracer(nil)
+	defer untraced.Shutdown()
+	propagated := untraced.StartSpan("POST /v1/transfer", Kind_server, parent)
+	context, ok = ParseTraceParent(propagated.TraceParent())
+	if !ok || context.TraceID != parent_context.TraceID {
+		t.Error("Expected: ", parent_context.TraceID, ", Got: ", propagated.TraceParent())
+	}
+	propagated.End()
+	new_trace := untraced.StartSpan("POST /v1/transfer", Kind_server, "")
+	if strings.HasSuffix(new_trace.TraceParent(), "-01") {
+		t.Error("Expected: ", "-00", ", Got: ", new_trace.TraceParent())
+	}
+
+	// Nil spans do nothing
+	var nil_span *Span
+	nil_span.SetAttribute("key", "value")
+	nil_span.StartChild("child", Kind_internal).End()
+	if len(nil_span.TraceParent()) != 0 {
+		t.Error("Expected: ", "", ", Got: ", nil_span.TraceParent())
+	}
+}
+
+func Test_Exporters(t *testing.T) {
+	started_at := time.Date(2026, 10, 18, 9, 30, 0, 0, time.UTC)
+	spans := []SpanData{
+		{
+			TraceID:      [16]byte{0x4b, 0xf9},
+			SpanID:       [8]byte{0x01},
+			ParentSpanID: [8]byte{0x02},
+			Name:         "postgres transaction",
+			Kind:         Kind_client,
+			StartTime:    started_at,
+			EndTime:      started_at.Add(1500 * time.Microsecond),
+			Attributes:   []Attribute{{Key: "db.system", Value: "postgresql"}},
+			Error:        "rollback",
+		},
+	}
+
+	// OTLP over HTTP with JSON encoding
+	{
+		var received []byte
+		server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			received, _ = io.ReadAll(request.Body)
+			if request.Header.Get("Content-Type") != "application/json" {
+				writer.WriteHeader(http.StatusUnsupportedMediaType)
+			}
+		}))
+		defer server.Close()
+
+		exporter, err := CreateExporter(Exporter_otlp, "transfer_service", server.URL+"/v1/traces", time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = exporter.Export(spans)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := `{"resourceSpans":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"transfer_service"}}]},` +
+			`"scopeSpans":[{"scope":{"name":"shared/tracing"},"spans":[{"traceId":"4bf90000000000000000000000000000","spanId":"0100000000000000",` +
+			`"parentSpanId":"0200000000000000","name":"postgres transaction","kind":3,"startTimeUnixNano":"1792315800000000000",` +
+			`"endTimeUnixNano":"1792315800001500000","attributes":[{"key":"db.system","value":{"stringValue":"postgresql"}}],` +
+			`"status":{"code":2,"message":"rollback"}}]}]}]}`
+		if string(received) != expected {
+			t.Error("Expected: ", expected, ", Got: ", string(received))
+		}
+	}
+
+	// Standard output, one span per line
+	{
+		buffer := bytes.Buffer{}
+		exporter := CreateStdoutExporter("transfer_service", &buffer)
+		err := exporter.Export(spans)
+		if err != nil {
+			t.Fatal(err)
+		}
+		line := map[string]any{}
+		err = json.Unmarshal(buffer.Bytes(), &line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line["name"] != "postgres transaction" || line["duration_ms"] != 1.5 || line["parent_span_id"] != "0200000000000000" {
+			t.Error("Expected: ", "postgres transaction 1.5", ", Got: ", buffer.String())
+		}
+	}
+
+	// Unknown exporters are rejected
+	_, err := CreateExporter("zipkin", "transfer_service", "", time.Second)
+	if err == nil {
+		t.Error("Expected: ", "error", ", Got: ", err)
+	}
+	exporter, err := CreateExporter(Exporter_none, "transfer_service", "", time.Second)
+	if err != nil || exporter != nil {
+		t.Error("Expected: ", nil, ", Got: ", exporter, " ", err)
+	}
+}
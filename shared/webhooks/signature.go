@@ -0,0 +1,64 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers sent with every webhook
+const (
+	Header_event_id    string = "Webhook-ID"        // Same for every delivery of an event
+	Header_delivery_id string = "Webhook-Delivery"  // Different for every redelivery
+	Header_event_type  string = "Webhook-Event"     // e.g. deposit.completed
+	Header_timestamp   string = "Webhook-Timestamp" // Unix time in s
+	Header_signature   string = "Webhook-Signature" // v1=<hex>
+)
+
+const signature_version string = "v1="
+
+// Receivers should reject webhooks signed longer ago than this to stop replays
+const Default_tolerance time.Duration = 5 * time.Minute
+
+var ErrInvalidSignature = errors.New("Webhook signature does not match")
+var ErrInvalidTimestamp = errors.New("Webhook timestamp is invalid or too old")
+
+/*
+Signs the body of a webhook with the secret of its subscription. The signature is the
+HMAC SHA256 of the timestamp and the body joined by a full stop, so that a captured
+webhook cannot be replayed later with a new timestamp.
+
+	Webhook-Signature: v1=hex(hmac_sha256(secret, timestamp + "." + body))
+*/
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return signature_version + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Checks a webhook received with the given Webhook-Timestamp and Webhook-Signature
+// headers. Used by receivers and unit tests.
+func Verify(secret string, timestamp string, body []byte, signature string, tolerance time.Duration, now time.Time) error {
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalidTimestamp
+	}
+	signed_at := time.Unix(seconds, 0)
+	if now.Sub(signed_at) > tolerance || signed_at.Sub(now) > tolerance {
+		return ErrInvalidTimestamp
+	}
+	if !strings.HasPrefix(signature, signature_version) {
+		return ErrInvalidSignature
+	}
+	expected := Sign(secret, seconds, body)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package webhooks
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func Test_Signature(t *testing.T) {
+
+	secret := "whsec_unit_test"
+	body := []byte(`{"id":"1","type":"deposit.completed"}`)
+	now := time.Unix(1760000000, 0)
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	signature := Sign(secret, now.Unix(), body)
+
+	// Known signature, so that receivers in other languages can check their code
+	expected := "v1=f1f167c535e1a2828c3c5190554da617790ed901db7784b2d63d496975a7a47a"
+	if signature != expected {
+		t.Error("Expected: ", expected, ", Got: ", signature)
+	}
+
+	err := Verify(secret, timestamp, body, signature, Default_tolerance, now)
+	if err != nil {
+		t.Error("Expected: ", nil, ", Got: ", err)
+	}
+
+	// Changed body
+	err = Verify(secret, timestamp, []byte(`{"id":"2","type":"deposit.completed"}`), signature, Default_tolerance, now)
+	if err != ErrInvalidSignature {
+		t.Error("Expected: ", ErrInvalidSignature, ", Got: ", err)
+	}
+
+	// Wrong secret
+	err = Verify("whsec_other", timestamp, body, signature, Default_tolerance, now)
+	if err != ErrInvalidSignature {
+		t.Error("Expected: ", ErrInvalidSignature, ", Got: ", err)
+	}
+
+	// Changed timestamp
+	err = Verify(secret, strconv.FormatInt(now.Unix()+1, 10), body, signature, Default_tolerance, now)
+	if err != ErrInvalidSignature {
+		t.Error("Expected: ", ErrInvalidSignature, ", Got: ", err)
+	}
+
+	// Replayed later
+	err = Verify(secret, timestamp, body, signature, Default_tolerance, now.Add(Default_tolerance+time.Second))
+	if err != ErrInvalidTimestamp {
+		t.Error("Expected: ", ErrInvalidTimestamp, ", Got: ", err)
+	}
+
+	// Malformed headers
+	err = Verify(secret, "yesterday", body, signature, Default_tolerance, now)
+	if err != ErrInvalidTimestamp {
+		t.Error("Expected: ", ErrInvalidTimestamp, ", Got: ", err)
+	}
+	err = Verify(secret, timestamp, body, signature[len("v1="):], Default_tolerance, now)
+	if err != ErrInvalidSignature {
+		t.Error("Expected: ", ErrInvalidSignature, ", Got: ", err)
+	}
+}
@@ -0,0 +1,477 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+The parts of the WebSocket protocol (RFC 6455) needed to push events to clients and
+to receive them. Messages are read and written whole. Extensions such as compression
+are not supported.
+
+	Server: conn, err := websocket.Upgrade(writer, request)
+	Client: conn, err := websocket.Dial("wss://localhost:1120/wallets/abc/events", header, tls_config, timeout)
+*/
+
+const (
+	Opcode_continuation byte = 0x0
+	Opcode_text         byte = 0x1
+	Opcode_binary       byte = 0x2
+	Opcode_close        byte = 0x8
+	Opcode_ping         byte = 0x9
+	Opcode_pong         byte = 0xA
+)
+
+// Status codes sent in close frames
+const (
+	Close_normal           uint16 = 1000
+	Close_going_away       uint16 = 1001
+	Close_protocol_error   uint16 = 1002
+	Close_no_status        uint16 = 1005 // Never sent. Reported if the close frame had no status.
+	Close_policy_violation uint16 = 1008
+	Close_message_too_big  uint16 = 1009
+)
+
+// Messages larger than this are rejected with Close_message_too_big
+const Maximum_message_size int = 1024 * 1024
+
+// Appended to the key of the client to prove that the server speaks WebSocket
+const accept_guid string = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var ErrNotWebSocket = errors.New("Request is not a WebSocket handshake")
+var ErrHandshakeFailed = errors.New("WebSocket handshake failed")
+var ErrProtocol = errors.New("WebSocket protocol error")
+var ErrMessageTooBig = errors.New("WebSocket message too big")
+
+// Returned by Conn.ReadMessage once the other side has closed the connection
+type CloseError struct {
+	Code   uint16
+	Reason string
+}
+
+func (err *CloseError) Error() string {
+	return "WebSocket closed with status " + strconv.Itoa(int(err.Code)) + " " + err.Reason
+}
+
+// A WebSocket connection. Messages may be written by several goroutines at the same
+// time, but only one goroutine may read.
+type Conn struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	is_client bool // Clients mask the frames they send
+
+	write_mutex sync.Mutex
+	is_closing  bool // Set once a close frame was sent
+}
+
+func get_accept_key(key string) string {
+	hash := sha1.Sum([]byte(key + accept_guid))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// Returns true if the comma separated header contains the token, ignoring case
+func header_contains(header http.Header, name string, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, element := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(element), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns true if the request asks to switch to the WebSocket protocol
+func IsUpgradeRequest(request *http.Request) bool {
+	return request.Method == http.MethodGet &&
+		header_contains(request.Header, "Connection", "upgrade") &&
+		header_contains(request.Header, "Upgrade", "websocket")
+}
+
+/*
+Completes the handshake of a WebSocket client and takes over the connection from the
+HTTP server. Returns ErrNotWebSocket without responding if the request is not a valid
+handshake, so that the caller can respond with an error of its own. Deadlines set by
+the HTTP server are cleared, so callers must set their own.
+*/
+func Upgrade(writer http.ResponseWriter, request *http.Request) (*Conn, error) {
+	if !IsUpgradeRequest(request) {
+		return nil, ErrNotWebSocket
+	}
+	if request.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, ErrNotWebSocket
+	}
+	key := request.Header.Get("Sec-WebSocket-Key")
+	decoded_key, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(decoded_key) != 16 {
+		return nil, ErrNotWebSocket
+	}
+
+	conn, read_writer, err := http.NewResponseController(writer).Hijack()
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + get_accept_key(key) + "\r\n\r\n"
+	_, err = read_writer.WriteString(response)
+	if err == nil {
+		err = read_writer.Flush()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &Conn{
+		conn:   conn,
+		reader: read_writer.Reader,
+	}, nil
+}
+
+/*
+Connects to a WebSocket server. URLs start with ws:// or wss://. The header is sent
+with the handshake, e.g. to authenticate. The TLS configuration is only used for
+wss:// and may be nil. Returns an error with the HTTP status if the server did not
+accept the handshake.
+*/
+func Dial(raw_url string, header http.Header, tls_config *tls.Config, timeout time.Duration) (*Conn, error) {
+	parsed_url, err := url.Parse(raw_url)
+	if err != nil {
+		return nil, err
+	}
+	port := parsed_url.Port()
+	switch parsed_url.Scheme {
+	case "ws":
+		parsed_url.Scheme = "http"
+		if len(port) == 0 {
+			port = "80"
+		}
+	case "wss":
+		parsed_url.Scheme = "https"
+		if len(port) == 0 {
+			port = "443"
+		}
+	default:
+		return nil, errors.New("WebSocket URL must start with ws:// or wss://")
+	}
+
+	dialer := net.Dialer{Timeout: timeout}
+	var conn net.Conn = nil
+	address := net.JoinHostPort(parsed_url.Hostname(), port)
+	if parsed_url.Scheme == "https" {
+		if tls_config == nil {
+			tls_config = &tls.Config{}
+		} else {
+			tls_config = tls_config.Clone()
+		}
+		if len(tls_config.ServerName) == 0 {
+			tls_config.ServerName = parsed_url.Hostname()
+		}
+		// HTTP/2 cannot switch to WebSocket
+		tls_config.NextProtos = []string{"http/1.1"}
+		conn, err = tls.DialWithDialer(&dialer, "tcp", address, tls_config)
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	key_bytes := make([]byte, 16)
+	_, err = rand.Read(key_bytes)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(key_bytes)
+
+	request, err := http.NewRequest(http.MethodGet, parsed_url.String(), nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Upgrade", "websocket")
+	request.Header.Set("Sec-WebSocket-Version", "13")
+	request.Header.Set("Sec-WebSocket-Key", key)
+	err = request.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		response.Body.Close()
+		conn.Close()
+		return nil, errors.New(ErrHandshakeFailed.Error() + ". Unexpected HTTP status " + response.Status)
+	}
+	if response.Header.Get("Sec-WebSocket-Accept") != get_accept_key(key) {
+		conn.Close()
+		return nil, ErrHandshakeFailed
+	}
+	conn.SetDeadline(time.Time{})
+
+	return &Conn{
+		conn:      conn,
+		reader:    reader,
+		is_client: true,
+	}, nil
+}
+
+// Writes a whole message in a single frame. Fails if nothing could be written before
+// the deadline.
+func (conn *Conn) WriteMessage(opcode byte, payload []byte, deadline time.Time) error {
+	conn.write_mutex.Lock()
+	defer conn.write_mutex.Unlock()
+	return conn.write_frame(opcode, payload, deadline)
+}
+
+func (conn *Conn) write_frame(opcode byte, payload []byte, deadline time.Time) error {
+	if conn.is_closing {
+		return net.ErrClosed
+	}
+	if opcode == Opcode_close {
+		conn.is_closing = true
+	}
+
+	// FIN bit is always set. Messages are never fragmented when written.
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode)
+
+	var mask_bit byte = 0
+	if conn.is_client {
+		mask_bit = 0x80
+	}
+	length := len(payload)
+	switch {
+	case length <= 125:
+		frame = append(frame, mask_bit|byte(length))
+	case length <= 0xFFFF:
+		frame = append(frame, mask_bit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(length))
+	default:
+		frame = append(frame, mask_bit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(length))
+	}
+
+	if conn.is_client {
+		mask := make([]byte, 4)
+		_, err := rand.Read(mask)
+		if err != nil {
+			return err
+		}
+		frame = append(frame, mask...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		for i := range payload {
+			frame[start+i] ^= mask[i%4]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	conn.conn.SetWriteDeadline(deadline)
+	_, err := conn.conn.Write(frame)
+	return err
+}
+
+func (conn *Conn) WriteText(payload []byte, deadline time.Time) error {
+	return conn.WriteMessage(Opcode_text, payload, deadline)
+}
+
+func (conn *Conn) WritePing(payload []byte, deadline time.Time) error {
+	return conn.WriteMessage(Opcode_ping, payload, deadline)
+}
+
+// Tells the other side why the connection is being closed. The connection must still
+// be closed with Close.
+func (conn *Conn) WriteClose(code uint16, reason string, deadline time.Time) error {
+	payload := binary.BigEndian.AppendUint16(nil, code)
+	payload = append(payload, reason...)
+	if len(payload) > 125 {
+		payload = payload[:125]
+	}
+	return conn.WriteMessage(Opcode_close, payload, deadline)
+}
+
+func (conn *Conn) Close() error {
+	return conn.conn.Close()
+}
+
+type frame_header struct {
+	is_final bool
+	opcode   byte
+	length   uint64
+	mask     []byte
+}
+
+func (conn *Conn) read_frame_header() (*frame_header, error) {
+	bytes := make([]byte, 2)
+	_, err := io.ReadFull(conn.reader, bytes)
+	if err != nil {
+		return nil, err
+	}
+	header := &frame_header{
+		is_final: bytes[0]&0x80 != 0,
+		opcode:   bytes[0] & 0x0F,
+		length:   uint64(bytes[1] & 0x7F),
+	}
+
+	// No extensions were agreed, so the reserved bits must not be set
+	if bytes[0]&0x70 != 0 {
+		return nil, ErrProtocol
+	}
+
+	switch header.length {
+	case 126:
+		extended := make([]byte, 2)
+		_, err = io.ReadFull(conn.reader, extended)
+		if err != nil {
+			return nil, err
+		}
+		header.length = uint64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		_, err = io.ReadFull(conn.reader, extended)
+		if err != nil {
+			return nil, err
+		}
+		header.length = binary.BigEndian.Uint64(extended)
+	}
+
+	// Frames from clients must be masked and frames from servers must not
+	is_masked := bytes[1]&0x80 != 0
+	if is_masked == conn.is_client {
+		return nil, ErrProtocol
+	}
+	if is_masked {
+		header.mask = make([]byte, 4)
+		_, err = io.ReadFull(conn.reader, header.mask)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Control frames cannot be fragmented and carry at most 125 bytes
+	if header.opcode >= Opcode_close && (!header.is_final || header.length > 125) {
+		return nil, ErrProtocol
+	}
+	return header, nil
+}
+
+func (conn *Conn) read_payload(header *frame_header) ([]byte, error) {
+	payload := make([]byte, header.length)
+	_, err := io.ReadFull(conn.reader, payload)
+	if err != nil {
+		return nil, err
+	}
+	for i := range payload {
+		payload[i] ^= header.mask[i%4]
+	}
+	return payload, nil
+}
+
+/*
+Reads the next message. Fragmented messages are joined. Pings are answered and close
+frames are answered and reported as a *CloseError. Control messages are returned too,
+so that callers know the other side is still there. Fails if no frame arrives before
+the deadline.
+*/
+func (conn *Conn) ReadMessage(deadline time.Time) (byte, []byte, error) {
+	conn.conn.SetReadDeadline(deadline)
+
+	var message_opcode byte = 0
+	message := []byte{}
+	for {
+		header, err := conn.read_frame_header()
+		if err != nil {
+			conn.fail(err)
+			return 0, nil, err
+		}
+		if header.length > uint64(Maximum_message_size) || len(message)+int(header.length) > Maximum_message_size {
+			conn.fail(ErrMessageTooBig)
+			return 0, nil, ErrMessageTooBig
+		}
+		if header.mask == nil {
+			header.mask = make([]byte, 4)
+		}
+		payload, err := conn.read_payload(header)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch header.opcode {
+		case Opcode_ping:
+			conn.WriteMessage(Opcode_pong, payload, time.Now().Add(time.Second))
+			return header.opcode, payload, nil
+		case Opcode_pong:
+			return header.opcode, payload, nil
+		case Opcode_close:
+			close_error := &CloseError{Code: Close_no_status}
+			if len(payload) >= 2 {
+				close_error.Code = binary.BigEndian.Uint16(payload)
+				close_error.Reason = string(payload[2:])
+			}
+			conn.WriteClose(close_error.Code, "", time.Now().Add(time.Second))
+			return header.opcode, payload, close_error
+		case Opcode_text, Opcode_binary:
+			if message_opcode != 0 {
+				conn.fail(ErrProtocol)
+				return 0, nil, ErrProtocol
+			}
+			message_opcode = header.opcode
+		case Opcode_continuation:
+			if message_opcode == 0 {
+				conn.fail(ErrProtocol)
+				return 0, nil, ErrProtocol
+			}
+		default:
+			conn.fail(ErrProtocol)
+			return 0, nil, ErrProtocol
+		}
+
+		message = append(message, payload...)
+		if header.is_final {
+			return message_opcode, message, nil
+		}
+	}
+}
+
+// Tells the other side why the connection is given up after a bad frame
+func (conn *Conn) fail(err error) {
+	deadline := time.Now().Add(time.Second)
+	switch err {
+	case ErrProtocol:
+		conn.WriteClose(Close_protocol_error, "", deadline)
+	case ErrMessageTooBig:
+		conn.WriteClose(Close_message_too_big, "", deadline)
+	}
+}
@@ -0,0 +1,172 @@
+package websocket
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_AcceptKey(t *testing.T) {
+
+	// Example from RFC 6455
+	result := get_accept_key("dGhlIHNhbXBsZSBub25jZQ==")
+	expected := "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="
+	if result != expected {
+		t.Error("Expected: ", expected, ", Got: ", result)
+	}
+}
+
+func Test_WebSocket(t *testing.T) {
+
+	// Echoes text messages until the client closes the connection
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		conn, err := Upgrade(writer, request)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		defer conn.Close()
+		for {
+			opcode, message, err := conn.ReadMessage(time.Now().Add(5 * time.Second))
+			if err != nil {
+				return
+			}
+			if opcode == Opcode_text {
+				conn.WriteText(message, time.Now().Add(5*time.Second))
+			}
+		}
+	}))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	// Plain HTTP requests are not upgraded
+	response, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusBadRequest {
+		t.Error("Expected: ", http.StatusBadRequest, ", Got: ", response.StatusCode)
+	}
+
+	conn, err := Dial(url, nil, nil, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+
+	// Short, medium and long messages use different length encodings
+	for _, length := range []int{0, 5, 125, 126, 70000} {
+		message := strings.Repeat("a", length)
+		err = conn.WriteText([]byte(message), deadline)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opcode, result, err := conn.ReadMessage(deadline)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opcode != Opcode_text {
+			t.Error("Expected: ", Opcode_text, ", Got: ", opcode)
+		}
+		if string(result) != message {
+			t.Error("Expected message of length ", length, ", Got: ", len(result))
+		}
+	}
+
+	// Pings are answered with pongs carrying the same payload
+	err = conn.WritePing([]byte("ping"), deadline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opcode, result, err := conn.ReadMessage(deadline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opcode != Opcode_pong || string(result) != "ping" {
+		t.Error("Expected: pong with payload ping, Got: ", opcode, " ", string(result))
+	}
+
+	// The server answers the close frame and the client reports it
+	err = conn.WriteClose(Close_normal, "bye", deadline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = conn.ReadMessage(deadline)
+	close_error := &CloseError{}
+	if !errors.As(err, &close_error) {
+		t.Fatal("Expected: close error, Got: ", err)
+	}
+	if close_error.Code != Close_normal {
+		t.Error("Expected: ", Close_normal, ", Got: ", close_error.Code)
+	}
+
+	// Nothing can be written after the close frame
+	err = conn.WriteText([]byte("late"), deadline)
+	if err == nil {
+		t.Error("Expected an error after the connection was closed.")
+	}
+}
+
+func Test_ServerClose(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		conn, err := Upgrade(writer, request)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		deadline := time.Now().Add(5 * time.Second)
+		conn.WriteText([]byte("hello"), deadline)
+		conn.WriteClose(Close_going_away, "shutting down", deadline)
+		conn.ReadMessage(deadline)
+	}))
+	defer server.Close()
+
+	conn, err := Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil, nil, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+
+	_, result, err := conn.ReadMessage(deadline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != "hello" {
+		t.Error("Expected: ", "hello", ", Got: ", string(result))
+	}
+
+	_, _, err = conn.ReadMessage(deadline)
+	close_error := &CloseError{}
+	if !errors.As(err, &close_error) {
+		t.Fatal("Expected: close error, Got: ", err)
+	}
+	expected := CloseError{Code: Close_going_away, Reason: "shutting down"}
+	if *close_error != expected {
+		t.Error("Expected: ", expected, ", Got: ", *close_error)
+	}
+}
+
+func Test_DialRejected(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	_, err := Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil, nil, 5*time.Second)
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Error("Expected: handshake error with status 403, Got: ", err)
+	}
+
+	_, err = Dial(server.URL, nil, nil, 5*time.Second)
+	if err == nil {
+		t.Error("Expected URLs starting with http:// to be rejected.")
+	}
+}
@@ -39,6 +39,7 @@ func Test_TransactionHistoryService(t *testing.T) {
 	config.ResponsesQueue.QueueName = "transaction_history_responses_queue_test"
 	config.WalletDatabase.BalanceTable = "postgres.test_transaction_history_service.balances"
 	config.WalletDatabase.TransactionsTable = "postgres.test_transaction_history_service.transactions"
+	config.WalletDatabase.IdempotencyKeysTable = "postgres.test_transaction_history_service.idempotency_keys"
 
 	// Start running balance service
 	service := CreateTransactionHistoryService(config)
@@ -87,6 +88,10 @@ func Test_TransactionHistoryService(t *testing.T) {
 		if err != nil {
 			log.Fatal(err)
 		}
+		_, err = db.Exec("delete from " + config.WalletDatabase.IdempotencyKeysTable)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}()
 
 	// Create a new wallet with some transactions
@@ -183,4 +188,69 @@ func Test_TransactionHistoryService(t *testing.T) {
 		}
 	}
 
+	// Look up a deposit that was applied with an idempotency key
+	{
+		idempotency_key := "transaction_history_service_unit_test_key"
+		stored_response := `{"header":{"id":1,"action":1},"status":1,"currency":"SGD","new_balance":"1.00"}`
+		stored_date_time := time.Now().UTC().Truncate(time.Second)
+		_, err := db.Exec("insert into "+config.WalletDatabase.IdempotencyKeysTable+" (idempotency_key, action, request, response, date_and_time) values ($1, $2, $3, $4, $5)", idempotency_key, messages.Action_deposit, "{}", stored_response, stored_date_time)
+		if err != nil {
+			t.Fatal("Error updating database.", err)
+		}
+
+		// Put message into requests queue
+		request_message := messages.GET_IdempotencyKey{
+			Header: messages.Header{
+				MessageID: message_id,
+				Action:    messages.Action_get_idempotency_key,
+			},
+			IdempotencyKey: idempotency_key,
+		}
+		bytes_to_send, err := json.Marshal(request_message)
+		if err != nil {
+			t.Fatal("Could not serialise message.", err)
+		}
+		timeout := time.Duration(config.RequestsQueue.Timeout) * time.Second
+		queue_name := config.RequestsQueue.QueueName
+		timeout_context, cancel = context.WithTimeout(background_context, timeout)
+		_, err = requests_queue.LPush(timeout_context, queue_name, bytes_to_send).Result()
+		if err != nil {
+			cancel()
+			t.Fatal(err)
+		}
+		cancel()
+
+		// Wait for response from response queue
+		timeout = time.Duration(config.ResponsesQueue.Timeout) * time.Second
+		queue_name = config.ResponsesQueue.QueueName
+		timeout_context, cancel = context.WithTimeout(background_context, timeout)
+		string_slice, err := responses_queue.BRPop(timeout_context, timeout, queue_name).Result()
+		if err != nil {
+			cancel()
+			t.Fatal(err)
+		}
+		cancel()
+
+		// Deserialise JSON data received
+		response_message := responses.IdempotencyKey{}
+		err = json.Unmarshal([]byte(string_slice[1]), &response_message)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Verify response
+		expected_response := responses.IdempotencyKey{
+			Header: responses.Header{
+				MessageID: request_message.Header.MessageID,
+				Action:    request_message.Header.Action,
+			},
+			Status:        responses.Status_successful,
+			RequestAction: messages.Action_deposit,
+			DateAndTime:   stored_date_time.Format(time.RFC3339),
+			Response:      json.RawMessage(stored_response),
+		}
+		if !reflect.DeepEqual(response_message, expected_response) {
+			t.Fatal("Expected: ", expected_response, ", Got: ", response_message)
+		}
+	}
 }
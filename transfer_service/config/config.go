@@ -12,6 +12,12 @@ type Config struct {
 	RequestsQueue  shared_config.RedisMessageQueue  `yaml:"redis_requests_queue"`
 	ResponsesQueue shared_config.RedisMessageQueue  `yaml:"redis_responses_queue"`
 	WalletDatabase shared_config.PostgreSQLDatabase `yaml:"postgresql_wallet_database"`
+	MetricsServer  shared_config.MetricsServer      `yaml:"metrics_server"`
+	Tracing        shared_config.Tracing            `yaml:"tracing"`
+	Logging        shared_config.Logging            `yaml:"logging"`
+
+	// Committed transfers are published here for the live feed of the API gateway
+	EventsStream shared_config.RedisEventsStream `yaml:"redis_events_stream"`
 }
 
 func Load(filepath string) (*Config, error) {
@@ -30,3 +36,22 @@ func Load(filepath string) (*Config, error) {
 
 	return &config, nil
 }
+
+/*
+Returns an error listing the settings that cannot be changed without a restart, i.e.
+the Redis servers, the wallet database and the metrics server. Queue and stream
+names, lengths and timeouts are applied as soon as the configuration file is reloaded.
+*/
+func CheckReload(current *Config, next *Config) error {
+	restart_required := shared_config.RestartRequired{}
+	restart_required.Compare("redis_requests_queue", current.RequestsQueue.GetServer(), next.RequestsQueue.GetServer())
+	restart_required.Compare("redis_responses_queue", current.ResponsesQueue.GetServer(), next.ResponsesQueue.GetServer())
+	restart_required.Compare("redis_events_stream", current.EventsStream.GetServer(), next.EventsStream.GetServer())
+	restart_required.Compare("postgresql_wallet_database", current.WalletDatabase, next.WalletDatabase)
+	restart_required.Compare("metrics_server", current.MetricsServer, next.MetricsServer)
+	restart_required.Compare("tracing", current.Tracing, next.Tracing)
+
+	// The level of the logs is applied at once
+	restart_required.Compare("logging.file", current.Logging.File, next.Logging.File)
+	return restart_required.Err()
+}
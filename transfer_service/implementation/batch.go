@@ -0,0 +1,462 @@
+package implementation
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"shared/events"
+	"shared/logging"
+	"shared/messages"
+	"shared/metrics"
+	"shared/queues"
+	"shared/responses"
+	"shared/utilities"
+	"time"
+)
+
+// Prepared SQL statements used to apply batches
+type batch_statements struct {
+	get_currency_balance   *sql.Stmt
+	insert_transaction     *sql.Stmt
+	update_balance         *sql.Stmt
+	insert_new_balance     *sql.Stmt
+	get_idempotency_key    *sql.Stmt
+	insert_idempotency_key *sql.Stmt
+	insert_event           *sql.Stmt
+}
+
+// Committed events are only published once the whole batch was committed
+type batch_event struct {
+	event_type string
+	wallet_id  string
+	data       events.Data
+}
+
+// Response to a single item. Items failing for a reason other than the database are
+// reported in their response.
+type batch_item_outcome struct {
+	failed        bool
+	error_code    string
+	error_message string
+	currency      string
+	new_balance   int64
+	events        []batch_event
+}
+
+func item_failed(error_code string, error_message string) *batch_item_outcome {
+	return &batch_item_outcome{failed: true, error_code: error_code, error_message: error_message}
+}
+
+// Turns the outcome of an item into the response it would have had on its own
+func create_batch_item_response(message_id int64, item *messages.BatchItem, outcome *batch_item_outcome) responses.BatchItem {
+	header := responses.Header{MessageID: message_id, Action: item.Action}
+	status := responses.Status_successful
+	currency := outcome.currency
+	new_balance := ""
+	if outcome.failed {
+		status = responses.Status_failed
+		currency = ""
+	} else {
+		new_balance = utilities.Convert_database_to_display_format(outcome.new_balance)
+	}
+
+	var response any
+	switch item.Action {
+	case messages.Action_deposit:
+		response = &responses.Deposit{Header: header, Status: status, ErrorCode: outcome.error_code, ErrorMessage: outcome.error_message, Currency: currency, NewBalance: new_balance}
+	case messages.Action_withdraw:
+		response = &responses.Withdraw{Header: header, Status: status, ErrorCode: outcome.error_code, ErrorMessage: outcome.error_message, Currency: currency, NewBalance: new_balance}
+	default:
+		response = &responses.Transfer{Header: header, Status: status, ErrorCode: outcome.error_code, ErrorMessage: outcome.error_message, Currency: currency, NewBalance: new_balance}
+	}
+	bytes, err := json.Marshal(response)
+	if err != nil {
+		bytes = []byte("{}")
+	}
+	return responses.BatchItem{ItemID: item.ItemID, Action: item.Action, Response: bytes}
+}
+
+// Applies a deposit, withdrawal or transfer inside the database transaction of the
+// batch. Later items see the balances left by earlier items.
+func apply_batch_item(db_transaction *sql.Tx, statements *batch_statements, item *messages.BatchItem, date_and_time time.Time) (*batch_item_outcome, error) {
+
+	// Verify that inputs are correct
+	amount, err := utilities.Convert_display_to_database_format(item.Amount)
+	if err != nil {
+		return item_failed(responses.Error_code_invalid_amount, "Amount specified was invalid"), nil
+	}
+	if len(item.Currency) != 3 {
+		return item_failed(responses.Error_code_invalid_currency, "Invalid currency"), nil
+	}
+
+	tx_get_currency_balance := db_transaction.Stmt(statements.get_currency_balance)
+	tx_insert_transaction := db_transaction.Stmt(statements.insert_transaction)
+	tx_update_balance := db_transaction.Stmt(statements.update_balance)
+	tx_insert_event := db_transaction.Stmt(statements.insert_event)
+
+	switch item.Action {
+	case messages.Action_deposit:
+
+		// Wallets are created by their first deposit
+		var currency string = ""
+		var balance int64 = 0
+		err = tx_get_currency_balance.QueryRow(item.WalletID).Scan(&currency, &balance)
+		exists := err == nil
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		if exists && currency != item.Currency {
+			return item_failed(responses.Error_code_currency_mismatch, "Currency of deposit does not match currency of wallet"), nil
+		}
+		_, err = tx_insert_transaction.Exec(item.WalletID, date_and_time, item.Currency, amount)
+		if err != nil {
+			return nil, err
+		}
+		balance += amount
+		if exists {
+			_, err = tx_update_balance.Exec(balance, item.WalletID)
+		} else {
+			_, err = db_transaction.Stmt(statements.insert_new_balance).Exec(item.WalletID, item.Currency, balance)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		event := batch_event{
+			event_type: events.Event_type_deposit_completed,
+			wallet_id:  item.WalletID,
+			data: events.Data{
+				Currency:   item.Currency,
+				Amount:     utilities.Convert_database_to_display_format(amount),
+				NewBalance: utilities.Convert_database_to_display_format(balance),
+			},
+		}
+		err = insert_event(tx_insert_event, event.event_type, event.wallet_id, &event.data, date_and_time)
+		if err != nil {
+			return nil, err
+		}
+		return &batch_item_outcome{currency: item.Currency, new_balance: balance, events: []batch_event{event}}, nil
+
+	case messages.Action_withdraw:
+		var currency string = ""
+		var balance int64 = 0
+		err = tx_get_currency_balance.QueryRow(item.WalletID).Scan(&currency, &balance)
+		if errors.Is(err, sql.ErrNoRows) {
+			return item_failed(responses.Error_code_wallet_not_found, "Cannot withdraw from non-existent wallet"), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if currency != item.Currency {
+			return item_failed(responses.Error_code_currency_mismatch, "Currency of withdrawal does not match currency of wallet"), nil
+		}
+		if amount > balance {
+			return item_failed(responses.Error_code_insufficient_funds, "Insufficient funds in wallet"), nil
+		}
+		_, err = tx_insert_transaction.Exec(item.WalletID, date_and_time, item.Currency, -amount)
+		if err != nil {
+			return nil, err
+		}
+		balance -= amount
+		_, err = tx_update_balance.Exec(balance, item.WalletID)
+		if err != nil {
+			return nil, err
+		}
+
+		// The amount is sent as a positive number
+		event := batch_event{
+			event_type: events.Event_type_withdrawal_completed,
+			wallet_id:  item.WalletID,
+			data: events.Data{
+				Currency:   item.Currency,
+				Amount:     utilities.Convert_database_to_display_format(amount),
+				NewBalance: utilities.Convert_database_to_display_format(balance),
+			},
+		}
+		err = insert_event(tx_insert_event, event.event_type, event.wallet_id, &event.data, date_and_time)
+		if err != nil {
+			return nil, err
+		}
+		return &batch_item_outcome{currency: item.Currency, new_balance: balance, events: []batch_event{event}}, nil
+
+	case messages.Action_transfer:
+
+		// Both the source and destination wallets must exist
+		var source_currency string = ""
+		var source_balance int64 = 0
+		err = tx_get_currency_balance.QueryRow(item.SourceWalletID).Scan(&source_currency, &source_balance)
+		if errors.Is(err, sql.ErrNoRows) {
+			return item_failed(responses.Error_code_wallet_not_found, "Source wallet does not exist"), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if source_currency != item.Currency {
+			return item_failed(responses.Error_code_currency_mismatch, "Transfer currency does not match currency of source wallet"), nil
+		}
+		if amount > source_balance {
+			return item_failed(responses.Error_code_insufficient_funds, "Insufficient funds in source wallet"), nil
+		}
+
+		// The source wallet is updated before the destination wallet is read, so that
+		// a transfer to the same wallet leaves its balance as it was
+		_, err = tx_insert_transaction.Exec(item.SourceWalletID, date_and_time, item.Currency, -amount)
+		if err != nil {
+			return nil, err
+		}
+		source_balance -= amount
+		_, err = tx_update_balance.Exec(source_balance, item.SourceWalletID)
+		if err != nil {
+			return nil, err
+		}
+
+		var destination_currency string = ""
+		var destination_balance int64 = 0
+		err = tx_get_currency_balance.QueryRow(item.DestinationWalletID).Scan(&destination_currency, &destination_balance)
+		if errors.Is(err, sql.ErrNoRows) {
+			return item_failed(responses.Error_code_wallet_not_found, "Destination wallet does not exist"), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if destination_currency != item.Currency {
+			return item_failed(responses.Error_code_currency_mismatch, "Transfer currency does not match currency of destination wallet"), nil
+		}
+		_, err = tx_insert_transaction.Exec(item.DestinationWalletID, date_and_time, item.Currency, amount)
+		if err != nil {
+			return nil, err
+		}
+		destination_balance += amount
+		_, err = tx_update_balance.Exec(destination_balance, item.DestinationWalletID)
+		if err != nil {
+			return nil, err
+		}
+
+		// Record the transfer for webhooks of both wallets
+		sent := batch_event{
+			event_type: events.Event_type_transfer_sent,
+			wallet_id:  item.SourceWalletID,
+			data: events.Data{
+				Currency:             item.Currency,
+				Amount:               utilities.Convert_database_to_display_format(amount),
+				NewBalance:           utilities.Convert_database_to_display_format(source_balance),
+				CounterpartyWalletID: item.DestinationWalletID,
+			},
+		}
+		received := batch_event{
+			event_type: events.Event_type_transfer_received,
+			wallet_id:  item.DestinationWalletID,
+			data: events.Data{
+				Currency:             item.Currency,
+				Amount:               utilities.Convert_database_to_display_format(amount),
+				NewBalance:           utilities.Convert_database_to_display_format(destination_balance),
+				CounterpartyWalletID: item.SourceWalletID,
+			},
+		}
+		for _, event := range []batch_event{sent, received} {
+			err = insert_event(tx_insert_event, event.event_type, event.wallet_id, &event.data, date_and_time)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return &batch_item_outcome{currency: item.Currency, new_balance: source_balance, events: []batch_event{sent, received}}, nil
+	}
+	return item_failed(responses.Error_code_invalid_request, "Unknown action"), nil
+}
+
+// Turns the response into the response to a batch whose item failed. The batch fails
+// with the error code of the item, and every other item reports BATCH_ABORTED.
+func abort_batch(response_message *responses.Batch, request_message *messages.POST_Batch, failed_item int, outcome *batch_item_outcome) {
+	item_id := request_message.Items[failed_item].ItemID
+	aborted := item_failed(responses.Error_code_batch_aborted, "Not applied because item "+item_id+" failed")
+	for index := range request_message.Items {
+		if index != failed_item {
+			response_message.Items[index] = create_batch_item_response(request_message.Header.MessageID, &request_message.Items[index], aborted)
+		}
+	}
+	response_message.Status = responses.Status_failed
+	response_message.ErrorCode = outcome.error_code
+	if len(response_message.ErrorCode) == 0 {
+		response_message.ErrorCode = responses.Error_code_batch_aborted
+	}
+	response_message.ErrorMessage = "Item " + item_id + " failed: " + outcome.error_message
+}
+
+func (service *TransferService) send_failed_batch_response(error_code string, message string, request_message *messages.POST_Batch, request_log *logging.Request) error {
+	response_message := responses.Batch{
+		Header: responses.Header{
+			MessageID: request_message.Header.MessageID,
+			Action:    request_message.Header.Action,
+		},
+		Status:       responses.Status_failed,
+		ErrorCode:    error_code,
+		ErrorMessage: message,
+	}
+	return service.send_message(&response_message, false, error_code, message, &request_message.Header, request_log)
+}
+
+// Identifies the content of a batch regardless of the message that carried it
+func get_batch_fingerprint(request_message *messages.POST_Batch) string {
+	content := *request_message
+	content.Header = messages.Header{}
+	bytes, err := json.Marshal(&content)
+	if err != nil {
+		return ""
+	}
+	return string(bytes)
+}
+
+// Replies to a retried batch with the response to the original batch
+func (service *TransferService) send_stored_batch_response(stored_request string, stored_response string, request_message *messages.POST_Batch, request_log *logging.Request) error {
+	if stored_request != get_batch_fingerprint(request_message) {
+		return service.send_failed_batch_response(responses.Error_code_idempotency_key_reused, "Idempotency key was already used for a different request", request_message, request_log)
+	}
+	response_message := responses.Batch{}
+	err := json.Unmarshal([]byte(stored_response), &response_message)
+	if err != nil {
+		return service.send_failed_batch_response(responses.Error_code_database_error, "Database error", request_message, request_log)
+	}
+	response_message.Header = responses.Header{
+		MessageID: request_message.Header.MessageID,
+		Action:    request_message.Header.Action,
+	}
+	return service.send_message(&response_message, true, "", "", &request_message.Header, request_log)
+}
+
+/*
+Applies every item of the batch in a single database transaction. If any item fails,
+the transaction is rolled back and none of the items are applied. The failed item
+reports why, and every other item reports BATCH_ABORTED. Returns an error if the
+response could not be sent.
+*/
+func (service *TransferService) apply_batch(db *sql.DB, statements *batch_statements, request_message *messages.POST_Batch, request_log *logging.Request) error {
+
+	if len(request_message.Items) == 0 {
+		return service.send_failed_batch_response(responses.Error_code_invalid_request, "Missing items", request_message, request_log)
+	}
+
+	// Nobody is waiting for the response anymore, so the request is not applied
+	if request_message.Header.IsExpired() {
+		service.metrics.CountExpired()
+		request_log.Expired(request_message.Header.Deadline)
+		return nil
+	}
+
+	// Query PostgreSQL database
+	transaction_date_time := time.Now().UTC()
+	db_transaction, err := db.Begin()
+	if err != nil {
+		return service.send_failed_batch_response(responses.Error_code_database_error, "Database error", request_message, request_log)
+	}
+	transaction_started_at := time.Now()
+	database_span := service.tracer.StartDatabaseSpan(request_message.Header.TraceParent)
+
+	// Return the response to the original batch if this batch is a retry or was
+	// delivered again by a stream
+	idempotency_key := request_message.Header.GetIdempotencyKey(service.get_config().RequestsQueue.Transport == queues.Transport_stream)
+	if len(idempotency_key) > 0 {
+		var stored_request string = ""
+		var stored_response string = ""
+		tx_get_idempotency_key := db_transaction.Stmt(statements.get_idempotency_key)
+		err = tx_get_idempotency_key.QueryRow(idempotency_key).Scan(&stored_request, &stored_response)
+		if err == nil {
+			service.rollback(db_transaction, transaction_started_at, database_span)
+			return service.send_stored_batch_response(stored_request, stored_response, request_message, request_log)
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			service.rollback(db_transaction, transaction_started_at, database_span)
+			return service.send_failed_batch_response(responses.Error_code_database_error, "Database error", request_message, request_log)
+		}
+	}
+
+	items := make([]responses.BatchItem, len(request_message.Items))
+	committed_events := []batch_event{}
+	failed_item := -1
+	var failed_outcome *batch_item_outcome = nil
+	for index := range request_message.Items {
+		item := &request_message.Items[index]
+		outcome, err := apply_batch_item(db_transaction, statements, item, transaction_date_time)
+		if err != nil {
+			service.rollback(db_transaction, transaction_started_at, database_span)
+			return service.send_failed_batch_response(responses.Error_code_database_error, "Database error", request_message, request_log)
+		}
+		items[index] = create_batch_item_response(request_message.Header.MessageID, item, outcome)
+		if outcome.failed {
+			failed_item = index
+			failed_outcome = outcome
+			break
+		}
+		committed_events = append(committed_events, outcome.events...)
+	}
+
+	response_message := responses.Batch{
+		Header: responses.Header{
+			MessageID: request_message.Header.MessageID,
+			Action:    request_message.Header.Action,
+		},
+		Status: responses.Status_successful,
+		Items:  items,
+	}
+
+	// None of the items are applied if any of them failed
+	if failed_item >= 0 {
+		service.rollback(db_transaction, transaction_started_at, database_span)
+		abort_batch(&response_message, request_message, failed_item, failed_outcome)
+		return service.send_message(&response_message, false, response_message.ErrorCode, response_message.ErrorMessage, &request_message.Header, request_log)
+	}
+
+	// Record the idempotency key with the response in the same database transaction,
+	// so that a retry can never be applied twice
+	if len(idempotency_key) > 0 {
+		response_bytes, err := json.Marshal(&response_message)
+		if err != nil {
+			service.rollback(db_transaction, transaction_started_at, database_span)
+			return service.send_failed_batch_response(responses.Error_code_database_error, "Database error", request_message, request_log)
+		}
+		tx_insert_idempotency_key := db_transaction.Stmt(statements.insert_idempotency_key)
+		result, err := tx_insert_idempotency_key.Exec(
+			idempotency_key,
+			request_message.Header.Action,
+			get_batch_fingerprint(request_message),
+			string(response_bytes),
+			transaction_date_time)
+		if err != nil {
+			service.rollback(db_transaction, transaction_started_at, database_span)
+			return service.send_failed_batch_response(responses.Error_code_database_error, "Database error", request_message, request_log)
+		}
+		rows_affected, err := result.RowsAffected()
+		if err != nil {
+			service.rollback(db_transaction, transaction_started_at, database_span)
+			return service.send_failed_batch_response(responses.Error_code_database_error, "Database error", request_message, request_log)
+		}
+		if rows_affected == 0 {
+			// Another instance of this service committed the same batch first
+			service.rollback(db_transaction, transaction_started_at, database_span)
+			var stored_request string = ""
+			var stored_response string = ""
+			err = statements.get_idempotency_key.QueryRow(idempotency_key).Scan(&stored_request, &stored_response)
+			if err != nil {
+				return service.send_failed_batch_response(responses.Error_code_database_error, "Database error", request_message, request_log)
+			}
+			return service.send_stored_batch_response(stored_request, stored_response, request_message, request_log)
+		}
+	}
+
+	// Commit database transaction
+	err = db_transaction.Commit()
+	if err != nil {
+		service.rollback(db_transaction, transaction_started_at, database_span)
+		return service.send_failed_batch_response(responses.Error_code_database_error, "Database error", request_message, request_log)
+	}
+	service.metrics.DatabaseTransactionDuration.ObserveSince(transaction_started_at, metrics.Outcome_commit)
+	database_span.EndDatabaseSpan(metrics.Outcome_commit)
+
+	// Only committed batches are published, so that the live feed never shows a balance
+	// that was rolled back
+	for index := range committed_events {
+		event := &committed_events[index]
+		service.publish_event(event.event_type, event.wallet_id, &event.data, transaction_date_time, request_log)
+	}
+
+	return service.send_message(&response_message, true, "", "", &request_message.Header, request_log)
+}
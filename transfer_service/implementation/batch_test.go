@@ -0,0 +1,46 @@
+package implementation
+
+import (
+	"encoding/json"
+	"shared/messages"
+	"shared/responses"
+	"testing"
+)
+
+func Test_AbortBatch(t *testing.T) {
+	request_message := &messages.POST_Batch{
+		Header: messages.Header{MessageID: 1, Action: messages.Action_batch},
+		Items: []messages.BatchItem{
+			{ItemID: "deposit", Action: messages.Action_deposit},
+			{ItemID: "withdrawal", Action: messages.Action_withdraw},
+			{ItemID: "transfer", Action: messages.Action_transfer},
+		},
+	}
+	outcome := item_failed(responses.Error_code_insufficient_funds, "Insufficient funds in wallet")
+	response_message := &responses.Batch{
+		Header: responses.Header{MessageID: 1, Action: messages.Action_batch},
+		Status: responses.Status_successful,
+		Items: []responses.BatchItem{
+			create_batch_item_response(1, &request_message.Items[0], &batch_item_outcome{currency: "SGD", new_balance: 100}),
+			create_batch_item_response(1, &request_message.Items[1], outcome),
+			{},
+		},
+	}
+	abort_batch(response_message, request_message, 1, outcome)
+
+	// The batch fails as a whole with the error code of the failed item
+	if response_message.Status != responses.Status_failed || response_message.ErrorCode != responses.Error_code_insufficient_funds {
+		t.Error("Expected: ", responses.Status_failed, " ", responses.Error_code_insufficient_funds, ", Got: ", response_message.Status, " ", response_message.ErrorCode)
+	}
+	expected := []string{responses.Error_code_batch_aborted, responses.Error_code_insufficient_funds, responses.Error_code_batch_aborted}
+	for index, item := range response_message.Items {
+		item_status := responses.Deposit{}
+		err := json.Unmarshal(item.Response, &item_status)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item_status.Status != responses.Status_failed || item_status.ErrorCode != expected[index] {
+			t.Error("Expected: ", expected[index], ", Got: ", item_status.Status, " ", item_status.ErrorCode)
+		}
+	}
+}
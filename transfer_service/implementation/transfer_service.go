@@ -6,9 +6,17 @@ import (
 	"encoding/json"
 	"errors"
 	"log"
+	"log/slog"
+	shared_config "shared/config"
+	"shared/events"
+	"shared/logging"
 	"shared/messages"
+	"shared/metrics"
+	"shared/queues"
 	"shared/responses"
+	"shared/tracing"
 	"shared/utilities"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -19,29 +27,74 @@ import (
 )
 
 type TransferService struct {
-	config             *config.Config
+	config             atomic.Pointer[config.Config]
 	is_alive           atomic.Bool
 	waitgroup          sync.WaitGroup
 	background_context context.Context
-	requests_queue     *redis.Client
-	responses_queue    *redis.Client
+	requests_queue     queues.Transport
+	responses_queue    queues.Transport
+	events_stream      *redis.Client
+	metrics            *metrics.ServiceMetrics
+	tracer             *tracing.Tracer
+
+	// Nil if metrics are not served
+	metrics_server *metrics.Server
 }
 
 func CreateTransferService(config *config.Config) *TransferService {
 	service := &TransferService{
-		config:             config,
 		background_context: context.Background(),
+		metrics:            metrics.CreateServiceMetrics("transfer_service"),
 	}
+	service.config.Store(config)
+	exporter, err := tracing.CreateExporter(
+		config.Tracing.Exporter,
+		"transfer_service",
+		config.Tracing.Endpoint,
+		time.Duration(config.Tracing.Timeout)*time.Second)
+	if err != nil {
+		log.Println("Unable to export spans: ", err.Error())
+	}
+	service.tracer = tracing.CreateTracer(exporter)
 	return service
 }
 
+func (service *TransferService) get_config() *config.Config {
+	return service.config.Load()
+}
+
+// Applies a new configuration without a restart. Returns an error and keeps the old
+// settings if any setting that needs a restart was changed.
+func (service *TransferService) Reload(next *config.Config) error {
+	current := service.get_config()
+	err := config.CheckReload(current, next)
+	if err != nil {
+		return err
+	}
+	err = logging.SetLevel(next.Logging.Level)
+	if err != nil {
+		return err
+	}
+	service.config.Store(next)
+	log.Println("Reloaded configuration. Version " + shared_config.GetVersion(current) + " was replaced by version " + shared_config.GetVersion(next) + ".")
+	return nil
+}
+
+// Requests and responses are passed on through the transport instead of the Redis
+// servers in the configuration file, e.g. in memory shared with the API gateway in
+// tests. Must be called before Run.
+func (service *TransferService) SetTransport(transport queues.Transport) {
+	service.requests_queue = transport
+	service.responses_queue = transport
+}
+
 func (service *TransferService) prepare_redis_clients() error {
 
-	{
+	if service.requests_queue == nil {
 		// Prepare requests queue
-		requests_queue := redis.NewClient(service.config.RequestsQueue.GetRedisOptions())
+		requests_queue := redis.NewClient(service.get_config().RequestsQueue.GetRedisOptions())
 
-		timeout_context, cancel := context.WithTimeout(service.background_context, time.Duration(service.config.RequestsQueue.Timeout)*time.Second)
+		timeout_context, cancel := context.WithTimeout(service.background_context, time.Duration(service.get_config().RequestsQueue.Timeout)*time.Second)
 		_, err := requests_queue.Ping(timeout_context).Result()
 		if err != nil {
 			cancel()
@@ -49,14 +102,20 @@ func (service *TransferService) prepare_redis_clients() error {
 		}
 		cancel()
 
-		service.requests_queue = requests_queue
+		// Requests are taken by this consumer of the group if the requests queue is a stream
+		requests_queue_config := &service.get_config().RequestsQueue
+		service.requests_queue = queues.CreateRedisTransport(
+			requests_queue,
+			requests_queue_config.Transport,
+			requests_queue_config.ConsumerGroup,
+			queues.CreateConsumerName())
 	}
 
-	{
+	if service.responses_queue == nil {
 		// Prepare responses queue
-		responses_queue := redis.NewClient(service.config.ResponsesQueue.GetRedisOptions())
+		responses_queue := redis.NewClient(service.get_config().ResponsesQueue.GetRedisOptions())
 
-		timeout_context, cancel := context.WithTimeout(service.background_context, time.Duration(service.config.ResponsesQueue.Timeout)*time.Second)
+		timeout_context, cancel := context.WithTimeout(service.background_context, time.Duration(service.get_config().ResponsesQueue.Timeout)*time.Second)
 		_, err := responses_queue.Ping(timeout_context).Result()
 		if err != nil {
 			cancel()
@@ -64,44 +123,182 @@ func (service *TransferService) prepare_redis_clients() error {
 		}
 		cancel()
 
-		service.responses_queue = responses_queue
+		service.responses_queue = queues.CreateRedisTransport(responses_queue, queues.Transport_list, "", "")
+	}
+
+	{
+		// Prepare events stream
+		events_stream := redis.NewClient(service.get_config().EventsStream.GetRedisOptions())
+
+		timeout_context, cancel := context.WithTimeout(service.background_context, time.Duration(service.get_config().EventsStream.Timeout)*time.Second)
+		_, err := events_stream.Ping(timeout_context).Result()
+		if err != nil {
+			cancel()
+			return err
+		}
+		cancel()
+
+		service.events_stream = events_stream
 	}
 
 	return nil
 }
 
-func (service *TransferService) send_response(response_message *responses.Transfer) {
+// Publishes a committed event to the live feed of the wallet. The event is already in
+// the events table, so a failure is only logged. Clients of the live feed can still
+// get the new balance from the API.
+func (service *TransferService) publish_event(event_type string, wallet_id string, data *events.Data, date_and_time time.Time, request_log *logging.Request) {
+	events_stream_config := &service.get_config().EventsStream
+	timeout_context, cancel := context.WithTimeout(service.background_context, time.Duration(events_stream_config.Timeout)*time.Second)
+	defer cancel()
+	err := events.Publish(timeout_context, service.events_stream, events_stream_config.StreamName, events_stream_config.MaximumLength, &events.Event{
+		EventType: event_type,
+		WalletID:  wallet_id,
+		CreatedAt: date_and_time.UTC().Format(time.RFC3339),
+		Data:      *data,
+	})
+	if err != nil {
+		request_log.Logger().Warn("Unable to publish event to live feed", logging.Key_error, err.Error())
+	}
+}
+
+func (service *TransferService) send_response(response_message *responses.Transfer, request_header *messages.Header, request_log *logging.Request) error {
+	return service.send_message(response_message, response_message.Status == responses.Status_successful, response_message.ErrorCode, response_message.ErrorMessage, request_header, request_log)
+}
+
+// Sends a response to a transfer or a batch. Returns an error if the response could not
+// be put into the responses queue. The request is then not acknowledged, so that it is
+// processed again.
+func (service *TransferService) send_message(response_message any, successful bool, error_code string, error_message string, request_header *messages.Header, request_log *logging.Request) error {
+	service.metrics.CountMessage(successful, error_code)
+	request_log.Done(error_code, error_message)
+
 	bytes_to_send, err := json.Marshal(response_message)
 	if err != nil {
-		log.Println("Failed to serialise response message. Should not happen in production.")
+		request_log.Logger().Error("Failed to serialise response message. Should not happen in production.", logging.Key_error, err.Error())
 		// In practice, we will need an error notification system. I have skipped
 		// building an error notification system due to time constraints.
-		return
+		return err
 	}
 
-	// Put response into responses queue
-	timeout := time.Duration(service.config.ResponsesQueue.Timeout) * time.Second
-	queue_name := service.config.ResponsesQueue.QueueName
+	// Put response into the reply queue of the API gateway that sent the request
+	responses_queue_config := &service.get_config().ResponsesQueue
+	timeout := time.Duration(responses_queue_config.Timeout) * time.Second
+	queue_name := request_header.GetReplyQueueName(responses_queue_config.QueueName)
+	time_to_live := time.Duration(0)
+	if len(request_header.ReplyTo) > 0 {
+		time_to_live = shared_config.Reply_queue_time_to_live
+	}
 	timeout_context, cancel := context.WithTimeout(service.background_context, timeout)
-	_, err = service.responses_queue.LPush(timeout_context, queue_name, bytes_to_send).Result()
+	push_span := service.tracer.StartPushSpan(queue_name, request_header.TraceParent)
+	err = service.responses_queue.PushResponse(timeout_context, queue_name, bytes_to_send, time_to_live)
+	push_span.EndWithError(err)
 	if err != nil {
 		cancel()
-		log.Println("Failed to put response into responses queue.")
-		return
+		request_log.Logger().Error("Failed to put response into responses queue.", logging.Key_error, err.Error())
+		return err
 	}
 	cancel()
+	return nil
 }
 
-func (service *TransferService) send_failed_response(message string, request_message *messages.POST_Transfer) {
+func (service *TransferService) send_failed_response(error_code string, message string, request_message *messages.POST_Transfer, request_log *logging.Request) error {
 	response_message := responses.Transfer{
 		Header: responses.Header{
 			MessageID: request_message.Header.MessageID,
 			Action:    request_message.Header.Action,
 		},
 		Status:       responses.Status_failed,
+		ErrorCode:    error_code,
 		ErrorMessage: message,
 	}
-	service.send_response(&response_message)
+	return service.send_response(&response_message, &request_message.Header, request_log)
+}
+
+// Identifies the content of a request regardless of the message that carried it
+func get_request_fingerprint(request_message *messages.POST_Transfer) string {
+	content := *request_message
+	content.Header = messages.Header{}
+	bytes, err := json.Marshal(&content)
+	if err != nil {
+		return ""
+	}
+	return string(bytes)
+}
+
+// Replies to a retried request with the response to the original request
+func (service *TransferService) send_stored_response(stored_request string, stored_response string, request_message *messages.POST_Transfer, request_log *logging.Request) error {
+	if stored_request != get_request_fingerprint(request_message) {
+		return service.send_failed_response(responses.Error_code_idempotency_key_reused, "Idempotency key was already used for a different request", request_message, request_log)
+	}
+	response_message := responses.Transfer{}
+	err := json.Unmarshal([]byte(stored_response), &response_message)
+	if err != nil {
+		return service.send_failed_response(responses.Error_code_database_error, "Database error", request_message, request_log)
+	}
+	response_message.Header = responses.Header{
+		MessageID: request_message.Header.MessageID,
+		Action:    request_message.Header.Action,
+	}
+	return service.send_response(&response_message, &request_message.Header, request_log)
+}
+
+// Records an event for webhooks in the database transaction that moves the money, so
+// that an event exists if and only if the money was moved
+func insert_event(tx_insert_event *sql.Stmt, event_type string, wallet_id string, data *events.Data, date_and_time time.Time) error {
+	bytes, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = tx_insert_event.Exec(event_type, wallet_id, string(bytes), date_and_time)
+	return err
+}
+
+// Rolls back a database transaction and measures how long it was open
+func (service *TransferService) rollback(db_transaction *sql.Tx, started_at time.Time, database_span *tracing.Span) {
+	db_transaction.Rollback()
+	service.metrics.DatabaseTransactionDuration.ObserveSince(started_at, metrics.Outcome_rollback)
+	database_span.EndDatabaseSpan(metrics.Outcome_rollback)
+}
+
+// Requests taken from a stream are processed again by another consumer unless they
+// are acknowledged. Failures are logged with the message ID from the log of the request,
+// if the request was read.
+func (service *TransferService) acknowledge(message *queues.Message, request_log *logging.Request) {
+	if message == nil {
+		return
+	}
+	timeout := time.Duration(service.get_config().RequestsQueue.Timeout) * time.Second
+	timeout_context, cancel := context.WithTimeout(service.background_context, timeout)
+	defer cancel()
+	err := service.requests_queue.AckRequest(timeout_context, message)
+	if err != nil {
+		request_log.Logger().Error("Unable to acknowledge request", logging.Key_error, err.Error())
+	}
+}
+
+// Moves a request that cannot be processed to the dead-letter queue, where it can be
+// inspected and re-enqueued with the dlq command. Returns false if the request could not
+// be moved, so that it is not acknowledged.
+func (service *TransferService) dead_letter(message *queues.Message, reason string, metrics_reason string) bool {
+	requests_queue_config := &service.get_config().RequestsQueue
+	if len(requests_queue_config.DeadLetterQueue) == 0 {
+		slog.Error("Dropped request", logging.Key_error, reason)
+		service.metrics.DeadLetters.Inc(metrics_reason)
+		return true
+	}
+	timeout := time.Duration(requests_queue_config.Timeout) * time.Second
+	timeout_context, cancel := context.WithTimeout(service.background_context, timeout)
+	defer cancel()
+	dead_letter := queues.CreateDeadLetter(queues.Kind_request, requests_queue_config.QueueName, reason, message.Data)
+	err := service.requests_queue.PushDeadLetter(timeout_context, requests_queue_config.DeadLetterQueue, dead_letter)
+	if err != nil {
+		slog.Error("Unable to move request to dead-letter queue", logging.Key_error, err.Error())
+		return false
+	}
+	slog.Warn("Moved request to dead-letter queue", logging.Key_error, reason)
+	service.metrics.DeadLetters.Inc(metrics_reason)
+	return true
 }
 
 func (service *TransferService) async_run() {
@@ -118,8 +315,15 @@ func (service *TransferService) async_run() {
 	}
 	log.Println("Created clients for Redis message queues.")
 
+	// Requests are taken by a consumer of the group if the requests queue is a stream
+	requests_queue_config := &service.get_config().RequestsQueue
+	err = queues.CheckConsumer(requests_queue_config.Transport, requests_queue_config.ConsumerGroup)
+	if err != nil {
+		log.Fatal("Unable to read requests queue: ", err)
+	}
+
 	// Open connection to PostgreSQL database
-	db, err := sql.Open("postgres", service.config.WalletDatabase.GetConnectionString())
+	db, err := sql.Open("postgres", service.get_config().WalletDatabase.GetConnectionString())
 	if err != nil {
 		log.Fatal("Could not create PostgreSQL database object.", err)
 	}
@@ -131,60 +335,150 @@ func (service *TransferService) async_run() {
 	log.Println("Connected to PostgreSQL database.")
 
 	// Prepare commonly used SQL statements
-	get_currency_balance, err := db.Prepare("select currency, balance from " + service.config.WalletDatabase.BalanceTable + " where wallet_id=$1")
+	get_currency_balance, err := db.Prepare("select currency, balance from " + service.get_config().WalletDatabase.BalanceTable + " where wallet_id=$1")
 	if err != nil {
 		log.Fatal("Unable to prepare SQL statement.")
 	}
 	defer get_currency_balance.Close()
 
-	insert_transaction, err := db.Prepare("insert into " + service.config.WalletDatabase.TransactionsTable + " (wallet_id, date_and_time, currency, amount) values ($1, $2, $3, $4)")
+	insert_transaction, err := db.Prepare("insert into " + service.get_config().WalletDatabase.TransactionsTable + " (wallet_id, date_and_time, currency, amount) values ($1, $2, $3, $4)")
 	if err != nil {
 		log.Fatal("Unable to prepare SQL statement.")
 	}
 	defer insert_transaction.Close()
 
-	update_balance, err := db.Prepare("update " + service.config.WalletDatabase.BalanceTable + " set balance=$1 where wallet_id=$2")
+	update_balance, err := db.Prepare("update " + service.get_config().WalletDatabase.BalanceTable + " set balance=$1 where wallet_id=$2")
 	if err != nil {
 		log.Fatal("Unable to prepare SQL statement.")
 	}
 	defer update_balance.Close()
 
+	get_idempotency_key, err := db.Prepare("select request, response from " + service.get_config().WalletDatabase.IdempotencyKeysTable + " where idempotency_key=$1")
+	if err != nil {
+		log.Fatal("Unable to prepare SQL statement.")
+	}
+	defer get_idempotency_key.Close()
+
+	insert_idempotency_key, err := db.Prepare("insert into " + service.get_config().WalletDatabase.IdempotencyKeysTable + " (idempotency_key, action, request, response, date_and_time) values ($1, $2, $3, $4, $5) on conflict (idempotency_key) do nothing")
+	if err != nil {
+		log.Fatal("Unable to prepare SQL statement.")
+	}
+	defer insert_idempotency_key.Close()
+
+	insert_event_, err := db.Prepare("insert into " + service.get_config().WalletDatabase.EventsTable + " (event_type, wallet_id, data, date_and_time) values ($1, $2, $3, $4)")
+	if err != nil {
+		log.Fatal("Unable to prepare SQL statement.")
+	}
+	defer insert_event_.Close()
+
+	// Wallets may be created by deposits of a batch
+	insert_new_balance, err := db.Prepare("insert into " + service.get_config().WalletDatabase.BalanceTable + " (wallet_id, currency, balance) values ($1, $2, $3)")
+	if err != nil {
+		log.Fatal("Unable to prepare SQL statement.")
+	}
+	defer insert_new_balance.Close()
+
+	statements := batch_statements{
+		get_currency_balance:   get_currency_balance,
+		insert_transaction:     insert_transaction,
+		update_balance:         update_balance,
+		insert_new_balance:     insert_new_balance,
+		get_idempotency_key:    get_idempotency_key,
+		insert_idempotency_key: insert_idempotency_key,
+		insert_event:           insert_event_,
+	}
+
 	// Service continues running until terminated by user
+	var message *queues.Message = nil
+
+	// Log of the request in message, kept until the request is acknowledged
+	var request_log *logging.Request = nil
 	for service.is_alive.Load() {
 
+		// The previous request was processed and its response was put into the
+		// responses queue, so it is not processed again
+		service.acknowledge(message, request_log)
+		request_log = nil
+
 		// Get next request from requests queue
-		timeout := time.Duration(service.config.RequestsQueue.Timeout) * time.Second
-		queue_name := service.config.RequestsQueue.QueueName
+		// Read on every request, so that a reloaded configuration is applied at once
+		requests_queue_config := &service.get_config().RequestsQueue
+		timeout := time.Duration(requests_queue_config.Timeout) * time.Second
+		claim_idle_time := time.Duration(requests_queue_config.ClaimIdleTime) * time.Second
+		queue_name := requests_queue_config.QueueName
 		timeout_context, cancel := context.WithTimeout(service.background_context, timeout)
-		string_slice, err := service.requests_queue.BRPop(timeout_context, timeout, queue_name).Result()
+		popped_at := time.Now()
+		message, err = service.requests_queue.PopRequest(timeout_context, queue_name, timeout, claim_idle_time)
 		if err != nil {
 			cancel()
 			continue
 		}
 		cancel()
-
-		// string_slice[0] gives the name of the queue
-		// string_slice[1] gives the data retrieved from the queue
+		service.metrics.QueuePopDuration.ObserveSince(popped_at)
+
+		// Requests taken over again and again without being acknowledged, e.g. because
+		// processing them stops the service, are not processed any more
+		maximum_deliveries := requests_queue_config.MaximumDeliveries
+		if maximum_deliveries > 0 && message.Deliveries > maximum_deliveries {
+			reason := "Delivered " + strconv.FormatInt(message.Deliveries, 10) + " times without being acknowledged"
+			if !service.dead_letter(message, reason, metrics.Reason_too_many_deliveries) {
+				message = nil
+			}
+			continue
+		}
 
 		// Deserialise JSON data received
 		request_message := messages.POST_Transfer{}
-		err = json.Unmarshal([]byte(string_slice[1]), &request_message)
+		err = json.Unmarshal(message.Data, &request_message)
 		if err != nil {
-			log.Println("Failed to deserialise JSON message. Should not happen in production.")
-			// In practice, we will need an error notification system. Building an error
-			// notification is skipped due to time constraints.
+			service.metrics.CountMessage(false, responses.Error_code_invalid_request)
+			if !service.dead_letter(message, "Failed to deserialise JSON message: "+err.Error(), metrics.Reason_invalid_message) {
+				message = nil
+			}
 			continue
 		}
 
+		// Atomic batches of deposits, withdrawals and transfers
+		if request_message.Header.Action == messages.Action_batch {
+			request_log = logging.StartRequest(request_message.Header.MessageID, messages.GetActionName(request_message.Header.Action))
+			batch_message := messages.POST_Batch{}
+			err = json.Unmarshal(message.Data, &batch_message)
+			if err != nil {
+				if service.send_failed_response(responses.Error_code_invalid_request, "Invalid batch", &request_message, request_log) != nil {
+					message = nil
+				}
+				continue
+			}
+			if service.apply_batch(db, &statements, &batch_message, request_log) != nil {
+				message = nil
+			}
+			continue
+		}
+		request_log = logging.StartRequest(request_message.Header.MessageID, messages.GetActionName(request_message.Header.Action),
+			logging.Key_source_wallet_id, request_message.SourceWalletID,
+			logging.Key_destination_wallet_id, request_message.DestinationWalletID,
+			logging.Key_amount, request_message.Amount)
+
 		// Verify that the correct message was received
 		if request_message.Header.Action != messages.Action_transfer {
-			service.send_failed_response("Message received by wrong service", &request_message)
+			if service.send_failed_response(responses.Error_code_internal_error, "Message received by wrong service", &request_message, request_log) != nil {
+				message = nil
+			}
 			continue
 		}
 
 		// Verify that inputs are correct
 		if len(request_message.Currency) != 3 {
-			service.send_failed_response("Invalid currency", &request_message)
+			if service.send_failed_response(responses.Error_code_invalid_currency, "Invalid currency", &request_message, request_log) != nil {
+				message = nil
+			}
+			continue
+		}
+
+		// Nobody is waiting for the response anymore, so the request is not applied
+		if request_message.Header.IsExpired() {
+			service.metrics.CountExpired()
+			request_log.Expired(request_message.Header.Deadline)
 			continue
 		}
 
@@ -192,9 +486,37 @@ func (service *TransferService) async_run() {
 		transaction_date_time := time.Now().UTC()
 		db_transaction, err := db.Begin()
 		if err != nil {
-			service.send_failed_response("Database error", &request_message)
+			if service.send_failed_response(responses.Error_code_database_error, "Database error", &request_message, request_log) != nil {
+				message = nil
+			}
 			continue
 		}
+		transaction_started_at := time.Now()
+		database_span := service.tracer.StartDatabaseSpan(request_message.Header.TraceParent)
+
+		// Return the response to the original request if this request is a retry or was
+		// delivered again by a stream
+		idempotency_key := request_message.Header.GetIdempotencyKey(service.get_config().RequestsQueue.Transport == queues.Transport_stream)
+		if len(idempotency_key) > 0 {
+			var stored_request string = ""
+			var stored_response string = ""
+			tx_get_idempotency_key := db_transaction.Stmt(get_idempotency_key)
+			err = tx_get_idempotency_key.QueryRow(idempotency_key).Scan(&stored_request, &stored_response)
+			if err == nil {
+				service.rollback(db_transaction, transaction_started_at, database_span)
+				if service.send_stored_response(stored_request, stored_response, &request_message, request_log) != nil {
+					message = nil
+				}
+				continue
+			}
+			if !errors.Is(err, sql.ErrNoRows) {
+				service.rollback(db_transaction, transaction_started_at, database_span)
+				if service.send_failed_response(responses.Error_code_database_error, "Database error", &request_message, request_log) != nil {
+					message = nil
+				}
+				continue
+			}
+		}
 
 		// Both the source and destination wallets must exist, otherwise return an error
 		var source_currency string = ""
@@ -202,11 +524,15 @@ func (service *TransferService) async_run() {
 		tx_get_currency_balance := db_transaction.Stmt(get_currency_balance)
 		err = tx_get_currency_balance.QueryRow(request_message.SourceWalletID).Scan(&source_currency, &source_balance)
 		if err != nil {
-			db_transaction.Rollback()
+			service.rollback(db_transaction, transaction_started_at, database_span)
 			if errors.Is(err, sql.ErrNoRows) {
-				service.send_failed_response("Source wallet does not exist", &request_message)
+				if service.send_failed_response(responses.Error_code_wallet_not_found, "Source wallet does not exist", &request_message, request_log) != nil {
+					message = nil
+				}
 			} else {
-				service.send_failed_response("Database error", &request_message)
+				if service.send_failed_response(responses.Error_code_database_error, "Database error", &request_message, request_log) != nil {
+					message = nil
+				}
 			}
 			continue
 		}
@@ -215,11 +541,15 @@ func (service *TransferService) async_run() {
 		var destination_balance int64 = 0
 		err = tx_get_currency_balance.QueryRow(request_message.DestinationWalletID).Scan(&destination_currency, &destination_balance)
 		if err != nil {
-			db_transaction.Rollback()
+			service.rollback(db_transaction, transaction_started_at, database_span)
 			if errors.Is(err, sql.ErrNoRows) {
-				service.send_failed_response("Destination wallet does not exist", &request_message)
+				if service.send_failed_response(responses.Error_code_wallet_not_found, "Destination wallet does not exist", &request_message, request_log) != nil {
+					message = nil
+				}
 			} else {
-				service.send_failed_response("Database error", &request_message)
+				if service.send_failed_response(responses.Error_code_database_error, "Database error", &request_message, request_log) != nil {
+					message = nil
+				}
 			}
 			continue
 		}
@@ -227,13 +557,17 @@ func (service *TransferService) async_run() {
 		// The currency of the transfer must match the source and destination wallets.
 		// Otherwise return an error.
 		if source_currency != request_message.Currency {
-			db_transaction.Rollback()
-			service.send_failed_response("Transfer currency does not match currency of source wallet", &request_message)
+			service.rollback(db_transaction, transaction_started_at, database_span)
+			if service.send_failed_response(responses.Error_code_currency_mismatch, "Transfer currency does not match currency of source wallet", &request_message, request_log) != nil {
+				message = nil
+			}
 			continue
 		}
 		if destination_currency != request_message.Currency {
-			db_transaction.Rollback()
-			service.send_failed_response("Transfer currency does not match currency of destination wallet", &request_message)
+			service.rollback(db_transaction, transaction_started_at, database_span)
+			if service.send_failed_response(responses.Error_code_currency_mismatch, "Transfer currency does not match currency of destination wallet", &request_message, request_log) != nil {
+				message = nil
+			}
 			continue
 		}
 
@@ -241,13 +575,17 @@ func (service *TransferService) async_run() {
 		// Otherwise return an error.
 		transfer_amount, err := utilities.Convert_display_to_database_format(request_message.Amount)
 		if err != nil {
-			db_transaction.Rollback()
-			service.send_failed_response("Amount specified was invalid", &request_message)
+			service.rollback(db_transaction, transaction_started_at, database_span)
+			if service.send_failed_response(responses.Error_code_invalid_amount, "Amount specified was invalid", &request_message, request_log) != nil {
+				message = nil
+			}
 			continue
 		}
 		if transfer_amount > source_balance {
-			db_transaction.Rollback()
-			service.send_failed_response("Insufficient funds in source wallet", &request_message)
+			service.rollback(db_transaction, transaction_started_at, database_span)
+			if service.send_failed_response(responses.Error_code_insufficient_funds, "Insufficient funds in source wallet", &request_message, request_log) != nil {
+				message = nil
+			}
 			continue
 		}
 
@@ -255,16 +593,20 @@ func (service *TransferService) async_run() {
 		tx_insert_transaction := db_transaction.Stmt(insert_transaction)
 		_, err = tx_insert_transaction.Exec(request_message.SourceWalletID, transaction_date_time, request_message.Currency, -transfer_amount)
 		if err != nil {
-			db_transaction.Rollback()
-			service.send_failed_response("Database error", &request_message)
+			service.rollback(db_transaction, transaction_started_at, database_span)
+			if service.send_failed_response(responses.Error_code_database_error, "Database error", &request_message, request_log) != nil {
+				message = nil
+			}
 			continue
 		}
 
 		// Add deposit transaction to destination wallet
 		_, err = tx_insert_transaction.Exec(request_message.DestinationWalletID, transaction_date_time, request_message.Currency, transfer_amount)
 		if err != nil {
-			db_transaction.Rollback()
-			service.send_failed_response("Database error", &request_message)
+			service.rollback(db_transaction, transaction_started_at, database_span)
+			if service.send_failed_response(responses.Error_code_database_error, "Database error", &request_message, request_log) != nil {
+				message = nil
+			}
 			continue
 		}
 
@@ -273,8 +615,10 @@ func (service *TransferService) async_run() {
 		tx_update_balance := db_transaction.Stmt(update_balance)
 		_, err = tx_update_balance.Exec(source_balance, request_message.SourceWalletID)
 		if err != nil {
-			db_transaction.Rollback()
-			service.send_failed_response("Database error", &request_message)
+			service.rollback(db_transaction, transaction_started_at, database_span)
+			if service.send_failed_response(responses.Error_code_database_error, "Database error", &request_message, request_log) != nil {
+				message = nil
+			}
 			continue
 		}
 
@@ -282,16 +626,41 @@ func (service *TransferService) async_run() {
 		destination_balance += transfer_amount
 		_, err = tx_update_balance.Exec(destination_balance, request_message.DestinationWalletID)
 		if err != nil {
-			db_transaction.Rollback()
-			service.send_failed_response("Database error", &request_message)
+			service.rollback(db_transaction, transaction_started_at, database_span)
+			if service.send_failed_response(responses.Error_code_database_error, "Database error", &request_message, request_log) != nil {
+				message = nil
+			}
 			continue
 		}
 
-		// Commit database transaction
-		err = db_transaction.Commit()
+		// Record the transfer for webhooks of both wallets
+		sent_event_data := events.Data{
+			Currency:             request_message.Currency,
+			Amount:               utilities.Convert_database_to_display_format(transfer_amount),
+			NewBalance:           utilities.Convert_database_to_display_format(source_balance),
+			CounterpartyWalletID: request_message.DestinationWalletID,
+		}
+		received_event_data := events.Data{
+			Currency:             request_message.Currency,
+			Amount:               utilities.Convert_database_to_display_format(transfer_amount),
+			NewBalance:           utilities.Convert_database_to_display_format(destination_balance),
+			CounterpartyWalletID: request_message.SourceWalletID,
+		}
+		tx_insert_event := db_transaction.Stmt(insert_event_)
+		err = insert_event(tx_insert_event, events.Event_type_transfer_sent, request_message.SourceWalletID, &sent_event_data, transaction_date_time)
+		if err != nil {
+			service.rollback(db_transaction, transaction_started_at, database_span)
+			if service.send_failed_response(responses.Error_code_database_error, "Database error", &request_message, request_log) != nil {
+				message = nil
+			}
+			continue
+		}
+		err = insert_event(tx_insert_event, events.Event_type_transfer_received, request_message.DestinationWalletID, &received_event_data, transaction_date_time)
 		if err != nil {
-			db_transaction.Rollback()
-			service.send_failed_response("Database error", &request_message)
+			service.rollback(db_transaction, transaction_started_at, database_span)
+			if service.send_failed_response(responses.Error_code_database_error, "Database error", &request_message, request_log) != nil {
+				message = nil
+			}
 			continue
 		}
 
@@ -305,13 +674,99 @@ func (service *TransferService) async_run() {
 			Currency:   request_message.Currency,
 			NewBalance: utilities.Convert_database_to_display_format(source_balance),
 		}
-		service.send_response(&response_message)
+
+		// Record the idempotency key with the response in the same database transaction,
+		// so that a retry can never be applied twice
+		if len(idempotency_key) > 0 {
+			response_bytes, err := json.Marshal(&response_message)
+			if err != nil {
+				service.rollback(db_transaction, transaction_started_at, database_span)
+				if service.send_failed_response(responses.Error_code_database_error, "Database error", &request_message, request_log) != nil {
+					message = nil
+				}
+				continue
+			}
+			tx_insert_idempotency_key := db_transaction.Stmt(insert_idempotency_key)
+			result, err := tx_insert_idempotency_key.Exec(
+				idempotency_key,
+				request_message.Header.Action,
+				get_request_fingerprint(&request_message),
+				string(response_bytes),
+				transaction_date_time)
+			if err != nil {
+				service.rollback(db_transaction, transaction_started_at, database_span)
+				if service.send_failed_response(responses.Error_code_database_error, "Database error", &request_message, request_log) != nil {
+					message = nil
+				}
+				continue
+			}
+			rows_affected, err := result.RowsAffected()
+			if err != nil {
+				service.rollback(db_transaction, transaction_started_at, database_span)
+				if service.send_failed_response(responses.Error_code_database_error, "Database error", &request_message, request_log) != nil {
+					message = nil
+				}
+				continue
+			}
+			if rows_affected == 0 {
+				// Another instance of this service committed the same request first
+				service.rollback(db_transaction, transaction_started_at, database_span)
+				var stored_request string = ""
+				var stored_response string = ""
+				err = get_idempotency_key.QueryRow(idempotency_key).Scan(&stored_request, &stored_response)
+				if err != nil {
+					if service.send_failed_response(responses.Error_code_database_error, "Database error", &request_message, request_log) != nil {
+						message = nil
+					}
+					continue
+				}
+				if service.send_stored_response(stored_request, stored_response, &request_message, request_log) != nil {
+					message = nil
+				}
+				continue
+			}
+		}
+
+		// Commit database transaction
+		err = db_transaction.Commit()
+		if err != nil {
+			service.rollback(db_transaction, transaction_started_at, database_span)
+			if service.send_failed_response(responses.Error_code_database_error, "Database error", &request_message, request_log) != nil {
+				message = nil
+			}
+			continue
+		}
+		service.metrics.DatabaseTransactionDuration.ObserveSince(transaction_started_at, metrics.Outcome_commit)
+		database_span.EndDatabaseSpan(metrics.Outcome_commit)
+
+		// Only committed transfers are published, so that the live feed never shows a
+		// balance that was rolled back. Both wallets see the transfer.
+		service.publish_event(events.Event_type_transfer_sent, request_message.SourceWalletID, &sent_event_data, transaction_date_time, request_log)
+		service.publish_event(events.Event_type_transfer_received, request_message.DestinationWalletID, &received_event_data, transaction_date_time, request_log)
+
+		if service.send_response(&response_message, &request_message.Header, request_log) != nil {
+			message = nil
+		}
 
 	}
+
+	// The last request was processed before the service was shut down
+	service.acknowledge(message, request_log)
 }
 
 func (service *TransferService) Run() {
 	service.is_alive.Store(true)
+
+	if len(service.get_config().MetricsServer.ListenPort) > 0 {
+		metrics_server := metrics.CreateServer(service.get_config().MetricsServer.ListenPort, service.metrics.Registry)
+		err := metrics_server.Run()
+		if err != nil {
+			log.Println("Unable to serve metrics: ", err.Error())
+		} else {
+			service.metrics_server = metrics_server
+		}
+	}
+
 	service.waitgroup.Add(1)
 	go service.async_run()
 }
@@ -319,4 +774,8 @@ func (service *TransferService) Run() {
 func (service *TransferService) Shutdown() {
 	service.is_alive.Store(false)
 	service.waitgroup.Wait()
+	service.tracer.Shutdown()
+	if service.metrics_server != nil {
+		service.metrics_server.Shutdown()
+	}
 }
@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"log"
 	"reflect"
+	"shared/events"
 	"shared/messages"
 	"shared/responses"
 	"testing"
@@ -43,6 +44,9 @@ func Test_TransferService(t *testing.T) {
 	config.ResponsesQueue.QueueName = "transfer_responses_queue_test"
 	config.WalletDatabase.BalanceTable = "postgres.test_transfer_service.balances"
 	config.WalletDatabase.TransactionsTable = "postgres.test_transfer_service.transactions"
+	config.WalletDatabase.IdempotencyKeysTable = "postgres.test_transfer_service.idempotency_keys"
+	config.WalletDatabase.EventsTable = "postgres.test_transfer_service.events"
+	config.EventsStream.StreamName = "wallet_events_test"
 
 	// Start running balance service
 	service := CreateTransferService(config)
@@ -70,6 +74,19 @@ func Test_TransferService(t *testing.T) {
 	}
 	cancel()
 
+	// Ensure the events streams of both wallets only have the events of this unit test
+	for _, wallet_id := range []string{source_wallet_id, destination_wallet_id} {
+		events_stream_name := events.GetStreamName(config.EventsStream.StreamName, wallet_id)
+		timeout_context, cancel = context.WithTimeout(background_context, time.Duration(config.EventsStream.Timeout)*time.Second)
+		_, err = requests_queue.Del(timeout_context, events_stream_name).Result()
+		if err != nil {
+			cancel()
+			t.Fatal(err)
+		}
+		cancel()
+		defer requests_queue.Del(background_context, events_stream_name)
+	}
+
 	// Prepare connection to PostgreSQL database
 	db, err := sql.Open("postgres", config.WalletDatabase.GetConnectionString())
 	if err != nil {
@@ -91,6 +108,14 @@ func Test_TransferService(t *testing.T) {
 		if err != nil {
 			log.Fatal(err)
 		}
+		_, err = db.Exec("delete from " + config.WalletDatabase.IdempotencyKeysTable)
+		if err != nil {
+			log.Fatal(err)
+		}
+		_, err = db.Exec("delete from " + config.WalletDatabase.EventsTable)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}()
 
 	// Create source wallet
@@ -183,7 +208,7 @@ func Test_TransferService(t *testing.T) {
 			t.Fatal("Expected: ", expected_response, ", Got: ", response_message)
 		}
 
-		get_balance, err := db.Prepare("select balance from " + service.config.WalletDatabase.BalanceTable + " where wallet_id=$1")
+		get_balance, err := db.Prepare("select balance from " + service.get_config().WalletDatabase.BalanceTable + " where wallet_id=$1")
 		if err != nil {
 			t.Fatal("Unable to prepare SQL statement.")
 		}
@@ -207,6 +232,213 @@ func Test_TransferService(t *testing.T) {
 		if balance != int64(destination_final_balance) {
 			t.Error("Expected: ", destination_final_balance, ", Got: ", balance)
 		}
+
+		// Verify events recorded for webhooks of both wallets
+		rows, err := db.Query("select event_type, wallet_id, data from " + config.WalletDatabase.EventsTable + " order by event_id")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		recorded_events := []string{}
+		for rows.Next() {
+			var event_type string = ""
+			var event_wallet_id string = ""
+			var data string = ""
+			err = rows.Scan(&event_type, &event_wallet_id, &data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			recorded_events = append(recorded_events, event_type+" "+event_wallet_id+" "+data)
+		}
+		expected_events := []string{
+			events.Event_type_transfer_sent + " " + source_wallet_id + ` {"currency":"` + currency + `","amount":"` + request_message.Amount + `","new_balance":"` + source_final_balance_str + `","counterparty_wallet_id":"` + destination_wallet_id + `"}`,
+			events.Event_type_transfer_received + " " + destination_wallet_id + ` {"currency":"` + currency + `","amount":"` + request_message.Amount + `","new_balance":"110.00","counterparty_wallet_id":"` + source_wallet_id + `"}`,
+		}
+		if !reflect.DeepEqual(recorded_events, expected_events) {
+			t.Error("Expected: ", expected_events, ", Got: ", recorded_events)
+		}
+
+		// Both wallets see the transfer in their live feed
+		published_events := []string{}
+		for _, wallet_id := range []string{source_wallet_id, destination_wallet_id} {
+			timeout_context, cancel = context.WithTimeout(background_context, time.Duration(config.EventsStream.Timeout)*time.Second)
+			result, err := events.ReadStream(timeout_context, requests_queue, config.EventsStream.StreamName, wallet_id, "", 10)
+			cancel()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, event := range result {
+				data, err := json.Marshal(event.Data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				published_events = append(published_events, event.EventType+" "+event.WalletID+" "+string(data))
+			}
+		}
+		if !reflect.DeepEqual(published_events, expected_events) {
+			t.Error("Expected: ", expected_events, ", Got: ", published_events)
+		}
+	}
+
+	// Transfer is retried with the same idempotency key. It must only be applied once.
+	idempotency_key := "transfer_service_unit_test_key"
+	retried_transfer_amount := "1.00"
+	retried_source_final_balance_str := "89.00"
+	for attempt := 0; attempt < 2; attempt++ {
+		// Put message into requests queue
+		request_message := messages.POST_Transfer{
+			Header: messages.Header{
+				MessageID:      message_id + int64(attempt),
+				Action:         messages.Action_transfer,
+				IdempotencyKey: idempotency_key,
+			},
+			SourceWalletID:      source_wallet_id,
+			DestinationWalletID: destination_wallet_id,
+			Amount:              retried_transfer_amount,
+			Currency:            currency,
+		}
+		bytes_to_send, err := json.Marshal(request_message)
+		if err != nil {
+			t.Fatal("Could not serialise message.", err)
+		}
+		timeout := time.Duration(config.RequestsQueue.Timeout) * time.Second
+		queue_name := config.RequestsQueue.QueueName
+		timeout_context, cancel = context.WithTimeout(background_context, timeout)
+		_, err = requests_queue.LPush(timeout_context, queue_name, bytes_to_send).Result()
+		if err != nil {
+			cancel()
+			t.Fatal(err)
+		}
+		cancel()
+
+		// Wait for response from response queue
+		timeout = time.Duration(config.ResponsesQueue.Timeout) * time.Second
+		queue_name = config.ResponsesQueue.QueueName
+		timeout_context, cancel = context.WithTimeout(background_context, timeout)
+		string_slice, err := responses_queue.BRPop(timeout_context, timeout, queue_name).Result()
+		if err != nil {
+			cancel()
+			t.Fatal(err)
+		}
+		cancel()
+
+		// Deserialise JSON data received
+		response_message := responses.Transfer{}
+		err = json.Unmarshal([]byte(string_slice[1]), &response_message)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Verify response. The retry gets the response to the original request.
+		expected_response := responses.Transfer{
+			Header: responses.Header{
+				MessageID: request_message.Header.MessageID,
+				Action:    request_message.Header.Action,
+			},
+			Status:     responses.Status_successful,
+			Currency:   request_message.Currency,
+			NewBalance: retried_source_final_balance_str,
+		}
+		if !reflect.DeepEqual(response_message, expected_response) {
+			t.Fatal("Expected: ", expected_response, ", Got: ", response_message)
+		}
+	}
+
+	// Items of an atomic batch are applied in a single database transaction
+	send_batch := func(request_message *messages.POST_Batch) *responses.Batch {
+		bytes_to_send, err := json.Marshal(request_message)
+		if err != nil {
+			t.Fatal("Could not serialise message.", err)
+		}
+		timeout := time.Duration(config.RequestsQueue.Timeout) * time.Second
+		timeout_context, cancel := context.WithTimeout(background_context, timeout)
+		_, err = requests_queue.LPush(timeout_context, config.RequestsQueue.QueueName, bytes_to_send).Result()
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		timeout = time.Duration(config.ResponsesQueue.Timeout) * time.Second
+		timeout_context, cancel = context.WithTimeout(background_context, timeout)
+		string_slice, err := responses_queue.BRPop(timeout_context, timeout, config.ResponsesQueue.QueueName).Result()
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		response_message := &responses.Batch{}
+		err = json.Unmarshal([]byte(string_slice[1]), response_message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response_message
+	}
+	get_item_status := func(item *responses.BatchItem) string {
+		item_status := responses.Transfer{}
+		err := json.Unmarshal(item.Response, &item_status)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return item_status.ErrorCode + " " + item_status.NewBalance
+	}
+	get_source_balance := func() int64 {
+		var balance int64 = 0
+		err := db.QueryRow("select balance from "+config.WalletDatabase.BalanceTable+" where wallet_id=$1", source_wallet_id).Scan(&balance)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return balance
+	}
+	batch_items := []messages.BatchItem{
+		{ItemID: "deposit", Action: messages.Action_deposit, WalletID: source_wallet_id, Amount: "1.00", Currency: currency},
+		{ItemID: "transfer", Action: messages.Action_transfer, SourceWalletID: source_wallet_id, DestinationWalletID: destination_wallet_id, Amount: "5.00", Currency: currency},
+		{ItemID: "withdrawal", Action: messages.Action_withdraw, WalletID: destination_wallet_id, Amount: "1000.00", Currency: currency},
 	}
 
+	// None of the items are applied if any of them fails
+	{
+		response_message := send_batch(&messages.POST_Batch{
+			Header: messages.Header{MessageID: message_id + 2, Action: messages.Action_batch},
+			Items:  batch_items,
+		})
+		if response_message.Status != responses.Status_failed || response_message.ErrorCode != responses.Error_code_insufficient_funds || len(response_message.Items) != 3 {
+			t.Fatal("Expected: ", responses.Status_failed, " ", responses.Error_code_insufficient_funds, " ", 3, ", Got: ", response_message.Status, " ", response_message.ErrorCode, " ", len(response_message.Items))
+		}
+		expected_statuses := []string{
+			responses.Error_code_batch_aborted + " ",
+			responses.Error_code_batch_aborted + " ",
+			responses.Error_code_insufficient_funds + " ",
+		}
+		for index := range response_message.Items {
+			item_status := get_item_status(&response_message.Items[index])
+			if item_status != expected_statuses[index] {
+				t.Error("Expected: ", expected_statuses[index], ", Got: ", item_status)
+			}
+		}
+		balance := get_source_balance()
+		if balance != 8900 {
+			t.Error("Expected: ", 8900, ", Got: ", balance)
+		}
+	}
+
+	// Later items see the balances left by earlier items
+	{
+		response_message := send_batch(&messages.POST_Batch{
+			Header: messages.Header{MessageID: message_id + 3, Action: messages.Action_batch},
+			Items:  batch_items[:2],
+		})
+		if response_message.Status != responses.Status_successful || len(response_message.Items) != 2 {
+			t.Fatal("Expected: ", responses.Status_successful, " ", 2, ", Got: ", response_message.Status, " ", len(response_message.Items))
+		}
+		expected_statuses := []string{" 90.00", " 85.00"}
+		for index := range response_message.Items {
+			item_status := get_item_status(&response_message.Items[index])
+			if item_status != expected_statuses[index] {
+				t.Error("Expected: ", expected_statuses[index], ", Got: ", item_status)
+			}
+		}
+		balance := get_source_balance()
+		if balance != 8500 {
+			t.Error("Expected: ", 8500, ", Got: ", balance)
+		}
+	}
 }
@@ -4,6 +4,8 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	shared_config "shared/config"
+	"shared/logging"
 	"syscall"
 	"transfer_service/config"
 	"transfer_service/implementation"
@@ -19,21 +21,43 @@ func main() {
 	if len(os.Args) > 1 {
 		config_file_path = os.Args[1]
 	}
-	config, err := config.Load(config_file_path)
+	initial_config, err := config.Load(config_file_path)
 	if err != nil {
 		log.Fatal("Unable to load configuration file at ", config_file_path)
 	}
+
+	// Log JSON lines from now on
+	logs, err := logging.Setup("transfer_service", initial_config.Logging.Level, initial_config.Logging.File)
+	if err != nil {
+		log.Fatal("Unable to set up logging: ", err)
+	}
+	defer logs.Close()
 	log.Println("Successfully loaded configuration file at ", config_file_path)
 
 	// Start running transfer service
-	service := implementation.CreateTransferService(config)
+	service := implementation.CreateTransferService(initial_config)
 	service.Run()
 
+	// Reload configuration file on SIGHUP or whenever it is changed
+	watcher := shared_config.CreateWatcher(config_file_path, func() {
+		next_config, err := config.Load(config_file_path)
+		if err != nil {
+			log.Println("Configuration not reloaded. Unable to load configuration file at ", config_file_path)
+			return
+		}
+		err = service.Reload(next_config)
+		if err != nil {
+			log.Println("Configuration not reloaded. " + err.Error())
+		}
+	})
+	watcher.Run()
+
 	// Listen for abort signal to terminate the balance service
 	// Pressing CTRL + C while the application is running
 	abort_channel := make(chan os.Signal, 1)
 	signal.Notify(abort_channel, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 	<-abort_channel
+	watcher.Shutdown()
 
 	// Shutdown the transfer service gracefully
 	service.Shutdown()
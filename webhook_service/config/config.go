@@ -0,0 +1,83 @@
+package config
+
+import (
+	"os"
+
+	shared_config "shared/config"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Tables of the webhook service. Kept in the wallet database next to the events table.
+type WebhookTables struct {
+	SubscriptionsTable string `yaml:"subscriptions_table"`
+	DeliveriesTable    string `yaml:"deliveries_table"`
+	AttemptsTable      string `yaml:"attempts_table"`
+}
+
+/*
+Events are turned into deliveries, one for each matching webhook, and deliveries are
+sent every PollInterval. A delivery that fails is retried after InitialBackoff, and
+the wait doubles after every further failure up to MaximumBackoff. A delivery is
+given up after MaximumAttempts attempts.
+*/
+type Dispatcher struct {
+	PollInterval    int `yaml:"poll_interval"`   // ms
+	BatchSize       int `yaml:"batch_size"`      // Events or deliveries taken at once
+	RequestTimeout  int `yaml:"request_timeout"` // s
+	MaximumAttempts int `yaml:"maximum_attempts"`
+	InitialBackoff  int `yaml:"initial_backoff"` // s
+	MaximumBackoff  int `yaml:"maximum_backoff"` // s
+
+	// Webhooks are only registered for and sent to public addresses, so that they
+	// cannot reach the services of the wallet. Only for local test sinks.
+	AllowPrivateAddresses bool `yaml:"allow_private_addresses"`
+}
+
+type Config struct {
+	RequestsQueue  shared_config.RedisMessageQueue  `yaml:"redis_requests_queue"`
+	ResponsesQueue shared_config.RedisMessageQueue  `yaml:"redis_responses_queue"`
+	WalletDatabase shared_config.PostgreSQLDatabase `yaml:"postgresql_wallet_database"`
+	WebhookTables  WebhookTables                    `yaml:"webhook_tables"`
+	Dispatcher     Dispatcher                       `yaml:"dispatcher"`
+	MetricsServer  shared_config.MetricsServer      `yaml:"metrics_server"`
+	Tracing        shared_config.Tracing            `yaml:"tracing"`
+	Logging        shared_config.Logging            `yaml:"logging"`
+}
+
+func Load(filepath string) (*Config, error) {
+
+	bytes, err := os.ReadFile(filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	config := Config{}
+
+	err = yaml.Unmarshal(bytes, &config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+/*
+Returns an error listing the settings that cannot be changed without a restart, i.e.
+the Redis servers, the database tables and the metrics server. Queue names, timeouts
+and the settings of the dispatcher are applied as soon as the configuration file is
+reloaded.
+*/
+func CheckReload(current *Config, next *Config) error {
+	restart_required := shared_config.RestartRequired{}
+	restart_required.Compare("redis_requests_queue", current.RequestsQueue.GetServer(), next.RequestsQueue.GetServer())
+	restart_required.Compare("redis_responses_queue", current.ResponsesQueue.GetServer(), next.ResponsesQueue.GetServer())
+	restart_required.Compare("postgresql_wallet_database", current.WalletDatabase, next.WalletDatabase)
+	restart_required.Compare("webhook_tables", current.WebhookTables, next.WebhookTables)
+	restart_required.Compare("metrics_server", current.MetricsServer, next.MetricsServer)
+	restart_required.Compare("tracing", current.Tracing, next.Tracing)
+
+	// The level of the logs is applied at once
+	restart_required.Compare("logging.file", current.Logging.File, next.Logging.File)
+	return restart_required.Err()
+}
@@ -0,0 +1,77 @@
+package config
+
+import (
+	"reflect"
+	shared_config "shared/config"
+	"testing"
+)
+
+func Test_LoadConfig(t *testing.T) {
+
+	test_file_path := "../config.yml"
+	config, err := Load(test_file_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected_config := Config{
+		RequestsQueue: shared_config.RedisMessageQueue{
+			Host:              "localhost",
+			Port:              "1640",
+			Username:          "default",
+			Password:          "",
+			QueueName:         "webhook_requests_queue",
+			Timeout:           5,
+			Transport:         "list",
+			ConsumerGroup:     "webhook_service",
+			ClaimIdleTime:     30,
+			DeadLetterQueue:   "webhook_dead_letter_queue",
+			MaximumDeliveries: 5,
+		},
+		ResponsesQueue: shared_config.RedisMessageQueue{
+			Host:      "localhost",
+			Port:      "1640",
+			Username:  "default",
+			Password:  "",
+			QueueName: "webhook_responses_queue",
+			Timeout:   5,
+		},
+		WalletDatabase: shared_config.PostgreSQLDatabase{
+			Host:        "localhost",
+			Port:        "5432",
+			Username:    "postgres",
+			Password:    "postgres",
+			Database:    "postgres",
+			EventsTable: "postgres.wallet.events",
+		},
+		WebhookTables: WebhookTables{
+			SubscriptionsTable: "postgres.wallet.webhook_subscriptions",
+			DeliveriesTable:    "postgres.wallet.webhook_deliveries",
+			AttemptsTable:      "postgres.wallet.webhook_attempts",
+		},
+		Dispatcher: Dispatcher{
+			PollInterval:    500,
+			BatchSize:       50,
+			RequestTimeout:  10,
+			MaximumAttempts: 10,
+			InitialBackoff:  5,
+			MaximumBackoff:  3600,
+		},
+		MetricsServer: shared_config.MetricsServer{
+			ListenPort: "1136",
+		},
+		Tracing: shared_config.Tracing{
+			Exporter: "none",
+			Endpoint: "http://localhost:4318/v1/traces",
+			Timeout:  5,
+		},
+		Logging: shared_config.Logging{
+			Level: "info",
+			File:  "",
+		},
+	}
+	if !reflect.DeepEqual(*config, expected_config) {
+		t.Fatal("Expected: ", expected_config, " Got: ", *config)
+	}
+
+}
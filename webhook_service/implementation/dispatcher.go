@@ -0,0 +1,497 @@
+package implementation
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"shared/events"
+	"shared/responses"
+	"shared/webhooks"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	delivery_outcome_delivered string = "delivered"
+	delivery_outcome_retry     string = "retry"
+	delivery_outcome_failed    string = "failed"
+	delivery_outcome_cancelled string = "cancelled"
+
+	// Errors are cut to this length before they are recorded
+	maximum_length_of_errors int = 1000
+
+	// Only this much of the response body is read, so that the connection can be reused
+	maximum_length_of_responses int64 = 64 * 1024
+
+	user_agent string = "DigitalWallet-Webhooks/1.0"
+)
+
+/*
+Returns the time to wait before the next attempt after the given number of failed
+attempts. The wait doubles after every failure, starting at the initial backoff and
+never exceeding the maximum backoff.
+
+	initial_backoff = 5 s: 5 s, 10 s, 20 s, 40 s ...
+*/
+func get_backoff(failed_attempts int, initial_backoff time.Duration, maximum_backoff time.Duration) time.Duration {
+	backoff := initial_backoff
+	for i := 1; i < failed_attempts; i++ {
+		if backoff >= maximum_backoff/2 {
+			return maximum_backoff
+		}
+		backoff *= 2
+	}
+	return min(backoff, maximum_backoff)
+}
+
+/*
+Webhooks must not reach the services behind the firewall of the wallet, e.g. Redis,
+PostgreSQL or the metadata endpoint of a cloud provider. Only public unicast addresses
+are allowed, i.e. no private, loopback, link-local, multicast or unspecified address.
+*/
+func is_public_address(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate()
+}
+
+// Returns true if every address of the host of the URL is public. Checked again when
+// the webhook is sent, since the addresses of a host may change after it was registered.
+func resolves_to_public_addresses(raw_url string, timeout time.Duration) bool {
+	parsed_url, err := url.Parse(raw_url)
+	if err != nil {
+		return false
+	}
+	timeout_context, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	addresses, err := net.DefaultResolver.LookupIPAddr(timeout_context, parsed_url.Hostname())
+	if err != nil || len(addresses) == 0 {
+		return false
+	}
+	for _, address := range addresses {
+		if !is_public_address(address.IP) {
+			return false
+		}
+	}
+	return true
+}
+
+// Refuses connections to addresses which are not public. Checks the address actually
+// dialled, so that a host cannot resolve to a public address when it is checked and to
+// a private address when it is connected to.
+func check_dialled_address(network string, address string, connection syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !is_public_address(ip) {
+		return errors.New("Webhooks are not sent to address " + host + ", which is not public")
+	}
+	return nil
+}
+
+/*
+Redirects are not followed, so that webhooks are only sent to the URL registered.
+Webhooks are only sent to public addresses unless private addresses are allowed, e.g.
+for a local test sink. Proxies are not used, since the address of the proxy would be
+checked instead of the address of the URL.
+*/
+func create_http_client(timeout time.Duration, allow_private_addresses bool) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout}
+	if !allow_private_addresses {
+		dialer.Control = check_dialled_address
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(request *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// Details of a delivery needed to send it
+type webhook_delivery struct {
+	delivery_id int64
+	event_id    int64
+	attempts    int // Attempts made before this one
+	url         string
+	secret      string
+	event_type  string
+	body        []byte
+}
+
+/*
+Sends one attempt of a delivery with its signature. Returns the HTTP status of the
+response, or 0 if there was none, and an error if the URL did not answer with 2xx.
+*/
+func deliver(http_client *http.Client, delivery *webhook_delivery, now time.Time) (int, error) {
+	request, err := http.NewRequest(http.MethodPost, delivery.url, bytes.NewReader(delivery.body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := now.Unix()
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", user_agent)
+	request.Header.Set(webhooks.Header_event_id, strconv.FormatInt(delivery.event_id, 10))
+	request.Header.Set(webhooks.Header_delivery_id, strconv.FormatInt(delivery.delivery_id, 10))
+	request.Header.Set(webhooks.Header_event_type, delivery.event_type)
+	request.Header.Set(webhooks.Header_timestamp, strconv.FormatInt(timestamp, 10))
+	request.Header.Set(webhooks.Header_signature, webhooks.Sign(delivery.secret, timestamp, delivery.body))
+
+	response, err := http_client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, maximum_length_of_responses))
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, errors.New("Unexpected HTTP status " + response.Status)
+	}
+	return response.StatusCode, nil
+}
+
+// Builds the body of the webhook of an event
+func create_event_body(event_id int64, event_type string, wallet_id string, data string, created_at time.Time) ([]byte, error) {
+	event := events.Event{
+		EventID:   strconv.FormatInt(event_id, 10),
+		EventType: event_type,
+		WalletID:  wallet_id,
+		CreatedAt: created_at.UTC().Format(time.RFC3339),
+	}
+	err := json.Unmarshal([]byte(data), &event.Data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&event)
+}
+
+/*
+Turns new events into one delivery for each webhook subscribed to them. Global
+webhooks, i.e. those without a wallet ID, get the events of every wallet. Events are
+locked while they are processed, so that several instances of the webhook service can
+run at the same time without creating the same delivery twice.
+*/
+func (service *WebhookService) async_dispatch_events(db *sql.DB, waitgroup *sync.WaitGroup) {
+	defer waitgroup.Done()
+
+	config := service.get_config()
+	events_table := config.WalletDatabase.EventsTable
+	subscriptions_table := config.WebhookTables.SubscriptionsTable
+	deliveries_table := config.WebhookTables.DeliveriesTable
+
+	get_events, err := db.Prepare("select event_id, event_type, wallet_id from " + events_table + " where dispatched=false order by event_id limit $1 for update skip locked")
+	if err != nil {
+		log.Fatal("Unable to prepare SQL statement.")
+	}
+	defer get_events.Close()
+
+	insert_deliveries, err := db.Prepare(
+		"insert into " + deliveries_table + " (webhook_id, event_id, status, attempts, next_attempt_at, redelivery_of, date_and_time)" +
+			" select webhook_id, $1, '" + responses.Delivery_status_pending + "', 0, $2, 0, $2 from " + subscriptions_table +
+			" where (wallet_id='' or wallet_id=$3) and position(',' || $4 || ',' in ',' || event_types || ',') > 0")
+	if err != nil {
+		log.Fatal("Unable to prepare SQL statement.")
+	}
+	defer insert_deliveries.Close()
+
+	mark_dispatched, err := db.Prepare("update " + events_table + " set dispatched=true where event_id=$1")
+	if err != nil {
+		log.Fatal("Unable to prepare SQL statement.")
+	}
+	defer mark_dispatched.Close()
+
+	log.Println("Started up events dispatcher.")
+	defer log.Println("Shutdown events dispatcher.")
+
+	for service.is_alive.Load() {
+		dispatcher := service.get_config().Dispatcher
+		poll_interval := time.Duration(dispatcher.PollInterval) * time.Millisecond
+
+		number_of_events, err := service.dispatch_events(db, get_events, insert_deliveries, mark_dispatched, dispatcher.BatchSize)
+		if err != nil {
+			log.Println("Unable to dispatch events: ", err.Error())
+		}
+
+		// Keep going without waiting while there is a backlog of events
+		if err != nil || number_of_events < dispatcher.BatchSize {
+			service.sleep(poll_interval)
+		}
+	}
+}
+
+// Returns the number of events dispatched
+func (service *WebhookService) dispatch_events(db *sql.DB, get_events *sql.Stmt, insert_deliveries *sql.Stmt, mark_dispatched *sql.Stmt, batch_size int) (int, error) {
+
+	type event struct {
+		event_id   int64
+		event_type string
+		wallet_id  string
+	}
+
+	db_transaction, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	transaction_started_at := time.Now()
+
+	rows, err := db_transaction.Stmt(get_events).Query(max(batch_size, 1))
+	if err != nil {
+		service.rollback(db_transaction, transaction_started_at)
+		return 0, err
+	}
+	new_events := []event{}
+	for rows.Next() {
+		new_event := event{}
+		err = rows.Scan(&new_event.event_id, &new_event.event_type, &new_event.wallet_id)
+		if err != nil {
+			rows.Close()
+			service.rollback(db_transaction, transaction_started_at)
+			return 0, err
+		}
+		new_events = append(new_events, new_event)
+	}
+	rows.Close()
+	if len(new_events) == 0 {
+		service.rollback(db_transaction, transaction_started_at)
+		return 0, nil
+	}
+
+	now := time.Now().UTC()
+	tx_insert_deliveries := db_transaction.Stmt(insert_deliveries)
+	tx_mark_dispatched := db_transaction.Stmt(mark_dispatched)
+	for _, new_event := range new_events {
+		_, err = tx_insert_deliveries.Exec(new_event.event_id, now, new_event.wallet_id, new_event.event_type)
+		if err != nil {
+			service.rollback(db_transaction, transaction_started_at)
+			return 0, err
+		}
+		_, err = tx_mark_dispatched.Exec(new_event.event_id)
+		if err != nil {
+			service.rollback(db_transaction, transaction_started_at)
+			return 0, err
+		}
+	}
+
+	err = service.commit(db_transaction, transaction_started_at)
+	if err != nil {
+		return 0, err
+	}
+	service.events_dispatched.Add(float64(len(new_events)))
+	return len(new_events), nil
+}
+
+// Statements used to send deliveries
+type delivery_statements struct {
+	claim_deliveries *sql.Stmt
+	get_target       *sql.Stmt
+	insert_attempt   *sql.Stmt
+	update_delivery  *sql.Stmt
+}
+
+/*
+Sends deliveries that are due. Deliveries are claimed before they are sent by moving
+their next attempt past the request timeout, so that no other instance of the webhook
+service sends them at the same time. A delivery claimed by an instance that stops
+before recording the outcome is sent again once the claim runs out.
+*/
+func (service *WebhookService) async_deliver_webhooks(db *sql.DB, waitgroup *sync.WaitGroup) {
+	defer waitgroup.Done()
+
+	config := service.get_config()
+	events_table := config.WalletDatabase.EventsTable
+	subscriptions_table := config.WebhookTables.SubscriptionsTable
+	deliveries_table := config.WebhookTables.DeliveriesTable
+	attempts_table := config.WebhookTables.AttemptsTable
+
+	statements := delivery_statements{}
+	var err error = nil
+
+	statements.claim_deliveries, err = db.Prepare(
+		"update " + deliveries_table + " set next_attempt_at=$1 where delivery_id in (" +
+			"select delivery_id from " + deliveries_table +
+			" where status='" + responses.Delivery_status_pending + "' and next_attempt_at<=$2" +
+			" order by next_attempt_at limit $3 for update skip locked)" +
+			" returning delivery_id, webhook_id, event_id, attempts")
+	if err != nil {
+		log.Fatal("Unable to prepare SQL statement.")
+	}
+	defer statements.claim_deliveries.Close()
+
+	statements.get_target, err = db.Prepare(
+		"select s.url, s.secret, e.event_type, e.wallet_id, e.data, e.date_and_time from " + subscriptions_table + " s, " + events_table + " e" +
+			" where s.webhook_id=$1 and e.event_id=$2")
+	if err != nil {
+		log.Fatal("Unable to prepare SQL statement.")
+	}
+	defer statements.get_target.Close()
+
+	statements.insert_attempt, err = db.Prepare("insert into " + attempts_table + " (delivery_id, attempt, date_and_time, status_code, error, duration) values ($1, $2, $3, $4, $5, $6)")
+	if err != nil {
+		log.Fatal("Unable to prepare SQL statement.")
+	}
+	defer statements.insert_attempt.Close()
+
+	statements.update_delivery, err = db.Prepare("update " + deliveries_table + " set status=$2, attempts=$3, next_attempt_at=$4 where delivery_id=$1")
+	if err != nil {
+		log.Fatal("Unable to prepare SQL statement.")
+	}
+	defer statements.update_delivery.Close()
+
+	log.Println("Started up webhooks dispatcher.")
+	defer log.Println("Shutdown webhooks dispatcher.")
+
+	for service.is_alive.Load() {
+		dispatcher := service.get_config().Dispatcher
+		poll_interval := time.Duration(dispatcher.PollInterval) * time.Millisecond
+
+		number_of_deliveries, err := service.deliver_webhooks(&statements, &dispatcher_settings{
+			batch_size:       max(dispatcher.BatchSize, 1),
+			request_timeout:  time.Duration(dispatcher.RequestTimeout) * time.Second,
+			maximum_attempts: dispatcher.MaximumAttempts,
+			initial_backoff:  time.Duration(dispatcher.InitialBackoff) * time.Second,
+			maximum_backoff:  time.Duration(dispatcher.MaximumBackoff) * time.Second,
+
+			allow_private_addresses: dispatcher.AllowPrivateAddresses,
+		})
+		if err != nil {
+			log.Println("Unable to deliver webhooks: ", err.Error())
+		}
+		if err != nil || number_of_deliveries < dispatcher.BatchSize {
+			service.sleep(poll_interval)
+		}
+	}
+}
+
+type dispatcher_settings struct {
+	batch_size              int
+	request_timeout         time.Duration
+	maximum_attempts        int
+	initial_backoff         time.Duration
+	maximum_backoff         time.Duration
+	allow_private_addresses bool
+}
+
+// Sends the deliveries that are due at the same time. Returns the number of deliveries sent.
+func (service *WebhookService) deliver_webhooks(statements *delivery_statements, settings *dispatcher_settings) (int, error) {
+
+	// Claim deliveries for longer than it takes to send them
+	now := time.Now().UTC()
+	claimed_until := now.Add(2*settings.request_timeout + time.Minute)
+	rows, err := statements.claim_deliveries.Query(claimed_until, now, settings.batch_size)
+	if err != nil {
+		return 0, err
+	}
+	type claimed_delivery struct {
+		delivery_id int64
+		webhook_id  string
+		event_id    int64
+		attempts    int
+	}
+	claimed := []claimed_delivery{}
+	for rows.Next() {
+		delivery := claimed_delivery{}
+		err = rows.Scan(&delivery.delivery_id, &delivery.webhook_id, &delivery.event_id, &delivery.attempts)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		claimed = append(claimed, delivery)
+	}
+	rows.Close()
+
+	http_client := create_http_client(settings.request_timeout, settings.allow_private_addresses)
+	defer http_client.CloseIdleConnections()
+	var waitgroup sync.WaitGroup
+	for _, claimed_delivery := range claimed {
+
+		// Find out where to send the delivery and what to send
+		delivery := webhook_delivery{
+			delivery_id: claimed_delivery.delivery_id,
+			event_id:    claimed_delivery.event_id,
+			attempts:    claimed_delivery.attempts,
+		}
+		var wallet_id string = ""
+		var data string = ""
+		var created_at time.Time
+		err = statements.get_target.QueryRow(claimed_delivery.webhook_id, claimed_delivery.event_id).Scan(
+			&delivery.url, &delivery.secret, &delivery.event_type, &wallet_id, &data, &created_at)
+		if errors.Is(err, sql.ErrNoRows) {
+			// The webhook was deleted after the delivery was claimed
+			statements.update_delivery.Exec(delivery.delivery_id, responses.Delivery_status_cancelled, delivery.attempts, now)
+			service.delivery_attempts.Inc(delivery_outcome_cancelled)
+			continue
+		}
+		if err != nil {
+			log.Println("Unable to find webhook of delivery ", delivery.delivery_id, ": ", err.Error())
+			continue
+		}
+		delivery.body, err = create_event_body(delivery.event_id, delivery.event_type, wallet_id, data, created_at)
+		if err != nil {
+			log.Println("Unable to build body of delivery ", delivery.delivery_id, ": ", err.Error())
+			continue
+		}
+
+		// A slow URL must not hold up the deliveries to other URLs
+		waitgroup.Add(1)
+		go func() {
+			defer waitgroup.Done()
+			service.attempt_delivery(http_client, statements, settings, &delivery)
+		}()
+	}
+	waitgroup.Wait()
+	return len(claimed), nil
+}
+
+// Sends a delivery once and records the outcome of the attempt
+func (service *WebhookService) attempt_delivery(http_client *http.Client, statements *delivery_statements, settings *dispatcher_settings, delivery *webhook_delivery) {
+	attempted_at := time.Now().UTC()
+	status_code, err := deliver(http_client, delivery, attempted_at)
+	duration := time.Since(attempted_at)
+	service.delivery_duration.Observe(duration.Seconds())
+
+	attempt := delivery.attempts + 1
+	error_message := ""
+	if err != nil {
+		error_message = err.Error()
+		if len(error_message) > maximum_length_of_errors {
+			error_message = error_message[:maximum_length_of_errors]
+		}
+	}
+	_, db_err := statements.insert_attempt.Exec(delivery.delivery_id, attempt, attempted_at, status_code, error_message, duration.Milliseconds())
+	if db_err != nil {
+		log.Println("Unable to record attempt of delivery ", delivery.delivery_id, ": ", db_err.Error())
+	}
+
+	status := responses.Delivery_status_delivered
+	outcome := delivery_outcome_delivered
+	next_attempt_at := attempted_at
+	if err != nil {
+		if attempt >= settings.maximum_attempts {
+			status = responses.Delivery_status_failed
+			outcome = delivery_outcome_failed
+		} else {
+			status = responses.Delivery_status_pending
+			outcome = delivery_outcome_retry
+			next_attempt_at = attempted_at.Add(get_backoff(attempt, settings.initial_backoff, settings.maximum_backoff))
+		}
+	}
+	service.delivery_attempts.Inc(outcome)
+
+	_, db_err = statements.update_delivery.Exec(delivery.delivery_id, status, attempt, next_attempt_at)
+	if db_err != nil {
+		log.Println("Unable to record outcome of delivery ", delivery.delivery_id, ": ", db_err.Error())
+	}
+}
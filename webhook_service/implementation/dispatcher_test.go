@@ -0,0 +1,217 @@
+package implementation
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"shared/webhooks"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_Backoff(t *testing.T) {
+	initial_backoff := 5 * time.Second
+	maximum_backoff := time.Minute
+
+	expected := []time.Duration{
+		5 * time.Second,
+		10 * time.Second,
+		20 * time.Second,
+		40 * time.Second,
+		time.Minute,
+		time.Minute,
+	}
+	for i, expected_backoff := range expected {
+		backoff := get_backoff(i+1, initial_backoff, maximum_backoff)
+		if backoff != expected_backoff {
+			t.Error("Expected: ", expected_backoff, ", Got: ", backoff)
+		}
+	}
+
+	// Must not overflow after many attempts
+	backoff := get_backoff(1000, initial_backoff, maximum_backoff)
+	if backoff != maximum_backoff {
+		t.Error("Expected: ", maximum_backoff, ", Got: ", backoff)
+	}
+}
+
+func Test_Deliver(t *testing.T) {
+
+	secret := "whsec_dispatcher_unit_test"
+	body := []byte(`{"id":"7","type":"deposit.completed"}`)
+	now := time.Unix(1760000000, 0)
+
+	received_headers := http.Header{}
+	received_body := []byte{}
+	status_code := http.StatusNoContent
+	sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received_headers = r.Header.Clone()
+		received_body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(status_code)
+	}))
+	defer sink.Close()
+
+	delivery := webhook_delivery{
+		delivery_id: 3,
+		event_id:    7,
+		url:         sink.URL,
+		secret:      secret,
+		event_type:  "deposit.completed",
+		body:        body,
+	}
+	// The sink listens on a loopback address
+	http_client := create_http_client(time.Second, true)
+
+	// Successful delivery
+	{
+		result, err := deliver(http_client, &delivery, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != http.StatusNoContent {
+			t.Error("Expected: ", http.StatusNoContent, ", Got: ", result)
+		}
+		if !reflect.DeepEqual(received_body, body) {
+			t.Error("Expected: ", string(body), ", Got: ", string(received_body))
+		}
+		expected_headers := map[string]string{
+			webhooks.Header_event_id:    "7",
+			webhooks.Header_delivery_id: "3",
+			webhooks.Header_event_type:  "deposit.completed",
+			webhooks.Header_timestamp:   "1760000000",
+			"Content-Type":              "application/json",
+		}
+		for name, expected_value := range expected_headers {
+			if received_headers.Get(name) != expected_value {
+				t.Error("Expected: ", expected_value, ", Got: ", received_headers.Get(name))
+			}
+		}
+
+		// The receiver must be able to check the signature with the secret
+		err = webhooks.Verify(secret, received_headers.Get(webhooks.Header_timestamp), received_body, received_headers.Get(webhooks.Header_signature), webhooks.Default_tolerance, now)
+		if err != nil {
+			t.Error("Expected: ", nil, ", Got: ", err)
+		}
+		err = webhooks.Verify("whsec_wrong", received_headers.Get(webhooks.Header_timestamp), received_body, received_headers.Get(webhooks.Header_signature), webhooks.Default_tolerance, now)
+		if err != webhooks.ErrInvalidSignature {
+			t.Error("Expected: ", webhooks.ErrInvalidSignature, ", Got: ", err)
+		}
+	}
+
+	// Failed delivery
+	{
+		status_code = http.StatusInternalServerError
+		result, err := deliver(http_client, &delivery, now)
+		if err == nil {
+			t.Error("Expected an error for HTTP status ", status_code)
+		}
+		if result != http.StatusInternalServerError {
+			t.Error("Expected: ", http.StatusInternalServerError, ", Got: ", result)
+		}
+	}
+
+	// Redirects are not followed
+	{
+		status_code = http.StatusFound
+		result, err := deliver(http_client, &delivery, now)
+		if err == nil {
+			t.Error("Expected an error for HTTP status ", status_code)
+		}
+		if result != http.StatusFound {
+			t.Error("Expected: ", http.StatusFound, ", Got: ", result)
+		}
+	}
+
+	// Webhooks are not sent to private addresses unless they are allowed
+	{
+		status_code = http.StatusNoContent
+		received_body = []byte{}
+		result, err := deliver(create_http_client(time.Second, false), &delivery, now)
+		if err == nil || !strings.Contains(err.Error(), "not public") {
+			t.Error("Expected: ", "address is not public", ", Got: ", err)
+		}
+		if result != 0 || len(received_body) > 0 {
+			t.Error("Expected: ", 0, ", Got: ", result, " ", string(received_body))
+		}
+	}
+
+	// No response
+	{
+		sink.Close()
+		result, err := deliver(http_client, &delivery, now)
+		if err == nil {
+			t.Error("Expected an error when the URL does not respond")
+		}
+		if result != 0 {
+			t.Error("Expected: ", 0, ", Got: ", result)
+		}
+	}
+}
+
+func Test_EventTypes(t *testing.T) {
+
+	event_types, error_message := get_event_types([]string{"transfer.sent", "deposit.completed", "transfer.sent"})
+	expected := []string{"transfer.sent", "deposit.completed"}
+	if error_message != "" || !reflect.DeepEqual(event_types, expected) {
+		t.Error("Expected: ", expected, ", Got: ", event_types, error_message)
+	}
+	if !reflect.DeepEqual(split_event_types(join_event_types(expected)), expected) {
+		t.Error("Expected: ", expected, ", Got: ", split_event_types(join_event_types(expected)))
+	}
+
+	_, error_message = get_event_types([]string{"deposit.completed", "deposit.created"})
+	if error_message != "Unknown event type deposit.created" {
+		t.Error("Expected: ", "Unknown event type deposit.created", ", Got: ", error_message)
+	}
+	_, error_message = get_event_types(nil)
+	if error_message != "Missing event types" {
+		t.Error("Expected: ", "Missing event types", ", Got: ", error_message)
+	}
+
+	urls := map[string]bool{
+		"https://example.com/hooks": true,
+		"http://localhost:8080":     true,
+		"ftp://example.com":         false,
+		"/hooks":                    false,
+		"https://":                  false,
+		"not a url":                 false,
+	}
+	for raw_url, expected_result := range urls {
+		if is_valid_url(raw_url) != expected_result {
+			t.Error("Expected: ", expected_result, ", Got: ", !expected_result, " for ", raw_url)
+		}
+	}
+
+	// Webhooks must not reach the services of the wallet
+	addresses := map[string]bool{
+		"93.184.215.14":   true,
+		"2606:4700::1111": true,
+		"127.0.0.1":       false,
+		"::1":             false,
+		"10.0.0.5":        false,
+		"172.16.3.4":      false,
+		"192.168.1.1":     false,
+		"169.254.169.254": false,
+		"fe80::1":         false,
+		"fd00::1":         false,
+		"0.0.0.0":         false,
+		"224.0.0.1":       false,
+	}
+	for address, expected_result := range addresses {
+		if is_public_address(net.ParseIP(address)) != expected_result {
+			t.Error("Expected: ", expected_result, ", Got: ", !expected_result, " for ", address)
+		}
+	}
+	private_urls := []string{"http://localhost:8080", "http://127.0.0.1/hooks", "http://[::1]/hooks", "http://169.254.169.254/latest/meta-data"}
+	for _, raw_url := range private_urls {
+		if resolves_to_public_addresses(raw_url, time.Second) {
+			t.Error("Expected: ", false, ", Got: ", true, " for ", raw_url)
+		}
+	}
+	if !resolves_to_public_addresses("https://93.184.215.14/hooks", time.Second) {
+		t.Error("Expected: ", true, ", Got: ", false, " for ", "https://93.184.215.14/hooks")
+	}
+}
@@ -0,0 +1,536 @@
+package implementation
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/url"
+	"shared/events"
+	"shared/logging"
+	"shared/messages"
+	"shared/responses"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	webhook_id_prefix string = "wh_"
+	secret_prefix     string = "whsec_"
+
+	// Newest deliveries returned when listing the deliveries of a webhook
+	maximum_deliveries_listed int = 100
+)
+
+// Statements used to answer requests from the API gateway
+type subscription_statements struct {
+	insert_webhook    *sql.Stmt
+	get_webhooks      *sql.Stmt
+	get_webhook       *sql.Stmt
+	delete_webhook    *sql.Stmt
+	cancel_deliveries *sql.Stmt
+	get_deliveries    *sql.Stmt
+	redeliver         *sql.Stmt
+}
+
+func (service *WebhookService) prepare_subscription_statements(db *sql.DB) *subscription_statements {
+	config := service.get_config()
+	subscriptions_table := config.WebhookTables.SubscriptionsTable
+	deliveries_table := config.WebhookTables.DeliveriesTable
+	attempts_table := config.WebhookTables.AttemptsTable
+	events_table := config.WalletDatabase.EventsTable
+
+	statements := &subscription_statements{}
+	var err error = nil
+
+	statements.insert_webhook, err = db.Prepare("insert into " + subscriptions_table + " (webhook_id, owner, url, wallet_id, event_types, secret, date_and_time) values ($1, $2, $3, $4, $5, $6, $7)")
+	if err != nil {
+		log.Fatal("Unable to prepare SQL statement.")
+	}
+
+	statements.get_webhooks, err = db.Prepare("select webhook_id, url, wallet_id, event_types, date_and_time from " + subscriptions_table + " where owner=$1 order by date_and_time, webhook_id")
+	if err != nil {
+		log.Fatal("Unable to prepare SQL statement.")
+	}
+
+	statements.get_webhook, err = db.Prepare("select webhook_id from " + subscriptions_table + " where webhook_id=$1 and owner=$2")
+	if err != nil {
+		log.Fatal("Unable to prepare SQL statement.")
+	}
+
+	statements.delete_webhook, err = db.Prepare("delete from " + subscriptions_table + " where webhook_id=$1 and owner=$2")
+	if err != nil {
+		log.Fatal("Unable to prepare SQL statement.")
+	}
+
+	statements.cancel_deliveries, err = db.Prepare("update " + deliveries_table + " set status='" + responses.Delivery_status_cancelled + "' where webhook_id=$1 and status='" + responses.Delivery_status_pending + "'")
+	if err != nil {
+		log.Fatal("Unable to prepare SQL statement.")
+	}
+
+	// Newest deliveries first, each with its attempts in order
+	statements.get_deliveries, err = db.Prepare(
+		"select d.delivery_id, d.event_id, e.event_type, d.status, d.next_attempt_at, d.redelivery_of, d.date_and_time," +
+			" a.attempt, a.date_and_time, a.status_code, a.error, a.duration" +
+			" from (select * from " + deliveries_table + " where webhook_id=$1 order by delivery_id desc limit $2) d" +
+			" join " + events_table + " e on e.event_id=d.event_id" +
+			" left join " + attempts_table + " a on a.delivery_id=d.delivery_id" +
+			" order by d.delivery_id desc, a.attempt")
+	if err != nil {
+		log.Fatal("Unable to prepare SQL statement.")
+	}
+
+	// A redelivery is a new delivery of the same event. The log of the original
+	// delivery is kept as it is.
+	statements.redeliver, err = db.Prepare(
+		"with new_delivery as (" +
+			"insert into " + deliveries_table + " (webhook_id, event_id, status, attempts, next_attempt_at, redelivery_of, date_and_time)" +
+			" select webhook_id, event_id, '" + responses.Delivery_status_pending + "', 0, $3, delivery_id, $3 from " + deliveries_table +
+			" where delivery_id=$1 and webhook_id=$2" +
+			" returning delivery_id, event_id)" +
+			" select n.delivery_id, n.event_id, e.event_type from new_delivery n join " + events_table + " e on e.event_id=n.event_id")
+	if err != nil {
+		log.Fatal("Unable to prepare SQL statement.")
+	}
+
+	return statements
+}
+
+func (statements *subscription_statements) close() {
+	statements.insert_webhook.Close()
+	statements.get_webhooks.Close()
+	statements.get_webhook.Close()
+	statements.delete_webhook.Close()
+	statements.cancel_deliveries.Close()
+	statements.get_deliveries.Close()
+	statements.redeliver.Close()
+}
+
+// Returns the prefix followed by random bytes in hex
+func generate_token(prefix string, number_of_bytes int) (string, error) {
+	bytes := make([]byte, number_of_bytes)
+	_, err := rand.Read(bytes)
+	if err != nil {
+		return "", err
+	}
+	return prefix + hex.EncodeToString(bytes), nil
+}
+
+// Webhooks are only sent to absolute HTTP or HTTPS URLs
+func is_valid_url(raw_url string) bool {
+	parsed_url, err := url.Parse(raw_url)
+	if err != nil {
+		return false
+	}
+	if parsed_url.Scheme != "http" && parsed_url.Scheme != "https" {
+		return false
+	}
+	return len(parsed_url.Host) > 0
+}
+
+// Returns the event types without duplicates, in the order given. Returns an error
+// message if no event type or an unknown event type was given.
+func get_event_types(event_types []string) ([]string, string) {
+	if len(event_types) == 0 {
+		return nil, "Missing event types"
+	}
+	result := make([]string, 0, len(event_types))
+	for _, event_type := range event_types {
+		if !events.IsValidEventType(event_type) {
+			return nil, "Unknown event type " + event_type
+		}
+		is_duplicate := false
+		for _, existing := range result {
+			if existing == event_type {
+				is_duplicate = true
+				break
+			}
+		}
+		if !is_duplicate {
+			result = append(result, event_type)
+		}
+	}
+	return result, ""
+}
+
+// Event types are stored as a comma separated list
+func join_event_types(event_types []string) string {
+	return strings.Join(event_types, ",")
+}
+
+func split_event_types(event_types string) []string {
+	if len(event_types) == 0 {
+		return nil
+	}
+	return strings.Split(event_types, ",")
+}
+
+func create_webhooks_response(header *messages.Header) responses.Webhooks {
+	return responses.Webhooks{
+		Header: responses.Header{
+			MessageID: header.MessageID,
+			Action:    header.Action,
+		},
+		Status: responses.Status_failed,
+	}
+}
+
+func create_deliveries_response(header *messages.Header) responses.WebhookDeliveries {
+	return responses.WebhookDeliveries{
+		Header: responses.Header{
+			MessageID: header.MessageID,
+			Action:    header.Action,
+		},
+		Status: responses.Status_failed,
+	}
+}
+
+// The secret is returned only once. Callers need it to check the signature of the
+// webhooks they receive.
+func (service *WebhookService) process_create_webhook(bytes []byte, statements *subscription_statements, request_log *logging.Request) error {
+
+	request_message := messages.POST_Webhook{}
+	err := json.Unmarshal(bytes, &request_message)
+	if err != nil {
+		request_log.Logger().Error("Failed to deserialise JSON message. Should not happen in production.", logging.Key_error, err.Error())
+		service.metrics.CountMessage(false, responses.Error_code_invalid_request)
+		return nil
+	}
+	response_message := create_webhooks_response(&request_message.Header)
+
+	// Verify that request message is valid
+	if len(request_message.Owner) == 0 {
+		response_message.ErrorCode = responses.Error_code_invalid_request
+		response_message.ErrorMessage = "Missing owner"
+		return service.send_webhooks_response(&response_message, &request_message.Header, request_log)
+	}
+	if !is_valid_url(request_message.URL) {
+		response_message.ErrorCode = responses.Error_code_invalid_request
+		response_message.ErrorMessage = "URL must be an absolute http or https URL"
+		return service.send_webhooks_response(&response_message, &request_message.Header, request_log)
+	}
+	dispatcher := service.get_config().Dispatcher
+	if !dispatcher.AllowPrivateAddresses && !resolves_to_public_addresses(request_message.URL, time.Duration(dispatcher.RequestTimeout)*time.Second) {
+		response_message.ErrorCode = responses.Error_code_invalid_request
+		response_message.ErrorMessage = "URL must resolve to public addresses only"
+		return service.send_webhooks_response(&response_message, &request_message.Header, request_log)
+	}
+	event_types, error_message := get_event_types(request_message.EventTypes)
+	if len(error_message) > 0 {
+		response_message.ErrorCode = responses.Error_code_invalid_request
+		response_message.ErrorMessage = error_message
+		return service.send_webhooks_response(&response_message, &request_message.Header, request_log)
+	}
+
+	webhook_id, err := generate_token(webhook_id_prefix, 12)
+	if err != nil {
+		response_message.ErrorCode = responses.Error_code_internal_error
+		response_message.ErrorMessage = "Unable to generate webhook ID"
+		return service.send_webhooks_response(&response_message, &request_message.Header, request_log)
+	}
+	secret, err := generate_token(secret_prefix, 32)
+	if err != nil {
+		response_message.ErrorCode = responses.Error_code_internal_error
+		response_message.ErrorMessage = "Unable to generate secret"
+		return service.send_webhooks_response(&response_message, &request_message.Header, request_log)
+	}
+
+	created_at := time.Now().UTC()
+	_, err = statements.insert_webhook.Exec(
+		webhook_id,
+		request_message.Owner,
+		request_message.URL,
+		request_message.WalletID,
+		join_event_types(event_types),
+		secret,
+		created_at)
+	if err != nil {
+		response_message.ErrorCode = responses.Error_code_database_error
+		response_message.ErrorMessage = "Database error"
+		return service.send_webhooks_response(&response_message, &request_message.Header, request_log)
+	}
+
+	response_message.Status = responses.Status_successful
+	response_message.Webhooks = []responses.Webhook{
+		{
+			WebhookID:  webhook_id,
+			URL:        request_message.URL,
+			WalletID:   request_message.WalletID,
+			EventTypes: event_types,
+			Secret:     secret,
+			CreatedAt:  created_at.Format(time.RFC3339),
+		},
+	}
+	return service.send_webhooks_response(&response_message, &request_message.Header, request_log)
+}
+
+func (service *WebhookService) process_get_webhooks(bytes []byte, statements *subscription_statements, request_log *logging.Request) error {
+
+	request_message := messages.GET_Webhooks{}
+	err := json.Unmarshal(bytes, &request_message)
+	if err != nil {
+		request_log.Logger().Error("Failed to deserialise JSON message. Should not happen in production.", logging.Key_error, err.Error())
+		service.metrics.CountMessage(false, responses.Error_code_invalid_request)
+		return nil
+	}
+	response_message := create_webhooks_response(&request_message.Header)
+
+	rows, err := statements.get_webhooks.Query(request_message.Owner)
+	if err != nil {
+		response_message.ErrorCode = responses.Error_code_database_error
+		response_message.ErrorMessage = "Database error"
+		return service.send_webhooks_response(&response_message, &request_message.Header, request_log)
+	}
+	defer rows.Close()
+
+	webhooks := []responses.Webhook{}
+	for rows.Next() {
+		webhook := responses.Webhook{}
+		var event_types string = ""
+		var created_at time.Time
+		err = rows.Scan(&webhook.WebhookID, &webhook.URL, &webhook.WalletID, &event_types, &created_at)
+		if err != nil {
+			response_message.ErrorCode = responses.Error_code_database_error
+			response_message.ErrorMessage = "Database error"
+			return service.send_webhooks_response(&response_message, &request_message.Header, request_log)
+		}
+		webhook.EventTypes = split_event_types(event_types)
+		webhook.CreatedAt = created_at.UTC().Format(time.RFC3339)
+		webhooks = append(webhooks, webhook)
+	}
+
+	response_message.Status = responses.Status_successful
+	response_message.Webhooks = webhooks
+	return service.send_webhooks_response(&response_message, &request_message.Header, request_log)
+}
+
+// Deliveries still waiting to be sent are cancelled together with the webhook
+func (service *WebhookService) process_delete_webhook(bytes []byte, db *sql.DB, statements *subscription_statements, request_log *logging.Request) error {
+
+	request_message := messages.DELETE_Webhook{}
+	err := json.Unmarshal(bytes, &request_message)
+	if err != nil {
+		request_log.Logger().Error("Failed to deserialise JSON message. Should not happen in production.", logging.Key_error, err.Error())
+		service.metrics.CountMessage(false, responses.Error_code_invalid_request)
+		return nil
+	}
+	response_message := create_webhooks_response(&request_message.Header)
+
+	db_transaction, err := db.Begin()
+	if err != nil {
+		response_message.ErrorCode = responses.Error_code_database_error
+		response_message.ErrorMessage = "Database error"
+		return service.send_webhooks_response(&response_message, &request_message.Header, request_log)
+	}
+	transaction_started_at := time.Now()
+
+	result, err := db_transaction.Stmt(statements.delete_webhook).Exec(request_message.WebhookID, request_message.Owner)
+	if err != nil {
+		service.rollback(db_transaction, transaction_started_at)
+		response_message.ErrorCode = responses.Error_code_database_error
+		response_message.ErrorMessage = "Database error"
+		return service.send_webhooks_response(&response_message, &request_message.Header, request_log)
+	}
+	rows_affected, err := result.RowsAffected()
+	if err != nil || rows_affected == 0 {
+		service.rollback(db_transaction, transaction_started_at)
+		response_message.ErrorCode = responses.Error_code_webhook_not_found
+		response_message.ErrorMessage = "Webhook does not exist"
+		return service.send_webhooks_response(&response_message, &request_message.Header, request_log)
+	}
+
+	_, err = db_transaction.Stmt(statements.cancel_deliveries).Exec(request_message.WebhookID)
+	if err != nil {
+		service.rollback(db_transaction, transaction_started_at)
+		response_message.ErrorCode = responses.Error_code_database_error
+		response_message.ErrorMessage = "Database error"
+		return service.send_webhooks_response(&response_message, &request_message.Header, request_log)
+	}
+
+	err = service.commit(db_transaction, transaction_started_at)
+	if err != nil {
+		response_message.ErrorCode = responses.Error_code_database_error
+		response_message.ErrorMessage = "Database error"
+		return service.send_webhooks_response(&response_message, &request_message.Header, request_log)
+	}
+
+	response_message.Status = responses.Status_successful
+	return service.send_webhooks_response(&response_message, &request_message.Header, request_log)
+}
+
+// Returns the error code to report if the webhook is not owned by the caller
+func (service *WebhookService) check_owner(statements *subscription_statements, webhook_id string, owner string) string {
+	var found string = ""
+	err := statements.get_webhook.QueryRow(webhook_id, owner).Scan(&found)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return responses.Error_code_webhook_not_found
+		}
+		return responses.Error_code_database_error
+	}
+	return ""
+}
+
+func format_time(value sql.NullTime) string {
+	if !value.Valid {
+		return ""
+	}
+	return value.Time.UTC().Format(time.RFC3339)
+}
+
+func format_id(id int64) string {
+	if id == 0 {
+		return ""
+	}
+	return strconv.FormatInt(id, 10)
+}
+
+// The delivery log of a webhook. Lists the newest deliveries with every attempt made.
+func (service *WebhookService) process_get_webhook_deliveries(bytes []byte, statements *subscription_statements, request_log *logging.Request) error {
+
+	request_message := messages.GET_WebhookDeliveries{}
+	err := json.Unmarshal(bytes, &request_message)
+	if err != nil {
+		request_log.Logger().Error("Failed to deserialise JSON message. Should not happen in production.", logging.Key_error, err.Error())
+		service.metrics.CountMessage(false, responses.Error_code_invalid_request)
+		return nil
+	}
+	response_message := create_deliveries_response(&request_message.Header)
+
+	error_code := service.check_owner(statements, request_message.WebhookID, request_message.Owner)
+	if len(error_code) > 0 {
+		response_message.ErrorCode = error_code
+		response_message.ErrorMessage = "Webhook does not exist"
+		if error_code == responses.Error_code_database_error {
+			response_message.ErrorMessage = "Database error"
+		}
+		return service.send_deliveries_response(&response_message, &request_message.Header, request_log)
+	}
+
+	rows, err := statements.get_deliveries.Query(request_message.WebhookID, maximum_deliveries_listed)
+	if err != nil {
+		response_message.ErrorCode = responses.Error_code_database_error
+		response_message.ErrorMessage = "Database error"
+		return service.send_deliveries_response(&response_message, &request_message.Header, request_log)
+	}
+	defer rows.Close()
+
+	deliveries := []responses.WebhookDelivery{}
+	for rows.Next() {
+		var delivery_id int64 = 0
+		var event_id int64 = 0
+		var event_type string = ""
+		var status string = ""
+		var next_attempt_at sql.NullTime
+		var redelivery_of int64 = 0
+		var created_at time.Time
+		var attempt sql.NullInt64
+		var attempted_at sql.NullTime
+		var status_code sql.NullInt64
+		var attempt_error sql.NullString
+		var duration sql.NullInt64
+		err = rows.Scan(
+			&delivery_id, &event_id, &event_type, &status, &next_attempt_at, &redelivery_of, &created_at,
+			&attempt, &attempted_at, &status_code, &attempt_error, &duration)
+		if err != nil {
+			response_message.ErrorCode = responses.Error_code_database_error
+			response_message.ErrorMessage = "Database error"
+			return service.send_deliveries_response(&response_message, &request_message.Header, request_log)
+		}
+
+		// Rows of the same delivery come one after another
+		id := format_id(delivery_id)
+		if len(deliveries) == 0 || deliveries[len(deliveries)-1].DeliveryID != id {
+			delivery := responses.WebhookDelivery{
+				DeliveryID:   id,
+				EventID:      format_id(event_id),
+				EventType:    event_type,
+				Status:       status,
+				RedeliveryOf: format_id(redelivery_of),
+				CreatedAt:    created_at.UTC().Format(time.RFC3339),
+			}
+			if status == responses.Delivery_status_pending {
+				delivery.NextAttemptAt = format_time(next_attempt_at)
+			}
+			deliveries = append(deliveries, delivery)
+		}
+		if attempt.Valid {
+			delivery := &deliveries[len(deliveries)-1]
+			delivery.Attempts = append(delivery.Attempts, responses.WebhookDeliveryAttempt{
+				Attempt:     int(attempt.Int64),
+				DateAndTime: format_time(attempted_at),
+				StatusCode:  int(status_code.Int64),
+				Error:       attempt_error.String,
+				Duration:    duration.Int64,
+			})
+		}
+	}
+
+	response_message.Status = responses.Status_successful
+	response_message.Deliveries = deliveries
+	return service.send_deliveries_response(&response_message, &request_message.Header, request_log)
+}
+
+// Sends the event of a delivery again as a new delivery, whatever happened to the
+// original delivery
+func (service *WebhookService) process_redeliver_webhook(bytes []byte, statements *subscription_statements, request_log *logging.Request) error {
+
+	request_message := messages.POST_WebhookRedelivery{}
+	err := json.Unmarshal(bytes, &request_message)
+	if err != nil {
+		request_log.Logger().Error("Failed to deserialise JSON message. Should not happen in production.", logging.Key_error, err.Error())
+		service.metrics.CountMessage(false, responses.Error_code_invalid_request)
+		return nil
+	}
+	response_message := create_deliveries_response(&request_message.Header)
+
+	error_code := service.check_owner(statements, request_message.WebhookID, request_message.Owner)
+	if len(error_code) > 0 {
+		response_message.ErrorCode = error_code
+		response_message.ErrorMessage = "Webhook does not exist"
+		if error_code == responses.Error_code_database_error {
+			response_message.ErrorMessage = "Database error"
+		}
+		return service.send_deliveries_response(&response_message, &request_message.Header, request_log)
+	}
+
+	delivery_id, err := strconv.ParseInt(request_message.DeliveryID, 10, 64)
+	if err != nil {
+		response_message.ErrorCode = responses.Error_code_delivery_not_found
+		response_message.ErrorMessage = "Delivery does not exist"
+		return service.send_deliveries_response(&response_message, &request_message.Header, request_log)
+	}
+
+	created_at := time.Now().UTC()
+	var new_delivery_id int64 = 0
+	var event_id int64 = 0
+	var event_type string = ""
+	err = statements.redeliver.QueryRow(delivery_id, request_message.WebhookID, created_at).Scan(&new_delivery_id, &event_id, &event_type)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			response_message.ErrorCode = responses.Error_code_delivery_not_found
+			response_message.ErrorMessage = "Delivery does not exist"
+		} else {
+			response_message.ErrorCode = responses.Error_code_database_error
+			response_message.ErrorMessage = "Database error"
+		}
+		return service.send_deliveries_response(&response_message, &request_message.Header, request_log)
+	}
+
+	response_message.Status = responses.Status_successful
+	response_message.Deliveries = []responses.WebhookDelivery{
+		{
+			DeliveryID:    format_id(new_delivery_id),
+			EventID:       format_id(event_id),
+			EventType:     event_type,
+			Status:        responses.Delivery_status_pending,
+			NextAttemptAt: created_at.Format(time.RFC3339),
+			RedeliveryOf:  format_id(delivery_id),
+			CreatedAt:     created_at.Format(time.RFC3339),
+		},
+	}
+	return service.send_deliveries_response(&response_message, &request_message.Header, request_log)
+}
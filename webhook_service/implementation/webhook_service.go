@@ -0,0 +1,443 @@
+package implementation
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"log/slog"
+	shared_config "shared/config"
+	"shared/logging"
+	"shared/messages"
+	"shared/metrics"
+	"shared/queues"
+	"shared/responses"
+	"shared/tracing"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"webhook_service/config"
+
+	_ "github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
+)
+
+/*
+The webhook service lets callers subscribe URLs to the events of their wallets and
+sends those events to them.
+
+The deposit, withdraw and transfer services record an event in the events table in
+the same database transaction that moves the money. The webhook service turns every
+new event into a delivery for each matching webhook and sends the deliveries with an
+HMAC signature, retrying failed deliveries with exponential backoff. Every attempt is
+recorded, so that callers can see what was sent and ask for a delivery to be sent
+again.
+*/
+type WebhookService struct {
+	config             atomic.Pointer[config.Config]
+	is_alive           atomic.Bool
+	waitgroup          sync.WaitGroup
+	background_context context.Context
+	requests_queue     queues.Transport
+	responses_queue    queues.Transport
+	metrics            *metrics.ServiceMetrics
+	tracer             *tracing.Tracer
+
+	// Events turned into deliveries
+	events_dispatched *metrics.Counter
+
+	// Attempts to deliver an event by outcome
+	delivery_attempts *metrics.Counter
+
+	// Time taken by the URL of a webhook to respond
+	delivery_duration *metrics.Histogram
+
+	// Nil if metrics are not served
+	metrics_server *metrics.Server
+}
+
+func CreateWebhookService(config *config.Config) *WebhookService {
+	service := &WebhookService{
+		background_context: context.Background(),
+		metrics:            metrics.CreateServiceMetrics("webhook_service"),
+	}
+	service.config.Store(config)
+	exporter, err := tracing.CreateExporter(
+		config.Tracing.Exporter,
+		"webhook_service",
+		config.Tracing.Endpoint,
+		time.Duration(config.Tracing.Timeout)*time.Second)
+	if err != nil {
+		log.Println("Unable to export spans: ", err.Error())
+	}
+	service.tracer = tracing.CreateTracer(exporter)
+	registry := service.metrics.Registry
+	service.events_dispatched = registry.CreateCounter(
+		"webhook_service_events_dispatched_total",
+		"Events turned into deliveries.")
+	service.delivery_attempts = registry.CreateCounter(
+		"webhook_service_delivery_attempts_total",
+		"Attempts to deliver an event by outcome.",
+		"outcome")
+	service.delivery_duration = registry.CreateHistogram(
+		"webhook_service_delivery_duration_seconds",
+		"Time taken by the URL of a webhook to respond.",
+		metrics.Latency_buckets)
+	return service
+}
+
+func (service *WebhookService) get_config() *config.Config {
+	return service.config.Load()
+}
+
+// Applies a new configuration without a restart. Returns an error and keeps the old
+// settings if any setting that needs a restart was changed.
+func (service *WebhookService) Reload(next *config.Config) error {
+	current := service.get_config()
+	err := config.CheckReload(current, next)
+	if err != nil {
+		return err
+	}
+	err = logging.SetLevel(next.Logging.Level)
+	if err != nil {
+		return err
+	}
+	service.config.Store(next)
+	log.Println("Reloaded configuration. Version " + shared_config.GetVersion(current) + " was replaced by version " + shared_config.GetVersion(next) + ".")
+	return nil
+}
+
+// Requests and responses are passed on through the transport instead of the Redis
+// servers in the configuration file, e.g. in memory shared with the API gateway in
+// tests. Must be called before Run.
+func (service *WebhookService) SetTransport(transport queues.Transport) {
+	service.requests_queue = transport
+	service.responses_queue = transport
+}
+
+func (service *WebhookService) prepare_redis_clients() error {
+
+	if service.requests_queue == nil {
+		// Prepare requests queue
+		requests_queue := redis.NewClient(service.get_config().RequestsQueue.GetRedisOptions())
+
+		timeout_context, cancel := context.WithTimeout(service.background_context, time.Duration(service.get_config().RequestsQueue.Timeout)*time.Second)
+		_, err := requests_queue.Ping(timeout_context).Result()
+		if err != nil {
+			cancel()
+			return err
+		}
+		cancel()
+
+		// Requests are taken by this consumer of the group if the requests queue is a stream
+		requests_queue_config := &service.get_config().RequestsQueue
+		service.requests_queue = queues.CreateRedisTransport(
+			requests_queue,
+			requests_queue_config.Transport,
+			requests_queue_config.ConsumerGroup,
+			queues.CreateConsumerName())
+	}
+
+	if service.responses_queue == nil {
+		// Prepare responses queue
+		responses_queue := redis.NewClient(service.get_config().ResponsesQueue.GetRedisOptions())
+
+		timeout_context, cancel := context.WithTimeout(service.background_context, time.Duration(service.get_config().ResponsesQueue.Timeout)*time.Second)
+		_, err := responses_queue.Ping(timeout_context).Result()
+		if err != nil {
+			cancel()
+			return err
+		}
+		cancel()
+
+		service.responses_queue = queues.CreateRedisTransport(responses_queue, queues.Transport_list, "", "")
+	}
+
+	return nil
+}
+
+// Returns an error if the response could not be put into the responses queue. The request
+// is then not acknowledged, so that it is processed again.
+func (service *WebhookService) push_response(bytes_to_send []byte, request_header *messages.Header, request_log *logging.Request) error {
+	// Put response into the reply queue of the API gateway that sent the request
+	responses_queue_config := &service.get_config().ResponsesQueue
+	timeout := time.Duration(responses_queue_config.Timeout) * time.Second
+	queue_name := request_header.GetReplyQueueName(responses_queue_config.QueueName)
+	time_to_live := time.Duration(0)
+	if len(request_header.ReplyTo) > 0 {
+		time_to_live = shared_config.Reply_queue_time_to_live
+	}
+	timeout_context, cancel := context.WithTimeout(service.background_context, timeout)
+	push_span := service.tracer.StartPushSpan(queue_name, request_header.TraceParent)
+	err := service.responses_queue.PushResponse(timeout_context, queue_name, bytes_to_send, time_to_live)
+	push_span.EndWithError(err)
+	if err != nil {
+		cancel()
+		request_log.Logger().Error("Failed to put response into responses queue.", logging.Key_error, err.Error())
+		return err
+	}
+	cancel()
+	return nil
+}
+
+func (service *WebhookService) send_webhooks_response(response_message *responses.Webhooks, request_header *messages.Header, request_log *logging.Request) error {
+	service.metrics.CountMessage(response_message.Status == responses.Status_successful, response_message.ErrorCode)
+	request_log.Done(response_message.ErrorCode, response_message.ErrorMessage)
+
+	bytes_to_send, err := json.Marshal(response_message)
+	if err != nil {
+		request_log.Logger().Error("Failed to serialise response message. Should not happen in production.", logging.Key_error, err.Error())
+		return err
+	}
+	return service.push_response(bytes_to_send, request_header, request_log)
+}
+
+func (service *WebhookService) send_deliveries_response(response_message *responses.WebhookDeliveries, request_header *messages.Header, request_log *logging.Request) error {
+	service.metrics.CountMessage(response_message.Status == responses.Status_successful, response_message.ErrorCode)
+	request_log.Done(response_message.ErrorCode, response_message.ErrorMessage)
+
+	bytes_to_send, err := json.Marshal(response_message)
+	if err != nil {
+		request_log.Logger().Error("Failed to serialise response message. Should not happen in production.", logging.Key_error, err.Error())
+		return err
+	}
+	return service.push_response(bytes_to_send, request_header, request_log)
+}
+
+// Rolls back a database transaction and measures how long it was open
+func (service *WebhookService) rollback(db_transaction *sql.Tx, started_at time.Time) {
+	db_transaction.Rollback()
+	service.metrics.DatabaseTransactionDuration.ObserveSince(started_at, metrics.Outcome_rollback)
+}
+
+func (service *WebhookService) commit(db_transaction *sql.Tx, started_at time.Time) error {
+	err := db_transaction.Commit()
+	if err != nil {
+		service.rollback(db_transaction, started_at)
+		return err
+	}
+	service.metrics.DatabaseTransactionDuration.ObserveSince(started_at, metrics.Outcome_commit)
+	return nil
+}
+
+// Waits for the given time, or less if the service is shut down in the meantime
+func (service *WebhookService) sleep(duration time.Duration) {
+	const step time.Duration = 100 * time.Millisecond
+	for duration > 0 && service.is_alive.Load() {
+		time.Sleep(min(step, duration))
+		duration -= step
+	}
+}
+
+// Requests taken from a stream are processed again by another consumer unless they
+// are acknowledged. Failures are logged with the message ID from the log of the request,
+// if the request was read.
+func (service *WebhookService) acknowledge(message *queues.Message, request_log *logging.Request) {
+	if message == nil {
+		return
+	}
+	timeout := time.Duration(service.get_config().RequestsQueue.Timeout) * time.Second
+	timeout_context, cancel := context.WithTimeout(service.background_context, timeout)
+	defer cancel()
+	err := service.requests_queue.AckRequest(timeout_context, message)
+	if err != nil {
+		request_log.Logger().Error("Unable to acknowledge request", logging.Key_error, err.Error())
+	}
+}
+
+// Moves a request that cannot be processed to the dead-letter queue, where it can be
+// inspected and re-enqueued with the dlq command. Returns false if the request could not
+// be moved, so that it is not acknowledged.
+func (service *WebhookService) dead_letter(message *queues.Message, reason string, metrics_reason string) bool {
+	requests_queue_config := &service.get_config().RequestsQueue
+	if len(requests_queue_config.DeadLetterQueue) == 0 {
+		slog.Error("Dropped request", logging.Key_error, reason)
+		service.metrics.DeadLetters.Inc(metrics_reason)
+		return true
+	}
+	timeout := time.Duration(requests_queue_config.Timeout) * time.Second
+	timeout_context, cancel := context.WithTimeout(service.background_context, timeout)
+	defer cancel()
+	dead_letter := queues.CreateDeadLetter(queues.Kind_request, requests_queue_config.QueueName, reason, message.Data)
+	err := service.requests_queue.PushDeadLetter(timeout_context, requests_queue_config.DeadLetterQueue, dead_letter)
+	if err != nil {
+		slog.Error("Unable to move request to dead-letter queue", logging.Key_error, err.Error())
+		return false
+	}
+	slog.Warn("Moved request to dead-letter queue", logging.Key_error, reason)
+	service.metrics.DeadLetters.Inc(metrics_reason)
+	return true
+}
+
+func (service *WebhookService) async_run() {
+	defer func() {
+		service.waitgroup.Done()
+		log.Println("Shutdown webhook service.")
+	}()
+
+	log.Println("Started up webhook service.")
+
+	err := service.prepare_redis_clients()
+	if err != nil {
+		log.Fatal("Could not connect to Redis server: ", err)
+	}
+	log.Println("Created clients for Redis message queues.")
+
+	// Requests are taken by a consumer of the group if the requests queue is a stream
+	requests_queue_config := &service.get_config().RequestsQueue
+	err = queues.CheckConsumer(requests_queue_config.Transport, requests_queue_config.ConsumerGroup)
+	if err != nil {
+		log.Fatal("Unable to read requests queue: ", err)
+	}
+
+	// Open connection to PostgreSQL database
+	db, err := sql.Open("postgres", service.get_config().WalletDatabase.GetConnectionString())
+	if err != nil {
+		log.Fatal("Could not create PostgreSQL database object.", err)
+	}
+	defer db.Close()
+	err = db.Ping()
+	if err != nil {
+		log.Fatal("Could not connect to PostgreSQL database.", err)
+	}
+	log.Println("Connected to PostgreSQL database.")
+
+	// Events are sent to webhooks while requests from the API gateway are processed.
+	// The database connection is closed once all of them have stopped.
+	var dispatcher_waitgroup sync.WaitGroup
+	dispatcher_waitgroup.Add(2)
+	go service.async_dispatch_events(db, &dispatcher_waitgroup)
+	go service.async_deliver_webhooks(db, &dispatcher_waitgroup)
+	defer dispatcher_waitgroup.Wait()
+
+	statements := service.prepare_subscription_statements(db)
+	defer statements.close()
+
+	// Service continues running until terminated by user
+	var message *queues.Message = nil
+
+	// Log of the request in message, kept until the request is acknowledged
+	var request_log *logging.Request = nil
+	for service.is_alive.Load() {
+
+		// The previous request was processed and its response was put into the
+		// responses queue, so it is not processed again
+		service.acknowledge(message, request_log)
+		request_log = nil
+
+		// Get next request from requests queue
+		// Read on every request, so that a reloaded configuration is applied at once
+		requests_queue_config := &service.get_config().RequestsQueue
+		timeout := time.Duration(requests_queue_config.Timeout) * time.Second
+		claim_idle_time := time.Duration(requests_queue_config.ClaimIdleTime) * time.Second
+		queue_name := requests_queue_config.QueueName
+		timeout_context, cancel := context.WithTimeout(service.background_context, timeout)
+		popped_at := time.Now()
+		message, err = service.requests_queue.PopRequest(timeout_context, queue_name, timeout, claim_idle_time)
+		if err != nil {
+			cancel()
+			continue
+		}
+		cancel()
+		service.metrics.QueuePopDuration.ObserveSince(popped_at)
+
+		// Requests taken over again and again without being acknowledged, e.g. because
+		// processing them stops the service, are not processed any more
+		maximum_deliveries := requests_queue_config.MaximumDeliveries
+		if maximum_deliveries > 0 && message.Deliveries > maximum_deliveries {
+			reason := "Delivered " + strconv.FormatInt(message.Deliveries, 10) + " times without being acknowledged"
+			if !service.dead_letter(message, reason, metrics.Reason_too_many_deliveries) {
+				message = nil
+			}
+			continue
+		}
+
+		// Only the header is needed to find out which request was received
+		bytes := message.Data
+		request_message := struct {
+			Header messages.Header `json:"header"`
+		}{}
+		err = json.Unmarshal(bytes, &request_message)
+		if err != nil {
+			service.metrics.CountMessage(false, responses.Error_code_invalid_request)
+			if !service.dead_letter(message, "Failed to deserialise JSON message: "+err.Error(), metrics.Reason_invalid_message) {
+				message = nil
+			}
+			continue
+		}
+		request_log = logging.StartRequest(request_message.Header.MessageID, messages.GetActionName(request_message.Header.Action))
+
+		// Nobody is waiting for the response anymore, so the request is not applied
+		if request_message.Header.IsExpired() {
+			service.metrics.CountExpired()
+			request_log.Expired(request_message.Header.Deadline)
+			continue
+		}
+
+		switch request_message.Header.Action {
+		case messages.Action_create_webhook:
+			if service.process_create_webhook(bytes, statements, request_log) != nil {
+				message = nil
+			}
+		case messages.Action_get_webhooks:
+			if service.process_get_webhooks(bytes, statements, request_log) != nil {
+				message = nil
+			}
+		case messages.Action_delete_webhook:
+			if service.process_delete_webhook(bytes, db, statements, request_log) != nil {
+				message = nil
+			}
+		case messages.Action_get_webhook_deliveries:
+			if service.process_get_webhook_deliveries(bytes, statements, request_log) != nil {
+				message = nil
+			}
+		case messages.Action_redeliver_webhook:
+			if service.process_redeliver_webhook(bytes, statements, request_log) != nil {
+				message = nil
+			}
+		default:
+			response_message := responses.Webhooks{
+				Header: responses.Header{
+					MessageID: request_message.Header.MessageID,
+					Action:    request_message.Header.Action,
+				},
+				Status:       responses.Status_failed,
+				ErrorCode:    responses.Error_code_internal_error,
+				ErrorMessage: "Message received by wrong service",
+			}
+			if service.send_webhooks_response(&response_message, &request_message.Header, request_log) != nil {
+				message = nil
+			}
+		}
+	}
+
+	// The last request was processed before the service was shut down
+	service.acknowledge(message, request_log)
+}
+
+func (service *WebhookService) Run() {
+	service.is_alive.Store(true)
+
+	if len(service.get_config().MetricsServer.ListenPort) > 0 {
+		metrics_server := metrics.CreateServer(service.get_config().MetricsServer.ListenPort, service.metrics.Registry)
+		err := metrics_server.Run()
+		if err != nil {
+			log.Println("Unable to serve metrics: ", err.Error())
+		} else {
+			service.metrics_server = metrics_server
+		}
+	}
+
+	service.waitgroup.Add(1)
+	go service.async_run()
+}
+
+func (service *WebhookService) Shutdown() {
+	service.is_alive.Store(false)
+	service.waitgroup.Wait()
+	service.tracer.Shutdown()
+	if service.metrics_server != nil {
+		service.metrics_server.Shutdown()
+	}
+}
@@ -0,0 +1,403 @@
+package implementation
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"shared/events"
+	"shared/messages"
+	"shared/responses"
+	"shared/webhooks"
+	"sync"
+	"testing"
+	"time"
+	"webhook_service/config"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func Test_WebhookService(t *testing.T) {
+
+	message_id := int64(481516)
+	owner := "webhook_service_unit_test"
+	wallet_id := "webhook_service_unit_test_wallet"
+	other_wallet_id := "webhook_service_unit_test_other_wallet"
+
+	// Load default configuration file
+	config_file_path := "../config.yml"
+	config, err := config.Load(config_file_path)
+	if err != nil {
+		t.Fatal("Unable to load configuration file at ", config_file_path)
+	}
+
+	// Modify the table and message queue names
+	config.RequestsQueue.QueueName = "webhook_requests_queue_test"
+	config.ResponsesQueue.QueueName = "webhook_responses_queue_test"
+	config.WalletDatabase.EventsTable = "postgres.test_webhook_service.events"
+	config.WebhookTables.SubscriptionsTable = "postgres.test_webhook_service.webhook_subscriptions"
+	config.WebhookTables.DeliveriesTable = "postgres.test_webhook_service.webhook_deliveries"
+	config.WebhookTables.AttemptsTable = "postgres.test_webhook_service.webhook_attempts"
+
+	// Retry quickly, so that the test does not take long
+	config.Dispatcher.PollInterval = 50
+	config.Dispatcher.RequestTimeout = 2
+	config.Dispatcher.MaximumAttempts = 2
+	config.Dispatcher.InitialBackoff = 1
+	config.Dispatcher.MaximumBackoff = 1
+
+	// The sink listens on a loopback address
+	config.Dispatcher.AllowPrivateAddresses = true
+
+	// Local HTTP sink that receives the webhooks. Fails the first delivery of every
+	// event, so that retries are tested.
+	type received_webhook struct {
+		header http.Header
+		body   []byte
+	}
+	var mutex sync.Mutex
+	received := []received_webhook{}
+	failed_events := map[string]bool{}
+	sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mutex.Lock()
+		defer mutex.Unlock()
+		received = append(received, received_webhook{header: r.Header.Clone(), body: body})
+		event_id := r.Header.Get(webhooks.Header_event_id)
+		if !failed_events[event_id] {
+			failed_events[event_id] = true
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer sink.Close()
+
+	// Start running webhook service
+	service := CreateWebhookService(config)
+	service.Run()
+	defer service.Shutdown()
+
+	// Prepare requests queue
+	background_context := context.Background()
+	requests_queue := redis.NewClient(config.RequestsQueue.GetRedisOptions())
+	timeout_context, cancel := context.WithTimeout(background_context, time.Duration(config.RequestsQueue.Timeout)*time.Second)
+	_, err = requests_queue.Ping(timeout_context).Result()
+	if err != nil {
+		cancel()
+		t.Fatal("Could not connect to requests queue.", err)
+	}
+	cancel()
+
+	// Prepare responses queue
+	responses_queue := redis.NewClient(config.ResponsesQueue.GetRedisOptions())
+	timeout_context, cancel = context.WithTimeout(background_context, time.Duration(config.ResponsesQueue.Timeout)*time.Second)
+	_, err = responses_queue.Ping(timeout_context).Result()
+	if err != nil {
+		cancel()
+		t.Fatal("Could not connect to responses queue.", err)
+	}
+	cancel()
+
+	// Prepare connection to PostgreSQL database
+	db, err := sql.Open("postgres", config.WalletDatabase.GetConnectionString())
+	if err != nil {
+		t.Fatal("Could not create PostgreSQL database object.", err)
+	}
+	defer db.Close()
+	err = db.Ping()
+	if err != nil {
+		t.Fatal("Could not connect to PostgreSQL database.", err)
+	}
+
+	// Ensure tables are empty when this unit test is finished
+	defer func() {
+		tables := []string{
+			config.WalletDatabase.EventsTable,
+			config.WebhookTables.SubscriptionsTable,
+			config.WebhookTables.DeliveriesTable,
+			config.WebhookTables.AttemptsTable,
+		}
+		for _, table := range tables {
+			_, err = db.Exec("delete from " + table)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	}()
+
+	// Puts a request into the requests queue and returns the response
+	send_request := func(request_message any) []byte {
+		bytes_to_send, err := json.Marshal(request_message)
+		if err != nil {
+			t.Fatal("Could not serialise message.", err)
+		}
+		timeout := time.Duration(config.RequestsQueue.Timeout) * time.Second
+		timeout_context, cancel := context.WithTimeout(background_context, timeout)
+		_, err = requests_queue.LPush(timeout_context, config.RequestsQueue.QueueName, bytes_to_send).Result()
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		timeout = time.Duration(config.ResponsesQueue.Timeout) * time.Second
+		timeout_context, cancel = context.WithTimeout(background_context, timeout)
+		string_slice, err := responses_queue.BRPop(timeout_context, timeout, config.ResponsesQueue.QueueName).Result()
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// string_slice[0] gives the name of the queue
+		// string_slice[1] gives the data retrieved from the queue
+		return []byte(string_slice[1])
+	}
+
+	// Invalid event type
+	{
+		request_message := messages.POST_Webhook{
+			Header: messages.Header{
+				MessageID: message_id,
+				Action:    messages.Action_create_webhook,
+			},
+			Owner:      owner,
+			URL:        sink.URL,
+			WalletID:   wallet_id,
+			EventTypes: []string{"deposit.created"},
+		}
+		response_message := responses.Webhooks{}
+		err = json.Unmarshal(send_request(&request_message), &response_message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response_message.Status != responses.Status_failed || response_message.ErrorCode != responses.Error_code_invalid_request {
+			t.Error("Expected: ", responses.Error_code_invalid_request, ", Got: ", response_message.ErrorCode)
+		}
+	}
+
+	// Create webhook
+	var webhook responses.Webhook
+	{
+		message_id++
+		request_message := messages.POST_Webhook{
+			Header: messages.Header{
+				MessageID: message_id,
+				Action:    messages.Action_create_webhook,
+			},
+			Owner:      owner,
+			URL:        sink.URL,
+			WalletID:   wallet_id,
+			EventTypes: []string{events.Event_type_deposit_completed, events.Event_type_transfer_sent},
+		}
+		response_message := responses.Webhooks{}
+		err = json.Unmarshal(send_request(&request_message), &response_message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response_message.Status != responses.Status_successful || len(response_message.Webhooks) != 1 {
+			t.Fatal("Expected: ", responses.Status_successful, ", Got: ", response_message.Status, response_message.ErrorMessage)
+		}
+		webhook = response_message.Webhooks[0]
+		if len(webhook.Secret) == 0 {
+			t.Error("Expected the secret to be returned when the webhook is created")
+		}
+		if !reflect.DeepEqual(webhook.EventTypes, request_message.EventTypes) {
+			t.Error("Expected: ", request_message.EventTypes, ", Got: ", webhook.EventTypes)
+		}
+	}
+
+	// List webhooks. The secret is not returned again.
+	{
+		message_id++
+		request_message := messages.GET_Webhooks{
+			Header: messages.Header{
+				MessageID: message_id,
+				Action:    messages.Action_get_webhooks,
+			},
+			Owner: owner,
+		}
+		response_message := responses.Webhooks{}
+		err = json.Unmarshal(send_request(&request_message), &response_message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := webhook
+		expected.Secret = ""
+		if len(response_message.Webhooks) != 1 || !reflect.DeepEqual(response_message.Webhooks[0], expected) {
+			t.Error("Expected: ", expected, ", Got: ", response_message.Webhooks)
+		}
+	}
+
+	// Record events as the deposit, withdraw and transfer services do. Only the
+	// deposit is sent: the withdrawal is not subscribed to and the transfer is made
+	// from another wallet.
+	{
+		insert_event := "insert into " + config.WalletDatabase.EventsTable + " (event_type, wallet_id, data, date_and_time) values ($1, $2, $3, $4)"
+		recorded := []struct {
+			event_type string
+			wallet_id  string
+		}{
+			{events.Event_type_deposit_completed, wallet_id},
+			{events.Event_type_withdrawal_completed, wallet_id},
+			{events.Event_type_transfer_sent, other_wallet_id},
+		}
+		for _, event := range recorded {
+			_, err = db.Exec(insert_event, event.event_type, event.wallet_id, `{"currency":"SGD","amount":"10.00","new_balance":"10.00"}`, time.Now().UTC())
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Wait for the deposit to be delivered after one retry
+	get_deliveries := func() []responses.WebhookDelivery {
+		message_id++
+		request_message := messages.GET_WebhookDeliveries{
+			Header: messages.Header{
+				MessageID: message_id,
+				Action:    messages.Action_get_webhook_deliveries,
+			},
+			Owner:     owner,
+			WebhookID: webhook.WebhookID,
+		}
+		response_message := responses.WebhookDeliveries{}
+		err = json.Unmarshal(send_request(&request_message), &response_message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response_message.Status != responses.Status_successful {
+			t.Fatal("Expected: ", responses.Status_successful, ", Got: ", response_message.Status, response_message.ErrorMessage)
+		}
+		return response_message.Deliveries
+	}
+	var deliveries []responses.WebhookDelivery
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		deliveries = get_deliveries()
+		if len(deliveries) == 1 && deliveries[0].Status != responses.Delivery_status_pending {
+			break
+		}
+	}
+	if len(deliveries) != 1 {
+		t.Fatal("Expected: ", 1, ", Got: ", len(deliveries))
+	}
+	delivery := deliveries[0]
+	if delivery.Status != responses.Delivery_status_delivered || delivery.EventType != events.Event_type_deposit_completed {
+		t.Error("Expected: ", responses.Delivery_status_delivered, ", Got: ", delivery.Status)
+	}
+	if len(delivery.Attempts) != 2 || delivery.Attempts[0].StatusCode != http.StatusServiceUnavailable || delivery.Attempts[1].StatusCode != http.StatusOK {
+		t.Error("Expected: ", "attempts with status 503 and 200", ", Got: ", delivery.Attempts)
+	}
+
+	// Check what the sink received
+	{
+		mutex.Lock()
+		if len(received) != 2 {
+			t.Error("Expected: ", 2, ", Got: ", len(received))
+		}
+		for _, webhook_received := range received {
+			header := webhook_received.header
+			err = webhooks.Verify(webhook.Secret, header.Get(webhooks.Header_timestamp), webhook_received.body, header.Get(webhooks.Header_signature), webhooks.Default_tolerance, time.Now())
+			if err != nil {
+				t.Error("Expected: ", nil, ", Got: ", err)
+			}
+			event := events.Event{}
+			err = json.Unmarshal(webhook_received.body, &event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := events.Data{Currency: "SGD", Amount: "10.00", NewBalance: "10.00"}
+			if event.EventID != delivery.EventID || event.WalletID != wallet_id || !reflect.DeepEqual(event.Data, expected) {
+				t.Error("Expected: ", expected, ", Got: ", event)
+			}
+		}
+		mutex.Unlock()
+	}
+
+	// Redeliver
+	{
+		message_id++
+		request_message := messages.POST_WebhookRedelivery{
+			Header: messages.Header{
+				MessageID: message_id,
+				Action:    messages.Action_redeliver_webhook,
+			},
+			Owner:      owner,
+			WebhookID:  webhook.WebhookID,
+			DeliveryID: delivery.DeliveryID,
+		}
+		response_message := responses.WebhookDeliveries{}
+		err = json.Unmarshal(send_request(&request_message), &response_message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(response_message.Deliveries) != 1 || response_message.Deliveries[0].RedeliveryOf != delivery.DeliveryID {
+			t.Fatal("Expected: ", delivery.DeliveryID, ", Got: ", response_message.Deliveries, response_message.ErrorMessage)
+		}
+		redelivery_id := response_message.Deliveries[0].DeliveryID
+
+		for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+			deliveries = get_deliveries()
+			if len(deliveries) == 2 && deliveries[0].Status != responses.Delivery_status_pending {
+				break
+			}
+		}
+		if len(deliveries) != 2 || deliveries[0].DeliveryID != redelivery_id || deliveries[0].Status != responses.Delivery_status_delivered {
+			t.Error("Expected: ", redelivery_id, " delivered, Got: ", deliveries)
+		}
+	}
+
+	// Redeliver a delivery of another webhook
+	{
+		message_id++
+		request_message := messages.POST_WebhookRedelivery{
+			Header: messages.Header{
+				MessageID: message_id,
+				Action:    messages.Action_redeliver_webhook,
+			},
+			Owner:      owner,
+			WebhookID:  webhook.WebhookID,
+			DeliveryID: "999999999",
+		}
+		response_message := responses.WebhookDeliveries{}
+		err = json.Unmarshal(send_request(&request_message), &response_message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response_message.ErrorCode != responses.Error_code_delivery_not_found {
+			t.Error("Expected: ", responses.Error_code_delivery_not_found, ", Got: ", response_message.ErrorCode)
+		}
+	}
+
+	// Delete webhook. Only the owner can delete it.
+	for _, test_case := range []struct {
+		owner              string
+		expected_status    int
+		expected_errorcode string
+	}{
+		{"someone_else", responses.Status_failed, responses.Error_code_webhook_not_found},
+		{owner, responses.Status_successful, ""},
+		{owner, responses.Status_failed, responses.Error_code_webhook_not_found},
+	} {
+		message_id++
+		request_message := messages.DELETE_Webhook{
+			Header: messages.Header{
+				MessageID: message_id,
+				Action:    messages.Action_delete_webhook,
+			},
+			Owner:     test_case.owner,
+			WebhookID: webhook.WebhookID,
+		}
+		response_message := responses.Webhooks{}
+		err = json.Unmarshal(send_request(&request_message), &response_message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response_message.Status != test_case.expected_status || response_message.ErrorCode != test_case.expected_errorcode {
+			t.Error("Expected: ", test_case.expected_errorcode, ", Got: ", response_message.ErrorCode)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	shared_config "shared/config"
+	"shared/logging"
+	"syscall"
+	"webhook_service/config"
+	"webhook_service/implementation"
+)
+
+func main() {
+
+	log.Println("DIGITAL WALLET INC WEBHOOK SERVICE")
+	log.Println("The webhook service manages webhook subscriptions and sends signed wallet events to them.")
+
+	// Load configuration file
+	config_file_path := "config.yml"
+	if len(os.Args) > 1 {
+		config_file_path = os.Args[1]
+	}
+	initial_config, err := config.Load(config_file_path)
+	if err != nil {
+		log.Fatal("Unable to load configuration file at ", config_file_path)
+	}
+
+	// Log JSON lines from now on
+	logs, err := logging.Setup("webhook_service", initial_config.Logging.Level, initial_config.Logging.File)
+	if err != nil {
+		log.Fatal("Unable to set up logging: ", err)
+	}
+	defer logs.Close()
+	log.Println("Successfully loaded configuration file at ", config_file_path)
+
+	// Start running webhook service
+	service := implementation.CreateWebhookService(initial_config)
+	service.Run()
+
+	// Reload configuration file on SIGHUP or whenever it is changed
+	watcher := shared_config.CreateWatcher(config_file_path, func() {
+		next_config, err := config.Load(config_file_path)
+		if err != nil {
+			log.Println("Configuration not reloaded. Unable to load configuration file at ", config_file_path)
+			return
+		}
+		err = service.Reload(next_config)
+		if err != nil {
+			log.Println("Configuration not reloaded. " + err.Error())
+		}
+	})
+	watcher.Run()
+
+	// Listen for abort signal to terminate the balance service
+	// Pressing CTRL + C while the application is running
+	abort_channel := make(chan os.Signal, 1)
+	signal.Notify(abort_channel, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	<-abort_channel
+	watcher.Shutdown()
+
+	// Shutdown the webhook service gracefully
+	service.Shutdown()
+}
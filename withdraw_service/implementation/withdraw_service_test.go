@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"log"
 	"reflect"
+	"shared/events"
 	"shared/messages"
 	"shared/responses"
 	"testing"
@@ -36,6 +37,9 @@ func Test_WithdrawService(t *testing.T) {
 	config.ResponsesQueue.QueueName = "withdrawal_responses_queue_test"
 	config.WalletDatabase.BalanceTable = "postgres.test_withdraw_service.balances"
 	config.WalletDatabase.TransactionsTable = "postgres.test_withdraw_service.transactions"
+	config.WalletDatabase.IdempotencyKeysTable = "postgres.test_withdraw_service.idempotency_keys"
+	config.WalletDatabase.EventsTable = "postgres.test_withdraw_service.events"
+	config.EventsStream.StreamName = "wallet_events_test"
 
 	// Start running balance service
 	service := CreateWithdrawService(config)
@@ -63,6 +67,17 @@ func Test_WithdrawService(t *testing.T) {
 	}
 	cancel()
 
+	// Ensure the events stream of the wallet only has the events of this unit test
+	events_stream_name := events.GetStreamName(config.EventsStream.StreamName, wallet_id)
+	timeout_context, cancel = context.WithTimeout(background_context, time.Duration(config.EventsStream.Timeout)*time.Second)
+	_, err = requests_queue.Del(timeout_context, events_stream_name).Result()
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	cancel()
+	defer requests_queue.Del(background_context, events_stream_name)
+
 	// Prepare connection to PostgreSQL database
 	db, err := sql.Open("postgres", config.WalletDatabase.GetConnectionString())
 	if err != nil {
@@ -84,6 +99,14 @@ func Test_WithdrawService(t *testing.T) {
 		if err != nil {
 			log.Fatal(err)
 		}
+		_, err = db.Exec("delete from " + config.WalletDatabase.IdempotencyKeysTable)
+		if err != nil {
+			log.Fatal(err)
+		}
+		_, err = db.Exec("delete from " + config.WalletDatabase.EventsTable)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}()
 
 	// Create a new wallet with an initial balance
@@ -162,4 +185,27 @@ func Test_WithdrawService(t *testing.T) {
 		}
 	}
 
+	// The committed withdrawal is published to the live feed
+	{
+		timeout_context, cancel = context.WithTimeout(background_context, time.Duration(config.EventsStream.Timeout)*time.Second)
+		result, err := events.ReadStream(timeout_context, requests_queue, config.EventsStream.StreamName, wallet_id, "", 10)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result) != 1 {
+			t.Fatal("Expected: ", 1, ", Got: ", len(result))
+		}
+		expected_data := events.Data{
+			Currency:   currency,
+			Amount:     withdraw_1_amount,
+			NewBalance: expected_balance_1,
+		}
+		if result[0].EventType != events.Event_type_withdrawal_completed {
+			t.Error("Expected: ", events.Event_type_withdrawal_completed, ", Got: ", result[0].EventType)
+		}
+		if !reflect.DeepEqual(result[0].Data, expected_data) {
+			t.Error("Expected: ", expected_data, ", Got: ", result[0].Data)
+		}
+	}
 }